@@ -0,0 +1,13 @@
+// Package gdir embeds the built worker and static files into the tools, so
+// that they can be deployed without a checkout of the repository and a build.
+package gdir
+
+import "embed"
+
+// Dist is the dist directory as it was built when the tools were compiled:
+// the worker script, the static files and version.json. version.json is not
+// committed; npm run build or go generate writes it from the commit built.
+//
+//go:generate go run ./tools/distversion
+//go:embed dist
+var Dist embed.FS
@@ -1,6 +1,6 @@
 module github.com/workerindex/gdir
 
-go 1.14
+go 1.16
 
 require (
 	github.com/cloudflare/cloudflare-go v0.11.6
@@ -1,4 +1,5 @@
 import fs from 'fs';
+import { execSync } from 'child_process';
 import rmfr from 'rmfr';
 import sass from 'gulp-sass';
 import * as gulp from 'gulp';
@@ -90,13 +91,24 @@ gulp.task('worker.rollup', async () => {
 
 gulp.task('worker.config', async () => {});
 
+// dist/version.json is embedded into the Go tools with the built files.
+gulp.task('version', async () => {
+    let commit = '';
+    try {
+        commit = execSync('git rev-parse --short HEAD', { encoding: 'utf-8' }).trim();
+    } catch (e) {}
+    const pkg = JSON.parse(fs.readFileSync('./package.json', 'utf-8'));
+    const version = { version: pkg.version, commit, built: new Date().toISOString() };
+    fs.writeFileSync('./dist/version.json', JSON.stringify(version, null, 4) + '\n');
+});
+
 gulp.task('clean', async () =>
     Promise.all([rmfr('./dist/*.*', { glob: {} }), rmfr('./dist/static/*.*', { glob: {} })]),
 );
 
-gulp.task('dist', series('clean', 'app.rollup', 'app.scss', 'app.static', 'worker.rollup'));
+gulp.task('dist', series('clean', 'app.rollup', 'app.scss', 'app.static', 'worker.rollup', 'version'));
 
-gulp.task('default', series('clean', 'app.rollup', 'app.scss', 'app.static', 'worker.rollup'));
+gulp.task('default', series('clean', 'app.rollup', 'app.scss', 'app.static', 'worker.rollup', 'version'));
 
 gulp.task('watch', () => {
     watch(['./app/**/*.ts', './app/**/*.tsx'], series('app.rollup'));
@@ -129,17 +141,16 @@ gulp.task(
                         }
                         return;
                     }
-                    const config = JSON.parse(fs.readFileSync('./config.json', 'utf-8'));
-                    const script = fs
-                        .readFileSync('./dist/worker.js', 'utf-8')
-                        .replace('__SECRET__', `${config.secret_key}`)
-                        .replace('__ACCOUNTS_COUNT__', `${config.accounts_count}`)
-                        .replace('__ACCOUNT_ROTATION__', `${config.account_rotation}`)
-                        .replace('__ACCOUNT_CANDIDATES__', `${config.account_candidates}`)
-                        .replace('__USERS_URL__', `http://${staticServerConfig.host}:${staticServerConfig.port}/`)
-                        .replace('__STATIC_URL__', `http://${staticServerConfig.host}:${staticServerConfig.port}`)
-                        .replace('__ACCOUNTS_URL__', `http://${staticServerConfig.host}:${staticServerConfig.port}/`);
-                    server = new Cloudworker(script, { debug }).listen(port, host);
+                    const script = fs.readFileSync('./dist/worker.js', 'utf-8');
+                    // The bindings are those DeployWorker uploads, with the derived master secret, the KDF salt
+                    // and the account IDs, but with every file fetched from the local static server.
+                    const bindings = JSON.parse(
+                        execSync(
+                            `go run ./tools/gdir bindings -url http://${staticServerConfig.host}:${staticServerConfig.port}/`,
+                            { encoding: 'utf-8', stdio: ['inherit', 'pipe', 'inherit'] },
+                        ),
+                    );
+                    server = new Cloudworker(script, { debug, bindings }).listen(port, host);
                 };
                 await startServer();
                 console.log(
@@ -7,28 +7,37 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"syscall"
 
 	"github.com/workerindex/gdir/tools/core"
-	"golang.org/x/crypto/ssh/terminal"
+	"github.com/workerindex/gdir/tools/prompt"
 )
 
 var args = struct {
 	newUser  core.User
 	oldUser  core.User
 	userPath string
+	answers  string
 }{}
 
 func init() {
-	flag.StringVar(&core.Config.ConfigFile, "config", "config.json", "config file to read and write")
+	flag.StringVar(&core.Config.StateDir, "state-dir", "", "directory of the config and the encrypted files (default GDIR_STATE_DIR, or $XDG_STATE_HOME/gdir)")
+	flag.StringVar(&core.Config.ConfigFile, "config", "", "config file to read and write (default config.json in the state directory)")
+	flag.StringVar(&core.Config.Profile, "profile", "", "profile of the config to add the user to")
 	flag.StringVar(&core.Config.SecretKey, "key", "", "gdir master secret key to derive other encryption keys")
 	flag.StringVar(&args.newUser.Name, "user", "", "username")
 	flag.StringVar(&args.newUser.Pass, "pass", "", "password")
+	flag.StringVar(&args.answers, "answers", "", "answer the questions with the lines of a file, or of stdin with -")
 }
 
 func run() (err error) {
 	flag.Parse()
 
+	if args.answers != "" {
+		if err = prompt.UseScriptFile(args.answers); err != nil {
+			return
+		}
+	}
+
 	if err = core.LoadConfigFile(); err != nil {
 		return
 	}
@@ -62,7 +71,7 @@ func run() (err error) {
 		return
 	}
 
-	if err = core.DeployGist("users", core.Config.GistID.Users); err != nil {
+	if err = core.DeployStorage("users"); err != nil {
 		return
 	}
 
@@ -72,8 +81,7 @@ func run() (err error) {
 
 func enterUsername() (err error) {
 	if args.newUser.Name == "" {
-		fmt.Printf("Username: ")
-		fmt.Scanln(&args.newUser.Name)
+		args.newUser.Name, err = prompt.Text("Username", "", prompt.Required)
 	}
 	return
 }
@@ -85,36 +93,38 @@ func readOldUser() (err error) {
 		if inBytes, err = ioutil.ReadFile(args.userPath); err != nil {
 			return
 		}
-		if inBytes, err = core.GCMDecrypt(core.Config.SecretKey, "user", inBytes); err != nil {
+		if inBytes, err = core.GCMDecrypt(core.MasterSecret(), "user", inBytes); err != nil {
 			return
 		}
 		if err = json.Unmarshal(inBytes, &args.oldUser); err != nil {
 			return
 		}
-		args.newUser.DrivesWhiteList = args.oldUser.DrivesWhiteList
-		args.newUser.DrivesBlackList = args.oldUser.DrivesBlackList
+		// keep everything but the password, which enterPassword asks about;
+		// decoding again gives the new user its own copy of the lists and rules
+		name, pass := args.newUser.Name, args.newUser.Pass
+		args.newUser = core.User{}
+		if err = json.Unmarshal(inBytes, &args.newUser); err != nil {
+			return
+		}
+		args.newUser.Name, args.newUser.Pass, args.newUser.PassHash = name, pass, ""
 	}
 	return
 }
 
 func enterPassword() (err error) {
-	var bytePassword []byte
-	if args.oldUser.Pass != "" && args.newUser.Pass == "" {
-		fmt.Println("Password:", args.oldUser.Pass)
-		if core.PromptYesNoWithDefault("Is it correct?", true) {
-			args.newUser.Pass = args.oldUser.Pass
+	if args.oldUser.HasPassword() && args.newUser.Pass == "" {
+		var keep bool
+		if keep, err = prompt.Confirm("Keep the existing password?", true); err != nil {
+			return
+		}
+		if keep {
+			// a plaintext password is hashed when saved
+			args.newUser.Pass, args.newUser.PassHash = args.oldUser.Pass, args.oldUser.PassHash
+			return
 		}
 	}
 	if args.newUser.Pass == "" {
-		for loop := true; loop; loop = args.newUser.Pass == "" {
-			fmt.Printf("Password: ")
-			bytePassword, err = terminal.ReadPassword(int(syscall.Stdin))
-			if err != nil {
-				return
-			}
-			fmt.Println()
-			args.newUser.Pass = string(bytePassword)
-		}
+		args.newUser.Pass, err = prompt.Secret("Password", prompt.Required)
 	}
 	return
 }
@@ -0,0 +1,172 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/workerindex/gdir/tools/drive"
+)
+
+// Statuses of an account reported by CheckAccounts.
+const (
+	AccountValid           = "valid"
+	AccountInvalidKey      = "invalid_key"
+	AccountDisabledProject = "disabled_project"
+	AccountNoDrive         = "no_drive"
+	AccountQuotaExceeded   = "quota_exceeded"
+	AccountError           = "error"
+)
+
+// AccountsQuarantineDir holds the encrypted accounts taken out of the deployed
+// set by AccountsManifest.Quarantine.
+const AccountsQuarantineDir = "accounts-quarantine"
+
+// AccountCheck is the result of checking one encrypted account.
+type AccountCheck struct {
+	ID      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+	Drives  int    `json:"drives"`
+}
+
+// Bad reports whether the account will keep failing and should be taken out
+// of the deployed set. Exceeded quotas and other errors may go away by
+// themselves.
+func (c *AccountCheck) Bad() bool {
+	return c.Status == AccountInvalidKey || c.Status == AccountDisabledProject || c.Status == AccountNoDrive
+}
+
+// ReadAccounts decrypts every account in the accounts directory.
+func ReadAccounts() (accounts []*drive.Account, err error) {
+	files, err := ioutil.ReadDir(ArtifactPath("accounts"))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		var b []byte
+		if b, err = ioutil.ReadFile(filepath.Join(ArtifactPath("accounts"), file.Name())); err != nil {
+			return
+		}
+		if b, err = GCMDecrypt(MasterSecret(), "account", b); err != nil {
+			err = fmt.Errorf("cannot decrypt account %s: %w", file.Name(), err)
+			return
+		}
+		var a *drive.Account
+		if a, err = drive.ParseAccount(file.Name(), b); err != nil {
+			return
+		}
+		accounts = append(accounts, a)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return lessAccountID(accounts[i].ID, accounts[j].ID) })
+	return
+}
+
+// lessAccountID orders account file names numerically when they are numbers.
+func lessAccountID(a string, b string) bool {
+	x, errA := strconv.Atoi(a)
+	y, errB := strconv.Atoi(b)
+	if errA == nil && errB == nil {
+		return x < y
+	}
+	return a < b
+}
+
+// CheckAccounts mints a token for every account and makes a Drive call with
+// it. When drives is empty the account must be a member of at least one
+// shared drive, otherwise it must be able to read every drive in drives.
+// Up to parallel accounts are checked at the same time.
+func CheckAccounts(client *drive.Client, accounts []*drive.Account, drives []string, parallel int) (checks []*AccountCheck) {
+	if parallel < 1 {
+		parallel = 1
+	}
+	checks = make([]*AccountCheck, len(accounts))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallel)
+	for i, a := range accounts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, a *drive.Account) {
+			defer wg.Done()
+			checks[i] = CheckAccount(client, a, drives)
+			<-sem
+		}(i, a)
+	}
+	wg.Wait()
+	return
+}
+
+// CheckAccount checks a single account, see CheckAccounts.
+func CheckAccount(client *drive.Client, a *drive.Account, drives []string) (check *AccountCheck) {
+	check = &AccountCheck{ID: a.ID, Name: a.Name(), Status: AccountValid}
+	if _, err := client.AccessToken(a); err != nil {
+		check.Status, check.Message = classifyAccountError(err)
+		return
+	}
+	if len(drives) == 0 {
+		found, err := client.Drives(a)
+		if err != nil {
+			check.Status, check.Message = classifyAccountError(err)
+			return
+		}
+		if check.Drives = len(found); check.Drives == 0 {
+			check.Status = AccountNoDrive
+			check.Message = "not a member of any shared drive"
+		}
+		return
+	}
+	for _, id := range drives {
+		if _, err := client.Drive(a, id); err != nil {
+			if check.Status, check.Message = classifyAccountError(err); check.Status == AccountError {
+				var apiErr *drive.Error
+				if errors.As(err, &apiErr) && apiErr.StatusCode == 404 {
+					check.Status = AccountNoDrive
+					check.Message = "not a member of shared drive " + id
+				}
+			}
+			return
+		}
+		check.Drives++
+	}
+	return
+}
+
+func classifyAccountError(err error) (status string, message string) {
+	message = err.Error()
+	var tokenErr *drive.TokenError
+	var apiErr *drive.Error
+	switch {
+	case errors.As(err, &tokenErr):
+		if tokenErr.StatusCode >= 500 {
+			return AccountError, message
+		}
+		return AccountInvalidKey, message
+	case errors.As(err, &apiErr):
+		switch apiErr.Reason() {
+		case "accessNotConfigured", "SERVICE_DISABLED":
+			return AccountDisabledProject, apiErr.Message
+		case "userRateLimitExceeded", "rateLimitExceeded", "dailyLimitExceeded", "quotaExceeded",
+			"downloadQuotaExceeded", "storageQuotaExceeded":
+			return AccountQuotaExceeded, apiErr.Message
+		}
+		if apiErr.StatusCode == 429 {
+			return AccountQuotaExceeded, apiErr.Message
+		}
+		if apiErr.StatusCode == 401 {
+			return AccountInvalidKey, apiErr.Message
+		}
+		return AccountError, apiErr.Message
+	case strings.Contains(message, "private key"):
+		return AccountInvalidKey, message
+	}
+	return AccountError, message
+}
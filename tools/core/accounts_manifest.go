@@ -0,0 +1,310 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/workerindex/gdir/tools/drive"
+)
+
+// AccountsManifestFile is the encrypted manifest of the accounts in the
+// accounts directory. It is kept next to the config and is not deployed.
+const AccountsManifestFile = "accounts.manifest"
+
+// Statuses of an account in the manifest.
+const (
+	AccountActive      = "active"
+	AccountQuarantined = "quarantined"
+)
+
+// AccountEntry describes an encrypted account. ID is the name of its file in
+// the accounts directory and is never reused, and Hash is the SHA-256 of the
+// account JSON file it was imported from.
+type AccountEntry struct {
+	ID          string    `json:"id"`
+	Hash        string    `json:"hash"`
+	ClientEmail string    `json:"client_email,omitempty"`
+	ClientID    string    `json:"client_id,omitempty"`
+	Added       time.Time `json:"added"`
+	Status      string    `json:"status"`
+}
+
+// Name returns the email of a service account, or the client ID of a user
+// account.
+func (e *AccountEntry) Name() string {
+	if e.ClientEmail != "" {
+		return e.ClientEmail
+	}
+	return e.ClientID
+}
+
+type AccountsManifest struct {
+	LastID   uint64          `json:"last_id"`
+	Accounts []*AccountEntry `json:"accounts"`
+}
+
+// LoadAccountsManifest reads the accounts manifest. Without a manifest, one is
+// built from the files in the accounts directory, keeping their names as IDs.
+func LoadAccountsManifest() (m *AccountsManifest, err error) {
+	m = &AccountsManifest{}
+	b, err := ioutil.ReadFile(ArtifactPath(AccountsManifestFile))
+	if err == nil {
+		if b, err = GCMDecrypt(MasterSecret(), "accountsManifest", b); err != nil {
+			err = fmt.Errorf("cannot decrypt %s: %w", AccountsManifestFile, err)
+			return
+		}
+		err = json.Unmarshal(b, m)
+		return
+	}
+	if !os.IsNotExist(err) {
+		return
+	}
+	err = nil
+
+	files, err := ioutil.ReadDir(ArtifactPath("accounts"))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		if b, err = ioutil.ReadFile(filepath.Join(ArtifactPath("accounts"), file.Name())); err != nil {
+			return
+		}
+		if b, err = GCMDecrypt(MasterSecret(), "account", b); err != nil {
+			err = fmt.Errorf("cannot decrypt account %s: %w", file.Name(), err)
+			return
+		}
+		var a *drive.Account
+		if a, err = drive.ParseAccount(file.Name(), b); err != nil {
+			return
+		}
+		m.Accounts = append(m.Accounts, &AccountEntry{
+			ID:          file.Name(),
+			Hash:        accountHash(b),
+			ClientEmail: a.ClientEmail,
+			ClientID:    a.ClientID,
+			Added:       file.ModTime().UTC(),
+			Status:      AccountActive,
+		})
+		if id, e := strconv.ParseUint(file.Name(), 10, 64); e == nil && id > m.LastID {
+			m.LastID = id
+		}
+	}
+	m.sort()
+	return
+}
+
+// Save writes the manifest and updates the accounts count in the config.
+func (m *AccountsManifest) Save() (err error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	if b, err = GCMEncrypt(MasterSecret(), "accountsManifest", b); err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(ArtifactPath(AccountsManifestFile), b, 0600); err != nil {
+		return
+	}
+	Config.AccountsCount = uint64(len(m.Active()))
+	return SaveConfigFile()
+}
+
+// Active returns the entries of the deployed accounts.
+func (m *AccountsManifest) Active() (entries []*AccountEntry) {
+	for _, e := range m.Accounts {
+		if e.Status == AccountActive {
+			entries = append(entries, e)
+		}
+	}
+	return
+}
+
+// ActiveIDs returns the IDs of the deployed accounts, which are the file names
+// the worker fetches.
+func (m *AccountsManifest) ActiveIDs() (ids []string) {
+	ids = []string{}
+	for _, e := range m.Active() {
+		ids = append(ids, e.ID)
+	}
+	return
+}
+
+// Find returns the entry with the given ID or client email.
+func (m *AccountsManifest) Find(key string) *AccountEntry {
+	for _, e := range m.Accounts {
+		if e.ID == key || (e.ClientEmail != "" && e.ClientEmail == key) {
+			return e
+		}
+	}
+	return nil
+}
+
+// Match returns the entry of the manifest that the account JSON b would be
+// stored as, or nil for a new account, and whether Add would change anything.
+// An account with the same hash is unchanged, even when it is quarantined, so
+// that importing a directory again does not bring bad accounts back. An
+// account with the same client email keeps its ID and gets the new key. User
+// accounts can share a client ID, so they are only matched by hash.
+func (m *AccountsManifest) Match(b []byte) (entry *AccountEntry, changed bool, err error) {
+	a, err := drive.ParseAccount("", b)
+	if err != nil {
+		return
+	}
+	hash := accountHash(b)
+	for _, e := range m.Accounts {
+		if e.Hash == hash {
+			return e, false, nil
+		}
+	}
+	if a.ClientEmail != "" {
+		entry = m.Find(a.ClientEmail)
+	}
+	return entry, true, nil
+}
+
+// Add encrypts the account JSON b into the accounts directory, see Match.
+func (m *AccountsManifest) Add(b []byte) (entry *AccountEntry, added bool, err error) {
+	if entry, added, err = m.Match(b); err != nil || !added {
+		return
+	}
+	a, err := drive.ParseAccount("", b)
+	if err != nil {
+		return
+	}
+	if entry == nil {
+		m.LastID++
+		entry = &AccountEntry{ID: strconv.FormatUint(m.LastID, 10), Added: time.Now().UTC()}
+		m.Accounts = append(m.Accounts, entry)
+	} else if entry.Status == AccountQuarantined {
+		os.Remove(filepath.Join(ArtifactPath(AccountsQuarantineDir), entry.ID))
+	}
+	entry.Hash = accountHash(b)
+	entry.ClientEmail = a.ClientEmail
+	entry.ClientID = a.ClientID
+	entry.Status = AccountActive
+
+	if err = os.MkdirAll(ArtifactPath("accounts"), 0700); err != nil {
+		return
+	}
+	out, err := GCMEncrypt(MasterSecret(), "account", b)
+	if err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(filepath.Join(ArtifactPath("accounts"), entry.ID), out, 0600); err != nil {
+		return
+	}
+	return entry, true, nil
+}
+
+// Remove deletes the encrypted file of an account and its entry.
+func (m *AccountsManifest) Remove(entry *AccountEntry) (err error) {
+	dir := "accounts"
+	if entry.Status == AccountQuarantined {
+		dir = AccountsQuarantineDir
+	}
+	if err = os.Remove(filepath.Join(ArtifactPath(dir), entry.ID)); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	for i, e := range m.Accounts {
+		if e == entry {
+			m.Accounts = append(m.Accounts[:i], m.Accounts[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// Quarantine moves the encrypted file of an account into
+// AccountsQuarantineDir, so that it is no longer deployed.
+func (m *AccountsManifest) Quarantine(entry *AccountEntry) (err error) {
+	if entry.Status == AccountQuarantined {
+		return
+	}
+	if err = os.MkdirAll(ArtifactPath(AccountsQuarantineDir), 0700); err != nil {
+		return
+	}
+	if err = os.Rename(filepath.Join(ArtifactPath("accounts"), entry.ID), filepath.Join(ArtifactPath(AccountsQuarantineDir), entry.ID)); err != nil {
+		return
+	}
+	entry.Status = AccountQuarantined
+	return
+}
+
+func (m *AccountsManifest) sort() {
+	sort.Slice(m.Accounts, func(i, j int) bool { return lessAccountID(m.Accounts[i].ID, m.Accounts[j].ID) })
+}
+
+func accountHash(b []byte) string {
+	hash := sha256.Sum256(b)
+	return hex.EncodeToString(hash[:])
+}
+
+// AccountJSONFiles returns the account JSON files to import from path, which
+// is either a JSON file or a directory of them.
+func AccountJSONFiles(path string) (files []string, err error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if !stat.IsDir() {
+		return []string{path}, nil
+	}
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ".json") && info.Size() > 0 {
+			files = append(files, filepath.Join(path, info.Name()))
+		}
+	}
+	return
+}
+
+// AddAccounts imports the account JSON files found in paths into the accounts
+// manifest and returns the number of new or changed accounts.
+func AddAccounts(paths ...string) (added int, err error) {
+	m, err := LoadAccountsManifest()
+	if err != nil {
+		return
+	}
+	for _, path := range paths {
+		var files []string
+		if files, err = AccountJSONFiles(path); err != nil {
+			return
+		}
+		for _, file := range files {
+			var b []byte
+			if b, err = ioutil.ReadFile(file); err != nil {
+				return
+			}
+			var entry *AccountEntry
+			var changed bool
+			if entry, changed, err = m.Add(b); err != nil {
+				err = fmt.Errorf("cannot add account %s: %w", file, err)
+				return
+			}
+			if changed {
+				fmt.Printf("Encrypting account %s: %s\n", entry.ID, file)
+				added++
+			}
+		}
+	}
+	err = m.Save()
+	return
+}
@@ -0,0 +1,254 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/workerindex/gdir/tools/drive"
+)
+
+// Access is what folder rules give to a file or folder.
+type Access int
+
+const (
+	// AccessDenied hides a file or folder.
+	AccessDenied Access = iota
+	// AccessAllowed gives a file or folder, as any other rule would.
+	AccessAllowed
+	// AccessTraverse shows an ancestor of an allowed folder, only to reach it:
+	// listing it shows nothing but its allowed or traversable children.
+	AccessTraverse
+)
+
+func (a Access) String() string {
+	switch a {
+	case AccessAllowed:
+		return "allowed"
+	case AccessTraverse:
+		return "traverse"
+	}
+	return "denied"
+}
+
+// maxFolderDepth bounds the ancestors of a folder, in case of a cycle.
+const maxFolderDepth = 64
+
+// FolderRule allows or denies a folder and everything inside it. Path holds
+// the IDs of the ancestors of the folder, from its drive down, so that its
+// ancestors can be traversed to reach an allowed folder. Name is the path of
+// the folder by names, for display.
+type FolderRule struct {
+	ID   string   `json:"id"`
+	Path []string `json:"path,omitempty"`
+	Name string   `json:"name,omitempty"`
+}
+
+// FolderACL are the folder rules of a user or group. A file or folder gets the
+// access of the nearest of itself and its ancestors with a rule, and a deny
+// rule wins over an allow rule of the same folder. Without such a rule, it is
+// allowed when there are no allow rules, and denied otherwise. A denied folder
+// can still be traversed when it is an ancestor of an allowed folder.
+type FolderACL struct {
+	Allow []FolderRule `json:"allow,omitempty"`
+	Deny  []FolderRule `json:"deny,omitempty"`
+}
+
+// Empty reports whether there are no rules, so that everything is allowed.
+func (acl *FolderACL) Empty() bool {
+	return acl == nil || len(acl.Allow)+len(acl.Deny) == 0
+}
+
+// Evaluate returns the access to the file or folder whose ID and ancestor IDs
+// are chain, the file first and its drive last.
+func (acl *FolderACL) Evaluate(chain []string) Access {
+	if acl.Empty() {
+		return AccessAllowed
+	}
+	denied := len(acl.Allow) > 0
+	for _, id := range chain {
+		if acl.find(acl.Deny, id) >= 0 {
+			denied = true
+			break
+		}
+		if acl.find(acl.Allow, id) >= 0 {
+			return AccessAllowed
+		}
+	}
+	if !denied {
+		return AccessAllowed
+	}
+	if len(chain) > 0 {
+		for _, rule := range acl.Allow {
+			if containsString(rule.Path, chain[0]) {
+				return AccessTraverse
+			}
+		}
+	}
+	return AccessDenied
+}
+
+func (acl *FolderACL) find(rules []FolderRule, id string) int {
+	for i, rule := range rules {
+		if rule.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Set adds an allow or deny rule, replacing any rule of the same folder.
+func (acl *FolderACL) Set(rule FolderRule, allow bool) {
+	acl.Remove(rule.ID)
+	if allow {
+		acl.Allow = append(acl.Allow, rule)
+	} else {
+		acl.Deny = append(acl.Deny, rule)
+	}
+}
+
+// Remove removes the rules of a folder given by ID or name, and reports
+// whether there were any.
+func (acl *FolderACL) Remove(folder string) (removed bool) {
+	filter := func(rules []FolderRule) (out []FolderRule) {
+		for _, rule := range rules {
+			if rule.ID == folder || rule.Name == folder {
+				removed = true
+			} else {
+				out = append(out, rule)
+			}
+		}
+		return
+	}
+	acl.Allow = filter(acl.Allow)
+	acl.Deny = filter(acl.Deny)
+	return
+}
+
+// Merge returns the rules of acl and other together, or nil without rules.
+func (acl *FolderACL) Merge(other *FolderACL) *FolderACL {
+	merged := &FolderACL{}
+	for _, a := range []*FolderACL{acl, other} {
+		if a.Empty() {
+			continue
+		}
+		for _, rule := range a.Allow {
+			if merged.find(merged.Allow, rule.ID) < 0 {
+				merged.Allow = append(merged.Allow, rule)
+			}
+		}
+		for _, rule := range a.Deny {
+			if merged.find(merged.Deny, rule.ID) < 0 {
+				merged.Deny = append(merged.Deny, rule)
+			}
+		}
+	}
+	if merged.Empty() {
+		return nil
+	}
+	return merged
+}
+
+// FolderChain returns id and the IDs of its ancestors, its drive last, using
+// parents to get the parents of a file.
+func FolderChain(id string, parents func(id string) ([]string, error)) (chain []string, err error) {
+	for id != "" {
+		if len(chain) == maxFolderDepth {
+			return nil, fmt.Errorf("too many ancestors of folder %s", chain[0])
+		}
+		chain = append(chain, id)
+		var p []string
+		if p, err = parents(id); err != nil {
+			return nil, err
+		}
+		id = ""
+		if len(p) > 0 {
+			id = p[0]
+		}
+	}
+	return
+}
+
+// ResolveFolder finds a folder by ID, or by a path of names starting with its
+// shared drive such as "Team Drive/Projects/2020", and returns a rule for it.
+func ResolveFolder(client *drive.Client, a *drive.Account, folder string) (rule FolderRule, err error) {
+	rule, file, err := resolveFile(client, a, folder)
+	if err == nil && file.Kind != "drive#drive" && file.MimeType != drive.FolderMimeType {
+		err = fmt.Errorf("not a folder: %s", folder)
+	}
+	return
+}
+
+// ResolveFile is ResolveFolder for any file.
+func ResolveFile(client *drive.Client, a *drive.Account, path string) (rule FolderRule, err error) {
+	rule, _, err = resolveFile(client, a, path)
+	return
+}
+
+func resolveFile(client *drive.Client, a *drive.Account, path string) (rule FolderRule, first *drive.File, err error) {
+	id := path
+	if strings.Contains(path, "/") {
+		if id, err = findFileByPath(client, a, path); err != nil {
+			return
+		}
+	}
+	var names []string
+	var chain []string
+	for next := id; next != ""; {
+		if len(chain) == maxFolderDepth {
+			return rule, nil, fmt.Errorf("too many ancestors of %s", path)
+		}
+		var file *drive.File
+		if file, err = client.File(a, next); err != nil {
+			return rule, nil, fmt.Errorf("cannot find %s: %w", path, err)
+		}
+		if first == nil {
+			first = file
+		}
+		chain = append([]string{file.ID}, chain...)
+		names = append([]string{file.Name}, names...)
+		next = ""
+		if len(file.Parents) > 0 {
+			next = file.Parents[0]
+		}
+	}
+	rule.ID = chain[len(chain)-1]
+	rule.Path = chain[:len(chain)-1]
+	rule.Name = strings.Join(names, "/")
+	return
+}
+
+func findFileByPath(client *drive.Client, a *drive.Account, path string) (id string, err error) {
+	names := strings.Split(strings.Trim(path, "/"), "/")
+	drives, err := client.Drives(a)
+	if err != nil {
+		return
+	}
+	for _, d := range drives {
+		if d.Name != names[0] {
+			continue
+		}
+		if id != "" {
+			return "", fmt.Errorf("more than one shared drive named %s", names[0])
+		}
+		id = d.ID
+	}
+	if id == "" {
+		return "", fmt.Errorf("no shared drive named %s", names[0])
+	}
+	for i, name := range names[1:] {
+		var folders []drive.File
+		if folders, err = client.FindFiles(a, id, name, i == len(names)-2); err != nil {
+			return
+		}
+		at := strings.Join(names[:i+2], "/")
+		switch len(folders) {
+		case 0:
+			return "", fmt.Errorf("no such file or folder: %s", at)
+		case 1:
+			id = folders[0].ID
+		default:
+			return "", fmt.Errorf("more than one file named %s, use its ID", at)
+		}
+	}
+	return
+}
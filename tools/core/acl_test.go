@@ -0,0 +1,62 @@
+package core
+
+import "testing"
+
+func TestFolderACLEvaluate(t *testing.T) {
+	// drive
+	// └── projects
+	//     ├── public
+	//     │   └── secret
+	//     └── private
+	//         └── shared
+	public := FolderRule{ID: "public", Path: []string{"drive", "projects"}}
+	secret := FolderRule{ID: "secret", Path: []string{"drive", "projects", "public"}}
+	private := FolderRule{ID: "private", Path: []string{"drive", "projects"}}
+	shared := FolderRule{ID: "shared", Path: []string{"drive", "projects", "private"}}
+	projects := FolderRule{ID: "projects", Path: []string{"drive"}}
+
+	tests := []struct {
+		name  string
+		acl   *FolderACL
+		chain []string
+		want  Access
+	}{
+		{"nil", nil, []string{"file", "public", "projects", "drive"}, AccessAllowed},
+		{"no rules", &FolderACL{}, []string{"file", "public", "projects", "drive"}, AccessAllowed},
+		{"nil empty chain", nil, nil, AccessAllowed},
+
+		{"allow match", &FolderACL{Allow: []FolderRule{public}}, []string{"public", "projects", "drive"}, AccessAllowed},
+		{"allow match inside", &FolderACL{Allow: []FolderRule{public}}, []string{"file", "secret", "public", "projects", "drive"}, AccessAllowed},
+		{"allow no match", &FolderACL{Allow: []FolderRule{public}}, []string{"file", "private", "projects", "drive"}, AccessDenied},
+		{"allow empty chain", &FolderACL{Allow: []FolderRule{public}}, nil, AccessDenied},
+
+		{"deny only", &FolderACL{Deny: []FolderRule{private}}, []string{"file", "private", "projects", "drive"}, AccessDenied},
+		{"deny only elsewhere", &FolderACL{Deny: []FolderRule{private}}, []string{"file", "public", "projects", "drive"}, AccessAllowed},
+		{"deny empty chain", &FolderACL{Deny: []FolderRule{private}}, nil, AccessAllowed},
+
+		{"deny under allow", &FolderACL{Allow: []FolderRule{public}, Deny: []FolderRule{secret}}, []string{"secret", "public", "projects", "drive"}, AccessDenied},
+		{"deny under allow inside", &FolderACL{Allow: []FolderRule{public}, Deny: []FolderRule{secret}}, []string{"file", "secret", "public", "projects", "drive"}, AccessDenied},
+		{"deny under allow sibling", &FolderACL{Allow: []FolderRule{public}, Deny: []FolderRule{secret}}, []string{"file", "public", "projects", "drive"}, AccessAllowed},
+
+		{"allow under deny", &FolderACL{Allow: []FolderRule{shared}, Deny: []FolderRule{private}}, []string{"file", "shared", "private", "projects", "drive"}, AccessAllowed},
+		{"allow under deny sibling", &FolderACL{Allow: []FolderRule{shared}, Deny: []FolderRule{private}}, []string{"file", "private", "projects", "drive"}, AccessDenied},
+		{"allow under deny ancestor", &FolderACL{Allow: []FolderRule{shared}, Deny: []FolderRule{private}}, []string{"private", "projects", "drive"}, AccessTraverse},
+		{"allow under deny without allow elsewhere", &FolderACL{Allow: []FolderRule{shared}, Deny: []FolderRule{private}}, []string{"public", "projects", "drive"}, AccessDenied},
+
+		{"deny wins on the same folder", &FolderACL{Allow: []FolderRule{public}, Deny: []FolderRule{public}}, []string{"file", "public", "projects", "drive"}, AccessDenied},
+		{"deny wins inside the same folder", &FolderACL{Allow: []FolderRule{projects}, Deny: []FolderRule{projects}}, []string{"file", "projects", "drive"}, AccessDenied},
+
+		{"traverse drive", &FolderACL{Allow: []FolderRule{public}}, []string{"drive"}, AccessTraverse},
+		{"traverse parent", &FolderACL{Allow: []FolderRule{public}}, []string{"projects", "drive"}, AccessTraverse},
+		{"traverse not a sibling", &FolderACL{Allow: []FolderRule{public}}, []string{"private", "projects", "drive"}, AccessDenied},
+		{"traverse not a file", &FolderACL{Allow: []FolderRule{public}}, []string{"file", "projects", "drive"}, AccessDenied},
+		{"traverse denied ancestor", &FolderACL{Allow: []FolderRule{public}, Deny: []FolderRule{projects}}, []string{"projects", "drive"}, AccessTraverse},
+		{"traverse below denied ancestor", &FolderACL{Allow: []FolderRule{public}, Deny: []FolderRule{projects}}, []string{"private", "projects", "drive"}, AccessDenied},
+		{"traverse denied ancestor to allowed", &FolderACL{Allow: []FolderRule{public}, Deny: []FolderRule{projects}}, []string{"file", "public", "projects", "drive"}, AccessAllowed},
+	}
+	for _, tt := range tests {
+		if got := tt.acl.Evaluate(tt.chain); got != tt.want {
+			t.Errorf("%s: Evaluate(%v) = %v, want %v", tt.name, tt.chain, got, tt.want)
+		}
+	}
+}
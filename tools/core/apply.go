@@ -0,0 +1,416 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+// configEnv maps environment variables to config options. They are only used
+// when the option is not given on the command line.
+var configEnv = []struct {
+	name  string
+	value *string
+}{
+	{"GDIR_STATE_DIR", &Config.StateDir},
+	{"GDIR_PROFILE", &Config.Profile},
+	{"GDIR_DIST", &Config.DistDir},
+	{"GDIR_CF_EMAIL", &Config.CloudflareEmail},
+	{"GDIR_CF_KEY", &Config.CloudflareKey},
+	{"GDIR_CF_TOKEN", &Config.CloudflareToken},
+	{"GDIR_CF_ACCOUNT", &Config.CloudflareAccount},
+	{"GDIR_CF_SUBDOMAIN", &Config.CloudflareSubdomain},
+	{"GDIR_CF_WORKER", &Config.CloudflareWorker},
+	{"GDIR_CF_ZONE", &Config.CloudflareZone},
+	{"GDIR_CF_ROUTES", &Config.CloudflareRoutesStr},
+	{"GDIR_GIST_TOKEN", &Config.GistToken},
+	{"GDIR_ACCOUNTS_GIST", &Config.GistID.Accounts},
+	{"GDIR_USERS_GIST", &Config.GistID.Users},
+	{"GDIR_STATIC_GIST", &Config.GistID.Static},
+	{"GDIR_SECRET_KEY", &Config.SecretKey},
+	{"GDIR_ACCOUNT_ROTATION", &Config.AccountRotationStr},
+	{"GDIR_ACCOUNT_CANDIDATES", &Config.AccountCandidatesStr},
+	{"GDIR_ACCOUNTS_JSON_DIR", &Config.AccountsJSONDir},
+	{"GDIR_ADMIN_USER", &Config.AdminUser},
+	{"GDIR_ADMIN_PASS", &Config.AdminPass},
+	{"GDIR_SECRETS_STORE", &Config.Secrets.Store},
+}
+
+func LoadConfigEnv() {
+	for _, env := range configEnv {
+		if *env.value == "" {
+			if *env.value = strings.TrimSpace(os.Getenv(env.name)); *env.value != "" {
+				noteEnvSecret(env.value, env.name)
+			}
+		}
+	}
+}
+
+// ValidationError collects every problem found in the config, so that they
+// can all be fixed at once instead of failing on the first one.
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid config:\n    " + strings.Join(e, "\n    ")
+}
+
+// ValidateApplyConfig checks that every answer of the interactive setup can
+// be taken from the config, command line options or environment variables,
+// and fills in the defaults the interactive setup would have offered.
+func ValidateApplyConfig() (err error) {
+	var errs ValidationError
+	missing := func(what, flag, env, key string) {
+		errs = append(errs, fmt.Sprintf("missing %s (-%s, %s or \"%s\" in config)", what, flag, env, key))
+	}
+
+	if !UsesCloudflareToken() {
+		if Config.CloudflareKey == "" {
+			missing("Cloudflare API token", "cf-token", "GDIR_CF_TOKEN", "cf_token")
+		} else if Config.CloudflareEmail == "" {
+			missing("Cloudflare login Email of the Global API Key", "cf-email", "GDIR_CF_EMAIL", "cf_email")
+		}
+	}
+	if Config.CloudflareWorker == "" {
+		missing("Cloudflare Worker name", "cf-worker", "GDIR_CF_WORKER", "cf_worker")
+	} else if !ValidWorkerName(Config.CloudflareWorker) {
+		errs = append(errs, fmt.Sprintf("invalid Cloudflare Worker name: %s", Config.CloudflareWorker))
+	}
+	if Config.CloudflareRoutesStr != "" {
+		Config.CloudflareRoutes = nil
+		for _, pattern := range strings.Split(Config.CloudflareRoutesStr, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				Config.CloudflareRoutes = append(Config.CloudflareRoutes, pattern)
+			}
+		}
+	}
+	if len(Config.CloudflareRoutes) > 0 && Config.CloudflareZone == "" {
+		missing("Cloudflare zone of the routes", "cf-zone", "GDIR_CF_ZONE", "cf_zone")
+	}
+	switch Config.Secrets.Store {
+	case "", SecretStoreConfig:
+	case SecretStoreFile:
+		if os.Getenv(SecretsPassphraseEnv) == "" {
+			errs = append(errs, fmt.Sprintf("missing passphrase of the secrets file (%s)", SecretsPassphraseEnv))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("invalid secrets store (-secrets-store, GDIR_SECRETS_STORE or \"secrets.store\" in config): %s, want %s or %s", Config.Secrets.Store, SecretStoreFile, SecretStoreConfig))
+	}
+	if UsesGist() && Config.GistToken == "" {
+		missing("GitHub Gist Token", "gist-token", "GDIR_GIST_TOKEN", "gist_token")
+	}
+	for _, kind := range StorageKinds {
+		errs = append(errs, ValidateStorageConfig(kind)...)
+		if gistID := GistIDOf(kind); StorageType(kind) == StorageGist && *gistID != "" {
+			if id, e := ParseGistID(*gistID); e != nil {
+				errs = append(errs, fmt.Sprintf("%s Gist: %s", kind, e))
+			} else {
+				*gistID = id
+			}
+		}
+	}
+
+	if Config.AccountRotationStr != "" {
+		if Config.AccountRotation, err = strconv.ParseUint(Config.AccountRotationStr, 10, 64); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid account candidates rotations interval: %s", Config.AccountRotationStr))
+		}
+	} else if Config.AccountRotation == 0 {
+		Config.AccountRotation = 60
+	}
+	if Config.AccountCandidatesStr != "" {
+		if Config.AccountCandidates, err = strconv.ParseUint(Config.AccountCandidatesStr, 10, 64); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid account candidates size: %s", Config.AccountCandidatesStr))
+		}
+	} else if Config.AccountCandidates == 0 {
+		Config.AccountCandidates = 10
+	}
+	err = nil
+
+	if Config.AccountsCount == 0 || Config.RescanAccounts {
+		if Config.AccountsJSONDir == "" {
+			missing("Accounts JSON directory", "accounts-json-dir", "GDIR_ACCOUNTS_JSON_DIR", "accounts_json_dir")
+		} else if stat, e := os.Stat(Config.AccountsJSONDir); e != nil || !stat.IsDir() {
+			errs = append(errs, fmt.Sprintf("Accounts JSON directory is not a directory: %s", Config.AccountsJSONDir))
+		}
+	}
+
+	if found, e := HasUsers(); e != nil {
+		errs = append(errs, fmt.Sprintf("cannot read users: %s", e))
+	} else if !found {
+		if Config.AdminUser == "" {
+			errs = append(errs, "missing admin user name (-admin-user or GDIR_ADMIN_USER)")
+		}
+		if Config.AdminPass == "" {
+			errs = append(errs, "missing admin user password (-admin-pass or GDIR_ADMIN_PASS)")
+		}
+	}
+
+	if len(errs) > 0 {
+		err = errs
+	}
+	return
+}
+
+// ApplySetup runs the whole setup without asking any questions. With
+// Config.DryRun it only prints what would be done.
+func ApplySetup() (err error) {
+	if err = ValidateApplyConfig(); err != nil {
+		return
+	}
+
+	if Config.DryRun {
+		return PrintSetupPlan()
+	}
+
+	if Config.Secrets.Store == "" {
+		fmt.Printf("Warning: secrets that are not references are saved as they are in %s.\n", Config.ConfigFile)
+		fmt.Printf("Pass -secrets-store %s and set %s to keep them in %s instead.\n", SecretStoreFile, SecretsPassphraseEnv, SecretsFile().Path)
+	}
+
+	if err = InitCloudflareAPI(); err != nil {
+		return
+	}
+
+	if err = VerifyCloudflareToken(); err != nil {
+		return
+	}
+
+	if err = ResolveCloudflareAccount(); err != nil {
+		return
+	}
+
+	if err = ReportCloudflarePermissions(); err != nil {
+		return
+	}
+
+	if err = ResolveCloudflareSubdomain(); err != nil {
+		return
+	}
+
+	if UsesGist() {
+		if err = InitGitHubAPI(); err != nil {
+			return
+		}
+	}
+
+	for _, kind := range StorageKinds {
+		switch StorageType(kind) {
+		case StorageGist:
+			if *GistIDOf(kind) == "" {
+				fmt.Printf("Creating new Gist for %s...\n", kind)
+				if err = CreateNewGist(strings.Title(kind), GistIDOf(kind)); err != nil {
+					return
+				}
+			}
+		case StorageKV:
+			if StorageConfigOf(kind).KVNamespace == "" {
+				if err = CreateKVNamespace(kind); err != nil {
+					return
+				}
+			}
+		}
+	}
+
+	if err = GetGistUser(); err != nil {
+		return
+	}
+
+	if Config.SecretKey == "" {
+		if err = GenerateSecretKey(); err != nil {
+			return
+		}
+	} else if err = EnsureKDFConfig(); err != nil {
+		return
+	}
+
+	if Config.AccountsCount == 0 || Config.RescanAccounts {
+		if _, err = AddAccounts(Config.AccountsJSONDir); err != nil {
+			return
+		}
+	} else if err = SaveConfigFile(); err != nil {
+		return
+	}
+
+	found, err := HasUsers()
+	if err != nil {
+		return
+	}
+	if !found {
+		if err = os.MkdirAll(ArtifactPath("users"), 0700); err != nil {
+			return
+		}
+		if err = SaveUser(&User{Name: Config.AdminUser, Pass: Config.AdminPass, Role: RoleAdmin}); err != nil {
+			return
+		}
+	}
+
+	return Deploy()
+}
+
+// ResolveCloudflareAccount is the non-interactive SelectCloudflareAccount. It
+// only picks an account by itself when there is exactly one.
+func ResolveCloudflareAccount() (err error) {
+	if Config.CloudflareAccount == "" {
+		var accounts []cloudflare.Account
+		if accounts, _, err = Cf.Accounts(cloudflare.PaginationOptions{}); err != nil {
+			return
+		}
+		if len(accounts) == 0 {
+			return noCloudflareAccountsError()
+		}
+		if len(accounts) != 1 {
+			var names []string
+			for _, account := range accounts {
+				names = append(names, fmt.Sprintf("%s [%s]", account.Name, account.ID))
+			}
+			err = fmt.Errorf("cannot choose from %d Cloudflare accounts, please specify one with -cf-account: %s", len(accounts), strings.Join(names, ", "))
+			return
+		}
+		Config.CloudflareAccount = accounts[0].ID
+	}
+	Cf.AccountID = Config.CloudflareAccount
+	return
+}
+
+// ResolveCloudflareSubdomain is the non-interactive SetupCloudflareSubdomain.
+// Config.CloudflareSubdomain is registered when there is no subdomain yet.
+func ResolveCloudflareSubdomain() (err error) {
+	subdomain, err := Cf.GetSubdomain()
+	if err != nil {
+		return
+	}
+	if subdomain == "" {
+		if Config.CloudflareSubdomain == "" {
+			err = fmt.Errorf("you don't have a Cloudflare subdomain yet, please specify one to register with -cf-subdomain")
+			return
+		}
+		subdomain = Config.CloudflareSubdomain
+		fmt.Printf("Registering Cloudflare subdomain %s.workers.dev...\n", subdomain)
+		if err = Cf.RegisterSubdomain(subdomain); err != nil {
+			return
+		}
+	}
+	Config.CloudflareSubdomain = subdomain
+	return
+}
+
+func PrintSetupPlan() (err error) {
+	fmt.Println("Setup plan (dry run, nothing will be changed):")
+
+	if Config.CloudflareAccount != "" {
+		fmt.Printf("    use Cloudflare account %s\n", Config.CloudflareAccount)
+	} else {
+		if UsesCloudflareToken() {
+			fmt.Println("    use the only Cloudflare account of the API token")
+		} else {
+			fmt.Printf("    use the only Cloudflare account of %s\n", Config.CloudflareEmail)
+		}
+	}
+
+	for _, kind := range StorageKinds {
+		switch StorageType(kind) {
+		case StorageGist:
+			if *GistIDOf(kind) == "" {
+				fmt.Printf("    create Gist .gdir-%s\n", kind)
+			}
+		case StorageKV:
+			if StorageConfigOf(kind).KVNamespace == "" {
+				fmt.Printf("    create Workers KV namespace gdir-%s-%s\n", Config.CloudflareWorker, kind)
+			}
+		}
+	}
+
+	if Config.SecretKey == "" {
+		fmt.Println("    generate a new secret key")
+	}
+
+	if Config.Secrets.Store == SecretStoreFile {
+		fmt.Printf("    keep secrets in %s\n", SecretsFile().Path)
+	} else {
+		fmt.Printf("    keep secrets as they are in %s\n", Config.ConfigFile)
+	}
+
+	if Config.AccountsCount == 0 || Config.RescanAccounts {
+		manifest := &AccountsManifest{}
+		if Config.SecretKey != "" {
+			if manifest, err = LoadAccountsManifest(); err != nil {
+				return
+			}
+		}
+		var files []string
+		if files, err = AccountJSONFiles(Config.AccountsJSONDir); err != nil {
+			return
+		}
+		for _, file := range files {
+			var b []byte
+			if b, err = ioutil.ReadFile(file); err != nil {
+				return
+			}
+			entry, changed, e := manifest.Match(b)
+			switch {
+			case e != nil:
+				fmt.Printf("    cannot add %s: %s\n", file, e)
+			case !changed:
+			case entry != nil:
+				fmt.Printf("    encrypt %s into %s\n", file, filepath.Join(ArtifactPath("accounts"), entry.ID))
+			default:
+				fmt.Printf("    encrypt %s as a new account\n", file)
+			}
+		}
+	} else {
+		fmt.Printf("    keep %d encrypted accounts\n", Config.AccountsCount)
+	}
+
+	found, err := HasUsers()
+	if err != nil {
+		return
+	}
+	if !found {
+		var userPath string
+		if userPath, err = ComputeUserPath(Config.AdminUser); err != nil {
+			return
+		}
+		if Config.SecretKey == "" {
+			userPath = ArtifactPath("users")
+		}
+		fmt.Printf("    encrypt admin user %s into %s\n", Config.AdminUser, userPath)
+	}
+
+	dist, err := DescribeDist()
+	if err != nil {
+		return
+	}
+	fmt.Printf("    copy the static files of the %s into %s\n", dist, ArtifactPath("static"))
+	for _, kind := range StorageKinds {
+		var s Storage
+		if s, err = NewStorage(kind); err != nil {
+			return
+		}
+		fmt.Printf("    deploy %s to %s\n", kind, s)
+	}
+
+	script, err := WorkerScript()
+	if err != nil {
+		return
+	}
+	fmt.Printf("    upload %s (%d bytes) to Cloudflare Worker %s\n", WorkerScriptFile, len(script), Config.CloudflareWorker)
+	if Config.SecretKey != "" {
+		var bindings []WorkerBinding
+		if bindings, err = WorkerBindings(); err != nil {
+			return
+		}
+		for _, binding := range bindings {
+			fmt.Printf("        with binding %s\n", binding)
+		}
+	} else {
+		fmt.Println("        with the bindings of the new secret key")
+	}
+	for _, pattern := range Config.CloudflareRoutes {
+		fmt.Printf("    route %s in zone %s to Cloudflare Worker %s\n", pattern, Config.CloudflareZone, Config.CloudflareWorker)
+	}
+	return
+}
@@ -0,0 +1,32 @@
+package core
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateApplyConfigErrors(t *testing.T) {
+	old := Config
+	defer func() { Config = old }()
+	Config.StateDir, Config.Dir, Config.Profile = t.TempDir(), "", ""
+	Config.CloudflareToken, Config.CloudflareWorker = "token", ""
+	if err := ioutil.WriteFile(filepath.Join(Config.StateDir, "users"), []byte("not a directory"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err := ValidateApplyConfig()
+	errs, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("got %v, want a ValidationError", err)
+	}
+	for _, want := range []string{"missing Cloudflare Worker name", "cannot read users"} {
+		found := false
+		for _, e := range errs {
+			found = found || strings.HasPrefix(e, want)
+		}
+		if !found {
+			t.Errorf("errors %q, want %q among them", errs, want)
+		}
+	}
+}
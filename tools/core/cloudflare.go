@@ -0,0 +1,280 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/workerindex/gdir/tools/prompt"
+)
+
+// CloudflareTokensURL is where Cloudflare API tokens are created.
+const CloudflareTokensURL = "https://dash.cloudflare.com/profile/api-tokens"
+
+// CloudflarePermission is a permission the Cloudflare API token needs.
+type CloudflarePermission struct {
+	// Label is the name of the permission in the dashboard.
+	Label string
+	// Names are the permission groups of token policies granting it.
+	Names []string
+	// Write tells that probe only shows the permission to read.
+	Write bool
+	// probe is a request that needs the permission, or its read counterpart.
+	probe func() error
+}
+
+// RequiredCloudflarePermissions returns the permissions of the API token that
+// the config needs.
+func RequiredCloudflarePermissions() (permissions []CloudflarePermission) {
+	account := "/accounts/" + Config.CloudflareAccount
+	permissions = []CloudflarePermission{
+		{
+			Label: "Account Settings: Read",
+			Names: []string{"Account Settings Read", "Account Settings Write"},
+			probe: func() (err error) {
+				_, err = Cf.Raw("GET", account, nil)
+				return
+			},
+		},
+		{
+			Label: "Workers Scripts: Edit",
+			Names: []string{"Workers Scripts Write"},
+			Write: true,
+			probe: func() (err error) {
+				_, err = Cf.Raw("GET", account+"/workers/scripts", nil)
+				return
+			},
+		},
+	}
+	if UsesWorkersKV() {
+		permissions = append(permissions, CloudflarePermission{
+			Label: "Workers KV Storage: Edit",
+			Names: []string{"Workers KV Storage Write"},
+			Write: true,
+			probe: func() (err error) {
+				_, err = Cf.Raw("GET", account+"/storage/kv/namespaces", nil)
+				return
+			},
+		})
+	}
+	if len(Config.CloudflareRoutes) > 0 {
+		permissions = append(permissions, CloudflarePermission{
+			Label: "Zone: Read",
+			Names: []string{"Zone Read", "Zone Write"},
+			probe: func() (err error) {
+				_, err = CloudflareZoneID()
+				return
+			},
+		}, CloudflarePermission{
+			Label: "Workers Routes: Edit",
+			Names: []string{"Workers Routes Write"},
+			Write: true,
+			probe: func() (err error) {
+				zoneID, err := CloudflareZoneID()
+				if err == nil {
+					_, err = Cf.Raw("GET", "/zones/"+zoneID+"/workers/routes", nil)
+				}
+				return
+			},
+		})
+	}
+	return
+}
+
+// UsesWorkersKV reports whether a storage or the usage is in Workers KV.
+func UsesWorkersKV() bool {
+	for _, kind := range StorageKinds {
+		if StorageType(kind) == StorageKV {
+			return true
+		}
+	}
+	return Config.Usage.Type == UsageKV
+}
+
+// Results of a PermissionCheck.
+const (
+	PermissionGranted    = "granted"
+	PermissionMissing    = "missing"
+	PermissionUnverified = "unverified"
+)
+
+// PermissionCheck is whether the API token has a permission.
+type PermissionCheck struct {
+	CloudflarePermission
+	Result string
+	Detail string
+}
+
+// cloudflareToken is the result of verifying an API token.
+type cloudflareToken struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Policies []struct {
+		Effect           string `json:"effect"`
+		PermissionGroups []struct {
+			Name string `json:"name"`
+		} `json:"permission_groups"`
+	} `json:"policies"`
+}
+
+// UsesCloudflareToken reports whether Cloudflare is signed in with a scoped
+// API token rather than the legacy Global API Key.
+func UsesCloudflareToken() bool {
+	return Config.CloudflareToken != ""
+}
+
+// VerifyCloudflareToken checks that the API token is active. It does nothing
+// with the Global API Key.
+func VerifyCloudflareToken() (err error) {
+	if !UsesCloudflareToken() {
+		return
+	}
+	_, err = verifyCloudflareToken()
+	return
+}
+
+func verifyCloudflareToken() (token *cloudflareToken, err error) {
+	res, err := Cf.Raw("GET", "/user/tokens/verify", nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot verify your Cloudflare API token: %w", err)
+	}
+	if err = json.Unmarshal(res, &token); err != nil {
+		return
+	}
+	if token.Status != "active" {
+		return nil, fmt.Errorf("your Cloudflare API token is %s", token.Status)
+	}
+	return
+}
+
+// CheckCloudflarePermissions checks the permissions of the API token on the
+// selected account. The policies of the token are read when the token may
+// read them, and otherwise the permissions are probed with read requests.
+func CheckCloudflarePermissions() (checks []PermissionCheck, err error) {
+	token, err := verifyCloudflareToken()
+	if err != nil {
+		return
+	}
+	granted := map[string]bool{}
+	readable := false
+	if res, e := Cf.Raw("GET", "/user/tokens/"+token.ID, nil); e == nil {
+		if e = json.Unmarshal(res, &token); e == nil {
+			readable = true
+			for _, policy := range token.Policies {
+				if policy.Effect != "allow" {
+					continue
+				}
+				for _, group := range policy.PermissionGroups {
+					granted[group.Name] = true
+				}
+			}
+		}
+	}
+	for _, permission := range RequiredCloudflarePermissions() {
+		check := PermissionCheck{CloudflarePermission: permission, Result: PermissionMissing}
+		if readable {
+			for _, name := range permission.Names {
+				if granted[name] {
+					check.Result = PermissionGranted
+				}
+			}
+		} else if e := permission.probe(); e != nil {
+			check.Detail = e.Error()
+		} else if permission.Write {
+			check.Result = PermissionUnverified
+			check.Detail = "can read, editing is only checked when deploying"
+		} else {
+			check.Result = PermissionGranted
+		}
+		checks = append(checks, check)
+	}
+	return
+}
+
+// ReportCloudflarePermissions checks and prints the permissions of the API
+// token, and fails when any is missing. It does nothing with the Global API
+// Key, which has every permission.
+func ReportCloudflarePermissions() (err error) {
+	if !UsesCloudflareToken() {
+		return
+	}
+	fmt.Println("Checking the permissions of your Cloudflare API token...")
+	checks, err := CheckCloudflarePermissions()
+	if err != nil {
+		return
+	}
+	var missing []string
+	for _, check := range checks {
+		if check.Detail != "" {
+			fmt.Printf("    %-10s  %-26s  %s\n", check.Result, check.Label, check.Detail)
+		} else {
+			fmt.Printf("    %-10s  %s\n", check.Result, check.Label)
+		}
+		if check.Result == PermissionMissing {
+			missing = append(missing, check.Label)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("your Cloudflare API token is missing permissions on account %s: %s, please edit it at %s", Config.CloudflareAccount, strings.Join(missing, ", "), CloudflareTokensURL)
+	}
+	return
+}
+
+// noCloudflareAccountsError explains why no accounts were found.
+func noCloudflareAccountsError() error {
+	if UsesCloudflareToken() {
+		return fmt.Errorf("your Cloudflare API token cannot read any account, it needs the Account Settings: Read permission")
+	}
+	return fmt.Errorf("no accounts under your cloudflare")
+}
+
+// EnterCloudflareCredentials asks how to sign in to Cloudflare: with a scoped
+// API token, or with the legacy Global API Key and login Email.
+func EnterCloudflareCredentials() (err error) {
+	if err = confirmSecret("Your Cloudflare API token", "cf_token", &Config.CloudflareToken); err != nil || Config.CloudflareToken != "" {
+		return
+	}
+	choice := 0
+	if Config.CloudflareKey != "" {
+		fmt.Println("You sign in to Cloudflare with your Global API Key, which can do anything on your account.")
+		var keep bool
+		if keep, err = prompt.Confirm("Keep using it instead of a scoped API token?", false); err != nil {
+			return
+		}
+		if keep {
+			choice = 1
+		}
+	} else if choice, err = prompt.Select("Specify how you want gdir to sign in to Cloudflare:", []string{
+		"Scoped API token             (recommended)",
+		"Global API Key and login Email   (legacy)",
+	}, 0); err != nil {
+		return
+	}
+	if choice == 1 {
+		if err = EnterCloudflareEmail(); err != nil {
+			return
+		}
+		return EnterCloudflareKey()
+	}
+	fmt.Printf("Please visit %s and create a token\n", CloudflareTokensURL)
+	fmt.Println("from the \"Edit Cloudflare Workers\" template, or with these permissions:")
+	for _, permission := range RequiredCloudflarePermissions() {
+		fmt.Printf("    %s\n", permission.Label)
+	}
+	if err = EnterSecret("your API token", "cf_token"); err != nil {
+		return
+	}
+	Config.CloudflareKey = ""
+	fmt.Println("")
+	return SaveConfigFile()
+}
+
+// newCloudflareAPI returns a Cloudflare client signed in with the API token,
+// or with the Global API Key.
+func newCloudflareAPI() (*cloudflare.API, error) {
+	if UsesCloudflareToken() {
+		return cloudflare.NewWithAPIToken(Config.CloudflareToken)
+	}
+	return cloudflare.New(Config.CloudflareKey, Config.CloudflareEmail)
+}
@@ -1,32 +1,65 @@
 package core
 
 import (
+	"encoding/json"
+	"time"
+
 	"github.com/cloudflare/cloudflare-go"
 	"github.com/google/go-github/v31/github"
 )
 
 var Config = struct {
-	ConfigFile          string `json:"-"`
-	CloudflareEmail     string `json:"cf_email,omitempty"`
-	CloudflareKey       string `json:"cf_key,omitempty"`
-	CloudflareAccount   string `json:"cf_account,omitempty"`
-	CloudflareSubdomain string `json:"-"`
-	CloudflareWorker    string `json:"cf_worker,omitempty"`
-	GistToken           string `json:"gist_token,omitempty"`
-	GistUser            string `json:"gist_user,omitempty"`
+	ConfigFile          string   `json:"-"`
+	StateDir            string   `json:"-"`
+	DistDir             string   `json:"-"`
+	Profile             string   `json:"-"`
+	CreateProfile       bool     `json:"-"`
+	CloudflareEmail     string   `json:"cf_email,omitempty"`
+	CloudflareKey       string   `json:"cf_key,omitempty"`
+	CloudflareToken     string   `json:"cf_token,omitempty"`
+	CloudflareAccount   string   `json:"cf_account,omitempty"`
+	CloudflareSubdomain string   `json:"-"`
+	CloudflareWorker    string   `json:"cf_worker,omitempty"`
+	CloudflareZone      string   `json:"cf_zone,omitempty"`
+	CloudflareRoutes    []string `json:"cf_routes,omitempty"`
+	CloudflareRoutesStr string   `json:"-"`
+	GistToken           string   `json:"gist_token,omitempty"`
+	GistUser            string   `json:"gist_user,omitempty"`
 	GistID              struct {
 		Accounts string `json:"accounts,omitempty"`
 		Users    string `json:"users,omitempty"`
 		Static   string `json:"static,omitempty"`
 	} `json:"gist_id,omitempty"`
-	SecretKey            string `json:"secret_key,omitempty"`
-	AccountRotation      uint64 `json:"account_rotation,omitempty"`
-	AccountRotationStr   string `json:"-"`
-	AccountCandidates    uint64 `json:"account_candidates,omitempty"`
-	AccountCandidatesStr string `json:"-"`
-	AccountsJSONDir      string `json:"accounts_json_dir,omitempty"`
-	AccountsCount        uint64 `json:"accounts_count,omitempty"`
-	Debug                bool   `json:"-"`
+	Storage struct {
+		Accounts StorageConfig `json:"accounts,omitempty"`
+		Users    StorageConfig `json:"users,omitempty"`
+		Static   StorageConfig `json:"static,omitempty"`
+	} `json:"storage,omitempty"`
+	SecretKey            string            `json:"secret_key,omitempty"`
+	KDF                  *KDFConfig        `json:"kdf,omitempty"`
+	AccountRotation      uint64            `json:"account_rotation,omitempty"`
+	AccountRotationStr   string            `json:"-"`
+	AccountCandidates    uint64            `json:"account_candidates,omitempty"`
+	AccountCandidatesStr string            `json:"-"`
+	AccountsJSONDir      string            `json:"accounts_json_dir,omitempty"`
+	AccountsCount        uint64            `json:"accounts_count,omitempty"`
+	Groups               map[string]*Group `json:"groups,omitempty"`
+	Usage                UsageConfig       `json:"usage,omitempty"`
+	Secrets              SecretsConfig     `json:"secrets,omitempty"`
+	RescanAccounts       bool              `json:"-"`
+	AdminUser            string            `json:"-"`
+	AdminPass            string            `json:"-"`
+	Apply                bool              `json:"-"`
+	DryRun               bool              `json:"-"`
+	Debug                bool              `json:"-"`
+	// Dir keeps the artifacts, such as the users and the accounts, in the
+	// state directory itself by default, or in profiles/<name> for a profile.
+	Dir string `json:"dir,omitempty"`
+	// Paths keep artifacts apart from Dir, and locate the built worker.
+	Paths ArtifactPaths `json:"paths,omitempty"`
+	// Profiles are the options of the named profiles, selected with -profile
+	// instead of those at the top of the file.
+	Profiles map[string]json.RawMessage `json:"profiles,omitempty"`
 }{}
 
 // Cf is the Cloudflare client
@@ -37,8 +70,37 @@ var Gh *github.Client
 
 // User is the user type
 type User struct {
-	Name            string   `json:"name"`
-	Pass            string   `json:"pass"`
-	DrivesWhiteList []string `json:"drives_white_list,omitempty"`
-	DrivesBlackList []string `json:"drives_black_list,omitempty"`
+	Name            string     `json:"name"`
+	Pass            string     `json:"pass,omitempty"`
+	PassHash        string     `json:"pass_hash,omitempty"`
+	DrivesWhiteList []string   `json:"drives_white_list,omitempty"`
+	DrivesBlackList []string   `json:"drives_black_list,omitempty"`
+	Disabled        bool       `json:"disabled,omitempty"`
+	Role            string     `json:"role,omitempty"`
+	Groups          []string   `json:"groups,omitempty"`
+	Folders         *FolderACL `json:"folders,omitempty"`
+	// ExpiresAt is when the user can no longer log in, if ever.
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	MaxDailyBytes    int64      `json:"max_daily_bytes,omitempty"`
+	MaxDailyRequests int64      `json:"max_daily_requests,omitempty"`
+	// Policy is resolved by SaveUser from the fields above.
+	Policy *UserPolicy `json:"policy,omitempty"`
+}
+
+// StorageConfig selects where an artifact kind (accounts, users or static) is
+// published for the worker to fetch. Only the options of the selected type are
+// used.
+type StorageConfig struct {
+	Type        string `json:"type,omitempty"`
+	URL         string `json:"url,omitempty"`
+	GitRemote   string `json:"git_remote,omitempty"`
+	GitBranch   string `json:"git_branch,omitempty"`
+	KVNamespace string `json:"kv_namespace,omitempty"`
+	S3Endpoint  string `json:"s3_endpoint,omitempty"`
+	S3Region    string `json:"s3_region,omitempty"`
+	S3Bucket    string `json:"s3_bucket,omitempty"`
+	S3Prefix    string `json:"s3_prefix,omitempty"`
+	S3AccessKey string `json:"s3_access_key,omitempty"`
+	S3SecretKey string `json:"s3_secret_key,omitempty"`
+	Dir         string `json:"dir,omitempty"`
 }
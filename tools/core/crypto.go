@@ -1,12 +1,17 @@
 package core
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
+	"fmt"
 )
 
+// GCMKey derives the AES-256 key of a namespace from the secret the same way
+// as the worker, with a single SHA-256.
 func GCMKey(secret string, namespace string) (key []byte) {
 	hash := sha256.New()
 	hash.Write([]byte(secret + ":" + namespace))
@@ -22,21 +27,210 @@ func GCMCipher(secret string, namespace string) (c cipher.AEAD, err error) {
 	return cipher.NewGCM(block)
 }
 
+// Encrypted files are envelopes with a header that says how to decrypt them:
+//
+//	"GDIR" | version | KDF | KDF params length | KDF params | key ID length | key ID | nonce | ciphertext
+//
+// The header and the namespace are authenticated as AES-GCM associated data,
+// so that a file cannot be modified or used in another namespace. Files
+// written before envelopes are a bare nonce and ciphertext.
+const (
+	envelopeMagic   = "GDIR"
+	EnvelopeVersion = 1
+	nonceSize       = 12
+)
+
+// KDFs deriving the key of a namespace from the secret.
+const (
+	// KDFSHA256 is GCMKey.
+	KDFSHA256 = 1
+	// KDFHKDF is HKDFKey, with the salt as KDF params.
+	KDFHKDF = 2
+)
+
+var (
+	ErrCiphertextTooShort = errors.New("ciphertext too short")
+	ErrUnsupportedVersion = errors.New("unsupported ciphertext envelope version")
+)
+
+// WrongKeyError is returned when decrypting an envelope encrypted with another
+// secret key.
+type WrongKeyError struct {
+	KeyID []byte
+}
+
+func (e *WrongKeyError) Error() string {
+	return fmt.Sprintf("encrypted with another secret key (key ID %x)", e.KeyID)
+}
+
+// Envelope is a parsed encrypted file.
+type Envelope struct {
+	Version    byte
+	KDF        byte
+	KDFParams  []byte
+	KeyID      []byte
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// KeyID identifies a secret key without revealing it. Like secretFingerprint,
+// it is derived with HKDF and the salt of the deployment, and envelopes without
+// a salt have no key ID rather than an unsalted hash of the secret.
+func KeyID(secret string, salt []byte) []byte {
+	if len(salt) == 0 {
+		return nil
+	}
+	key, err := HKDFKey(secret, salt, "key-id")
+	if err != nil {
+		return nil
+	}
+	return key[:8]
+}
+
+// legacyKeyID is the key ID of envelopes written before key IDs were derived
+// with HKDF, which migrate replaces.
+func legacyKeyID(secret string) []byte {
+	hash := sha256.Sum256([]byte("gdir:key-id:" + secret))
+	return hash[:8]
+}
+
+// IsEnvelope reports whether data starts like an envelope. Legacy ciphertext
+// starts with a random nonce, so it may look like an envelope too.
+func IsEnvelope(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(envelopeMagic))
+}
+
+// ParseEnvelope splits an envelope into its fields.
+func ParseEnvelope(data []byte) (e *Envelope, err error) {
+	if !IsEnvelope(data) || len(data) < len(envelopeMagic)+3 {
+		return nil, ErrCiphertextTooShort
+	}
+	e = &Envelope{Version: data[4], KDF: data[5]}
+	if e.Version != EnvelopeVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, e.Version)
+	}
+	rest := data[6:]
+	next := func() (field []byte, ok bool) {
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return nil, false
+		}
+		field, rest = rest[1:1+int(rest[0])], rest[1+int(rest[0]):]
+		return field, true
+	}
+	var ok bool
+	if e.KDFParams, ok = next(); !ok {
+		return nil, ErrCiphertextTooShort
+	}
+	if e.KeyID, ok = next(); !ok {
+		return nil, ErrCiphertextTooShort
+	}
+	if len(rest) < nonceSize {
+		return nil, ErrCiphertextTooShort
+	}
+	e.Nonce, e.Ciphertext = rest[:nonceSize], rest[nonceSize:]
+	return
+}
+
+// Header returns the envelope up to the nonce.
+func (e *Envelope) Header() []byte {
+	b := []byte(envelopeMagic)
+	b = append(b, e.Version, e.KDF, byte(len(e.KDFParams)))
+	b = append(b, e.KDFParams...)
+	b = append(b, byte(len(e.KeyID)))
+	return append(b, e.KeyID...)
+}
+
+func (e *Envelope) additionalData(namespace string) []byte {
+	return append(e.Header(), namespace...)
+}
+
+func (e *Envelope) cipher(secret string, namespace string) (c cipher.AEAD, err error) {
+	switch e.KDF {
+	case KDFSHA256:
+		return GCMCipher(secret, namespace)
+	case KDFHKDF:
+		var key []byte
+		if key, err = HKDFKey(secret, e.KDFParams, namespace); err != nil {
+			return
+		}
+		var block cipher.Block
+		if block, err = aes.NewCipher(key); err != nil {
+			return
+		}
+		return cipher.NewGCM(block)
+	}
+	return nil, fmt.Errorf("unknown KDF %d", e.KDF)
+}
+
+// newEnvelope returns the header of new envelopes, with the KDF of the config.
+func newEnvelope(secret string) *Envelope {
+	e := &Envelope{Version: EnvelopeVersion, KDF: KDFSHA256}
+	if Config.KDF.Enabled() {
+		e.KDF, e.KDFParams = KDFHKDF, Config.KDF.SaltBytes()
+		e.KeyID = KeyID(secret, e.KDFParams)
+	}
+	return e
+}
+
+// GCMEncrypt encrypts data of a namespace into an envelope.
 func GCMEncrypt(secret string, namespace string, data []byte) (out []byte, err error) {
-	gcm, err := GCMCipher(secret, namespace)
+	e := newEnvelope(secret)
+	gcm, err := e.cipher(secret, namespace)
 	if err != nil {
 		return
 	}
-	out = make([]byte, 12, 12+len(data)+gcm.Overhead())
-	rand.Read(out[:12])
-	out = gcm.Seal(out, out[:12], data, nil)
+	header := e.Header()
+	out = make([]byte, len(header)+nonceSize, len(header)+nonceSize+len(data)+gcm.Overhead())
+	copy(out, header)
+	nonce := out[len(header):]
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	out = gcm.Seal(out, nonce, data, e.additionalData(namespace))
 	return
 }
 
+// GCMDecrypt decrypts an envelope, or legacy ciphertext, of a namespace.
 func GCMDecrypt(secret string, namespace string, data []byte) (out []byte, err error) {
+	if IsEnvelope(data) {
+		if out, err = decryptEnvelope(secret, namespace, data); err == nil {
+			return
+		}
+		// a legacy nonce can start with the magic too
+		if legacy, e := decryptLegacy(secret, namespace, data); e == nil {
+			return legacy, nil
+		}
+		return
+	}
+	return decryptLegacy(secret, namespace, data)
+}
+
+func decryptEnvelope(secret string, namespace string, data []byte) (out []byte, err error) {
+	e, err := ParseEnvelope(data)
+	if err != nil {
+		return
+	}
+	switch {
+	case len(e.KeyID) == 0:
+	case e.KDF == KDFHKDF && bytes.Equal(e.KeyID, KeyID(secret, e.KDFParams)):
+	case bytes.Equal(e.KeyID, legacyKeyID(secret)):
+	default:
+		return nil, &WrongKeyError{KeyID: e.KeyID}
+	}
+	gcm, err := e.cipher(secret, namespace)
+	if err != nil {
+		return
+	}
+	return gcm.Open(nil, e.Nonce, e.Ciphertext, e.additionalData(namespace))
+}
+
+func decryptLegacy(secret string, namespace string, data []byte) (out []byte, err error) {
+	if len(data) < nonceSize {
+		return nil, ErrCiphertextTooShort
+	}
 	gcm, err := GCMCipher(secret, namespace)
 	if err != nil {
 		return
 	}
-	return gcm.Open(nil, data[:12], data[12:], nil)
+	return gcm.Open(nil, data[:nonceSize], data[nonceSize:], nil)
 }
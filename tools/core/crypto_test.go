@@ -0,0 +1,165 @@
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// sealEnvelope encrypts data into an envelope with the given header, to make
+// envelopes newEnvelope no longer writes.
+func sealEnvelope(t *testing.T, e *Envelope, secret string, namespace string, data []byte) []byte {
+	t.Helper()
+	gcm, err := e.cipher(secret, namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Nonce = make([]byte, nonceSize)
+	if _, err = rand.Read(e.Nonce); err != nil {
+		t.Fatal(err)
+	}
+	out := append(e.Header(), e.Nonce...)
+	return gcm.Seal(out, e.Nonce, data, e.additionalData(namespace))
+}
+
+// sealLegacy encrypts data the way files were before envelopes, as a bare
+// nonce and ciphertext.
+func sealLegacy(t *testing.T, secret string, namespace string, data []byte) []byte {
+	t.Helper()
+	gcm, err := GCMCipher(secret, namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err = rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+	return gcm.Seal(nonce, nonce, data, nil)
+}
+
+func TestGCMDecrypt(t *testing.T) {
+	defer func(old *KDFConfig) { Config.KDF = old }(Config.KDF)
+	const secret, namespace = "secret", "user"
+	plain := []byte(`{"name":"alice"}`)
+	salt := bytes.Repeat([]byte{0x5a}, 16)
+	hkdf := &KDFConfig{Type: KDFTypeHKDF, Salt: hex.EncodeToString(salt)}
+
+	for _, test := range []struct {
+		name      string
+		kdf       *KDFConfig
+		data      func() []byte
+		secret    string
+		namespace string
+		wrongKey  bool
+		fails     bool
+	}{
+		{name: "round trip without a KDF", data: func() []byte { return encrypt(t, secret, namespace, plain) }},
+		{name: "round trip with HKDF", kdf: hkdf, data: func() []byte { return encrypt(t, secret, namespace, plain) }},
+		{name: "legacy nonce and ciphertext", data: func() []byte { return sealLegacy(t, secret, namespace, plain) }},
+		{name: "legacy key ID", data: func() []byte {
+			return sealEnvelope(t, &Envelope{Version: EnvelopeVersion, KDF: KDFSHA256, KeyID: legacyKeyID(secret)}, secret, namespace, plain)
+		}},
+		{name: "legacy key ID with HKDF", kdf: hkdf, data: func() []byte {
+			return sealEnvelope(t, &Envelope{Version: EnvelopeVersion, KDF: KDFHKDF, KDFParams: salt, KeyID: legacyKeyID(secret)}, secret, namespace, plain)
+		}},
+		{name: "wrong namespace", data: func() []byte { return encrypt(t, secret, namespace, plain) }, namespace: "account", fails: true},
+		{name: "wrong namespace with HKDF", kdf: hkdf, data: func() []byte { return encrypt(t, secret, namespace, plain) }, namespace: "account", fails: true},
+		{name: "wrong namespace of legacy ciphertext", data: func() []byte { return sealLegacy(t, secret, namespace, plain) }, namespace: "account", fails: true},
+		{name: "wrong key", kdf: hkdf, data: func() []byte { return encrypt(t, secret, namespace, plain) }, secret: "other", wrongKey: true, fails: true},
+		{name: "wrong key of a legacy key ID", data: func() []byte {
+			return sealEnvelope(t, &Envelope{Version: EnvelopeVersion, KDF: KDFSHA256, KeyID: legacyKeyID(secret)}, secret, namespace, plain)
+		}, secret: "other", wrongKey: true, fails: true},
+		{name: "wrong key without a key ID", data: func() []byte { return encrypt(t, secret, namespace, plain) }, secret: "other", fails: true},
+		{name: "tampered ciphertext", kdf: hkdf, data: func() []byte {
+			b := encrypt(t, secret, namespace, plain)
+			b[len(b)-1] ^= 1
+			return b
+		}, fails: true},
+		{name: "truncated", data: func() []byte { return encrypt(t, secret, namespace, plain)[:10] }, fails: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			Config.KDF = test.kdf
+			data := test.data()
+			s, ns := secret, namespace
+			if test.secret != "" {
+				s = test.secret
+			}
+			if test.namespace != "" {
+				ns = test.namespace
+			}
+			out, err := GCMDecrypt(s, ns, data)
+			var wrongKey *WrongKeyError
+			if errors.As(err, &wrongKey) != test.wrongKey {
+				t.Errorf("got error %v, want a WrongKeyError: %v", err, test.wrongKey)
+			}
+			if test.fails {
+				if err == nil {
+					t.Errorf("decrypted %q, want an error", out)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(out, plain) {
+				t.Errorf("decrypted %q, %v, want %q", out, err, plain)
+			}
+		})
+	}
+}
+
+func encrypt(t *testing.T, secret string, namespace string, data []byte) []byte {
+	t.Helper()
+	b, err := GCMEncrypt(secret, namespace, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestGCMEncryptEnvelope(t *testing.T) {
+	defer func(old *KDFConfig) { Config.KDF = old }(Config.KDF)
+	salt := bytes.Repeat([]byte{0x5a}, 16)
+	for _, test := range []struct {
+		kdf       *KDFConfig
+		envelope  byte
+		kdfParams []byte
+		keyID     []byte
+	}{
+		{kdf: nil, envelope: KDFSHA256},
+		{kdf: &KDFConfig{}, envelope: KDFSHA256},
+		{kdf: &KDFConfig{Type: KDFTypeHKDF, Salt: hex.EncodeToString(salt)}, envelope: KDFHKDF, kdfParams: salt, keyID: KeyID("secret", salt)},
+	} {
+		Config.KDF = test.kdf
+		e, err := ParseEnvelope(encrypt(t, "secret", "user", []byte("data")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Version != EnvelopeVersion || e.KDF != test.envelope || !bytes.Equal(e.KDFParams, test.kdfParams) || !bytes.Equal(e.KeyID, test.keyID) {
+			t.Errorf("with KDF %+v: envelope %+v", test.kdf, e)
+		}
+	}
+}
+
+// TestKeyID checks key IDs against HKDF-SHA256 computed elsewhere, with the
+// info "gdir:key-id" the worker uses too.
+func TestKeyID(t *testing.T) {
+	salt := bytes.Repeat([]byte{0x5a}, 16)
+	for _, test := range []struct {
+		secret string
+		salt   []byte
+		want   string
+	}{
+		{secret: "secret", salt: nil, want: ""},
+		{secret: "secret", salt: []byte{}, want: ""},
+		{secret: "secret", salt: salt, want: "7a5a6c58b1aff0b5"},
+		{secret: "other", salt: salt, want: "20e36f2b0ed48bde"},
+		{secret: "secret", salt: bytes.Repeat([]byte{0xa5}, 16), want: "10ae4ab43800687b"},
+	} {
+		if id := hex.EncodeToString(KeyID(test.secret, test.salt)); id != test.want {
+			t.Errorf("KeyID(%q, %x) = %s, want %s", test.secret, test.salt, id, test.want)
+		}
+	}
+	if id, want := hex.EncodeToString(legacyKeyID("secret")), "6a2af0e9651040e8"; id != want {
+		t.Errorf("legacyKeyID = %s, want %s", id, want)
+	}
+}
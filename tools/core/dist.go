@@ -0,0 +1,137 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+
+	"github.com/workerindex/gdir"
+)
+
+// DistVersionFile is the version of a build, written next to the worker.
+const DistVersionFile = "version.json"
+
+// DistEmbedded is the source of the built files embedded in the tools.
+const DistEmbedded = "embedded"
+
+// DistVersion is the version of a build of the worker and static files.
+type DistVersion struct {
+	Version string    `json:"version"`
+	Commit  string    `json:"commit,omitempty"`
+	Built   time.Time `json:"built"`
+}
+
+func (v DistVersion) String() string {
+	if v.Version == "" {
+		return "unknown"
+	}
+	s := v.Version
+	if v.Commit != "" {
+		s += " (" + v.Commit + ")"
+	}
+	if !v.Built.IsZero() {
+		s += ", built " + v.Built.Local().Format("2006-01-02 15:04")
+	}
+	return s
+}
+
+// DistFile is a built file with its SHA-256.
+type DistFile struct {
+	Name string
+	Hash string
+}
+
+// EmbeddedDist returns the built files embedded in the tools.
+func EmbeddedDist() (fs.FS, error) {
+	return fs.Sub(gdir.Dist, "dist")
+}
+
+// DistSource returns the directory of the built files to deploy, given with
+// -dist or in paths of the config, or DistEmbedded.
+func DistSource() string {
+	if Config.DistDir != "" {
+		return Config.DistDir
+	}
+	if dir := CurrentWorkspace().DistDir(); dir != "" {
+		return dir
+	}
+	return DistEmbedded
+}
+
+// DistFS returns the built files to deploy, those of a local build when one
+// is given, or else those embedded in the tools.
+func DistFS() (fsys fs.FS, err error) {
+	source := DistSource()
+	if source == DistEmbedded {
+		return EmbeddedDist()
+	}
+	if _, err = os.Stat(source); err != nil {
+		return nil, fmt.Errorf("cannot use the build in %s: %w", source, err)
+	}
+	return os.DirFS(source), nil
+}
+
+// ReadDistVersion reads the version of a build. Builds from before versions
+// were recorded have none.
+func ReadDistVersion(fsys fs.FS) (version DistVersion, err error) {
+	b, err := fs.ReadFile(fsys, DistVersionFile)
+	if os.IsNotExist(err) {
+		return version, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &version)
+	return
+}
+
+// DistFiles returns the hashes of the files of a build, by path.
+func DistFiles(fsys fs.FS) (files []DistFile, err error) {
+	err = fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || path.Base(name)[0] == '.' {
+			return err
+		}
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(b)
+		files = append(files, DistFile{Name: name, Hash: hex.EncodeToString(sum[:])})
+		return nil
+	})
+	return
+}
+
+// StaticDist returns the built static files.
+func StaticDist() (fs.FS, error) {
+	fsys, err := DistFS()
+	if err != nil {
+		return nil, err
+	}
+	return fs.Sub(fsys, "static")
+}
+
+// DescribeDist describes the build that is deployed, for messages.
+func DescribeDist() (desc string, err error) {
+	fsys, err := DistFS()
+	if err != nil {
+		return
+	}
+	version, err := ReadDistVersion(fsys)
+	if err != nil {
+		return
+	}
+	desc = "build"
+	if version.Version != "" {
+		desc += " " + version.String()
+	}
+	if source := DistSource(); source != DistEmbedded {
+		return fmt.Sprintf("%s in %s", desc, source), nil
+	}
+	return "embedded " + desc, nil
+}
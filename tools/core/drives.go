@@ -0,0 +1,217 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/workerindex/gdir/tools/drive"
+	"github.com/workerindex/gdir/tools/prompt"
+)
+
+// DriveEntry is a shared drive and the number of accounts that can reach it.
+type DriveEntry struct {
+	ID       string
+	Name     string
+	Accounts int
+}
+
+// DriveCatalog is the shared drives visible to the accounts, as listed with
+// drives.list.
+type DriveCatalog struct {
+	Drives []*DriveEntry
+	// Accounts is the number of accounts that listed their drives.
+	Accounts int
+
+	client   *drive.Client
+	account  *drive.Account
+	problems map[string]string
+}
+
+// LoadDriveCatalog lists the shared drives of every account, parallel
+// accounts at a time. Accounts that cannot list their drives are left out.
+func LoadDriveCatalog(client *drive.Client, accounts []*drive.Account, parallel int) (c *DriveCatalog, err error) {
+	if len(accounts) == 0 {
+		return nil, fmt.Errorf("no accounts to list the shared drives with")
+	}
+	if parallel < 1 {
+		parallel = 1
+	}
+	lists := make([][]drive.Drive, len(accounts))
+	errs := make([]error, len(accounts))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, a := range accounts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, a *drive.Account) {
+			defer wg.Done()
+			lists[i], errs[i] = client.Drives(a)
+			<-sem
+		}(i, a)
+	}
+	wg.Wait()
+	c = &DriveCatalog{client: client}
+	byID := make(map[string]*DriveEntry)
+	for i, list := range lists {
+		if errs[i] != nil {
+			continue
+		}
+		if c.account == nil {
+			c.account = accounts[i]
+		}
+		c.Accounts++
+		for _, d := range list {
+			entry, ok := byID[d.ID]
+			if !ok {
+				entry = &DriveEntry{ID: d.ID, Name: d.Name}
+				byID[d.ID] = entry
+				c.Drives = append(c.Drives, entry)
+			}
+			entry.Accounts++
+		}
+	}
+	if c.Accounts == 0 {
+		return nil, fmt.Errorf("no account can list the shared drives: %w", errs[0])
+	}
+	sort.Slice(c.Drives, func(i, j int) bool { return c.Drives[i].Name < c.Drives[j].Name })
+	return
+}
+
+// Find returns the drive of an ID, or nil.
+func (c *DriveCatalog) Find(id string) *DriveEntry {
+	if c == nil {
+		return nil
+	}
+	for _, d := range c.Drives {
+		if d.ID == id {
+			return d
+		}
+	}
+	return nil
+}
+
+// DriveName returns the name and ID of a drive, or only the ID of an unknown
+// drive.
+func (c *DriveCatalog) DriveName(id string) string {
+	if d := c.Find(id); d != nil {
+		return fmt.Sprintf("%s (%s)", d.Name, d.ID)
+	}
+	return id
+}
+
+// Check returns what is wrong with a drive ID, or an empty string when every
+// account can reach it.
+func (c *DriveCatalog) Check(id string) string {
+	if d := c.Find(id); d != nil {
+		if d.Accounts < c.Accounts {
+			return fmt.Sprintf("only %d of %d accounts can reach it", d.Accounts, c.Accounts)
+		}
+		return ""
+	}
+	if problem, ok := c.problems[id]; ok {
+		return problem
+	}
+	problem := "the accounts are not members of it"
+	if _, err := c.client.Drive(c.account, id); err != nil {
+		var apiErr *drive.Error
+		if errors.As(err, &apiErr) && apiErr.StatusCode == 404 {
+			problem = "unknown shared drive"
+		} else {
+			problem = fmt.Sprintf("the accounts cannot reach it: %v", err)
+		}
+	}
+	if c.problems == nil {
+		c.problems = make(map[string]string)
+	}
+	c.problems[id] = problem
+	return problem
+}
+
+var driveCatalog struct {
+	once sync.Once
+	*DriveCatalog
+}
+
+// LoadedDriveCatalog lists the shared drives of the accounts once, for the
+// access list editor. It returns nil when they cannot be listed, e.g. before
+// any account is added.
+func LoadedDriveCatalog() *DriveCatalog {
+	driveCatalog.once.Do(func() {
+		accounts, err := ReadAccounts()
+		if err == nil {
+			fmt.Println("Listing the shared drives of the accounts...")
+			driveCatalog.DriveCatalog, err = LoadDriveCatalog(&drive.Client{}, accounts, 10)
+		}
+		if err != nil {
+			fmt.Printf("Cannot list the shared drives, drive IDs will not be checked: %v\n", err)
+		}
+	})
+	return driveCatalog.DriveCatalog
+}
+
+// drivesList is a list of drive IDs for prompt.EditList, showing the names of
+// the drives and what is wrong with them.
+func drivesList(name string) prompt.List {
+	return prompt.List{
+		Name: name,
+		Format: func(id string) string {
+			catalog := LoadedDriveCatalog()
+			if catalog == nil {
+				return id
+			}
+			if problem := catalog.Check(id); problem != "" {
+				return fmt.Sprintf("%s    (warning: %s)", catalog.DriveName(id), problem)
+			}
+			return catalog.DriveName(id)
+		},
+		Enter: enterDrives,
+	}
+}
+
+// enterDrives asks for drives, by their numbers in the listed shared drives or
+// by ID, and asks whether to keep the drives that are not reachable.
+func enterDrives(p *prompt.Prompter, question string) (drives []string, err error) {
+	catalog := LoadedDriveCatalog()
+	if catalog != nil && len(catalog.Drives) > 0 {
+		p.Println("Shared drives of the accounts:")
+		for i, d := range catalog.Drives {
+			p.Printf("    (%d) %s\n", i+1, catalog.DriveName(d.ID))
+		}
+		p.Println("(Use comma to separate between drive numbers or IDs.)")
+	} else {
+		p.Println("(Use comma to separate between drive IDs.)")
+	}
+	line, err := p.Text(question, "", nil)
+	if err != nil {
+		return
+	}
+	for _, s := range strings.Split(line, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		id := s
+		if catalog != nil {
+			if i, err := strconv.Atoi(s); err == nil && i >= 1 && i <= len(catalog.Drives) {
+				id = catalog.Drives[i-1].ID
+			}
+			if problem := catalog.Check(id); problem != "" {
+				p.Printf("Drive %s: %s\n", id, problem)
+				var keep bool
+				if keep, err = p.Confirm("Keep it anyway?", false); err != nil {
+					return nil, err
+				}
+				if !keep {
+					continue
+				}
+			}
+		}
+		if !containsString(drives, id) {
+			drives = append(drives, id)
+		}
+	}
+	return
+}
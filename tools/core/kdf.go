@@ -0,0 +1,163 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+)
+
+// KDF types of the config. Without a type, keys are derived with GCMKey.
+const (
+	// KDFTypeHKDF derives the key of every namespace from the secret key with
+	// HKDF-SHA256 and the salt of the deployment.
+	KDFTypeHKDF = "hkdf"
+	// KDFTypeArgon2id is for secret keys chosen by humans: the passphrase is
+	// first stretched with Argon2id into the master secret, which is then used
+	// like a random secret key with HKDF.
+	KDFTypeArgon2id = "argon2id"
+)
+
+// Default Argon2id parameters, the second recommended option of RFC 9106.
+const (
+	DefaultArgon2Time    = 3
+	DefaultArgon2Memory  = 64 * 1024
+	DefaultArgon2Threads = 4
+)
+
+const kdfSaltSize = 16
+
+// KDFConfig records how keys are derived from the secret key. The salt is
+// generated once per deployment.
+type KDFConfig struct {
+	Type    string `json:"type,omitempty"`
+	Salt    string `json:"salt,omitempty"`
+	Time    uint32 `json:"time,omitempty"`
+	Memory  uint32 `json:"memory,omitempty"`
+	Threads uint8  `json:"threads,omitempty"`
+}
+
+// NewKDFConfig returns the parameters of a KDF type with a new random salt.
+func NewKDFConfig(kdfType string) (kdf *KDFConfig, err error) {
+	salt := make([]byte, kdfSaltSize)
+	if _, err = rand.Read(salt); err != nil {
+		return
+	}
+	kdf = &KDFConfig{Type: kdfType, Salt: hex.EncodeToString(salt)}
+	if kdfType == KDFTypeArgon2id {
+		kdf.Time, kdf.Memory, kdf.Threads = DefaultArgon2Time, DefaultArgon2Memory, DefaultArgon2Threads
+	}
+	err = kdf.Validate()
+	return
+}
+
+// Enabled reports whether a KDF type is selected.
+func (kdf *KDFConfig) Enabled() bool {
+	return kdf != nil && kdf.Type != ""
+}
+
+// Validate checks the type and parameters.
+func (kdf *KDFConfig) Validate() (err error) {
+	if !kdf.Enabled() {
+		return
+	}
+	switch kdf.Type {
+	case KDFTypeHKDF, KDFTypeArgon2id:
+	default:
+		return fmt.Errorf("unknown KDF type: %s", kdf.Type)
+	}
+	salt, err := hex.DecodeString(kdf.Salt)
+	if err != nil || len(salt) < 8 || len(salt) > 255 {
+		return fmt.Errorf("invalid KDF salt, expecting 8 to 255 hex encoded bytes: %s", kdf.Salt)
+	}
+	if kdf.Type == KDFTypeArgon2id && (kdf.Time == 0 || kdf.Memory < 8*uint32(kdf.Threads) || kdf.Threads == 0) {
+		return fmt.Errorf("invalid Argon2id parameters: time=%d memory=%d threads=%d", kdf.Time, kdf.Memory, kdf.Threads)
+	}
+	return
+}
+
+// SaltBytes is the decoded salt, empty without a KDF type.
+func (kdf *KDFConfig) SaltBytes() []byte {
+	if !kdf.Enabled() {
+		return nil
+	}
+	salt, _ := hex.DecodeString(kdf.Salt)
+	return salt
+}
+
+var masterSecrets = struct {
+	sync.Mutex
+	cache map[string]string
+}{cache: map[string]string{}}
+
+// MasterSecret is the secret everything is encrypted and hashed with, and
+// which is given to the worker. It is the secret key itself, except for
+// Argon2id where it is derived from the passphrase, so that the passphrase
+// never leaves this computer.
+func MasterSecret() string {
+	return DeriveMasterSecret(Config.SecretKey, Config.KDF)
+}
+
+// DeriveMasterSecret is MasterSecret for a given secret key and KDF.
+func DeriveMasterSecret(secretKey string, kdf *KDFConfig) string {
+	if !kdf.Enabled() || kdf.Type != KDFTypeArgon2id || secretKey == "" {
+		return secretKey
+	}
+	cacheKey := fmt.Sprintf("%x:%s:%d:%d:%d", sha256.Sum256([]byte(secretKey)), kdf.Salt, kdf.Time, kdf.Memory, kdf.Threads)
+	masterSecrets.Lock()
+	defer masterSecrets.Unlock()
+	if secret, ok := masterSecrets.cache[cacheKey]; ok {
+		return secret
+	}
+	secret := hex.EncodeToString(argon2.IDKey([]byte(secretKey), kdf.SaltBytes(), kdf.Time, kdf.Memory, kdf.Threads, 32))
+	masterSecrets.cache[cacheKey] = secret
+	return secret
+}
+
+// HKDFKey derives the AES-256 key of a namespace from the secret with
+// HKDF-SHA256, the same way as the worker.
+func HKDFKey(secret string, salt []byte, namespace string) (key []byte, err error) {
+	key = make([]byte, 32)
+	_, err = io.ReadFull(hkdf.New(sha256.New, []byte(secret), salt, []byte("gdir:"+namespace)), key)
+	return
+}
+
+// validateKDFConfig checks the KDF of the config, and drops an empty one, as
+// written by older versions, so that it is not saved again.
+func validateKDFConfig() (err error) {
+	if !Config.KDF.Enabled() {
+		Config.KDF = nil
+	}
+	return Config.KDF.Validate()
+}
+
+// EnsureKDFConfig selects HKDF for a secret key without a KDF when nothing
+// has been encrypted with it yet. Existing files are upgraded by migrate.
+func EnsureKDFConfig() (err error) {
+	if Config.KDF.Enabled() || Config.SecretKey == "" {
+		return
+	}
+	for _, set := range encryptedFileSets {
+		var names []string
+		if set.dir != "" {
+			if names, err = encryptedFiles(ArtifactPath(set.dir)); err != nil {
+				return
+			}
+		} else if _, e := os.Stat(ArtifactPath(set.file)); e == nil {
+			names = append(names, set.file)
+		}
+		if len(names) > 0 {
+			return
+		}
+	}
+	if Config.KDF, err = NewKDFConfig(KDFTypeHKDF); err != nil {
+		return
+	}
+	return SaveConfigFile()
+}
@@ -0,0 +1,85 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// TestDeriveMasterSecret pins the master secrets Argon2id derives, which
+// every file and the worker depend on, and checks that other KDFs pass the
+// secret key through.
+func TestDeriveMasterSecret(t *testing.T) {
+	argon2id := &KDFConfig{Type: KDFTypeArgon2id, Salt: "00112233445566778899aabbccddeeff", Time: 1, Memory: 64, Threads: 1}
+	for _, test := range []struct {
+		name   string
+		secret string
+		kdf    *KDFConfig
+		want   string
+	}{
+		{name: "without a KDF", secret: "passphrase", kdf: nil, want: "passphrase"},
+		{name: "with an empty KDF", secret: "passphrase", kdf: &KDFConfig{}, want: "passphrase"},
+		{name: "with HKDF", secret: "passphrase", kdf: &KDFConfig{Type: KDFTypeHKDF, Salt: argon2id.Salt}, want: "passphrase"},
+		{name: "with Argon2id", secret: "passphrase", kdf: argon2id, want: "e2cbd8db58ceeb703e6d2af0199b260eccbcfde11630b187f767245ddbaf83aa"},
+		{name: "with Argon2id and another passphrase", secret: "other", kdf: argon2id, want: "8da12ab0f7f57387d0dc29426046b3517dafe46330315173fb1344eaed5338b7"},
+		{name: "with Argon2id and another salt", secret: "passphrase", kdf: &KDFConfig{Type: KDFTypeArgon2id, Salt: "ffeeddccbbaa99887766554433221100", Time: 1, Memory: 64, Threads: 1}, want: "e535ce1d36773cb00dfe977e70b01e1de562254a7bfbbf05759cbcc7e1bba187"},
+		{name: "with Argon2id and other parameters", secret: "passphrase", kdf: &KDFConfig{Type: KDFTypeArgon2id, Salt: argon2id.Salt, Time: 2, Memory: 64, Threads: 1}, want: "2448db8db49cac5064d6489b74afe1ecaf0250abefb5e6d844d57da064fdf2a3"},
+		{name: "with Argon2id and no secret key", secret: "", kdf: argon2id, want: ""},
+	} {
+		if secret := DeriveMasterSecret(test.secret, test.kdf); secret != test.want {
+			t.Errorf("%s: master secret %s, want %s", test.name, secret, test.want)
+		}
+		if secret := DeriveMasterSecret(test.secret, test.kdf); secret != test.want {
+			t.Errorf("%s: cached master secret %s, want %s", test.name, secret, test.want)
+		}
+	}
+}
+
+func TestSaveConfigFileKDF(t *testing.T) {
+	old := Config
+	defer func() { Config = old }()
+	for _, env := range configEnv {
+		*env.value = ""
+	}
+	state := t.TempDir()
+	setEnv(t, map[string]string{"GDIR_STATE_DIR": state, "GDIR_PROFILE": ""})
+	file := filepath.Join(state, ConfigFileName)
+	if err := ioutil.WriteFile(file, []byte(`{"cf_worker": "gdir", "kdf": {}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadConfigFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveConfigFile(); err != nil {
+		t.Fatal(err)
+	}
+	var saved map[string]json.RawMessage
+	readConfig := func() {
+		saved = nil
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = json.Unmarshal(b, &saved); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readConfig()
+	if kdf, ok := saved["kdf"]; ok {
+		t.Errorf("saved an empty KDF: %s", kdf)
+	}
+
+	var err error
+	if Config.KDF, err = NewKDFConfig(KDFTypeHKDF); err != nil {
+		t.Fatal(err)
+	}
+	if err = SaveConfigFile(); err != nil {
+		t.Fatal(err)
+	}
+	readConfig()
+	var kdf KDFConfig
+	if err = json.Unmarshal(saved["kdf"], &kdf); err != nil || kdf != *Config.KDF {
+		t.Errorf("saved KDF %s, want %+v", saved["kdf"], *Config.KDF)
+	}
+}
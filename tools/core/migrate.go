@@ -0,0 +1,94 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// encryptedFileSets are the files encrypted by the secret key, with their
+// namespaces.
+var encryptedFileSets = []struct {
+	dir       string
+	file      string
+	namespace string
+}{
+	{dir: "accounts", namespace: "account"},
+	{dir: AccountsQuarantineDir, namespace: "account"},
+	{dir: "users", namespace: "user"},
+	{file: AccountsManifestFile, namespace: "accountsManifest"},
+	{file: UsersIndexFile, namespace: "usersIndex"},
+}
+
+// CurrentCiphertext reports whether data is an envelope in the current format,
+// with the KDF and the key ID of the config, that decrypts with secret.
+func CurrentCiphertext(secret string, namespace string, data []byte) bool {
+	e, err := ParseEnvelope(data)
+	current := newEnvelope(secret)
+	if err != nil || e.KDF != current.KDF || !bytes.Equal(e.KDFParams, current.KDFParams) || !bytes.Equal(e.KeyID, current.KeyID) {
+		return false
+	}
+	_, err = decryptEnvelope(secret, namespace, data)
+	return err == nil
+}
+
+// MigrateCiphertext re-encrypts every file that is not in the current envelope
+// format, or not with the KDF of the config, and returns the paths of the files that were, or with dryRun would
+// be, migrated.
+//
+// Without a KDF in the config, HKDF is selected first. Its master secret is
+// the secret key, so nothing else changes.
+func MigrateCiphertext(dryRun bool) (migrated []string, err error) {
+	if !Config.KDF.Enabled() {
+		if Config.KDF, err = NewKDFConfig(KDFTypeHKDF); err != nil {
+			return
+		}
+		if !dryRun {
+			if err = SaveConfigFile(); err != nil {
+				return
+			}
+		}
+	}
+	for _, set := range encryptedFileSets {
+		paths := []string{ArtifactPath(set.file)}
+		if set.dir != "" {
+			var names []string
+			if names, err = encryptedFiles(ArtifactPath(set.dir)); err != nil {
+				return
+			}
+			paths = nil
+			for _, name := range names {
+				paths = append(paths, filepath.Join(ArtifactPath(set.dir), name))
+			}
+		}
+		for _, path := range paths {
+			var b []byte
+			if b, err = ioutil.ReadFile(path); os.IsNotExist(err) {
+				err = nil
+				continue
+			} else if err != nil {
+				return
+			}
+			if CurrentCiphertext(MasterSecret(), set.namespace, b) {
+				continue
+			}
+			if b, err = GCMDecrypt(MasterSecret(), set.namespace, b); err != nil {
+				err = fmt.Errorf("cannot decrypt %s: %w", path, err)
+				return
+			}
+			migrated = append(migrated, path)
+			if dryRun {
+				continue
+			}
+			if b, err = GCMEncrypt(MasterSecret(), set.namespace, b); err != nil {
+				return
+			}
+			if err = ioutil.WriteFile(path, b, 0600); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
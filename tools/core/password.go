@@ -0,0 +1,116 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Passwords are hashed with PBKDF2-SHA256, which the worker can verify with
+// WebCrypto:
+//
+//	pbkdf2-sha256$<iterations>$<hex salt>$<hex hash>
+//
+// 100000 iterations is the most Cloudflare Workers allow.
+const (
+	PasswordHashPBKDF2  = "pbkdf2-sha256"
+	PasswordIterations  = 100000
+	passwordSaltSize    = 16
+	passwordHashSize    = 32
+	passwordStampPrefix = "gdir:pass-stamp:"
+)
+
+// HashPassword hashes a password with a new random salt.
+func HashPassword(pass string) (hash string, err error) {
+	salt := make([]byte, passwordSaltSize)
+	if _, err = rand.Read(salt); err != nil {
+		return
+	}
+	key := pbkdf2.Key([]byte(pass), salt, PasswordIterations, passwordHashSize, sha256.New)
+	hash = fmt.Sprintf("%s$%d$%s$%s", PasswordHashPBKDF2, PasswordIterations, hex.EncodeToString(salt), hex.EncodeToString(key))
+	return
+}
+
+// parsePasswordHash splits a password hash into its fields.
+func parsePasswordHash(hash string) (iterations int, salt []byte, key []byte, err error) {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 4 || fields[0] != PasswordHashPBKDF2 {
+		err = fmt.Errorf("unsupported password hash, expecting %s$<iterations>$<hex salt>$<hex hash>", PasswordHashPBKDF2)
+		return
+	}
+	if iterations, err = strconv.Atoi(fields[1]); err != nil || iterations <= 0 {
+		err = fmt.Errorf("invalid iterations of password hash: %s", fields[1])
+		return
+	}
+	if salt, err = hex.DecodeString(fields[2]); err != nil {
+		err = fmt.Errorf("invalid salt of password hash: %w", err)
+		return
+	}
+	if key, err = hex.DecodeString(fields[3]); err != nil || len(key) == 0 {
+		err = fmt.Errorf("invalid password hash: %s", fields[3])
+	}
+	return
+}
+
+// ValidatePasswordHash checks that the worker can verify passwords against a
+// hash, which it cannot with more than PasswordIterations iterations.
+func ValidatePasswordHash(hash string) (err error) {
+	iterations, _, _, err := parsePasswordHash(hash)
+	if err == nil && iterations > PasswordIterations {
+		err = fmt.Errorf("password hash has %d iterations, more than the %d Cloudflare Workers allow", iterations, PasswordIterations)
+	}
+	return
+}
+
+// CheckPasswordHash reports whether pass matches hash.
+func CheckPasswordHash(hash string, pass string) bool {
+	iterations, salt, want, err := parsePasswordHash(hash)
+	if err != nil {
+		return false
+	}
+	key := pbkdf2.Key([]byte(pass), salt, iterations, len(want), sha256.New)
+	return subtle.ConstantTimeCompare(key, want) == 1
+}
+
+// VerifyPassword checks the password of a user, hashed or, for records saved
+// before hashing, in plaintext. The worker does the same in verifyPassword.
+func VerifyPassword(user *User, pass string) bool {
+	if user.PassHash != "" {
+		return CheckPasswordHash(user.PassHash, pass)
+	}
+	return user.Pass != "" && subtle.ConstantTimeCompare([]byte(user.Pass), []byte(pass)) == 1
+}
+
+// HasPassword reports whether the user has a password, hashed or not.
+func (user *User) HasPassword() bool {
+	return user.PassHash != "" || user.Pass != ""
+}
+
+// HashPassword replaces a plaintext password with its hash.
+func (user *User) HashPassword() (err error) {
+	if user.Pass == "" {
+		return
+	}
+	if user.PassHash, err = HashPassword(user.Pass); err != nil {
+		return
+	}
+	user.Pass = ""
+	return
+}
+
+// PasswordStamp changes whenever the password of the user changes. Login
+// tokens carry it instead of the password.
+func PasswordStamp(user *User) string {
+	pass := user.PassHash
+	if pass == "" {
+		pass = user.Pass
+	}
+	hash := sha256.Sum256([]byte(passwordStampPrefix + pass))
+	return hex.EncodeToString(hash[:16])
+}
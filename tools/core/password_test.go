@@ -0,0 +1,101 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPasswordHash(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, fmt.Sprintf("%s$%d$", PasswordHashPBKDF2, PasswordIterations)) {
+		t.Errorf("hash %s, want %s with %d iterations", hash, PasswordHashPBKDF2, PasswordIterations)
+	}
+	if other, _ := HashPassword("correct horse"); other == hash {
+		t.Error("hashed the same password twice with the same salt")
+	}
+	for _, test := range []struct {
+		user *User
+		pass string
+		want bool
+	}{
+		{user: &User{PassHash: hash}, pass: "correct horse", want: true},
+		{user: &User{PassHash: hash}, pass: "wrong horse", want: false},
+		{user: &User{PassHash: hash}, pass: "", want: false},
+		// a hash takes precedence over a plaintext password
+		{user: &User{PassHash: hash, Pass: "wrong horse"}, pass: "wrong horse", want: false},
+		// users saved before passwords were hashed
+		{user: &User{Pass: "legacy"}, pass: "legacy", want: true},
+		{user: &User{Pass: "legacy"}, pass: "Legacy", want: false},
+		{user: &User{}, pass: "", want: false},
+		// PBKDF2-SHA256 of "password" with the salt "salt" and 1000 iterations, computed elsewhere
+		{user: &User{PassHash: "pbkdf2-sha256$1000$73616c74$632c2812e46d4604102ba7618e9d6d7d2f8128f6266b4a03264d2a0460b7dcb3"}, pass: "password", want: true},
+		{user: &User{PassHash: "pbkdf2-sha256$0$73616c74$632c2812e46d4604102ba7618e9d6d7d2f8128f6266b4a03264d2a0460b7dcb3"}, pass: "password", want: false},
+		{user: &User{PassHash: "bcrypt$10$73616c74$632c"}, pass: "password", want: false},
+	} {
+		if got := VerifyPassword(test.user, test.pass); got != test.want {
+			t.Errorf("VerifyPassword(%+v, %q) = %v, want %v", test.user, test.pass, got, test.want)
+		}
+	}
+
+	user := &User{Name: "alice", Pass: "correct horse"}
+	stamp := PasswordStamp(user)
+	if err = user.HashPassword(); err != nil {
+		t.Fatal(err)
+	}
+	if user.Pass != "" || !VerifyPassword(user, "correct horse") {
+		t.Errorf("hashing the password of %+v", user)
+	}
+	hashed := PasswordStamp(user)
+	if hashed == stamp {
+		t.Error("password stamp unchanged when the password was hashed")
+	}
+	if PasswordStamp(user) != hashed {
+		t.Error("password stamp changed without a new password")
+	}
+	user.Pass = "battery staple"
+	if err = user.HashPassword(); err != nil {
+		t.Fatal(err)
+	}
+	if PasswordStamp(user) == hashed {
+		t.Error("password stamp unchanged when the password changed")
+	}
+}
+
+func TestValidatePasswordHash(t *testing.T) {
+	for hash, want := range map[string]string{
+		"pbkdf2-sha256$100000$73616c74$632c":  "",
+		"pbkdf2-sha256$1000$73616c74$632c":    "",
+		"pbkdf2-sha256$100001$73616c74$632c":  "more than the 100000 Cloudflare Workers allow",
+		"pbkdf2-sha256$600000$73616c74$632c":  "more than the 100000 Cloudflare Workers allow",
+		"pbkdf2-sha256$-1$73616c74$632c":      "invalid iterations",
+		"pbkdf2-sha256$100000$salt$632c":      "invalid salt",
+		"pbkdf2-sha256$100000$73616c74$":      "invalid password hash",
+		"pbkdf2-sha512$100000$73616c74$632c":  "unsupported password hash",
+		"$2b$10$N9qo8uLOickgx2ZMRZoMyeIjZAgc": "unsupported password hash",
+	} {
+		err := ValidatePasswordHash(hash)
+		if want == "" && err != nil || want != "" && (err == nil || !strings.Contains(err.Error(), want)) {
+			t.Errorf("ValidatePasswordHash(%s) = %v, want %q", hash, err, want)
+		}
+	}
+}
+
+func TestPlanUsersImportPasswordHash(t *testing.T) {
+	old := Config
+	defer func() { Config = old }()
+	Config.StateDir, Config.Dir, Config.Profile, Config.KDF = t.TempDir(), "", "", nil
+	Config.SecretKey, Config.Groups = "secret", nil
+	users := []*User{
+		{Name: "alice", PassHash: "pbkdf2-sha256$100000$73616c74$632c"},
+		{Name: "bob", PassHash: "pbkdf2-sha256$600000$73616c74$632c"},
+	}
+	_, err := PlanUsersImport(users, false)
+	errs, ok := err.(UsersImportError)
+	if !ok || len(errs) != 1 || !strings.HasPrefix(errs[0], "user 2 (bob): password hash has 600000 iterations") {
+		t.Errorf("importing a hash with too many iterations: %v", err)
+	}
+}
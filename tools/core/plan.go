@@ -0,0 +1,188 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+// BindingChange is a binding a deployment adds, modifies or removes.
+type BindingChange struct {
+	Op      string
+	Binding WorkerBinding
+}
+
+// GistPlan is the changes a deployment makes to the Gist of a kind.
+type GistPlan struct {
+	Kind    string
+	ID      string
+	Changes []FileChange
+}
+
+// DeployPlan is what a deployment would change, compared with what is live.
+type DeployPlan struct {
+	Worker string
+	// NewWorker is set when the worker does not exist yet.
+	NewWorker  bool
+	ScriptHash string
+	LiveHash   string
+	Bindings   []BindingChange
+	Gists      []GistPlan
+	// Others are the storages deployed without comparing their files.
+	Others []string
+}
+
+// planFiles returns the files deployed for kind. Static files are copied
+// from the build when deploying.
+func planFiles(kind string) (fs.FS, error) {
+	if kind == "static" {
+		return StaticDist()
+	}
+	return os.DirFS(ArtifactPath(kind)), nil
+}
+
+// PlanDeploy compares what Deploy would publish with the live worker and
+// Gists, without changing anything.
+func PlanDeploy() (plan *DeployPlan, err error) {
+	script, err := WorkerScript()
+	if err != nil {
+		return
+	}
+	bindings, err := WorkerBindings()
+	if err != nil {
+		return
+	}
+	plan = &DeployPlan{Worker: Config.CloudflareWorker, ScriptHash: ScriptHash(script)}
+	var live []WorkerBinding
+	if plan.NewWorker, err = workerMissing(); err != nil {
+		return
+	}
+	if !plan.NewWorker {
+		var resp cloudflare.WorkerScriptResponse
+		if resp, err = Cf.DownloadWorker(&cloudflare.WorkerRequestParams{ScriptName: Config.CloudflareWorker}); err != nil {
+			return
+		}
+		plan.LiveHash = ScriptHash(resp.Script)
+		var res json.RawMessage
+		if res, err = Cf.Raw("GET", fmt.Sprintf("/accounts/%s/workers/scripts/%s/bindings", Config.CloudflareAccount, Config.CloudflareWorker), nil); err != nil {
+			return
+		}
+		if err = json.Unmarshal(res, &live); err != nil {
+			return
+		}
+	}
+	last, err := LastRelease(Config.CloudflareWorker)
+	if err != nil {
+		return
+	}
+	plan.Bindings = diffBindings(live, bindings, last)
+	for _, kind := range StorageKinds {
+		if StorageType(kind) != StorageGist {
+			var s Storage
+			if s, err = NewStorage(kind); err != nil {
+				return
+			}
+			plan.Others = append(plan.Others, fmt.Sprintf("%s to %s", kind, s))
+			continue
+		}
+		gist := GistPlan{Kind: kind, ID: *GistIDOf(kind)}
+		var files fs.FS
+		if files, err = planFiles(kind); err != nil {
+			return
+		}
+		if gist.Changes, err = PlanGist(files, gist.ID); err != nil {
+			return
+		}
+		plan.Gists = append(plan.Gists, gist)
+	}
+	return
+}
+
+// workerMissing reports whether the worker does not exist yet.
+func workerMissing() (missing bool, err error) {
+	resp, err := Cf.ListWorkerScripts()
+	if err != nil {
+		return
+	}
+	for _, worker := range resp.WorkerList {
+		if worker.ID == Config.CloudflareWorker {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// diffBindings compares the live bindings with the new ones. Cloudflare does
+// not return secrets, so they are compared with the fingerprints of the last
+// release, if any.
+func diffBindings(live []WorkerBinding, bindings []WorkerBinding, last *Release) (changes []BindingChange) {
+	old := make(map[string]WorkerBinding)
+	for _, binding := range live {
+		old[binding.Name] = binding
+	}
+	recorded := make(map[string]WorkerBinding)
+	if last != nil {
+		for _, binding := range last.Bindings {
+			recorded[binding.Name] = binding
+		}
+	}
+	for _, binding := range bindings {
+		o, ok := old[binding.Name]
+		delete(old, binding.Name)
+		if !ok {
+			changes = append(changes, BindingChange{FileAdded, binding})
+			continue
+		}
+		same := o.Type == binding.Type && o.Text == binding.Text && o.NamespaceID == binding.NamespaceID
+		if o.Type == binding.Type && binding.Type == BindingSecretText {
+			r, ok := recorded[binding.Name]
+			same = !ok || r.Text == secretFingerprint(binding.Text)
+		}
+		if !same {
+			changes = append(changes, BindingChange{FileModified, binding})
+		}
+	}
+	for _, binding := range live {
+		if _, ok := old[binding.Name]; ok {
+			changes = append(changes, BindingChange{FileRemoved, binding})
+		}
+	}
+	return
+}
+
+// planMarks are the marks of added, modified and removed items in a plan.
+var planMarks = map[string]string{FileAdded: "+", FileModified: "~", FileRemoved: "-"}
+
+// Print writes the plan.
+func (plan *DeployPlan) Print() {
+	fmt.Printf("Cloudflare Worker %s:\n", plan.Worker)
+	switch {
+	case plan.NewWorker:
+		fmt.Printf("    + script %s (new Worker)\n", plan.ScriptHash)
+	case plan.LiveHash != plan.ScriptHash:
+		fmt.Printf("    ~ script %s (live %s)\n", plan.ScriptHash, plan.LiveHash)
+	default:
+		fmt.Printf("      script %s (unchanged)\n", plan.ScriptHash)
+	}
+	for _, change := range plan.Bindings {
+		fmt.Printf("    %s binding %s\n", planMarks[change.Op], change.Binding)
+	}
+	if !plan.NewWorker && len(plan.Bindings) == 0 {
+		fmt.Println("      bindings unchanged")
+	}
+	for _, gist := range plan.Gists {
+		fmt.Printf("Gist %s (%s):\n", gist.ID, gist.Kind)
+		for _, change := range gist.Changes {
+			fmt.Printf("    %s %s\n", planMarks[change.Op], change.Name)
+		}
+		if len(gist.Changes) == 0 {
+			fmt.Println("      unchanged")
+		}
+	}
+	for _, other := range plan.Others {
+		fmt.Printf("Deploy %s (not compared)\n", other)
+	}
+}
@@ -0,0 +1,174 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Roles control which routes of the worker a user may call.
+const (
+	RoleAdmin      = "admin"
+	RoleViewer     = "viewer"
+	RoleDownloader = "downloader"
+	RoleCopier     = "copier"
+)
+
+// Permissions of the routes of the worker.
+const (
+	// PermissionBrowse is for /api/list, /api/search and /api/file.
+	PermissionBrowse = "browse"
+	// PermissionDownload is for /file/.
+	PermissionDownload = "download"
+	// PermissionCopy is for /api/copyFileInit, /api/copyFileExec and
+	// /api/copyFileStat.
+	PermissionCopy = "copy"
+)
+
+// Roles are the known roles, in the order of their privileges.
+var Roles = []string{RoleViewer, RoleDownloader, RoleCopier, RoleAdmin}
+
+// RolePermissions are the permissions of each role. Admins can also see every
+// drive, whatever their drive lists and groups.
+var RolePermissions = map[string][]string{
+	RoleViewer:     {PermissionBrowse},
+	RoleDownloader: {PermissionBrowse, PermissionDownload},
+	RoleCopier:     {PermissionBrowse, PermissionDownload, PermissionCopy},
+	RoleAdmin:      {PermissionBrowse, PermissionDownload, PermissionCopy},
+}
+
+// DefaultRole is the role of users without one, who could call every route
+// before roles existed.
+const DefaultRole = RoleCopier
+
+// Group gives drive access lists and folder rules to its members.
+type Group struct {
+	DrivesWhiteList []string   `json:"drives_white_list,omitempty"`
+	DrivesBlackList []string   `json:"drives_black_list,omitempty"`
+	Folders         *FolderACL `json:"folders,omitempty"`
+}
+
+// UserPolicy is the effective access of a user, resolved from the role, the
+// groups and the drive lists of the user. The worker only reads the policy.
+type UserPolicy struct {
+	Permissions     []string   `json:"permissions"`
+	DrivesWhiteList []string   `json:"drives_white_list,omitempty"`
+	DrivesBlackList []string   `json:"drives_black_list,omitempty"`
+	Folders         *FolderACL `json:"folders,omitempty"`
+}
+
+// ValidRole reports whether role is empty or a known role.
+func ValidRole(role string) bool {
+	_, ok := RolePermissions[role]
+	return role == "" || ok
+}
+
+// ResolvePolicy computes the policy of a user from Config.Groups. The drive
+// white lists of the user and its groups add up, and so do the black lists and
+// the folder rules. A drive in both lists is hidden.
+func ResolvePolicy(user *User) (policy *UserPolicy, err error) {
+	role := user.Role
+	if role == "" {
+		role = DefaultRole
+	}
+	permissions, ok := RolePermissions[role]
+	if !ok {
+		return nil, fmt.Errorf("unknown role of user %s: %s", user.Name, user.Role)
+	}
+	policy = &UserPolicy{Permissions: append([]string{}, permissions...)}
+	white := append([]string{}, user.DrivesWhiteList...)
+	black := append([]string{}, user.DrivesBlackList...)
+	folders := user.Folders.Merge(nil)
+	for _, name := range user.Groups {
+		group, ok := Config.Groups[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown group of user %s: %s", user.Name, name)
+		}
+		white = append(white, group.DrivesWhiteList...)
+		black = append(black, group.DrivesBlackList...)
+		folders = folders.Merge(group.Folders)
+	}
+	if role != RoleAdmin {
+		policy.DrivesWhiteList = uniqueStrings(white)
+		policy.DrivesBlackList = uniqueStrings(black)
+		policy.Folders = folders
+	}
+	return
+}
+
+// ResolveUserPolicy sets the policy of a user and reports whether it changed.
+func ResolveUserPolicy(user *User) (changed bool, err error) {
+	policy, err := ResolvePolicy(user)
+	if err != nil {
+		return
+	}
+	changed = !reflect.DeepEqual(policy, user.Policy)
+	user.Policy = policy
+	return
+}
+
+// ResolveUsers saves again every user whose policy has changed, after the
+// groups have changed, and returns their names.
+func ResolveUsers() (changed []string, err error) {
+	x, err := LoadUsersIndex()
+	if err != nil {
+		return
+	}
+	for _, entry := range x.Users {
+		var user *User
+		if user, err = ReadUser(entry.Name); err != nil {
+			return
+		}
+		var c bool
+		if c, err = ResolveUserPolicy(user); err != nil {
+			return
+		} else if !c {
+			continue
+		}
+		if err = SaveUser(user); err != nil {
+			return
+		}
+		changed = append(changed, user.Name)
+	}
+	return
+}
+
+// Can reports whether the policy of the user has a permission. Users saved
+// before policies can do anything.
+func (user *User) Can(permission string) bool {
+	return user.Policy == nil || containsString(user.Policy.Permissions, permission)
+}
+
+// ApplyPolicy replaces the drive lists and folder rules of the user with the
+// ones of its policy, for servers enforcing them like the worker.
+func (user *User) ApplyPolicy() {
+	if user.Policy != nil {
+		user.DrivesWhiteList = user.Policy.DrivesWhiteList
+		user.DrivesBlackList = user.Policy.DrivesBlackList
+		user.Folders = user.Policy.Folders
+	}
+}
+
+func uniqueStrings(list []string) (out []string) {
+	if len(list) == 0 {
+		return nil
+	}
+	out = append([]string{}, list...)
+	sort.Strings(out)
+	for i := 0; i < len(out); i++ {
+		if i > 0 && out[i] == out[i-1] {
+			out = append(out[:i], out[i+1:]...)
+			i--
+		}
+	}
+	return
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// DefaultProfile names the options at the top of the config file, outside of
+// the profiles.
+const DefaultProfile = "default"
+
+// ProfilesDir keeps the artifacts of the profiles without a dir of their own.
+const ProfilesDir = "profiles"
+
+// profileKeys are the options of the config that each profile has its own of.
+// The other options, such as the credentials, are shared by every profile.
+var profileKeys = []string{
+	"cf_worker",
+	"cf_zone",
+	"cf_routes",
+	"gist_id",
+	"storage",
+	"secret_key",
+	"kdf",
+	"account_rotation",
+	"account_candidates",
+	"accounts_count",
+	"usage",
+	"dir",
+	"paths",
+}
+
+// configTop is the config file as it was loaded, to keep the options of the
+// default profile when saving another profile.
+var configTop map[string]json.RawMessage
+
+// ProfileName returns the name of the selected profile.
+func ProfileName() string {
+	if Config.Profile == "" {
+		return DefaultProfile
+	}
+	return Config.Profile
+}
+
+// clearProfileOptions resets the options each profile has its own of.
+func clearProfileOptions() {
+	v := reflect.ValueOf(&Config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		key := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		if containsString(profileKeys, key) {
+			v.Field(i).Set(reflect.Zero(v.Field(i).Type()))
+		}
+	}
+}
+
+// useProfile replaces the options of the config with those of a profile. New
+// profiles are only allowed when create is set, so that a mistyped profile
+// fails instead of starting an empty one.
+func useProfile(name string, create bool) (err error) {
+	if name == DefaultProfile {
+		name = ""
+	}
+	options := make(map[string]json.RawMessage)
+	if name == "" {
+		for _, key := range profileKeys {
+			if value, ok := configTop[key]; ok {
+				options[key] = value
+			}
+		}
+	} else if raw, ok := Config.Profiles[name]; ok {
+		if err = json.Unmarshal(raw, &options); err != nil {
+			return fmt.Errorf("profile %s: %w", name, err)
+		}
+	} else if !create {
+		return fmt.Errorf("no profile %s in %s", name, Config.ConfigFile)
+	}
+	b, err := json.Marshal(options)
+	if err != nil {
+		return
+	}
+	clearProfileOptions()
+	if err = json.Unmarshal(b, &Config); err != nil {
+		return fmt.Errorf("profile %s: %w", name, err)
+	}
+	Config.Profile = name
+	return
+}
+
+// SwitchProfile replaces the options of the loaded config with those of
+// another profile, to copy artifacts between profiles. Options given on the
+// command line only applied to the profile the config was loaded with.
+func SwitchProfile(name string) (err error) {
+	if err = useProfile(name, false); err != nil {
+		return
+	}
+	for _, secret := range ConfigSecrets() {
+		if secret.Profiled {
+			delete(secretRefs, secret.Name)
+		}
+	}
+	if err = ResolveConfigSecrets(); err != nil {
+		return fmt.Errorf("profile %s: %w", name, err)
+	}
+	if err = validateKDFConfig(); err != nil {
+		return fmt.Errorf("profile %s: %w", name, err)
+	}
+	return
+}
+
+// profileConfigFile moves the options of the selected profile from the top of
+// the marshaled config into the profile, where SaveConfigFile writes them.
+func profileConfigFile(b []byte) (out []byte, err error) {
+	top := make(map[string]json.RawMessage)
+	if err = json.Unmarshal(b, &top); err != nil {
+		return
+	}
+	options := make(map[string]json.RawMessage)
+	for _, key := range profileKeys {
+		if value, ok := top[key]; ok && string(value) != "{}" {
+			options[key] = value
+		}
+		delete(top, key)
+		if value, ok := configTop[key]; ok {
+			top[key] = value
+		}
+	}
+	profile, err := json.Marshal(options)
+	if err != nil {
+		return
+	}
+	if Config.Profiles == nil {
+		Config.Profiles = make(map[string]json.RawMessage)
+	}
+	Config.Profiles[Config.Profile] = profile
+	if top["profiles"], err = json.Marshal(Config.Profiles); err != nil {
+		return
+	}
+	return json.MarshalIndent(top, "", "    ")
+}
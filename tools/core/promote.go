@@ -0,0 +1,83 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// PromoteUsers copies users of the selected profile to another one, and
+// deploys them there. Without names, every user is copied. The users are
+// encrypted again with the secret key of the other profile, and users it
+// has besides them are left as they are. Their policies are resolved against
+// the groups of the other profile before any of them is saved, so that a group
+// missing there does not leave the users half promoted.
+func PromoteUsers(to string, names []string) (err error) {
+	from := ProfileName()
+	if from == to {
+		return fmt.Errorf("cannot promote users of profile %s to itself", from)
+	}
+	if len(names) == 0 {
+		var x *UsersIndex
+		if x, err = LoadUsersIndex(); err != nil {
+			return
+		}
+		for _, e := range x.Users {
+			names = append(names, e.Name)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no users in profile %s", from)
+	}
+	var users []*User
+	for _, name := range names {
+		var user *User
+		if user, err = ReadUser(name); err != nil {
+			return
+		}
+		users = append(users, user)
+	}
+	if err = SwitchProfile(to); err != nil {
+		return
+	}
+	var errs []string
+	for _, user := range users {
+		if _, e := ResolveUserPolicy(user); e != nil {
+			errs = append(errs, e.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("cannot promote users to profile %s, nothing was changed: %s", to, strings.Join(errs, "; "))
+	}
+	for _, user := range users {
+		if err = SaveUser(user); err != nil {
+			return
+		}
+	}
+	fmt.Printf("Promoted %d users from profile %s to %s\n", len(users), from, to)
+	return DeployStorage("users")
+}
+
+// PromoteStatic replaces the static files of another profile with those of
+// the selected profile, as they were last deployed, and deploys them there.
+func PromoteStatic(to string) (err error) {
+	from := ProfileName()
+	if from == to {
+		return fmt.Errorf("cannot promote static files of profile %s to itself", from)
+	}
+	src := ArtifactPath("static")
+	if _, err = os.Stat(src); os.IsNotExist(err) {
+		return fmt.Errorf("no static files in %s, please deploy profile %s first", src, from)
+	}
+	if err != nil {
+		return
+	}
+	if err = SwitchProfile(to); err != nil {
+		return
+	}
+	if err = replaceStaticFiles(os.DirFS(src), ArtifactPath("static")); err != nil {
+		return
+	}
+	fmt.Printf("Promoted static files from profile %s to %s\n", from, to)
+	return DeployStorage("static")
+}
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPromoteUsers(t *testing.T) {
+	old := Config
+	defer func() { Config = old }()
+	for _, env := range configEnv {
+		*env.value = ""
+	}
+	state, served := t.TempDir(), t.TempDir()
+	setEnv(t, map[string]string{"GDIR_STATE_DIR": state, "GDIR_PROFILE": ""})
+	config := fmt.Sprintf(`{
+		"secret_key": "%s",
+		"groups": {"ops": {"drives_white_list": ["ops-drive"]}},
+		"profiles": {"prod": {
+			"secret_key": "%s",
+			"storage": {"users": {"type": "local", "dir": %q, "url": "http://localhost/users/"}}
+		}}
+	}`, strings.Repeat("a", 64), strings.Repeat("b", 64), served)
+	if err := ioutil.WriteFile(filepath.Join(state, ConfigFileName), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadConfigFile(); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []*User{{Name: "alice"}, {Name: "bob", Groups: []string{"ops"}}} {
+		if err := SaveUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A group missing when promoting stops it before any user is saved.
+	ops := Config.Groups["ops"]
+	delete(Config.Groups, "ops")
+	if err := PromoteUsers("prod", nil); err == nil || !strings.Contains(err.Error(), "unknown group of user bob: ops") {
+		t.Fatalf("promoting with a missing group: %v", err)
+	}
+	if _, err := os.Stat(ArtifactPath(UsersIndexFile)); !os.IsNotExist(err) {
+		t.Errorf("users index of profile prod after a failed promotion: %v", err)
+	}
+	if names, _ := filepath.Glob(filepath.Join(ArtifactPath("users"), "*")); len(names) > 0 {
+		t.Errorf("users of profile prod after a failed promotion: %v", names)
+	}
+
+	Config.Groups["ops"] = ops
+	if err := SwitchProfile(DefaultProfile); err != nil {
+		t.Fatal(err)
+	}
+	if err := PromoteUsers("prod", nil); err != nil {
+		t.Fatal(err)
+	}
+	bob, err := ReadUser("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bob.Policy == nil || len(bob.Policy.DrivesWhiteList) != 1 || bob.Policy.DrivesWhiteList[0] != "ops-drive" {
+		t.Errorf("policy of bob in profile prod: %+v", bob.Policy)
+	}
+	if names, _ := filepath.Glob(filepath.Join(served, "*")); len(names) != 2 {
+		t.Errorf("deployed %v, want the files of 2 users", names)
+	}
+}
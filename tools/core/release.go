@@ -0,0 +1,457 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ReleasesDir keeps the release log and the worker scripts of the releases.
+const ReleasesDir = "releases"
+
+// ReleaseLogFile is the release log in ReleasesDir.
+const ReleaseLogFile = "releases.json"
+
+// ReleaseObjectsDir keeps the local artifact files of every release in
+// ReleasesDir, named by the SHA-256 of their content.
+const ReleaseObjectsDir = "objects"
+
+// releaseArtifactDirs and releaseArtifactFiles are the local artifacts kept
+// with each release, which a rollback puts back.
+var (
+	releaseArtifactDirs  = []string{"accounts", AccountsQuarantineDir, "users"}
+	releaseArtifactFiles = []string{AccountsManifestFile, UsersIndexFile}
+)
+
+// Release is a deployment of the worker and the Gists.
+type Release struct {
+	ID     int       `json:"id"`
+	Time   time.Time `json:"time"`
+	Worker string    `json:"worker"`
+	// Script is the SHA-256 of the worker script, kept as <Script>.js.
+	Script string `json:"script"`
+	// Bindings are the bindings of the worker, with fingerprints instead of
+	// secrets.
+	Bindings []WorkerBinding `json:"bindings"`
+	Gists    []GistRelease   `json:"gists,omitempty"`
+	// Artifacts are the local artifact files when the release was deployed,
+	// such as "users/<name>" or "accounts.manifest", with the SHA-256 of
+	// their content kept in ReleaseObjectsDir.
+	Artifacts map[string]string `json:"artifacts,omitempty"`
+	// Rollback is the release this one restored, if any.
+	Rollback int `json:"rollback,omitempty"`
+}
+
+// GistRelease is the revision of a Gist in a release.
+type GistRelease struct {
+	Kind     string `json:"kind"`
+	ID       string `json:"id"`
+	Revision string `json:"revision"`
+}
+
+// ScriptHash returns the hex SHA-256 of a worker script.
+func ScriptHash(script string) string {
+	sum := sha256.Sum256([]byte(script))
+	return hex.EncodeToString(sum[:])
+}
+
+// secretFingerprint tells whether a secret binding changed between releases,
+// without keeping the secret.
+func secretFingerprint(secret string) string {
+	key, err := HKDFKey(secret, Config.KDF.SaltBytes(), "release")
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(key[:8])
+}
+
+// releaseBindings returns bindings with fingerprints instead of secrets.
+func releaseBindings(bindings []WorkerBinding) (released []WorkerBinding) {
+	for _, binding := range bindings {
+		if binding.Type == BindingSecretText {
+			binding.Text = secretFingerprint(binding.Text)
+		}
+		released = append(released, binding)
+	}
+	return
+}
+
+// ReadReleases reads the release log, oldest first.
+func ReadReleases() (releases []*Release, err error) {
+	b, err := ioutil.ReadFile(filepath.Join(ArtifactPath(ReleasesDir), ReleaseLogFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &releases)
+	return
+}
+
+// FindRelease returns a release of the log by ID.
+func FindRelease(id int) (release *Release, err error) {
+	releases, err := ReadReleases()
+	if err != nil {
+		return
+	}
+	for _, r := range releases {
+		if r.ID == id {
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("no release %d in %s", id, filepath.Join(ArtifactPath(ReleasesDir), ReleaseLogFile))
+}
+
+// LastRelease returns the latest release of the worker, or nil.
+func LastRelease(worker string) (release *Release, err error) {
+	releases, err := ReadReleases()
+	for i := len(releases) - 1; i >= 0; i-- {
+		if releases[i].Worker == worker {
+			return releases[i], err
+		}
+	}
+	return
+}
+
+// gistReleases returns the current revisions of the Gists of the storages.
+func gistReleases() (gists []GistRelease, err error) {
+	for _, kind := range StorageKinds {
+		if StorageType(kind) != StorageGist {
+			continue
+		}
+		var revision string
+		if revision, err = GistRevision(*GistIDOf(kind)); err != nil {
+			return
+		}
+		gists = append(gists, GistRelease{Kind: kind, ID: *GistIDOf(kind), Revision: revision})
+	}
+	return
+}
+
+// RecordRelease appends a deployment of the worker to the release log, with
+// the current revisions of the Gists, and keeps a copy of its script.
+func RecordRelease(script string, bindings []WorkerBinding, rollback int) (release *Release, err error) {
+	releases, err := ReadReleases()
+	if err != nil {
+		return
+	}
+	release = &Release{
+		ID:       1,
+		Time:     time.Now().UTC(),
+		Worker:   Config.CloudflareWorker,
+		Script:   ScriptHash(script),
+		Bindings: releaseBindings(bindings),
+		Rollback: rollback,
+	}
+	if len(releases) > 0 {
+		release.ID = releases[len(releases)-1].ID + 1
+	}
+	if release.Gists, err = gistReleases(); err != nil {
+		return
+	}
+	if err = os.MkdirAll(ArtifactPath(ReleasesDir), 0700); err != nil {
+		return
+	}
+	if release.Artifacts, err = snapshotArtifacts(); err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(filepath.Join(ArtifactPath(ReleasesDir), release.Script+".js"), []byte(script), 0600); err != nil {
+		return
+	}
+	b, err := json.MarshalIndent(append(releases, release), "", "    ")
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(filepath.Join(ArtifactPath(ReleasesDir), ReleaseLogFile), b, 0600)
+	return
+}
+
+// ReleaseScript reads the worker script of a release.
+func ReleaseScript(release *Release) (script string, err error) {
+	b, err := ioutil.ReadFile(filepath.Join(ArtifactPath(ReleasesDir), release.Script+".js"))
+	if err != nil {
+		return
+	}
+	if script = string(b); ScriptHash(script) != release.Script {
+		return "", fmt.Errorf("the script of release %d has changed since it was deployed", release.ID)
+	}
+	return
+}
+
+// Deploy publishes the static files, the storages and the worker, and
+// records the release.
+func Deploy() (err error) {
+	if err = CopyStaticFiles(); err != nil {
+		return
+	}
+	for _, kind := range StorageKinds {
+		if err = DeployStorage(kind); err != nil {
+			return
+		}
+	}
+	return DeployWorkerRelease()
+}
+
+// DeployWorkerRelease deploys the worker and records the release, for
+// commands that deploy the storages they change first.
+func DeployWorkerRelease() (err error) {
+	script, bindings, err := DeployWorker()
+	if err != nil {
+		return
+	}
+	release, err := RecordRelease(script, bindings, 0)
+	if err != nil {
+		return
+	}
+	fmt.Printf("Recorded release %d\n", release.ID)
+	return
+}
+
+// Rollback restores the worker script, the bindings, the Gist revisions and
+// the local artifacts of a release, deploys the restored artifacts to the
+// storages other than Gists, and records it as a new release. The worker is
+// uploaded first, and when a Gist cannot be restored, the worker and the Gists
+// are put back as they were.
+func Rollback(id int) (err error) {
+	release, err := FindRelease(id)
+	if err != nil {
+		return
+	}
+	if release.Worker != Config.CloudflareWorker {
+		return fmt.Errorf("release %d is of Cloudflare Worker %s, not %s", id, release.Worker, Config.CloudflareWorker)
+	}
+	if release.Artifacts == nil {
+		return fmt.Errorf("release %d was recorded without its local files, so rolling back to it would leave them to be deployed again", id)
+	}
+	script, bindings, err := releaseWorker(release)
+	if err != nil {
+		return
+	}
+	last, err := LastRelease(Config.CloudflareWorker)
+	if err != nil {
+		return
+	}
+	lastScript, lastBindings, err := releaseWorker(last)
+	if err != nil {
+		return
+	}
+	if err = checkArtifacts(release.Artifacts); err != nil {
+		return
+	}
+	current, err := gistReleases()
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("Restoring Cloudflare Worker %s to release %d...\n", Config.CloudflareWorker, id)
+	if err = publishWorker(script, bindings); err != nil {
+		return
+	}
+	for i, gist := range release.Gists {
+		if err = RestoreGist(gist.ID, gist.Revision); err != nil {
+			fmt.Printf("Cannot restore Gist %s: %s\nPutting back release %d...\n", gist.ID, err, last.ID)
+			return undoRollback(err, current, release.Gists[:i+1], lastScript, lastBindings)
+		}
+	}
+	fmt.Println("Restoring local files...")
+	if err = restoreArtifacts(release.Artifacts); err != nil {
+		return fmt.Errorf("cannot restore the local files of release %d, run the rollback again: %w", id, err)
+	}
+	for _, kind := range StorageKinds {
+		if StorageType(kind) != StorageGist {
+			if err = DeployStorage(kind); err != nil {
+				return
+			}
+		}
+	}
+	if release, err = RecordRelease(script, bindings, id); err != nil {
+		return
+	}
+	fmt.Printf("Recorded release %d, restoring release %d\n", release.ID, id)
+	return
+}
+
+// releaseWorker returns the worker script and the bindings of a release, with
+// the master secret instead of its fingerprint.
+func releaseWorker(release *Release) (script string, bindings []WorkerBinding, err error) {
+	if script, err = ReleaseScript(release); err != nil {
+		return
+	}
+	for _, binding := range release.Bindings {
+		if binding.Type == BindingSecretText {
+			if binding.Text != secretFingerprint(MasterSecret()) {
+				return "", nil, fmt.Errorf("the secret key has changed since release %d, whose files cannot be read with it", release.ID)
+			}
+			binding.Text = MasterSecret()
+		}
+		bindings = append(bindings, binding)
+	}
+	return
+}
+
+func publishWorker(script string, bindings []WorkerBinding) (err error) {
+	if err = UploadWorker(script, bindings); err != nil {
+		return
+	}
+	return Cf.PublishWorker(Config.CloudflareWorker)
+}
+
+// undoRollback restores the Gists a rollback already restored to their
+// revisions before it, and the worker of the latest release.
+func undoRollback(err error, current []GistRelease, restored []GistRelease, script string, bindings []WorkerBinding) error {
+	var undoErrs []string
+	for _, gist := range restored {
+		for _, c := range current {
+			if c.ID == gist.ID {
+				if e := RestoreGist(c.ID, c.Revision); e != nil {
+					undoErrs = append(undoErrs, e.Error())
+				}
+			}
+		}
+	}
+	if e := publishWorker(script, bindings); e != nil {
+		undoErrs = append(undoErrs, e.Error())
+	}
+	if len(undoErrs) > 0 {
+		return fmt.Errorf("%w, and cannot put back the latest release: %s", err, strings.Join(undoErrs, "; "))
+	}
+	return err
+}
+
+// snapshotArtifacts keeps the local artifacts in ReleaseObjectsDir, and
+// returns their names and hashes.
+func snapshotArtifacts() (artifacts map[string]string, err error) {
+	artifacts = make(map[string]string)
+	for _, dir := range releaseArtifactDirs {
+		var files map[string]string
+		if files, err = storageFiles(ArtifactPath(dir)); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return
+		}
+		for name, path := range files {
+			if artifacts[dir+"/"+name], err = storeReleaseObject(path); err != nil {
+				return
+			}
+		}
+	}
+	for _, file := range releaseArtifactFiles {
+		var sum string
+		if sum, err = storeReleaseObject(ArtifactPath(file)); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return
+		}
+		artifacts[file] = sum
+	}
+	return artifacts, nil
+}
+
+func releaseObjectPath(sum string) string {
+	return filepath.Join(ArtifactPath(ReleasesDir), ReleaseObjectsDir, sum)
+}
+
+// storeReleaseObject copies a file into ReleaseObjectsDir, unless it is there
+// already, and returns its hash.
+func storeReleaseObject(path string) (sum string, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	sum = ScriptHash(string(b))
+	if _, err = os.Stat(releaseObjectPath(sum)); err == nil || !os.IsNotExist(err) {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(releaseObjectPath(sum)), 0700); err != nil {
+		return
+	}
+	err = ioutil.WriteFile(releaseObjectPath(sum), b, 0600)
+	return
+}
+
+// readReleaseObject reads a file kept by storeReleaseObject.
+func readReleaseObject(sum string) (b []byte, err error) {
+	if b, err = ioutil.ReadFile(releaseObjectPath(sum)); err != nil {
+		return
+	}
+	if ScriptHash(string(b)) != sum {
+		return nil, fmt.Errorf("%s has changed since it was recorded", releaseObjectPath(sum))
+	}
+	return
+}
+
+// checkArtifacts checks that every artifact of a release can be restored,
+// before anything is changed.
+func checkArtifacts(artifacts map[string]string) (err error) {
+	for _, sum := range artifacts {
+		if _, err = readReleaseObject(sum); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// restoreArtifacts makes the local artifacts the same as in a release. Files
+// starting with a dot and subdirectories, such as a Git repository, are kept.
+func restoreArtifacts(artifacts map[string]string) (err error) {
+	for _, dir := range releaseArtifactDirs {
+		var files map[string]string
+		if files, err = storageFiles(ArtifactPath(dir)); err != nil && !os.IsNotExist(err) {
+			return
+		}
+		for name, path := range files {
+			if _, ok := artifacts[dir+"/"+name]; !ok {
+				if err = os.Remove(path); err != nil {
+					return
+				}
+			}
+		}
+	}
+	for _, file := range releaseArtifactFiles {
+		if _, ok := artifacts[file]; !ok {
+			if err = os.Remove(ArtifactPath(file)); err != nil && !os.IsNotExist(err) {
+				return
+			}
+		}
+	}
+	for name, sum := range artifacts {
+		path := ArtifactPath(name)
+		if i := strings.Index(name, "/"); i >= 0 {
+			path = filepath.Join(ArtifactPath(name[:i]), name[i+1:])
+			if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+				return
+			}
+		}
+		var b []byte
+		if b, err = readReleaseObject(sum); err != nil {
+			return
+		}
+		if err = ioutil.WriteFile(path, b, 0600); err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+// FormatRelease describes a release in a line.
+func FormatRelease(r *Release) string {
+	var gists []string
+	for _, gist := range r.Gists {
+		gists = append(gists, fmt.Sprintf("%s@%.7s", gist.Kind, gist.Revision))
+	}
+	s := fmt.Sprintf("%4d  %s  %s  script %.12s", r.ID, r.Time.Local().Format("2006-01-02 15:04"), r.Worker, r.Script)
+	if len(gists) > 0 {
+		s += "  gists " + strings.Join(gists, " ")
+	}
+	if r.Rollback != 0 {
+		s += fmt.Sprintf("  (rollback to %d)", r.Rollback)
+	}
+	return s
+}
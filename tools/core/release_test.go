@@ -0,0 +1,71 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreArtifacts(t *testing.T) {
+	old := Config
+	defer func() { Config = old }()
+	Config.StateDir, Config.Dir, Config.Profile, Config.Paths = t.TempDir(), "", "", ArtifactPaths{}
+
+	write := func(path string, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users := ArtifactPath("users")
+	write(filepath.Join(users, "kept"), "kept")
+	write(filepath.Join(users, "changed"), "old")
+	write(filepath.Join(users, ".git", "HEAD"), "ref")
+	write(ArtifactPath(UsersIndexFile), "index")
+	artifacts, err := snapshotArtifacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(artifacts) != 3 {
+		t.Errorf("artifacts = %v, want 2 users and the users index", artifacts)
+	}
+
+	write(filepath.Join(users, "changed"), "new")
+	write(filepath.Join(users, "added"), "added")
+	write(ArtifactPath(AccountsManifestFile), "manifest")
+	if err = os.Remove(ArtifactPath(UsersIndexFile)); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkArtifacts(artifacts); err != nil {
+		t.Fatal(err)
+	}
+	if err = restoreArtifacts(artifacts); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		filepath.Join(users, "kept"):         "kept",
+		filepath.Join(users, "changed"):      "old",
+		filepath.Join(users, ".git", "HEAD"): "ref",
+		ArtifactPath(UsersIndexFile):         "index",
+		filepath.Join(users, "added"):        "",
+		ArtifactPath(AccountsManifestFile):   "",
+	} {
+		b, err := ioutil.ReadFile(path)
+		if want == "" {
+			if !os.IsNotExist(err) {
+				t.Errorf("%s was not removed", path)
+			}
+		} else if string(b) != want {
+			t.Errorf("%s = %q, %v, want %q", path, b, err, want)
+		}
+	}
+
+	write(releaseObjectPath(artifacts["users/kept"]), "altered")
+	if err = checkArtifacts(artifacts); err == nil {
+		t.Error("restoring an altered file did not fail")
+	}
+}
@@ -0,0 +1,336 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RotateSecretKey re-encrypts every account and user with a new secret key and
+// KDF, renames the user files to their new hashed names and redeploys them
+// with the worker. When any step fails, the local files and config are restored and
+// what was already deployed is deployed again with the old key.
+//
+// The users and accounts are deployed first with both the old and the new
+// files, so that the old worker can still log users in and reach the drives
+// until the new worker is live. Accounts keep their names, so the new ones are
+// deployed with rotateKeyAccountsSuffix until the worker has switched keys.
+func RotateSecretKey(newKey string, newKDF *KDFConfig) (err error) {
+	if Config.SecretKey == "" {
+		return fmt.Errorf("missing secret key")
+	}
+	if err = checkSecretKeyRef(); err != nil {
+		return
+	}
+	if err = newKDF.Validate(); err != nil {
+		return
+	}
+	oldKey, oldKDF := Config.SecretKey, Config.KDF
+	oldSecret, newSecret := MasterSecret(), DeriveMasterSecret(newKey, newKDF)
+	if newSecret == oldSecret {
+		return fmt.Errorf("the new secret key is the same as the old one")
+	}
+
+	backup, err := backupRotateKeyFiles()
+	if err != nil {
+		return
+	}
+	fmt.Printf("Backed up encrypted files into %s\n", backup)
+
+	oldUsers, err := ioutil.TempDir(ArtifactPath("."), ".rotate-key-users-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(oldUsers)
+	if err = CopyDir(filepath.Join(backup, "users"), oldUsers); err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	// new files are encrypted with the KDF of the config
+	Config.KDF = newKDF
+	if err = reencryptFiles(oldSecret, newSecret, newKey); err != nil {
+		fmt.Printf("Cannot re-encrypt files: %s\n", err)
+		if e := restoreRotateKeyFiles(backup, oldKey, oldKDF); e != nil {
+			return fmt.Errorf("%w, and cannot restore the backup in %s: %s", err, backup, e)
+		}
+		os.RemoveAll(backup)
+		return
+	}
+
+	// steps to deploy with the new key, and to undo them with the old key
+	var deployed int
+	var script string
+	var bindings []WorkerBinding
+	oldAccounts, newAccounts, newUsers := filepath.Join(backup, "accounts"), ArtifactPath("accounts"), ArtifactPath("users")
+	steps := []struct {
+		name   string
+		deploy func() error
+	}{
+		{"users (old and new names)", func() error {
+			return deployUnion("users", unionDir{oldUsers, ""}, unionDir{newUsers, ""})
+		}},
+		{"accounts (old and renamed new ones)", func() error {
+			return deployUnion("accounts", unionDir{oldAccounts, ""}, unionDir{newAccounts, rotateKeyAccountsSuffix})
+		}},
+		{"worker (renamed accounts)", func() (err error) {
+			accountsFileSuffix = rotateKeyAccountsSuffix
+			defer func() { accountsFileSuffix = "" }()
+			_, _, err = DeployWorker()
+			return
+		}},
+		{"accounts (new and renamed new ones)", func() error {
+			return deployUnion("accounts", unionDir{newAccounts, ""}, unionDir{newAccounts, rotateKeyAccountsSuffix})
+		}},
+		{"worker", func() (err error) {
+			script, bindings, err = DeployWorker()
+			return
+		}},
+		{"accounts", func() error { return DeployStorage("accounts") }},
+		{"users", func() error { return DeployStorage("users") }},
+	}
+	for _, step := range steps {
+		fmt.Printf("Deploying %s...\n", step.name)
+		if err = step.deploy(); err != nil {
+			break
+		}
+		deployed++
+	}
+	if err == nil {
+		var release *Release
+		if release, err = RecordRelease(script, bindings, 0); err != nil {
+			return
+		}
+		fmt.Printf("Recorded release %d\n", release.ID)
+		fmt.Printf("Removing backup %s\n", backup)
+		return os.RemoveAll(backup)
+	}
+
+	fmt.Printf("Cannot deploy: %s\nRolling back to the old secret key...\n", err)
+	if e := restoreRotateKeyFiles(backup, oldKey, oldKDF); e != nil {
+		return fmt.Errorf("%w, and cannot restore the backup in %s: %s", err, backup, e)
+	}
+	var rollbackErrs []string
+	if deployed > 0 {
+		for _, undo := range []func() error{
+			func() error { return DeployStorage("accounts") },
+			func() (err error) {
+				_, _, err = DeployWorker()
+				return
+			},
+			func() error { return DeployStorage("users") },
+		} {
+			if e := undo(); e != nil {
+				rollbackErrs = append(rollbackErrs, e.Error())
+			}
+		}
+	}
+	if len(rollbackErrs) > 0 {
+		return fmt.Errorf("%w, and cannot redeploy with the old secret key (backup kept in %s): %s", err, backup, strings.Join(rollbackErrs, "; "))
+	}
+	os.RemoveAll(backup)
+	return
+}
+
+// rotateKeyDirs are the directories with files encrypted by the secret key.
+var rotateKeyDirs = []string{"accounts", AccountsQuarantineDir, "users"}
+
+// backupRotateKeyFiles copies the config and every encrypted file into a new
+// backup directory.
+func backupRotateKeyFiles() (backup string, err error) {
+	if backup, err = ioutil.TempDir(ArtifactPath("."), ".rotate-key-backup-"); err != nil {
+		return
+	}
+	for _, dir := range rotateKeyDirs {
+		if err = CopyDir(ArtifactPath(dir), filepath.Join(backup, dir)); err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+	for _, file := range []string{ArtifactPath(AccountsManifestFile), ArtifactPath(UsersIndexFile), Config.ConfigFile} {
+		if err = CopyFile(file, filepath.Join(backup, filepath.Base(file))); err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+	err = nil
+	return
+}
+
+// restoreRotateKeyFiles puts back the files saved by backupRotateKeyFiles.
+func restoreRotateKeyFiles(backup string, oldKey string, oldKDF *KDFConfig) (err error) {
+	for _, dir := range rotateKeyDirs {
+		if _, e := os.Stat(filepath.Join(backup, dir)); os.IsNotExist(e) {
+			continue
+		}
+		if err = os.RemoveAll(ArtifactPath(dir)); err != nil {
+			return
+		}
+		if err = CopyDir(filepath.Join(backup, dir), ArtifactPath(dir)); err != nil {
+			return
+		}
+	}
+	for _, file := range []string{AccountsManifestFile, UsersIndexFile} {
+		if _, e := os.Stat(filepath.Join(backup, file)); e == nil {
+			if err = CopyFile(filepath.Join(backup, file), ArtifactPath(file)); err != nil {
+				return
+			}
+		}
+	}
+	Config.KDF = oldKDF
+	return setSecretKey(oldKey)
+}
+
+// reencryptFiles re-encrypts the accounts, the users and their indexes in
+// place, and saves the new secret key in the config.
+func reencryptFiles(oldSecret string, newSecret string, newKey string) (err error) {
+	for _, dir := range []string{"accounts", AccountsQuarantineDir} {
+		if err = reencryptDir(ArtifactPath(dir), "account", oldSecret, newSecret); err != nil {
+			return
+		}
+	}
+	if err = reencryptFile(ArtifactPath(AccountsManifestFile), "accountsManifest", oldSecret, newSecret); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	if err = reencryptFile(ArtifactPath(UsersIndexFile), "usersIndex", oldSecret, newSecret); err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	files, err := encryptedFiles(ArtifactPath("users"))
+	if err != nil {
+		return
+	}
+	for _, name := range files {
+		path := filepath.Join(ArtifactPath("users"), name)
+		var b []byte
+		if b, err = ioutil.ReadFile(path); err != nil {
+			return
+		}
+		if b, err = GCMDecrypt(oldSecret, "user", b); err != nil {
+			return fmt.Errorf("cannot decrypt user %s: %w", path, err)
+		}
+		var user User
+		if err = json.Unmarshal(b, &user); err != nil {
+			return fmt.Errorf("cannot parse user %s: %w", path, err)
+		}
+		if b, err = GCMEncrypt(newSecret, "user", b); err != nil {
+			return
+		}
+		if err = os.Remove(path); err != nil {
+			return
+		}
+		if err = ioutil.WriteFile(filepath.Join(ArtifactPath("users"), UserFileName(newSecret, user.Name)), b, 0600); err != nil {
+			return
+		}
+	}
+
+	return setSecretKey(newKey)
+}
+
+// checkSecretKeyRef refuses to rotate a secret key read from an environment
+// variable or a command, which gdir cannot update. The old key would be read
+// from there again on the next run.
+func checkSecretKeyRef() error {
+	ref := SecretRef("secret_key")
+	scheme, name, _ := ParseSecretRef(ref)
+	switch scheme {
+	case SecretEnv:
+		return fmt.Errorf("the secret key is read from %s, which would still hold the old key after rotating it; unset %s, run \"gdir secrets set secret_key\" to keep the key in the config or secrets file, and rotate it again", ref, name)
+	case SecretCommand:
+		return fmt.Errorf("the secret key is read from %s, which gdir cannot update; run \"gdir secrets set secret_key\" to keep the key in the config or secrets file, rotate it again, then store the new key where the command reads it", ref)
+	}
+	return nil
+}
+
+// setSecretKey saves a secret key in the config. A key referenced from the
+// secrets file is replaced there, and the config keeps the reference.
+func setSecretKey(key string) (err error) {
+	ref := SecretRef("secret_key")
+	if scheme, name, _ := ParseSecretRef(ref); scheme == SecretFile {
+		if err = SecretsFile().SetSecret(name, key); err != nil {
+			return
+		}
+		for _, secret := range ConfigSecrets() {
+			if secret.Name == "secret_key" {
+				setSecretRef(secret, ref, key)
+			}
+		}
+	}
+	Config.SecretKey = key
+	return SaveConfigFile()
+}
+
+func reencryptDir(dir string, namespace string, oldSecret string, newSecret string) (err error) {
+	files, err := encryptedFiles(dir)
+	if err != nil {
+		return
+	}
+	for _, name := range files {
+		if err = reencryptFile(filepath.Join(dir, name), namespace, oldSecret, newSecret); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func reencryptFile(path string, namespace string, oldSecret string, newSecret string) (err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if b, err = GCMDecrypt(oldSecret, namespace, b); err != nil {
+		return fmt.Errorf("cannot decrypt %s: %w", path, err)
+	}
+	if b, err = GCMEncrypt(newSecret, namespace, b); err != nil {
+		return
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// encryptedFiles returns the names of the files in dir, which may not exist.
+func encryptedFiles(dir string) (names []string, err error) {
+	files, err := storageFiles(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return sortedNames(files), err
+}
+
+// rotateKeyAccountsSuffix is added to the names of the accounts encrypted with
+// the new key while the worker switches to it.
+const rotateKeyAccountsSuffix = ".rotate-key"
+
+// unionDir is a directory deployed by deployUnion, with a suffix added to the
+// names of its files.
+type unionDir struct {
+	dir    string
+	suffix string
+}
+
+// deployUnion deploys the files of several directories together to the
+// storage of kind. Directories that do not exist are skipped.
+func deployUnion(kind string, dirs ...unionDir) (err error) {
+	union, err := ioutil.TempDir(ArtifactPath("."), ".rotate-key-deploy-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(union)
+	for _, src := range dirs {
+		var files map[string]string
+		if files, err = storageFiles(src.dir); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return
+		}
+		for name, path := range files {
+			if err = CopyFile(path, filepath.Join(union, name+src.suffix)); err != nil {
+				return
+			}
+		}
+	}
+	s, err := NewStorage(kind)
+	if err != nil {
+		return
+	}
+	return s.Deploy(union)
+}
@@ -0,0 +1,502 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/workerindex/gdir/tools/prompt"
+)
+
+// Secret providers, the schemes of secret references such as
+// "env:GDIR_CF_KEY", "file:cf_key" or "cmd:pass show gdir/cf_key".
+const (
+	SecretEnv     = "env"
+	SecretFile    = "file"
+	SecretCommand = "cmd"
+)
+
+// Stores of new secret values.
+const (
+	// SecretStoreFile keeps new secrets in the passphrase encrypted secrets
+	// file, and references them from the config.
+	SecretStoreFile = "file"
+	// SecretStoreConfig keeps new secrets in the config file as they are.
+	SecretStoreConfig = "config"
+)
+
+// DefaultSecretsFile is the passphrase encrypted secrets file.
+const DefaultSecretsFile = "secrets.enc"
+
+// SecretsPassphraseEnv is the environment variable holding the passphrase of
+// the secrets file, instead of asking for it.
+const SecretsPassphraseEnv = "GDIR_SECRETS_PASSPHRASE"
+
+// SecretsConfig selects where new secret values are kept. Secrets given as
+// references are kept as references wherever they come from.
+type SecretsConfig struct {
+	Store string `json:"store,omitempty"`
+	File  string `json:"file,omitempty"`
+}
+
+// SecretProvider returns the secrets of a scheme of secret references.
+type SecretProvider interface {
+	// Secret returns the secret of the part of a reference after the scheme.
+	Secret(name string) (string, error)
+}
+
+// EnvSecrets reads secrets from environment variables.
+type EnvSecrets struct{}
+
+func (EnvSecrets) Secret(name string) (value string, err error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return strings.TrimSpace(value), nil
+}
+
+// CommandSecrets reads secrets from the output of shell commands such as
+// "pass show gdir/cf_key" or "op read op://vault/gdir/cf_key". The commands
+// come from the config file and run through the shell each time it is loaded,
+// so whoever can write the config file can run commands.
+type CommandSecrets struct{}
+
+func (CommandSecrets) Secret(command string) (value string, err error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	// the command may ask for its own passphrase
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("cannot run secret command %q: %w", command, err)
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// FileSecrets keeps secrets in a file encrypted with a key derived from a
+// passphrase with Argon2id.
+type FileSecrets struct {
+	Path string
+	// Passphrase returns the passphrase of the file, which is new when the
+	// file does not exist yet.
+	Passphrase func(path string, new bool) (string, error)
+
+	loaded     bool
+	passphrase string
+	kdf        *KDFConfig
+	values     map[string]string
+}
+
+// secretsFileData is the JSON of a secrets file.
+type secretsFileData struct {
+	KDF  *KDFConfig `json:"kdf"`
+	Data []byte     `json:"data"`
+}
+
+func (f *FileSecrets) cipher() (c cipher.AEAD, err error) {
+	key, err := HKDFKey(DeriveMasterSecret(f.passphrase, f.kdf), f.kdf.SaltBytes(), "secrets")
+	if err != nil {
+		return
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+	return cipher.NewGCM(block)
+}
+
+func (f *FileSecrets) load() (err error) {
+	if f.loaded {
+		return
+	}
+	b, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		if f.kdf, err = NewKDFConfig(KDFTypeArgon2id); err != nil {
+			return
+		}
+		if f.passphrase, err = f.Passphrase(f.Path, true); err != nil {
+			return
+		}
+		f.values, f.loaded = make(map[string]string), true
+		return
+	}
+	if err != nil {
+		return
+	}
+	var data secretsFileData
+	if err = json.Unmarshal(b, &data); err != nil {
+		return fmt.Errorf("%s: %w", f.Path, err)
+	}
+	if err = data.KDF.Validate(); err != nil {
+		return fmt.Errorf("%s: %w", f.Path, err)
+	}
+	f.kdf = data.KDF
+	if f.passphrase, err = f.Passphrase(f.Path, false); err != nil {
+		return
+	}
+	gcm, err := f.cipher()
+	if err != nil {
+		return
+	}
+	if len(data.Data) < gcm.NonceSize() {
+		return fmt.Errorf("%s: truncated secrets", f.Path)
+	}
+	plain, err := gcm.Open(nil, data.Data[:gcm.NonceSize()], data.Data[gcm.NonceSize():], []byte("gdir:secrets"))
+	if err != nil {
+		return fmt.Errorf("wrong passphrase of %s", f.Path)
+	}
+	if err = json.Unmarshal(plain, &f.values); err != nil {
+		return fmt.Errorf("%s: %w", f.Path, err)
+	}
+	f.loaded = true
+	return
+}
+
+func (f *FileSecrets) Secret(name string) (value string, err error) {
+	if err = f.load(); err != nil {
+		return
+	}
+	value, ok := f.values[name]
+	if !ok {
+		return "", fmt.Errorf("no secret %s in %s", name, f.Path)
+	}
+	return
+}
+
+// SetSecret writes a secret into the file.
+func (f *FileSecrets) SetSecret(name string, value string) (err error) {
+	if err = f.load(); err != nil {
+		return
+	}
+	f.values[name] = value
+	plain, err := json.Marshal(f.values)
+	if err != nil {
+		return
+	}
+	gcm, err := f.cipher()
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	b, err := json.MarshalIndent(&secretsFileData{KDF: f.kdf, Data: gcm.Seal(nonce, nonce, plain, []byte("gdir:secrets"))}, "", "    ")
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(f.Path), 0700); err != nil {
+		return
+	}
+	return ioutil.WriteFile(f.Path, b, 0600)
+}
+
+// askSecretsPassphrase takes the passphrase of the secrets file from the
+// environment, or asks for it.
+func askSecretsPassphrase(path string, new bool) (passphrase string, err error) {
+	if passphrase = os.Getenv(SecretsPassphraseEnv); passphrase != "" {
+		return
+	}
+	if !new {
+		return prompt.Secret(fmt.Sprintf("Passphrase of %s", path), prompt.Required)
+	}
+	fmt.Printf("Your secrets will be kept in %s, encrypted with a passphrase.\n", path)
+	for {
+		if passphrase, err = prompt.Secret(fmt.Sprintf("New passphrase of %s", path), prompt.Required); err != nil {
+			return
+		}
+		var again string
+		if again, err = prompt.Secret("Repeat the passphrase", nil); err != nil {
+			return
+		}
+		if passphrase == again {
+			return
+		}
+		fmt.Println("The passphrases do not match")
+	}
+}
+
+var secretsFile *FileSecrets
+
+// SecretsFile returns the secrets file of the config.
+func SecretsFile() *FileSecrets {
+	path := Config.Secrets.File
+	if path == "" {
+		path = DefaultSecretsFile
+	}
+	path = StatePath(path)
+	if secretsFile == nil || secretsFile.Path != path {
+		secretsFile = &FileSecrets{Path: path, Passphrase: askSecretsPassphrase}
+	}
+	return secretsFile
+}
+
+// SecretProviders are the providers of the schemes of secret references.
+var SecretProviders = map[string]func() SecretProvider{
+	SecretEnv:     func() SecretProvider { return EnvSecrets{} },
+	SecretFile:    func() SecretProvider { return SecretsFile() },
+	SecretCommand: func() SecretProvider { return CommandSecrets{} },
+}
+
+// ParseSecretRef splits a secret reference into its scheme and name, and
+// reports whether s is a reference at all rather than a secret value.
+func ParseSecretRef(s string) (scheme string, name string, ok bool) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return
+	}
+	if _, ok = SecretProviders[s[:i]]; !ok || strings.TrimSpace(s[i+1:]) == "" {
+		return "", "", false
+	}
+	return s[:i], strings.TrimSpace(s[i+1:]), true
+}
+
+// ResolveSecret returns the secret of a reference.
+func ResolveSecret(ref string) (value string, err error) {
+	scheme, name, ok := ParseSecretRef(ref)
+	if !ok {
+		return "", fmt.Errorf("not a secret reference: %s", ref)
+	}
+	if value, err = SecretProviders[scheme]().Secret(name); err == nil && value == "" {
+		err = fmt.Errorf("empty secret: %s", ref)
+	}
+	return
+}
+
+// ConfigSecret is a secret option of the config.
+type ConfigSecret struct {
+	// Name is the name of the option, and of the secret in the secrets file.
+	Name  string
+	Value *string
+	// Env is the environment variable of the option, if any.
+	Env string
+	// Profiled options are kept apart for each profile in the secrets file.
+	Profiled bool
+}
+
+// ConfigSecrets returns the secret options of the config.
+func ConfigSecrets() []ConfigSecret {
+	secrets := []ConfigSecret{
+		{"cf_key", &Config.CloudflareKey, "GDIR_CF_KEY", false},
+		{"cf_token", &Config.CloudflareToken, "GDIR_CF_TOKEN", false},
+		{"gist_token", &Config.GistToken, "GDIR_GIST_TOKEN", false},
+		{"secret_key", &Config.SecretKey, "GDIR_SECRET_KEY", true},
+	}
+	for _, kind := range StorageKinds {
+		secrets = append(secrets, ConfigSecret{Name: kind + "_s3_secret_key", Value: &StorageConfigOf(kind).S3SecretKey, Profiled: true})
+	}
+	return secrets
+}
+
+// secretRef is where a secret option of the config comes from, and its value
+// when it was resolved.
+type secretRef struct {
+	ref   string
+	value string
+}
+
+// secretRefs are the references of the secret options of the config, by name.
+var secretRefs = make(map[string]secretRef)
+
+// SecretRef returns the reference of a secret option, or empty when the option
+// is a value in the config file.
+func SecretRef(name string) string {
+	for _, secret := range ConfigSecrets() {
+		if secret.Name == name {
+			if r, ok := secretRefs[name]; ok && r.value == *secret.Value {
+				return r.ref
+			}
+		}
+	}
+	return ""
+}
+
+// setSecretRef sets a secret option to a reference and its value.
+func setSecretRef(secret ConfigSecret, ref string, value string) {
+	*secret.Value = value
+	secretRefs[secret.Name] = secretRef{ref, value}
+}
+
+// noteEnvSecret records that a config option was taken from an environment
+// variable, so that the config keeps referring to the variable.
+func noteEnvSecret(value *string, env string) {
+	for _, secret := range ConfigSecrets() {
+		if secret.Value == value {
+			secretRefs[secret.Name] = secretRef{SecretEnv + ":" + env, *value}
+		}
+	}
+}
+
+// ResolveConfigSecrets replaces the secret references of the config with
+// their secrets.
+func ResolveConfigSecrets() (err error) {
+	for _, secret := range ConfigSecrets() {
+		if _, _, ok := ParseSecretRef(*secret.Value); !ok {
+			continue
+		}
+		ref := *secret.Value
+		var value string
+		if value, err = ResolveSecret(ref); err != nil {
+			return fmt.Errorf("%s: %w", secret.Name, err)
+		}
+		setSecretRef(secret, ref, value)
+	}
+	return
+}
+
+// storeConfigSecrets replaces the secrets of the config with their references
+// to save it, keeping new secrets in the secrets store, and returns a function
+// to put the secrets back.
+func storeConfigSecrets() (restore func(), err error) {
+	var values []string
+	secrets := ConfigSecrets()
+	restore = func() {
+		for i, value := range values {
+			*secrets[i].Value = value
+		}
+	}
+	for _, secret := range secrets {
+		values = append(values, *secret.Value)
+	}
+	for _, secret := range secrets {
+		value := *secret.Value
+		if value == "" {
+			continue
+		}
+		if ref := SecretRef(secret.Name); ref != "" {
+			*secret.Value = ref
+			continue
+		}
+		if Config.Secrets.Store != SecretStoreFile {
+			continue
+		}
+		name := secret.Name
+		if secret.Profiled && Config.Profile != "" {
+			name = Config.Profile + "." + name
+		}
+		if err = SecretsFile().SetSecret(name, value); err != nil {
+			restore()
+			return
+		}
+		ref := SecretFile + ":" + name
+		secretRefs[secret.Name] = secretRef{ref, value}
+		*secret.Value = ref
+	}
+	return
+}
+
+// MaskSecret hides a secret for display, but its last characters.
+func MaskSecret(value string) string {
+	if len(value) < 12 {
+		return "********"
+	}
+	return "********" + value[len(value)-4:]
+}
+
+// SecretSource describes where a secret option of the config comes from.
+func SecretSource(name string, value string) string {
+	if value == "" {
+		return "not set"
+	}
+	if ref := SecretRef(name); ref != "" {
+		return ref
+	}
+	return "value in " + Config.ConfigFile
+}
+
+// confirmSecret shows where a secret comes from without revealing it, and
+// clears it unless it is confirmed.
+func confirmSecret(label string, name string, value *string) (err error) {
+	if *value == "" {
+		return
+	}
+	if ref := SecretRef(name); ref != "" {
+		fmt.Printf("%s: %s\n", label, ref)
+	} else {
+		fmt.Printf("%s: %s\n", label, MaskSecret(*value))
+	}
+	var yes bool
+	if yes, err = prompt.Confirm("Is it correct?", true); err == nil && !yes {
+		*value = ""
+		delete(secretRefs, name)
+	}
+	return
+}
+
+// EnterSecret asks for a secret option, given as a value or as a reference.
+func EnterSecret(question string, name string) (err error) {
+	var secret *ConfigSecret
+	secrets := ConfigSecrets()
+	for i := range secrets {
+		if secrets[i].Name == name {
+			secret = &secrets[i]
+		}
+	}
+	if secret == nil {
+		return fmt.Errorf("unknown secret: %s", name)
+	}
+	fmt.Println("(Enter the value, or env:VARIABLE or cmd:COMMAND to read it from there.)")
+	_, err = prompt.Secret(question, func(answer string) (err error) {
+		if answer = strings.TrimSpace(answer); answer == "" {
+			return prompt.Required(answer)
+		}
+		if scheme, _, ok := ParseSecretRef(answer); ok && scheme != SecretFile {
+			var value string
+			if value, err = ResolveSecret(answer); err != nil {
+				return
+			}
+			setSecretRef(*secret, answer, value)
+			return
+		}
+		*secret.Value = answer
+		delete(secretRefs, name)
+		return
+	})
+	return
+}
+
+// SetSecretsStore asks where new secrets are kept, unless it is set.
+func SetSecretsStore() (err error) {
+	if Config.Secrets.Store != "" {
+		return
+	}
+	var choice int
+	if choice, err = prompt.Select("Specify where you want to keep your secrets, such as API keys:", []string{
+		fmt.Sprintf("A file encrypted with a passphrase (%s)", SecretsFile().Path),
+		fmt.Sprintf("As they are in %s   (not recommended)", Config.ConfigFile),
+	}, 0); err != nil {
+		return
+	}
+	Config.Secrets.Store = []string{SecretStoreFile, SecretStoreConfig}[choice]
+	return SaveConfigFile()
+}
+
+// SortedSecretNames returns the names of the secrets in the secrets file.
+func (f *FileSecrets) SortedSecretNames() (names []string, err error) {
+	if _, err = os.Stat(f.Path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err = f.load(); err != nil {
+		return
+	}
+	for name := range f.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
@@ -0,0 +1,355 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/workerindex/gdir/tools/prompt"
+)
+
+// Storage types
+const (
+	StorageGist  = "gist"
+	StorageGit   = "git"
+	StorageKV    = "kv"
+	StorageS3    = "s3"
+	StorageLocal = "local"
+)
+
+// StorageKinds are the artifact kinds that are published to a storage, each
+// from the local directory of the same name.
+var StorageKinds = []string{"accounts", "users", "static"}
+
+// Storage publishes the files of a local artifact directory to where the
+// worker can fetch them.
+type Storage interface {
+	// URL is the base URL the worker appends file names to.
+	URL() string
+	// Deploy uploads every file in dir and removes the files that are no
+	// longer in dir.
+	Deploy(dir string) error
+	String() string
+}
+
+func StorageConfigOf(kind string) *StorageConfig {
+	switch kind {
+	case "accounts":
+		return &Config.Storage.Accounts
+	case "users":
+		return &Config.Storage.Users
+	case "static":
+		return &Config.Storage.Static
+	}
+	panic(fmt.Sprintf("unknown storage kind: %s", kind))
+}
+
+func GistIDOf(kind string) *string {
+	switch kind {
+	case "accounts":
+		return &Config.GistID.Accounts
+	case "users":
+		return &Config.GistID.Users
+	case "static":
+		return &Config.GistID.Static
+	}
+	panic(fmt.Sprintf("unknown storage kind: %s", kind))
+}
+
+func StorageType(kind string) string {
+	if t := StorageConfigOf(kind).Type; t != "" {
+		return t
+	}
+	return StorageGist
+}
+
+// KVBinding is the name of the KV namespace binding a kind is read from.
+func KVBinding(kind string) string {
+	return "GDIR_" + strings.ToUpper(kind)
+}
+
+// UsesGist reports whether any artifact kind is stored in a Gist.
+func UsesGist() bool {
+	for _, kind := range StorageKinds {
+		if StorageType(kind) == StorageGist {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateStorageConfig returns the problems of a storage config, without
+// contacting the storage.
+func ValidateStorageConfig(kind string) (errs []string) {
+	conf := StorageConfigOf(kind)
+	missing := func(what string) {
+		errs = append(errs, fmt.Sprintf("missing %s for %s storage (\"storage.%s\" in config)", what, kind, kind))
+	}
+	switch StorageType(kind) {
+	case StorageGist:
+	case StorageGit:
+		if conf.GitRemote == "" {
+			missing("git_remote")
+		}
+		if conf.URL == "" {
+			missing("url")
+		}
+	case StorageKV:
+	case StorageS3:
+		if conf.S3Endpoint == "" {
+			missing("s3_endpoint")
+		}
+		if conf.S3Bucket == "" {
+			missing("s3_bucket")
+		}
+		if conf.S3AccessKey == "" {
+			missing("s3_access_key")
+		}
+		if conf.S3SecretKey == "" {
+			missing("s3_secret_key")
+		}
+	case StorageLocal:
+		if conf.Dir == "" {
+			missing("dir")
+		}
+		if conf.URL == "" {
+			missing("url")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("unknown %s storage type: %s", kind, conf.Type))
+	}
+	return
+}
+
+func NewStorage(kind string) (s Storage, err error) {
+	if errs := ValidateStorageConfig(kind); len(errs) > 0 {
+		err = ValidationError(errs)
+		return
+	}
+	conf := StorageConfigOf(kind)
+	switch StorageType(kind) {
+	case StorageGist:
+		s = &GistStorage{ID: *GistIDOf(kind)}
+	case StorageGit:
+		s = &GitStorage{Remote: conf.GitRemote, Branch: conf.GitBranch, BaseURL: conf.URL}
+	case StorageKV:
+		s = &KVStorage{Namespace: conf.KVNamespace, Binding: KVBinding(kind)}
+	case StorageS3:
+		s = &S3Storage{
+			Endpoint:  conf.S3Endpoint,
+			Region:    conf.S3Region,
+			Bucket:    conf.S3Bucket,
+			Prefix:    conf.S3Prefix,
+			AccessKey: conf.S3AccessKey,
+			SecretKey: conf.S3SecretKey,
+			BaseURL:   conf.URL,
+		}
+	case StorageLocal:
+		s = &LocalStorage{Dir: conf.Dir, BaseURL: conf.URL}
+	}
+	return
+}
+
+func DeployStorage(kind string) (err error) {
+	s, err := NewStorage(kind)
+	if err != nil {
+		return
+	}
+	dir := ArtifactPath(kind)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	if err = s.Deploy(dir); err != nil || kind != "users" {
+		return
+	}
+	return markUsersDeployed()
+}
+
+// StorageURL returns the base URL the worker fetches files of kind from.
+func StorageURL(kind string) (url string, err error) {
+	s, err := NewStorage(kind)
+	if err != nil {
+		return
+	}
+	url = s.URL()
+	return
+}
+
+// StorageKVBindings returns the KV namespace bindings the worker needs to read
+// the kinds stored in Workers KV.
+func StorageKVBindings() (bindings []WorkerBinding) {
+	for _, kind := range StorageKinds {
+		if StorageType(kind) == StorageKV {
+			bindings = append(bindings, WorkerBinding{
+				Name:        KVBinding(kind),
+				Type:        BindingKVNamespace,
+				NamespaceID: StorageConfigOf(kind).KVNamespace,
+			})
+		}
+	}
+	return
+}
+
+func ConfigureStorage(name string) (err error) {
+	kind := strings.ToLower(name)
+	conf := StorageConfigOf(kind)
+	if err = confirmSetting(fmt.Sprintf("Your %s storage type", name), &conf.Type); err != nil {
+		return
+	}
+	if conf.Type == "" {
+		types := []string{StorageGist, StorageGit, StorageKV, StorageS3, StorageLocal}
+		var choice int
+		if choice, err = prompt.Select(fmt.Sprintf("Specify where you want to store your %s:", name), []string{
+			"GitHub Gist",
+			"Git repository on any host",
+			"Cloudflare Workers KV",
+			"S3 compatible bucket",
+			"Local directory served over HTTP",
+		}, 0); err != nil {
+			return
+		}
+		conf.Type = types[choice]
+		if err = SaveConfigFile(); err != nil {
+			return
+		}
+	}
+	var options []storageOption
+	switch conf.Type {
+	case StorageGist:
+		if Gh == nil {
+			if err = EnterGistToken(); err != nil {
+				return
+			}
+			if err = InitGitHubAPI(); err != nil {
+				return
+			}
+		}
+		return EnterAccoutsGist(name, GistIDOf(kind))
+	case StorageGit:
+		options = []storageOption{
+			{"Git remote URL", &conf.GitRemote, "", true},
+			{"Git branch", &conf.GitBranch, "master", true},
+			{"Public raw URL of the branch root", &conf.URL, "", true},
+		}
+	case StorageKV:
+		if conf.KVNamespace == "" {
+			fmt.Println("(Leave empty to create a new namespace.)")
+			if err = EnterStorageOption("Workers KV namespace ID", &conf.KVNamespace, "", false); err != nil {
+				return
+			}
+			if conf.KVNamespace == "" {
+				if err = CreateKVNamespace(kind); err != nil {
+					return
+				}
+			}
+		}
+	case StorageS3:
+		options = []storageOption{
+			{"S3 endpoint URL", &conf.S3Endpoint, "https://s3.amazonaws.com", true},
+			{"S3 region", &conf.S3Region, "us-east-1", true},
+			{"S3 bucket", &conf.S3Bucket, "", true},
+			{"S3 key prefix", &conf.S3Prefix, kind, true},
+			{"S3 access key", &conf.S3AccessKey, "", true},
+		}
+	case StorageLocal:
+		options = []storageOption{
+			{"Directory to copy files into", &conf.Dir, "", true},
+			{"Public URL of the directory", &conf.URL, "", true},
+		}
+	}
+	for _, option := range options {
+		if err = EnterStorageOption(option.prompt, option.value, option.defaultValue, option.required); err != nil {
+			return
+		}
+	}
+	if conf.Type == StorageS3 && conf.S3SecretKey == "" {
+		if err = EnterSecret("S3 secret key", kind+"_s3_secret_key"); err != nil {
+			return
+		}
+	}
+	if conf.Type == StorageS3 && conf.URL == "" {
+		fmt.Println("(Leave empty if objects are publicly readable from the endpoint.)")
+		if err = EnterStorageOption("Public URL of the bucket prefix", &conf.URL, "", false); err != nil {
+			return
+		}
+	}
+	return SaveConfigFile()
+}
+
+// storageOption is an option of a storage type for EnterStorageOption.
+type storageOption struct {
+	prompt       string
+	value        *string
+	defaultValue string
+	required     bool
+}
+
+// EnterStorageOption prompts for a storage option that is not set yet, which
+// is required or may be left empty.
+func EnterStorageOption(question string, value *string, defaultValue string, required bool) (err error) {
+	if *value != "" {
+		return
+	}
+	var validate func(string) error
+	if required {
+		validate = prompt.Required
+	}
+	*value, err = prompt.Text(question, defaultValue, validate)
+	return
+}
+
+// CreateKVNamespace creates a Workers KV namespace for kind.
+func CreateKVNamespace(kind string) (err error) {
+	if err = InitCloudflareAccount(); err != nil {
+		return
+	}
+	title := fmt.Sprintf("gdir-%s-%s", Config.CloudflareWorker, kind)
+	fmt.Printf("Creating Workers KV namespace %s...\n", title)
+	resp, err := Cf.CreateWorkersKVNamespace(context.Background(), &cloudflare.WorkersKVNamespaceRequest{Title: title})
+	if err != nil {
+		return
+	}
+	StorageConfigOf(kind).KVNamespace = resp.Result.ID
+	return SaveConfigFile()
+}
+
+// InitCloudflareAccount initializes the Cloudflare API with the configured
+// account, for commands that do not go through setup.
+func InitCloudflareAccount() (err error) {
+	if Cf == nil {
+		if err = InitCloudflareAPI(); err != nil {
+			return
+		}
+	}
+	Cf.AccountID = Config.CloudflareAccount
+	return
+}
+
+// storageFiles returns the files of an artifact directory to deploy, by name.
+func storageFiles(dir string) (files map[string]string, err error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	files = make(map[string]string)
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		files[info.Name()] = filepath.Join(dir, info.Name())
+	}
+	return
+}
+
+func sortedNames(files map[string]string) (names []string) {
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
@@ -0,0 +1,530 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/go-github/v31/github"
+)
+
+// GistStorage publishes files to a GitHub Gist.
+type GistStorage struct {
+	ID string
+}
+
+func (s *GistStorage) URL() string {
+	return GistRawURL(s.ID)
+}
+
+func (s *GistStorage) Deploy(dir string) error {
+	return DeployGist(dir, s.ID)
+}
+
+func (s *GistStorage) String() string {
+	return fmt.Sprintf("Gist %s", s.ID)
+}
+
+// gistBase64Prefix marks Gist files that hold base64 encoded binary content.
+// The Gist API only accepts UTF-8 text, so encrypted files are encoded and
+// the worker decodes them again when fetching.
+const gistBase64Prefix = "gdir:base64:"
+
+// gistEditBatch is the number of files changed by one Gist API request.
+const gistEditBatch = 100
+
+// EncodeGistContent returns the text a file is stored as in a Gist.
+func EncodeGistContent(b []byte) string {
+	if utf8.Valid(b) && !bytes.HasPrefix(b, []byte(gistBase64Prefix)) {
+		return string(b)
+	}
+	return gistBase64Prefix + base64.StdEncoding.EncodeToString(b)
+}
+
+// DecodeGistContent reverses EncodeGistContent.
+func DecodeGistContent(s string) ([]byte, error) {
+	if strings.HasPrefix(s, gistBase64Prefix) {
+		return base64.StdEncoding.DecodeString(s[len(gistBase64Prefix):])
+	}
+	return []byte(s), nil
+}
+
+// GistDeployError is returned when a file cannot be deployed to a Gist.
+type GistDeployError struct {
+	GistID string
+	Op     string
+	Files  []string
+	Err    error
+}
+
+func (e *GistDeployError) Error() string {
+	return fmt.Sprintf("cannot %s %s in Gist %s: %s", e.Op, strings.Join(e.Files, ", "), e.GistID, e.Err)
+}
+
+func (e *GistDeployError) Unwrap() error {
+	return e.Err
+}
+
+// Kinds of FileChange.
+const (
+	FileAdded    = "added"
+	FileModified = "modified"
+	FileRemoved  = "removed"
+)
+
+// FileChange is a file a deployment adds, modifies or removes.
+type FileChange struct {
+	Name string
+	Op   string
+}
+
+// gistMaxFiles is the most files the Gist API lists. The files of a Gist
+// with more are truncated, so such Gists are deployed from a git clone, which
+// is the only time git is needed.
+const gistMaxFiles = 300
+
+// gistGitURL returns the URL Gists with too many files for the API are cloned
+// from and pushed to.
+var gistGitURL = func(gistID string) string {
+	return fmt.Sprintf("https://gist.github.com/%s.git", gistID)
+}
+
+var errGistTooManyFiles = fmt.Errorf("the Gist API lists no more than %d files", gistMaxFiles)
+
+var errGistNeedsGit = fmt.Errorf("%w, and Gists with more are deployed with git, which is not installed: please install git, or store these files in Workers KV, S3 or a local directory instead", errGistTooManyFiles)
+
+// remoteGistFile is a file of a Gist as the Gist API lists it. The content of
+// large files is truncated, and fetched from RawURL when needed.
+type remoteGistFile struct {
+	Size      int    `json:"size"`
+	RawURL    string `json:"raw_url"`
+	Content   string `json:"content"`
+	Truncated bool   `json:"truncated"`
+}
+
+// listGistFiles lists the files of a Gist, or of a revision of it when
+// revision is not empty. A Gist whose files are truncated fails, since
+// deploying on top of part of its files would leave the others behind.
+func listGistFiles(ctx context.Context, gistID string, revision string) (files map[string]remoteGistFile, err error) {
+	if Gh == nil {
+		if err = InitGitHubAPI(); err != nil {
+			return
+		}
+	}
+	url := "gists/" + gistID
+	if revision != "" {
+		url += "/" + revision
+	}
+	// go-github leaves out whether the files are truncated
+	var gist struct {
+		Files     map[string]remoteGistFile `json:"files"`
+		Truncated bool                      `json:"truncated"`
+	}
+	req, err := Gh.NewRequest("GET", url, nil)
+	if err == nil {
+		_, err = Gh.Do(ctx, req, &gist)
+	}
+	if err == nil && gist.Truncated {
+		err = errGistTooManyFiles
+	}
+	if err != nil {
+		err = &GistDeployError{GistID: gistID, Op: "read", Files: []string{"files"}, Err: err}
+		return
+	}
+	return gist.Files, nil
+}
+
+// gistContents returns the contents of the files of a Gist.
+func gistContents(ctx context.Context, gistID string, files map[string]remoteGistFile) (contents map[string]string, err error) {
+	contents = make(map[string]string)
+	for name, file := range files {
+		if contents[name], err = gistFileContent(ctx, file); err != nil {
+			err = &GistDeployError{GistID: gistID, Op: "read", Files: []string{name}, Err: err}
+			return
+		}
+	}
+	return
+}
+
+// localGistFiles returns the files of fsys as they are stored in a Gist. Like
+// storageFiles, it leaves out directories and files starting with a dot.
+func localGistFiles(fsys fs.FS) (files map[string]string, err error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return
+	}
+	files = make(map[string]string)
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		var b []byte
+		if b, err = fs.ReadFile(fsys, entry.Name()); err != nil {
+			return
+		}
+		files[entry.Name()] = EncodeGistContent(b)
+	}
+	return
+}
+
+// diffGistFiles returns the changes that make the remote files the same as
+// files: the new contents, or nil for the files to delete. Remote files
+// starting with a dot, such as the placeholder file created with the Gist,
+// are kept. Files of the same size are compared by their SHA-256, and only
+// those the API truncated are fetched to do so.
+func diffGistFiles(ctx context.Context, gistID string, remote map[string]remoteGistFile, files map[string]string) (changes map[string]*string, err error) {
+	changes = make(map[string]*string)
+	for name, content := range files {
+		if file, ok := remote[name]; ok && file.Size == len(content) {
+			var old string
+			if old, err = gistFileContent(ctx, file); err != nil {
+				err = &GistDeployError{GistID: gistID, Op: "read", Files: []string{name}, Err: err}
+				return
+			}
+			if sha256.Sum256([]byte(old)) == sha256.Sum256([]byte(content)) {
+				continue
+			}
+		}
+		content := content
+		changes[name] = &content
+	}
+	for name := range remote {
+		if _, ok := files[name]; !ok && !strings.HasPrefix(name, ".") {
+			changes[name] = nil
+		}
+	}
+	return
+}
+
+// PlanGist returns the changes DeployGist would make to Gist gistID, sorted by
+// file name.
+func PlanGist(fsys fs.FS, gistID string) (changes []FileChange, err error) {
+	files, err := localGistFiles(fsys)
+	if err != nil {
+		return
+	}
+	ctx := context.Background()
+	remote, clone, err := readGist(ctx, gistID, len(files))
+	if err != nil {
+		return
+	}
+	if clone != "" {
+		defer os.RemoveAll(clone)
+	}
+	diff, err := diffGistFiles(ctx, gistID, remote, files)
+	if err != nil {
+		return
+	}
+	for _, name := range sortedChanges(diff) {
+		change := FileChange{Name: name, Op: FileModified}
+		if diff[name] == nil {
+			change.Op = FileRemoved
+		} else if _, ok := remote[name]; !ok {
+			change.Op = FileAdded
+		}
+		changes = append(changes, change)
+	}
+	return
+}
+
+// DeployGist makes the files of Gist gistID the same as the files in dir
+// through the Gist API, or through git when the Gist has or is about to have
+// more files than the API lists. Unchanged files are skipped.
+func DeployGist(dir string, gistID string) (err error) {
+	ctx := context.Background()
+	files, err := localGistFiles(os.DirFS(dir))
+	if err != nil {
+		return
+	}
+	remote, clone, err := readGist(ctx, gistID, len(files))
+	if err != nil {
+		return
+	}
+	if clone != "" {
+		defer os.RemoveAll(clone)
+	}
+	changes, err := diffGistFiles(ctx, gistID, remote, files)
+	if err != nil || len(changes) == 0 {
+		return
+	}
+	fmt.Printf("Deploying %s to Gist...\n", dir)
+	if clone != "" {
+		return pushGistChanges(gistID, clone, changes)
+	}
+	return applyGistChanges(ctx, gistID, changes)
+}
+
+// RestoreGist makes the files of Gist gistID the same as they were at a
+// revision, by committing them again on top of the current ones.
+func RestoreGist(gistID string, revision string) (err error) {
+	ctx := context.Background()
+	listed, err := listGistFiles(ctx, gistID, revision)
+	if isGistTooManyFiles(err) {
+		return restoreGistClone(gistID, revision)
+	}
+	if err != nil {
+		return
+	}
+	files, err := gistContents(ctx, gistID, listed)
+	if err != nil {
+		return
+	}
+	remote, err := listGistFiles(ctx, gistID, "")
+	if isGistTooManyFiles(err) {
+		return restoreGistClone(gistID, revision)
+	}
+	if err != nil {
+		return
+	}
+	changes, err := diffGistFiles(ctx, gistID, remote, files)
+	if err != nil || len(changes) == 0 {
+		return
+	}
+	fmt.Printf("Restoring Gist %s to revision %s...\n", gistID, revision)
+	return applyGistChanges(ctx, gistID, changes)
+}
+
+// GistRevision returns the SHA of the latest revision of a Gist.
+func GistRevision(gistID string) (revision string, err error) {
+	if Gh == nil {
+		if err = InitGitHubAPI(); err != nil {
+			return
+		}
+	}
+	commits, _, err := Gh.Gists.ListCommits(context.Background(), gistID, &github.ListOptions{PerPage: 1})
+	if err != nil {
+		return
+	}
+	if len(commits) == 0 {
+		return "", fmt.Errorf("Gist %s has no revisions", gistID)
+	}
+	return commits[0].GetVersion(), nil
+}
+
+// applyGistChanges edits the changed files of a Gist, in batches.
+func applyGistChanges(ctx context.Context, gistID string, changes map[string]*string) (err error) {
+	var batch []string
+	for _, name := range sortedChanges(changes) {
+		batch = append(batch, name)
+		if len(batch) == gistEditBatch {
+			if err = editGistFiles(ctx, gistID, batch, changes); err != nil {
+				return
+			}
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		err = editGistFiles(ctx, gistID, batch, changes)
+	}
+	return
+}
+
+func sortedChanges(changes map[string]*string) (names []string) {
+	for name := range changes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// editGistFiles updates the named files of a Gist, deleting the files that
+// have no content. go-github cannot send the null file a deletion needs, so
+// the request is built here.
+func editGistFiles(ctx context.Context, gistID string, names []string, changes map[string]*string) (err error) {
+	type gistFile struct {
+		Content string `json:"content"`
+	}
+	files := make(map[string]*gistFile)
+	for _, name := range names {
+		if content := changes[name]; content != nil {
+			fmt.Printf("    update %s\n", name)
+			files[name] = &gistFile{Content: *content}
+		} else {
+			fmt.Printf("    delete %s\n", name)
+			files[name] = nil
+		}
+	}
+	req, err := Gh.NewRequest("PATCH", "gists/"+gistID, map[string]interface{}{"files": files})
+	if err == nil {
+		_, err = Gh.Do(ctx, req, nil)
+	}
+	if err != nil {
+		err = &GistDeployError{GistID: gistID, Op: "update", Files: names, Err: err}
+	}
+	return
+}
+
+// gistFileContent returns the content of a Gist file, fetching the raw file
+// when the API has truncated it.
+func gistFileContent(ctx context.Context, file remoteGistFile) (content string, err error) {
+	if !file.Truncated && len(file.Content) == file.Size || file.RawURL == "" {
+		return file.Content, nil
+	}
+	req, err := http.NewRequest("GET", file.RawURL, nil)
+	if err != nil {
+		return
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("GET %s: %s", file.RawURL, resp.Status)
+		return
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	content = string(b)
+	return
+}
+
+func isGistTooManyFiles(err error) bool {
+	var deployErr *GistDeployError
+	return errors.As(err, &deployErr) && errors.Is(deployErr.Err, errGistTooManyFiles)
+}
+
+// readGist returns the files of a Gist that is about to have local files.
+// When the Gist has or would have more files than the Gist API lists, they are
+// read from a git clone of it instead, whose directory is returned.
+func readGist(ctx context.Context, gistID string, local int) (remote map[string]remoteGistFile, clone string, err error) {
+	if local <= gistMaxFiles {
+		if remote, err = listGistFiles(ctx, gistID, ""); !isGistTooManyFiles(err) {
+			return
+		}
+	}
+	if clone, err = cloneGist(gistID); err != nil {
+		return
+	}
+	if remote, err = cloneGistFiles(clone); err != nil {
+		os.RemoveAll(clone)
+		clone = ""
+		err = &GistDeployError{GistID: gistID, Op: "read", Files: []string{"files"}, Err: err}
+	}
+	return
+}
+
+// cloneGist clones a Gist into a new temporary directory. It fails with
+// errGistNeedsGit without git.
+func cloneGist(gistID string) (dir string, err error) {
+	if _, err = exec.LookPath("git"); err != nil {
+		err = &GistDeployError{GistID: gistID, Op: "clone", Files: []string{"files"}, Err: errGistNeedsGit}
+		return
+	}
+	if dir, err = ioutil.TempDir("", "gdir-gist-"); err != nil {
+		return
+	}
+	if err = gistGit(dir, "clone", "--quiet", gistGitURL(gistID), "."); err != nil {
+		os.RemoveAll(dir)
+		dir = ""
+		err = &GistDeployError{GistID: gistID, Op: "clone", Files: []string{"files"}, Err: err}
+	}
+	return
+}
+
+// cloneGistFiles returns the files of a Gist clone, with their full content.
+func cloneGistFiles(dir string) (files map[string]remoteGistFile, err error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	files = make(map[string]remoteGistFile)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		var b []byte
+		if b, err = ioutil.ReadFile(filepath.Join(dir, entry.Name())); err != nil {
+			return
+		}
+		files[entry.Name()] = remoteGistFile{Size: len(b), Content: string(b)}
+	}
+	return
+}
+
+// pushGistChanges writes the changed files into a Gist clone, commits them and
+// pushes them as a new revision of the Gist.
+func pushGistChanges(gistID string, clone string, changes map[string]*string) (err error) {
+	names := sortedChanges(changes)
+	for _, name := range names {
+		path := filepath.Join(clone, name)
+		if content := changes[name]; content != nil {
+			fmt.Printf("    update %s\n", name)
+			err = ioutil.WriteFile(path, []byte(*content), 0600)
+		} else {
+			fmt.Printf("    delete %s\n", name)
+			err = os.Remove(path)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return commitGistClone(gistID, clone, names)
+}
+
+// restoreGistClone restores a Gist with too many files for the Gist API to a
+// revision through git.
+func restoreGistClone(gistID string, revision string) (err error) {
+	clone, err := cloneGist(gistID)
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(clone)
+	fmt.Printf("Restoring Gist %s to revision %s...\n", gistID, revision)
+	if err = gistGit(clone, "read-tree", "-u", "--reset", revision); err != nil {
+		return &GistDeployError{GistID: gistID, Op: "restore", Files: []string{revision}, Err: err}
+	}
+	return commitGistClone(gistID, clone, []string{"files"})
+}
+
+// commitGistClone commits every change in a Gist clone and pushes it, unless
+// nothing changed.
+func commitGistClone(gistID string, clone string, names []string) (err error) {
+	if err = gistGit(clone, "add", "--all"); err != nil {
+		return &GistDeployError{GistID: gistID, Op: "update", Files: names, Err: err}
+	}
+	if gistGit(clone, "diff", "--cached", "--quiet") == nil {
+		return
+	}
+	if err = gistGit(clone, "commit", "--quiet", "--allow-empty-message", "-m", ""); err == nil {
+		err = gistGit(clone, "push", "--quiet", "origin", "HEAD")
+	}
+	if err != nil {
+		err = &GistDeployError{GistID: gistID, Op: "update", Files: names, Err: err}
+	}
+	return
+}
+
+// gistGit runs git in a Gist clone as the committer gdir uses, authenticated
+// with the Gist token. The token is given in the environment of git rather
+// than on its command line, which other users can read.
+func gistGit(dir string, args ...string) (err error) {
+	cmd := exec.Command("git", append([]string{"-c", "user.name=gdir", "-c", "user.email=gdir@google.com"}, args...)...)
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+	if Config.GistToken != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte("gdir:" + Config.GistToken))
+		cmd.Env = append(cmd.Env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.https://gist.github.com/.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth,
+		)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil && stderr.Len() > 0 {
+		err = fmt.Errorf("git %s: %s", args[0], strings.TrimSpace(stderr.String()))
+	}
+	return
+}
@@ -0,0 +1,208 @@
+package core
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v31/github"
+)
+
+func TestGistFiles(t *testing.T) {
+	var fetched []string
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gists/full":
+			fmt.Fprintf(w, `{"files": {
+				"same": {"size": 4, "content": "same"},
+				"resized": {"size": 3, "content": "old", "raw_url": "%[1]s/raw/resized"},
+				"large": {"size": 5, "content": "la", "truncated": true, "raw_url": "%[1]s/raw/large"},
+				"large-changed": {"size": 5, "content": "la", "truncated": true, "raw_url": "%[1]s/raw/large-changed"},
+				"stale": {"size": 5, "content": "stale"},
+				".placeholder": {"size": 1, "content": "."}
+			}}`, srv.URL)
+		case "/gists/many":
+			fmt.Fprint(w, `{"files": {"a": {"size": 1, "content": "a"}}, "truncated": true}`)
+		case "/raw/large":
+			fetched = append(fetched, "large")
+			fmt.Fprint(w, "large")
+		case "/raw/large-changed":
+			fetched = append(fetched, "large-changed")
+			fmt.Fprint(w, "lardy")
+		default:
+			fetched = append(fetched, r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	Gh = github.NewClient(nil)
+	Gh.BaseURL, _ = url.Parse(srv.URL + "/")
+	defer func() { Gh = nil }()
+	ctx := context.Background()
+
+	remote, err := listGistFiles(ctx, "full", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"same":          "same",
+		"resized":       "newer",
+		"large":         "large",
+		"large-changed": "large",
+		"added":         "added",
+	}
+	changes, err := diffGistFiles(ctx, "full", remote, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"resized": "newer", "large-changed": "large", "added": "added", "stale": ""}
+	if len(changes) != len(want) {
+		t.Errorf("changes = %v, want %v", sortedChanges(changes), want)
+	}
+	for name, content := range want {
+		change, ok := changes[name]
+		if !ok || (change == nil) != (content == "") || change != nil && *change != content {
+			t.Errorf("change of %s = %v, want %q", name, change, content)
+		}
+	}
+	if len(fetched) != 2 {
+		t.Errorf("fetched %v, want only the truncated files of the same size", fetched)
+	}
+
+	var deployErr *GistDeployError
+	if _, err = listGistFiles(ctx, "many", ""); !errors.As(err, &deployErr) || deployErr.Err != errGistTooManyFiles {
+		t.Errorf("listing a truncated Gist: %v", err)
+	}
+}
+
+func TestGistGitFallback(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"files": {".placeholder": {"size": 1, "content": "."}}, "truncated": true}`)
+	}))
+	defer srv.Close()
+	Gh = github.NewClient(nil)
+	Gh.BaseURL, _ = url.Parse(srv.URL + "/")
+	defer func() { Gh = nil }()
+
+	tmp := t.TempDir()
+	remote := filepath.Join(tmp, "gist.git")
+	seed := filepath.Join(tmp, "seed")
+	git := func(dir string, args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git(tmp, "init", "--quiet", "--bare", remote)
+	git(tmp, "clone", "--quiet", remote, seed)
+	for _, name := range []string{".placeholder", "stale"} {
+		if err := ioutil.WriteFile(filepath.Join(seed, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git(seed, "add", "--all")
+	git(seed, "commit", "--quiet", "-m", "seed")
+	git(seed, "push", "--quiet", "origin", "HEAD")
+	seeded := git(remote, "rev-parse", "HEAD")
+	defer func(old func(string) string) { gistGitURL = old }(gistGitURL)
+	gistGitURL = func(string) string { return remote }
+
+	dir := filepath.Join(tmp, "accounts")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= gistMaxFiles; i++ {
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprint(i)), []byte("file"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	changes, err := PlanGist(os.DirFS(dir), "large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != gistMaxFiles+2 {
+		t.Errorf("planned %d changes, want %d", len(changes), gistMaxFiles+2)
+	}
+	if err = DeployGist(dir, "large"); err != nil {
+		t.Fatal(err)
+	}
+	files := strings.Fields(git(remote, "ls-tree", "--name-only", "HEAD"))
+	if len(files) != gistMaxFiles+2 {
+		t.Errorf("Gist has %d files after deploying, want %d", len(files), gistMaxFiles+2)
+	}
+	if git(remote, "rev-parse", "HEAD~1") != seeded {
+		t.Error("deploying did not add a revision on top of the Gist")
+	}
+	if err = DeployGist(dir, "large"); err != nil {
+		t.Fatal(err)
+	}
+	if git(remote, "rev-parse", "HEAD~1") != seeded {
+		t.Error("deploying unchanged files added a revision")
+	}
+
+	if err = RestoreGist("large", seeded); err != nil {
+		t.Fatal(err)
+	}
+	if files := git(remote, "ls-tree", "--name-only", "HEAD"); files != ".placeholder\nstale" {
+		t.Errorf("Gist has %q after restoring, want the seeded files", files)
+	}
+}
+
+func TestGistGitToken(t *testing.T) {
+	bin := t.TempDir()
+	script := "#!/bin/sh\necho \"$@\" > args\nenv | grep ^GIT_CONFIG_ > env\n"
+	if err := ioutil.WriteFile(filepath.Join(bin, "git"), []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	setEnv(t, map[string]string{"PATH": bin + string(os.PathListSeparator) + os.Getenv("PATH")})
+	defer func(old string) { Config.GistToken = old }(Config.GistToken)
+	Config.GistToken = "ghp_secret"
+
+	dir := t.TempDir()
+	if err := gistGit(dir, "push", "--quiet", "origin", "HEAD"); err != nil {
+		t.Fatal(err)
+	}
+	args, _ := ioutil.ReadFile(filepath.Join(dir, "args"))
+	env, _ := ioutil.ReadFile(filepath.Join(dir, "env"))
+	auth := base64.StdEncoding.EncodeToString([]byte("gdir:ghp_secret"))
+	if strings.Contains(string(args), auth) || !strings.Contains(string(args), "push --quiet origin HEAD") {
+		t.Errorf("git run with %q, want the token left out", args)
+	}
+	if !strings.Contains(string(env), "GIT_CONFIG_VALUE_0=Authorization: Basic "+auth) {
+		t.Errorf("git run with %q, want the token in the environment", env)
+	}
+}
+
+func TestGistWithoutGit(t *testing.T) {
+	setEnv(t, map[string]string{"PATH": t.TempDir()})
+	dir := t.TempDir()
+	for i := 0; i <= gistMaxFiles; i++ {
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprint(i)), []byte("file"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := PlanGist(os.DirFS(dir), "large"); !errors.Is(err, errGistNeedsGit) {
+		t.Errorf("planning %d files without git: %v, want %v", gistMaxFiles+1, err, errGistNeedsGit)
+	}
+	if err := DeployGist(dir, "large"); !errors.Is(err, errGistNeedsGit) {
+		t.Errorf("deploying %d files without git: %v, want %v", gistMaxFiles+1, err, errGistNeedsGit)
+	}
+}
@@ -0,0 +1,51 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// GitStorage publishes files to a branch of any Git remote. BaseURL is where
+// the host serves the raw files of the branch, e.g.
+// https://raw.githubusercontent.com/<user>/<repo>/master/
+type GitStorage struct {
+	Remote  string
+	Branch  string
+	BaseURL string
+}
+
+func (s *GitStorage) URL() string {
+	if strings.HasSuffix(s.BaseURL, "/") {
+		return s.BaseURL
+	}
+	return s.BaseURL + "/"
+}
+
+func (s *GitStorage) Deploy(dir string) (err error) {
+	branch := s.Branch
+	if branch == "" {
+		branch = "master"
+	}
+	if _, err = os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+		fmt.Printf("Initializing Git repo in %s...\n", dir)
+		if err = InitGitRepo(dir); err != nil {
+			return
+		}
+	}
+	cmd := exec.Command("git", "remote", "get-url", "origin")
+	cmd.Dir = dir
+	remote, _ := cmd.Output()
+	if strings.TrimSpace(string(remote)) != s.Remote {
+		if err = SetGitRemote(dir, s.Remote); err != nil {
+			return
+		}
+	}
+	return PushGitRepo(dir, branch, s.String())
+}
+
+func (s *GitStorage) String() string {
+	return fmt.Sprintf("Git %s", s.Remote)
+}
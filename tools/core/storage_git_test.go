@@ -0,0 +1,75 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGitStorage(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	tmp := t.TempDir()
+	remote := filepath.Join(tmp, "remote.git")
+	git := func(dir string, args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git(tmp, "init", "--quiet", "--bare", remote)
+
+	s := &GitStorage{Remote: remote, Branch: "files", BaseURL: "https://git.example.com/raw/files"}
+	if s.URL() != "https://git.example.com/raw/files/" {
+		t.Errorf("URL() = %s", s.URL())
+	}
+	dir := filepath.Join(tmp, "users")
+	write := func(name string, content string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	write("kept", "old")
+	write("stale", "stale")
+	if err := s.Deploy(dir); err != nil {
+		t.Fatal(err)
+	}
+	write("kept", "new")
+	if err := os.Remove(filepath.Join(dir, "stale")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deploy(dir); err != nil {
+		t.Fatal(err)
+	}
+	if files := git(remote, "ls-tree", "--name-only", "files"); files != "kept" {
+		t.Errorf("files = %q, want only kept", files)
+	}
+	if content := git(remote, "show", "files:kept"); content != "new" {
+		t.Errorf("kept = %q, want new", content)
+	}
+	revisions := git(remote, "rev-list", "--count", "files")
+	if err := s.Deploy(dir); err != nil {
+		t.Fatal(err)
+	}
+	if git(remote, "rev-list", "--count", "files") != revisions {
+		t.Error("deploying unchanged files pushed a revision")
+	}
+
+	s.Remote = filepath.Join(tmp, "missing.git")
+	write("kept", "newer")
+	if err := s.Deploy(dir); err == nil {
+		t.Error("deploying to a missing remote did not fail")
+	}
+}
@@ -0,0 +1,63 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+// KVStorage publishes files to a Cloudflare Workers KV namespace. The worker
+// reads them through the namespace binding, so URL is not an HTTP URL but
+// kv://<binding>/.
+type KVStorage struct {
+	Namespace string
+	Binding   string
+}
+
+func (s *KVStorage) URL() string {
+	return fmt.Sprintf("kv://%s/", s.Binding)
+}
+
+func (s *KVStorage) Deploy(dir string) (err error) {
+	ctx := context.Background()
+	files, err := storageFiles(dir)
+	if err != nil {
+		return
+	}
+	if err = InitCloudflareAccount(); err != nil {
+		return
+	}
+	resp, err := Cf.ListWorkersKVs(ctx, s.Namespace)
+	if err != nil {
+		return
+	}
+	fmt.Printf("Deploying %s to %s...\n", dir, s)
+	for _, key := range resp.Result {
+		if _, ok := files[key.Name]; !ok {
+			if _, err = Cf.DeleteWorkersKV(ctx, s.Namespace, key.Name); err != nil {
+				return
+			}
+		}
+	}
+	var b []byte
+	for _, name := range sortedNames(files) {
+		if b, err = ioutil.ReadFile(files[name]); err != nil {
+			return
+		}
+		var resp cloudflare.Response
+		if resp, err = Cf.WriteWorkersKV(ctx, s.Namespace, name, b); err != nil {
+			return
+		}
+		if !resp.Success {
+			err = fmt.Errorf("cannot write %s to %s: %v", name, s, resp.Errors)
+			return
+		}
+	}
+	return
+}
+
+func (s *KVStorage) String() string {
+	return fmt.Sprintf("Workers KV namespace %s", s.Namespace)
+}
@@ -0,0 +1,77 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+func TestKVStorage(t *testing.T) {
+	values := map[string]string{"stale": "stale", "kept": "old"}
+	var failWrite bool
+	const prefix = "/accounts/account/storage/kv/namespaces/ns/"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, `{"success": false}`, http.StatusForbidden)
+			return
+		}
+		key := strings.TrimPrefix(r.URL.Path, prefix+"values/")
+		switch {
+		case r.Method == "GET" && r.URL.Path == prefix+"keys":
+			var keys []cloudflare.StorageKey
+			for name := range values {
+				keys = append(keys, cloudflare.StorageKey{Name: name})
+			}
+			json.NewEncoder(w).Encode(cloudflare.ListStorageKeysResponse{Response: cloudflare.Response{Success: true}, Result: keys})
+			return
+		case !strings.HasPrefix(r.URL.Path, prefix+"values/"):
+			http.NotFound(w, r)
+			return
+		case r.Method == "PUT" && failWrite:
+			fmt.Fprint(w, `{"success": false, "errors": [{"code": 10001, "message": "quota exceeded"}]}`)
+			return
+		case r.Method == "PUT":
+			b, _ := ioutil.ReadAll(r.Body)
+			values[key] = string(b)
+		case r.Method == "DELETE":
+			delete(values, key)
+		}
+		fmt.Fprint(w, `{"success": true, "errors": [], "messages": [], "result": null}`)
+	}))
+	defer srv.Close()
+
+	defer func(account string) { Cf, Config.CloudflareAccount = nil, account }(Config.CloudflareAccount)
+	Cf, _ = cloudflare.NewWithAPIToken("token")
+	Cf.BaseURL = srv.URL
+	Config.CloudflareAccount = "account"
+
+	s := &KVStorage{Namespace: "ns", Binding: KVBinding("users")}
+	if s.URL() != "kv://GDIR_USERS/" {
+		t.Errorf("URL() = %s", s.URL())
+	}
+	dir := t.TempDir()
+	for name, content := range map[string]string{"kept": "new", "added": "added", ".hidden": "hidden"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Deploy(dir); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"kept": "new", "added": "added"}
+	if fmt.Sprint(values) != fmt.Sprint(want) {
+		t.Errorf("values = %v, want %v", values, want)
+	}
+
+	failWrite = true
+	if err := s.Deploy(dir); err == nil || !strings.Contains(err.Error(), "quota exceeded") {
+		t.Errorf("deploying to a full namespace: %v", err)
+	}
+}
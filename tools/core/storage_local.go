@@ -0,0 +1,54 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalStorage copies files into a local directory that is served over HTTP
+// at BaseURL, by a web server or by anything standing in for one.
+type LocalStorage struct {
+	Dir     string
+	BaseURL string
+}
+
+func (s *LocalStorage) URL() string {
+	if strings.HasSuffix(s.BaseURL, "/") {
+		return s.BaseURL
+	}
+	return s.BaseURL + "/"
+}
+
+func (s *LocalStorage) Deploy(dir string) (err error) {
+	files, err := storageFiles(dir)
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(s.Dir, 0755); err != nil {
+		return
+	}
+	existing, err := storageFiles(s.Dir)
+	if err != nil {
+		return
+	}
+	fmt.Printf("Deploying %s to %s...\n", dir, s)
+	for _, name := range sortedNames(existing) {
+		if _, ok := files[name]; !ok {
+			if err = os.Remove(existing[name]); err != nil {
+				return
+			}
+		}
+	}
+	for _, name := range sortedNames(files) {
+		if err = CopyFile(files[name], filepath.Join(s.Dir, name)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *LocalStorage) String() string {
+	return fmt.Sprintf("directory %s", s.Dir)
+}
@@ -0,0 +1,51 @@
+package core
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalStorage(t *testing.T) {
+	served := t.TempDir()
+	srv := httptest.NewServer(http.FileServer(http.Dir(served)))
+	defer srv.Close()
+	for name, content := range map[string]string{"stale": "stale", "kept": "old", ".htaccess": "deny"} {
+		if err := ioutil.WriteFile(filepath.Join(served, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &LocalStorage{Dir: served, BaseURL: srv.URL}
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{"kept": "new", "added": "added"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Deploy(dir); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"kept": "new", "added": "added", "stale": "", ".htaccess": "deny"} {
+		resp, err := http.Get(s.URL() + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if want == "" && resp.StatusCode != http.StatusNotFound || want != "" && string(b) != want {
+			t.Errorf("GET %s = %s %q, want %q", name, resp.Status, b, want)
+		}
+	}
+
+	s.Dir = filepath.Join(dir, "kept", "sub")
+	if err := s.Deploy(dir); err == nil {
+		t.Error("deploying into a file did not fail")
+	}
+	if _, err := os.Stat(filepath.Join(served, "added")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,215 @@
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// S3Storage publishes files to a bucket of any S3 compatible service, such as
+// AWS S3, MinIO or Cloudflare R2, using path-style requests signed with AWS
+// Signature Version 4. The objects must be readable at BaseURL, which defaults
+// to <Endpoint>/<Bucket>/<Prefix>/ for buckets with anonymous read access.
+type S3Storage struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	BaseURL   string
+	Client    *http.Client
+}
+
+func (s *S3Storage) URL() string {
+	u := s.BaseURL
+	if u == "" {
+		u = strings.TrimSuffix(s.Endpoint, "/") + "/" + s.Bucket
+		if prefix := strings.Trim(s.Prefix, "/"); prefix != "" {
+			u += "/" + prefix
+		}
+	}
+	if strings.HasSuffix(u, "/") {
+		return u
+	}
+	return u + "/"
+}
+
+func (s *S3Storage) Deploy(dir string) (err error) {
+	files, err := storageFiles(dir)
+	if err != nil {
+		return
+	}
+	keys, err := s.list()
+	if err != nil {
+		return
+	}
+	fmt.Printf("Deploying %s to %s...\n", dir, s)
+	for _, key := range keys {
+		if _, ok := files[path.Base(key)]; !ok {
+			if _, err = s.do("DELETE", key, nil, nil, nil); err != nil {
+				return
+			}
+		}
+	}
+	var b []byte
+	for _, name := range sortedNames(files) {
+		if b, err = ioutil.ReadFile(files[name]); err != nil {
+			return
+		}
+		header := make(http.Header)
+		if contentType := mime.TypeByExtension(filepath.Ext(name)); contentType != "" {
+			header.Set("Content-Type", contentType)
+		} else {
+			header.Set("Content-Type", "application/octet-stream")
+		}
+		if _, err = s.do("PUT", s.key(name), nil, header, b); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *S3Storage) String() string {
+	return fmt.Sprintf("s3://%s/%s", s.Bucket, strings.Trim(s.Prefix, "/"))
+}
+
+func (s *S3Storage) key(name string) string {
+	if prefix := strings.Trim(s.Prefix, "/"); prefix != "" {
+		return prefix + "/" + name
+	}
+	return name
+}
+
+// list returns the keys of the objects directly under Prefix.
+func (s *S3Storage) list() (keys []string, err error) {
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("delimiter", "/")
+	if prefix := strings.Trim(s.Prefix, "/"); prefix != "" {
+		query.Set("prefix", prefix+"/")
+	}
+	for {
+		var b []byte
+		if b, err = s.do("GET", "", query, nil, nil); err != nil {
+			return
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err = xml.Unmarshal(b, &result); err != nil {
+			return
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		if !result.IsTruncated {
+			return
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s *S3Storage) do(method string, key string, query url.Values, header http.Header, body []byte) (respBody []byte, err error) {
+	u, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil {
+		return
+	}
+	u.Path += "/" + s.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	rawQuery := strings.Replace(query.Encode(), "+", "%20", -1)
+	u.RawQuery = rawQuery
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, u, rawQuery, body, time.Now().UTC())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if respBody, err = ioutil.ReadAll(resp.Body); err != nil {
+		return
+	}
+	if resp.StatusCode >= 300 {
+		err = fmt.Errorf("%s %s: %s: %s", method, u.Path, resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	return
+}
+
+// sign adds the AWS Signature Version 4 headers to req.
+func (s *S3Storage) sign(req *http.Request, u *url.URL, rawQuery string, body []byte, now time.Time) {
+	region := s.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		u.EscapedPath(),
+		rawQuery,
+		"host:" + u.Host + "\n" +
+			"x-amz-content-sha256:" + payloadHash + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+func sha256Hex(b []byte) string {
+	hash := sha256.Sum256(b)
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
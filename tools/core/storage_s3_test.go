@@ -0,0 +1,139 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an S3 compatible service with one bucket, which checks the
+// signatures of the requests and lists one object per page.
+type fakeS3 struct {
+	sync.Mutex
+	storage *S3Storage
+	objects map[string]string
+	types   map[string]string
+	failPut bool
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := f.checkSignature(r, body); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	bucket := "/" + f.storage.Bucket
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, bucket), "/")
+	switch {
+	case !strings.HasPrefix(r.URL.Path, bucket):
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+	case r.Method == "GET" && key == "":
+		var keys []string
+		for k := range f.objects {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		var start int
+		fmt.Sscan(r.URL.Query().Get("continuation-token"), &start)
+		fmt.Fprint(w, "<ListBucketResult>")
+		if start < len(keys) {
+			fmt.Fprintf(w, "<Contents><Key>%s</Key></Contents>", keys[start])
+		}
+		if start+1 < len(keys) {
+			fmt.Fprintf(w, "<IsTruncated>true</IsTruncated><NextContinuationToken>%d</NextContinuationToken>", start+1)
+		}
+		fmt.Fprint(w, "</ListBucketResult>")
+	case r.Method == "PUT" && f.failPut:
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+	case r.Method == "PUT":
+		f.objects[key] = string(body)
+		f.types[key] = r.Header.Get("Content-Type")
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// checkSignature signs the request again and compares the signatures.
+func (f *fakeS3) checkSignature(r *http.Request, body []byte) error {
+	if r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+		return fmt.Errorf("wrong payload hash")
+	}
+	now, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return err
+	}
+	u := &url.URL{Scheme: "http", Host: r.Host, Path: r.URL.Path, RawPath: r.URL.RawPath}
+	req, _ := http.NewRequest(r.Method, u.String(), nil)
+	f.storage.sign(req, u, r.URL.RawQuery, body, now)
+	if got, want := r.Header.Get("Authorization"), req.Header.Get("Authorization"); got != want {
+		return fmt.Errorf("signature mismatch: %s, want %s", got, want)
+	}
+	return nil
+}
+
+func TestS3Storage(t *testing.T) {
+	fake := &fakeS3{
+		objects: map[string]string{"users/stale": "stale", "users/kept": "old", "static/other": "other"},
+		types:   make(map[string]string),
+	}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	s := &S3Storage{
+		Endpoint:  srv.URL,
+		Region:    "eu-west-1",
+		Bucket:    "gdir",
+		Prefix:    "/users/",
+		AccessKey: "access",
+		SecretKey: "secret",
+	}
+	fake.storage = &S3Storage{Bucket: s.Bucket, Region: s.Region, AccessKey: s.AccessKey, SecretKey: s.SecretKey}
+	if want := srv.URL + "/gdir/users/"; s.URL() != want {
+		t.Errorf("URL() = %s, want %s", s.URL(), want)
+	}
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{"kept": "new", "added.json": "{}", ".hidden": "hidden"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deploy(dir); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"users/kept": "new", "users/added.json": "{}", "static/other": "other"}
+	if fmt.Sprint(fake.objects) != fmt.Sprint(want) {
+		t.Errorf("objects = %v, want %v", fake.objects, want)
+	}
+	if fake.types["users/added.json"] != "application/json" || fake.types["users/kept"] != "application/octet-stream" {
+		t.Errorf("content types = %v", fake.types)
+	}
+
+	fake.failPut = true
+	if err := s.Deploy(dir); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("deploying to a bucket denying access: %v", err)
+	}
+	fake.failPut = false
+	s.SecretKey = "wrong"
+	if err := s.Deploy(dir); err == nil {
+		t.Error("deploying with a wrong secret key did not fail")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"log"
 	"os"
@@ -15,17 +16,23 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
-	"syscall"
 
 	"github.com/cloudflare/cloudflare-go"
 	"github.com/google/go-github/v31/github"
-	"golang.org/x/crypto/ssh/terminal"
+	"github.com/workerindex/gdir/tools/prompt"
 	"golang.org/x/oauth2"
 )
 
 func LoadConfigFile() (err error) {
+	LoadConfigEnv()
+	if Config.Profile == DefaultProfile {
+		Config.Profile = ""
+	}
+	if Config.StateDir == "" {
+		Config.StateDir = DefaultStateDir()
+	}
 	if Config.ConfigFile == "" {
-		return
+		Config.ConfigFile = StatePath(ConfigFileName)
 	}
 
 	stat, err := os.Stat(Config.ConfigFile)
@@ -42,7 +49,7 @@ func LoadConfigFile() (err error) {
 		return
 	}
 
-	fmt.Printf("Loading existing config from %s\n", Config.ConfigFile)
+	fmt.Fprintf(os.Stderr, "Loading existing config from %s\n", Config.ConfigFile)
 
 	b, err := ioutil.ReadFile(Config.ConfigFile)
 	if err != nil {
@@ -58,25 +65,54 @@ func LoadConfigFile() (err error) {
 		return
 	}
 
+	if err = json.Unmarshal(b, &configTop); err != nil {
+		return
+	}
+
+	if Config.Profile != "" {
+		if err = useProfile(Config.Profile, Config.CreateProfile); err != nil {
+			return
+		}
+	}
+
 	// command line options overwrite config file options
 	if err = json.Unmarshal(clone, &Config); err != nil {
 		return
 	}
 
+	if err = ResolveConfigSecrets(); err != nil {
+		err = fmt.Errorf("%s: %w", Config.ConfigFile, err)
+		return
+	}
+
+	if err = validateKDFConfig(); err != nil {
+		err = fmt.Errorf("%s: %w", Config.ConfigFile, err)
+		return
+	}
+
+	return
+}
+
+// confirmSetting shows a setting, and clears it unless it is confirmed.
+func confirmSetting(label string, value *string) (err error) {
+	if *value == "" {
+		return
+	}
+	fmt.Printf("%s: %s\n", label, *value)
+	var yes bool
+	if yes, err = prompt.Confirm("Is it correct?", true); err == nil && !yes {
+		*value = ""
+	}
 	return
 }
 
 func EnterCloudflareEmail() (err error) {
-	if Config.CloudflareEmail != "" {
-		fmt.Println("Your Cloudflare login Email:", Config.CloudflareEmail)
-		if !PromptYesNoWithDefault("Is it correct?", true) {
-			Config.CloudflareEmail = ""
-		}
+	if err = confirmSetting("Your Cloudflare login Email", &Config.CloudflareEmail); err != nil {
+		return
 	}
 	if Config.CloudflareEmail == "" {
-		for loop := true; loop; loop = Config.CloudflareEmail == "" {
-			fmt.Printf("Your Cloudflare login Email: ")
-			fmt.Scanln(&Config.CloudflareEmail)
+		if Config.CloudflareEmail, err = prompt.Text("Your Cloudflare login Email", "", prompt.Required); err != nil {
+			return
 		}
 		fmt.Println("")
 		err = SaveConfigFile()
@@ -85,17 +121,13 @@ func EnterCloudflareEmail() (err error) {
 }
 
 func EnterCloudflareKey() (err error) {
-	if Config.CloudflareKey != "" {
-		fmt.Println("Your Cloudflare API Key:", Config.CloudflareKey)
-		if !PromptYesNoWithDefault("Is it correct?", true) {
-			Config.CloudflareKey = ""
-		}
+	if err = confirmSecret("Your Cloudflare API Key", "cf_key", &Config.CloudflareKey); err != nil {
+		return
 	}
 	if Config.CloudflareKey == "" {
-		for loop := true; loop; loop = Config.CloudflareKey == "" {
-			fmt.Println("Please visit https://dash.cloudflare.com/profile/api-tokens and get")
-			fmt.Printf("your Global API Key: ")
-			fmt.Scanln(&Config.CloudflareKey)
+		fmt.Println("Please visit https://dash.cloudflare.com/profile/api-tokens and get")
+		if err = EnterSecret("your Global API Key", "cf_key"); err != nil {
+			return
 		}
 		fmt.Println("")
 		err = SaveConfigFile()
@@ -104,44 +136,34 @@ func EnterCloudflareKey() (err error) {
 }
 
 func InitCloudflareAPI() (err error) {
-	Cf, err = cloudflare.New(Config.CloudflareKey, Config.CloudflareEmail)
+	Cf, err = newCloudflareAPI()
 	return
 }
 
 func SelectCloudflareAccount() (err error) {
-	if Config.CloudflareAccount != "" {
-		fmt.Println("Your selected Cloudflare account:", Config.CloudflareAccount)
-		if !PromptYesNoWithDefault("Is it correct?", true) {
-			Config.CloudflareAccount = ""
-		}
+	if err = confirmSetting("Your selected Cloudflare account", &Config.CloudflareAccount); err != nil {
+		return
 	}
 	if Config.CloudflareAccount == "" {
-		var line string
-		var selection uint64
 		var accounts []cloudflare.Account
 		if accounts, _, err = Cf.Accounts(cloudflare.PaginationOptions{}); err != nil {
 			return
 		}
 		if len(accounts) == 0 {
-			err = fmt.Errorf("no accounts under your cloudflare")
-			return
+			return noCloudflareAccountsError()
 		}
 		if len(accounts) == 1 {
 			Config.CloudflareAccount = accounts[0].ID
 		} else {
-			fmt.Println("Your available Cloudflare accounts:")
+			options := make([]string, len(accounts))
 			for i, account := range accounts {
-				fmt.Printf("    (%d) %s [%s]\n", i+1, account.Name, account.ID)
+				options[i] = fmt.Sprintf("%s [%s]", account.Name, account.ID)
 			}
-			for {
-				fmt.Printf("Choose an account: ")
-				fmt.Scanln(&line)
-				if selection, err = strconv.ParseUint(line, 10, 64); err != nil {
-					continue
-				}
-				Config.CloudflareAccount = accounts[selection-1].ID
-				break
+			var choice int
+			if choice, err = prompt.Select("Your available Cloudflare accounts:", options, -1); err != nil {
+				return
 			}
+			Config.CloudflareAccount = accounts[choice].ID
 		}
 		if err = SaveConfigFile(); err != nil {
 			return
@@ -151,8 +173,9 @@ func SelectCloudflareAccount() (err error) {
 	return
 }
 
+var subdomainPattern = regexp.MustCompile(`^[a-zA-Z0-9\-_]+$`)
+
 func SetupCloudflareSubdomain() (err error) {
-	var line string
 	subdomain, err := Cf.GetSubdomain()
 	if err != nil {
 		return
@@ -160,19 +183,18 @@ func SetupCloudflareSubdomain() (err error) {
 	if subdomain == "" {
 		fmt.Printf("You don't have a Cloudflare subdomain yet. It's a free service provided\n")
 		fmt.Printf("by Cloudflare to host your workers. We are going to register one for you.\n")
-		for {
-			fmt.Printf("Please enter a name for your subdomain:")
-			fmt.Scanln(&line)
-			if !regexp.MustCompile(`^\s*[a-zA-Z0-9\-_]+\s*$`).MatchString(line) {
-				fmt.Printf("Invalid subdomain format!\n")
-				continue
+		_, err = prompt.Text("Please enter a name for your subdomain", "", func(answer string) error {
+			if !subdomainPattern.MatchString(answer) {
+				return fmt.Errorf("invalid subdomain format")
 			}
-			if err = Cf.RegisterSubdomain(strings.TrimSpace(line)); err != nil {
-				fmt.Printf("Cannot register this subdomain. Please try another one.\n")
-				err = nil
-				continue
+			if err := Cf.RegisterSubdomain(answer); err != nil {
+				return fmt.Errorf("cannot register this subdomain, please try another one")
 			}
-			break
+			subdomain = answer
+			return nil
+		})
+		if err != nil {
+			return
 		}
 	}
 	Config.CloudflareSubdomain = subdomain
@@ -181,93 +203,71 @@ func SetupCloudflareSubdomain() (err error) {
 }
 
 func SelectWorker() (err error) {
-	if Config.CloudflareWorker != "" {
-		fmt.Println("Your selected Cloudflare Worker ID:", Config.CloudflareWorker)
-		if !PromptYesNoWithDefault("Is it correct?", true) {
-			Config.CloudflareWorker = ""
-		}
+	if err = confirmSetting("Your selected Cloudflare Worker ID", &Config.CloudflareWorker); err != nil {
+		return
 	}
 	if Config.CloudflareWorker == "" {
-		var line string
-		var selection uint64
 		var resp cloudflare.WorkerListResponse
 		if resp, err = Cf.ListWorkerScripts(); err != nil {
 			return
 		}
 		if len(resp.WorkerList) == 0 {
-			err = EnterNewWorkerName()
-		} else {
-			fmt.Println("Your available Cloudflare Workers:")
-			for i, worker := range resp.WorkerList {
-				fmt.Printf("    (%d) %s\n", i+1, worker.ID)
-			}
-			fmt.Println("    (0) Create a new Worker     (Default)")
-			for {
-				fmt.Printf("Choose one of above: ")
-				fmt.Scanln(&line)
-				if regexp.MustCompile(`^\s*$`).MatchString(line) {
-					err = EnterNewWorkerName()
-					break
-				}
-				if selection, err = strconv.ParseUint(line, 10, 64); err != nil {
-					continue
-				}
-				if selection == 0 {
-					err = EnterNewWorkerName()
-					break
-				} else {
-					Config.CloudflareWorker = resp.WorkerList[selection-1].ID
-					break
-				}
-			}
-			if err = SaveConfigFile(); err != nil {
-				return
-			}
+			return EnterNewWorkerName()
+		}
+		options := []string{"Create a new Worker"}
+		for _, worker := range resp.WorkerList {
+			options = append(options, worker.ID)
 		}
+		var choice int
+		if choice, err = prompt.Select("Your available Cloudflare Workers:", options, 0); err != nil {
+			return
+		}
+		if choice == 0 {
+			return EnterNewWorkerName()
+		}
+		Config.CloudflareWorker = resp.WorkerList[choice-1].ID
+		return SaveConfigFile()
 	}
 	return
 }
 
 func EnterNewWorkerName() (err error) {
-	var line string
-
 	fmt.Println("Naming rule:")
-
 	fmt.Println("    start with a letter")
-	var rule1 = regexp.MustCompile(`^[[:alpha:]]`)
-
 	fmt.Println("    end with a letter or digit")
-	var rule2 = regexp.MustCompile(`\w$`)
-
 	fmt.Println("    include only letters, digits, underscore, and hyphen")
-	var rule3 = regexp.MustCompile(`^[\w_-]+$`)
-
 	fmt.Println("    be 63 characters or less")
 
-	for {
-		fmt.Printf("Please enter a name for your new Worker: ")
-		fmt.Scanln(&line)
-		line = strings.TrimSpace(line)
-		if len(line) <= 63 && rule1.MatchString(line) && rule2.MatchString(line) && rule3.MatchString(line) {
-			break
+	Config.CloudflareWorker, err = prompt.Text("Please enter a name for your new Worker", "", func(answer string) error {
+		if !ValidWorkerName(answer) {
+			return fmt.Errorf("invalid Worker name: %s", answer)
 		}
+		return nil
+	})
+	if err != nil {
+		return
 	}
-	Config.CloudflareWorker = line
 	return SaveConfigFile()
 }
 
+var (
+	workerNameRule1 = regexp.MustCompile(`^[[:alpha:]]`)
+	workerNameRule2 = regexp.MustCompile(`\w$`)
+	workerNameRule3 = regexp.MustCompile(`^[\w_-]+$`)
+)
+
+func ValidWorkerName(name string) bool {
+	return len(name) <= 63 && workerNameRule1.MatchString(name) && workerNameRule2.MatchString(name) && workerNameRule3.MatchString(name)
+}
+
 func EnterGistToken() (err error) {
-	if Config.GistToken != "" {
-		fmt.Println("Your GitHub Gist Token:", Config.GistToken)
-		if !PromptYesNoWithDefault("Is it correct?", true) {
-			Config.GistToken = ""
-		}
+	if err = confirmSecret("Your GitHub Gist Token", "gist_token", &Config.GistToken); err != nil {
+		return
 	}
 	if Config.GistToken == "" {
-		for loop := true; loop; loop = Config.GistToken == "" {
-			fmt.Println("Please visit https://github.com/settings/tokens and generate a new")
-			fmt.Printf("token with \"gist\" scope: ")
-			fmt.Scanln(&Config.GistToken)
+		fmt.Println("Please visit https://github.com/settings/tokens and generate a new")
+		if err = EnterSecret("token with \"gist\" scope", "gist_token"); err != nil {
+			return
 		}
 		fmt.Println("")
 		err = SaveConfigFile()
@@ -286,28 +286,21 @@ func InitGitHubAPI() (err error) {
 }
 
 func EnterAccoutsGist(name string, conf *string) (err error) {
-	if *conf != "" {
-		fmt.Printf("Your %s Gist: %s\n", name, *conf)
-		if !PromptYesNoWithDefault("Is it correct?", true) {
-			*conf = ""
-		}
+	if err = confirmSetting(fmt.Sprintf("Your %s Gist", name), conf); err != nil {
+		return
 	}
 	if *conf == "" {
-		fmt.Printf("Specify how you want to configure your %s Gist:\n", name)
-		fmt.Println("    (1) Create a new Gist                   (default)")
-		fmt.Println("    (2) Enter an existing Gist URL / ID")
-		for {
-			var line string
-			fmt.Printf("Please enter your choice: ")
-			fmt.Scanln(&line)
-			if regexp.MustCompile(`^\s*$`).MatchString(line) || regexp.MustCompile(`^\s*1\s*$`).MatchString(line) {
-				err = CreateNewGist(name, conf)
-				break
-			} else if regexp.MustCompile(`^\s*2\s*$`).MatchString(line) {
-				err = EnterGistID(name, conf)
-				break
-			}
+		var choice int
+		if choice, err = prompt.Select(fmt.Sprintf("Specify how you want to configure your %s Gist:", name), []string{
+			"Create a new Gist",
+			"Enter an existing Gist URL / ID",
+		}, 0); err != nil {
+			return
 		}
+		if choice == 0 {
+			return CreateNewGist(name, conf)
+		}
+		return EnterGistID(name, conf)
 	}
 	return
 }
@@ -327,27 +320,35 @@ func CreateNewGist(name string, conf *string) (err error) {
 	}
 	if Config.Debug {
 		b, _ := json.MarshalIndent(gist, "", "    ")
-		log.Printf("Created new Gist for %s:\n", name, string(b))
+		log.Printf("Created new Gist for %s:\n%s", name, string(b))
 	}
 	*conf = *gist.ID
 	return SaveConfigFile()
 }
 
 func EnterGistID(name string, conf *string) (err error) {
-	var id string
-	for {
-		fmt.Printf("Please enter a Gist URL / ID for %s: ", name)
-		fmt.Scanln(&id)
-		if id, err = ParseGistID(id); err != nil {
-			continue
-		}
-		break
+	_, err = prompt.Text(fmt.Sprintf("Please enter a Gist URL / ID for %s", name), "", func(answer string) (err error) {
+		*conf, err = ParseGistID(answer)
+		return
+	})
+	if err != nil {
+		return
 	}
 	return SaveConfigFile()
 }
 
 func GetGistUser() (err error) {
-	gist, _, err := Gh.Gists.Get(context.Background(), Config.GistID.Accounts)
+	var gistID string
+	for _, kind := range StorageKinds {
+		if StorageType(kind) == StorageGist {
+			gistID = *GistIDOf(kind)
+			break
+		}
+	}
+	if gistID == "" {
+		return
+	}
+	gist, _, err := Gh.Gists.Get(context.Background(), gistID)
 	if err != nil {
 		return
 	}
@@ -356,30 +357,23 @@ func GetGistUser() (err error) {
 }
 
 func ConfigureSecretKey() (err error) {
-	if Config.SecretKey != "" {
-		fmt.Println("Your gdir secret key:", Config.SecretKey)
-		if !PromptYesNoWithDefault("Is it correct?", true) {
-			Config.SecretKey = ""
-		}
+	if err = confirmSecret("Your gdir secret key", "secret_key", &Config.SecretKey); err != nil {
+		return
 	}
 	if Config.SecretKey == "" {
-		fmt.Println("Specify how you want to configure your gdir secret key:")
-		fmt.Println("    (1) Generate secure random value           (default)")
-		fmt.Println("    (2) Enter your own secret key      (not recommended)")
-		for {
-			var line string
-			fmt.Printf("Please enter your choice: ")
-			fmt.Scanln(&line)
-			if regexp.MustCompile(`^\s*$`).MatchString(line) || regexp.MustCompile(`^\s*1\s*$`).MatchString(line) {
-				err = GenerateSecretKey()
-				break
-			} else if regexp.MustCompile(`^\s*2\s*$`).MatchString(line) {
-				err = EnterSecretKey()
-				break
-			}
+		var choice int
+		if choice, err = prompt.Select("Specify how you want to configure your gdir secret key:", []string{
+			"Generate secure random value",
+			"Enter your own secret key      (not recommended)",
+		}, 0); err != nil {
+			return
 		}
+		if choice == 0 {
+			return GenerateSecretKey()
+		}
+		return EnterSecretKey()
 	}
-	return
+	return EnsureKDFConfig()
 }
 
 func GenerateSecretKey() (err error) {
@@ -389,95 +383,68 @@ func GenerateSecretKey() (err error) {
 	}
 	Config.SecretKey = hex.EncodeToString(b)
 	if Config.Debug {
-		log.Printf("Generated secret key: %s", Config.SecretKey)
+		log.Printf("Generated secret key: %s", MaskSecret(Config.SecretKey))
+	}
+	if Config.KDF, err = NewKDFConfig(KDFTypeHKDF); err != nil {
+		return
 	}
 	return SaveConfigFile()
 }
 
+// EnterSecretKey asks for a passphrase, which is stretched with Argon2id.
 func EnterSecretKey() (err error) {
-	var line string
-	fmt.Printf("Please enter your secure gdir master secret key: ")
-	fmt.Scanln(&line)
-	Config.SecretKey = strings.TrimSpace(line)
+	if err = EnterSecret("Please enter your secure gdir master secret key", "secret_key"); err != nil {
+		return
+	}
+	if Config.KDF, err = NewKDFConfig(KDFTypeArgon2id); err != nil {
+		return
+	}
 	return SaveConfigFile()
 }
 
-func ConfigureAccountRotation() (err error) {
-	var line string
-	if Config.AccountRotationStr != "" {
-		Config.AccountRotation = 0
-		line = Config.AccountRotationStr
-	} else if Config.AccountRotation > 0 {
-		fmt.Println("Account candidates rotations interval:", Config.AccountRotation)
-		if !PromptYesNoWithDefault("Is it correct?", true) {
-			Config.AccountRotation = 0
-		}
-	}
-	if Config.AccountRotation == 0 {
-		for {
-			if line == "" {
-				fmt.Printf("Please enter account candidates rotations interval (default 60): ")
-				fmt.Scanln(&line)
-			}
-			line = strings.TrimSpace(line)
-			if line == "" {
-				Config.AccountRotation = 60
-				break
-			}
-			if Config.AccountRotation, err = strconv.ParseUint(line, 10, 64); err == nil {
-				break
-			}
-			line = ""
+// configureUint sets a number setting from value, given on the command line,
+// or asks for it unless it is set and confirmed.
+func configureUint(label string, setting *uint64, value string, def uint64) (err error) {
+	parse := func(answer string) (err error) {
+		*setting, err = strconv.ParseUint(answer, 10, 64)
+		return
+	}
+	if value != "" {
+		if err = parse(strings.TrimSpace(value)); err == nil {
+			return SaveConfigFile()
 		}
-		err = SaveConfigFile()
+		fmt.Printf("Invalid %s: %s\n", strings.ToLower(label), value)
+		*setting = 0
+	} else if *setting > 0 {
+		fmt.Printf("%s: %d\n", label, *setting)
+		var yes bool
+		if yes, err = prompt.Confirm("Is it correct?", true); err != nil || yes {
+			return
+		}
+		*setting = 0
 	}
-	return
+	if _, err = prompt.Text("Please enter "+strings.ToLower(label), strconv.FormatUint(def, 10), parse); err != nil {
+		return
+	}
+	return SaveConfigFile()
+}
+
+func ConfigureAccountRotation() (err error) {
+	return configureUint("Account candidates rotations interval", &Config.AccountRotation, Config.AccountRotationStr, 60)
 }
 
 func ConfigureAccountCandidates() (err error) {
-	var line string
-	if Config.AccountCandidatesStr != "" {
-		Config.AccountCandidates = 0
-		line = Config.AccountCandidatesStr
-	} else if Config.AccountCandidates > 0 {
-		fmt.Println("Account candidates size:", Config.AccountCandidates)
-		if !PromptYesNoWithDefault("Is it correct?", true) {
-			Config.AccountCandidates = 0
-		}
-	}
-	if Config.AccountCandidates == 0 {
-		for {
-			if line == "" {
-				fmt.Printf("Please enter account candidates size (default 10): ")
-				fmt.Scanln(&line)
-			}
-			line = strings.TrimSpace(line)
-			if line == "" {
-				Config.AccountCandidates = 10
-				break
-			}
-			if Config.AccountCandidates, err = strconv.ParseUint(line, 10, 64); err == nil {
-				break
-			}
-			line = ""
-		}
-		err = SaveConfigFile()
-	}
-	return
+	return configureUint("Account candidates size", &Config.AccountCandidates, Config.AccountCandidatesStr, 10)
 }
 
 func EnterAccountsJSONDir() (err error) {
-	if Config.AccountsJSONDir != "" {
-		fmt.Println("Your Accounts JSON directory:", Config.AccountsJSONDir)
-		if !PromptYesNoWithDefault("Is it correct?", true) {
-			Config.AccountsJSONDir = ""
-		}
+	if err = confirmSetting("Your Accounts JSON directory", &Config.AccountsJSONDir); err != nil {
+		return
 	}
 	if Config.AccountsJSONDir == "" {
-		for loop := true; loop; loop = Config.AccountsJSONDir == "" {
-			fmt.Println("Please follow https://github.com/xyou365/AutoRclone to generate")
-			fmt.Printf("Accounts JSON directory: ")
-			fmt.Scanln(&Config.AccountsJSONDir)
+		fmt.Println("Please follow https://github.com/xyou365/AutoRclone to generate")
+		if Config.AccountsJSONDir, err = prompt.Text("Accounts JSON directory", "", prompt.Required); err != nil {
+			return
 		}
 		fmt.Println("")
 		err = SaveConfigFile()
@@ -487,289 +454,139 @@ func EnterAccountsJSONDir() (err error) {
 
 func ProcessAccountsJSONDir() (err error) {
 	if Config.AccountsCount > 0 {
-		if PromptYesNoWithDefault(fmt.Sprintf("You have added %d accounts, do you want to re-scan for new accounts?", Config.AccountsCount), false) {
-			Config.AccountsCount = 0
-		}
-	}
-	if Config.AccountsCount == 0 {
-		var files []os.FileInfo
-		var inPath string
-		var inBytes []byte
-		var outBytes []byte
-		if files, err = ioutil.ReadDir(Config.AccountsJSONDir); err != nil {
+		var yes bool
+		if yes, err = prompt.Confirm(fmt.Sprintf("You have added %d accounts, do you want to re-scan for new accounts?", Config.AccountsCount), false); err != nil || !yes {
 			return
 		}
-
-		if _, err = os.Stat("accounts"); os.IsNotExist(err) {
-			if err = os.MkdirAll("accounts", 0700); err != nil {
-				return
-			}
-		}
-
-		for i, file := range files {
-			if !file.IsDir() && strings.HasSuffix(file.Name(), ".json") && file.Size() > 0 {
-				inPath = filepath.Join(Config.AccountsJSONDir, file.Name())
-				fmt.Printf("Encrypting account %d: %s\n", i, file.Name())
-
-				if inBytes, err = ioutil.ReadFile(inPath); err != nil {
-					return
-				}
-
-				if outBytes, err = GCMEncrypt(Config.SecretKey, "account", inBytes); err != nil {
-					return
-				}
-
-				if err = ioutil.WriteFile(filepath.Join("accounts", fmt.Sprintf("%d", i)), outBytes, 0600); err != nil {
-					return
-				}
-				Config.AccountsCount++
-			}
-		}
-		err = SaveConfigFile()
 	}
+	added, err := AddAccounts(Config.AccountsJSONDir)
+	if err != nil {
+		return
+	}
+	fmt.Printf("%d new accounts, %d accounts in total\n", added, Config.AccountsCount)
 	return
 }
 
 func ConfigureAdminUser() (err error) {
 	var user User
-	var files []os.FileInfo
-	var bytePassword []byte
-	if _, err = os.Stat("users"); !os.IsNotExist(err) {
-		if files, err = ioutil.ReadDir("users"); err != nil {
-			return
-		}
-		for _, file := range files {
-			if !file.IsDir() {
-				return
-			}
-		}
-	} else {
-		if err = os.MkdirAll("users", 0700); err != nil {
-			return
-		}
+	var found bool
+	if found, err = HasUsers(); err != nil || found {
+		return
+	}
+	if err = os.MkdirAll(ArtifactPath("users"), 0700); err != nil {
+		return
 	}
 	fmt.Println("Add an admin user...")
-	for loop := true; loop; loop = user.Name == "" {
-		fmt.Printf("Please enter your admin user name: ")
-		fmt.Scanln(&user.Name)
+	user.Role = RoleAdmin
+	if user.Name, err = prompt.Text("Please enter your admin user name", "", prompt.Required); err != nil {
+		return
+	}
+	if user.Pass, err = prompt.Secret("Please enter your admin user password", prompt.Required); err != nil {
+		return
+	}
+	return SaveUser(&user)
+}
+
+// HasUsers reports whether any user file has been saved.
+func HasUsers() (found bool, err error) {
+	var files []os.FileInfo
+	if _, err = os.Stat(ArtifactPath("users")); os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if files, err = ioutil.ReadDir(ArtifactPath("users")); err != nil {
+		return
 	}
-	for loop := true; loop; loop = user.Pass == "" {
-		fmt.Printf("Please enter your admin user password: ")
-		if bytePassword, err = terminal.ReadPassword(int(syscall.Stdin)); err != nil {
+	for _, file := range files {
+		if !file.IsDir() {
+			found = true
 			return
 		}
-		fmt.Println()
-		user.Pass = string(bytePassword)
 	}
-	return SaveUser(&user)
+	return
 }
 
 func ComputeUserPath(name string) (userPath string, err error) {
+	userPath = filepath.Join(ArtifactPath("users"), UserFileName(MasterSecret(), name))
+	return
+}
+
+// UserFileName is the name of the user file, which the worker computes from
+// the login name.
+func UserFileName(secret string, name string) string {
 	hash := sha256.New()
-	hash.Write([]byte(Config.SecretKey))
+	hash.Write([]byte(secret))
 	hash.Write([]byte(name))
-	userPath = filepath.Join("users", hex.EncodeToString(hash.Sum(nil)))
-	return
+	return hex.EncodeToString(hash.Sum(nil))
 }
 
+// ConfigureUserAccess asks whether the user may access all drives, or a
+// white-list or black-list of drives, and edits the list.
 func ConfigureUserAccess(user *User) (err error) {
-	for {
-		confirmed := false
-		if len(user.DrivesWhiteList) > 0 {
-			if confirmed, err = ConfigureUserAccessList("white-list", &user.DrivesWhiteList, "black-list", &user.DrivesBlackList); err != nil {
-				return
-			}
-		} else if len(user.DrivesBlackList) > 0 {
-			if confirmed, err = ConfigureUserAccessList("black-list", &user.DrivesBlackList, "white-list", &user.DrivesWhiteList); err != nil {
-				return
-			}
-		} else {
-			var line string
-			var drives []string
-			fmt.Println("The user currently has global access to all drives.")
-			fmt.Println("Please specify what do you want to do with it:")
-			fmt.Println("    (1) Confirm                         (default)")
-			fmt.Println("    (2) Convert to white-list access control list")
-			fmt.Println("    (3) Convert to black-list access control list")
-			fmt.Printf("Please enter your choice: ")
-			fmt.Scanln(&line)
-			if line == "1" || line == "" {
-				confirmed = true
-			} else if line == "2" {
-				fmt.Println("(Use comma to separate between drive IDs.)")
-				fmt.Printf("Enter white-list access control list of drives: ")
-				fmt.Scanln(&line)
-				drives = strings.Split(line, ",")
-				for i, drive := range drives {
-					drives[i] = strings.TrimSpace(drive)
-				}
-				user.DrivesWhiteList = drives
-			} else if line == "3" {
-				fmt.Println("(Use comma to separate between drive IDs.)")
-				fmt.Printf("Enter black-list access control list of drives: ")
-				fmt.Scanln(&line)
-				drives = strings.Split(line, ",")
-				for i, drive := range drives {
-					drives[i] = strings.TrimSpace(drive)
-				}
-				user.DrivesBlackList = drives
-			}
-		}
-		if confirmed {
-			break
-		}
+	mode := 0
+	if len(user.DrivesWhiteList) > 0 {
+		mode = 1
+	} else if len(user.DrivesBlackList) > 0 {
+		mode = 2
+	}
+	if mode, err = prompt.Select("Specify which drives the user can access:", []string{
+		"All drives",
+		"Only the drives of a white-list",
+		"All drives but those of a black-list",
+	}, mode); err != nil {
+		return
 	}
-	return
-}
-
-func ConfigureUserAccessList(targetListName string, targetList *[]string, counterListName string, counterList *[]string) (confirmed bool, err error) {
-	var line string
-	var drives []string
-	*counterList = nil
-	fmt.Printf("The user currently has following drives in its %s access list:\n", targetListName)
-	for i, drive := range *targetList {
-		fmt.Printf("    (%d) %s\n", i+1, drive)
-	}
-	fmt.Println("Please specify what do you want to do with it:")
-	fmt.Println("    (1) Confirm                         (default)")
-	fmt.Println("    (2) Append drives to the list")
-	fmt.Println("    (3) Remove drives from the list")
-	fmt.Println("    (4) Replace with a new list of drives")
-	fmt.Printf("    (5) Convert to %s access control\n", counterListName)
-	fmt.Println("    (6) Disable access control on the user")
-	fmt.Printf("Please enter your choice: ")
-	fmt.Scanln(&line)
-	if line == "1" || line == "" {
-		confirmed = true
-	} else if line == "2" {
-		fmt.Println("(Use comma to separate between drive IDs.)")
-		fmt.Printf("Append drives to %s access list: ", targetListName)
-		fmt.Scanln(&line)
-		drives = strings.Split(line, ",")
-		for _, drive := range drives {
-			found := false
-			drive = strings.TrimSpace(drive)
-			for _, d := range *targetList {
-				if d == drive {
-					found = true
-					break
-				}
-			}
-			if !found {
-				*targetList = append(*targetList, drive)
-			}
-		}
-	} else if line == "3" {
-		idxs := []uint64{}
-		drives = []string{}
-		for {
-			fmt.Println("(Enter numbers from the list above)")
-			fmt.Println("(Use comma to separate between selections)")
-			fmt.Printf("Remove drives from %s access list: ", targetListName)
-			fmt.Scanln(&line)
-			valid := true
-			for _, idx := range strings.Split(line, ",") {
-				var i uint64
-				if i, err = strconv.ParseUint(idx, 10, 64); err != nil {
-					err = nil
-					valid = false
-				}
-				idxs = append(idxs, i)
-			}
-			if valid {
-				break
-			}
-		}
-		for i, drive := range *targetList {
-			found := false
-			for _, idx := range idxs {
-				if uint64(i+1) == idx {
-					found = true
-					break
-				}
-			}
-			if !found {
-				drives = append(drives, drive)
-			}
-		}
-		*targetList = drives
-	} else if line == "4" {
-		fmt.Println("(Use comma to separate between drive IDs.)")
-		fmt.Printf("New %s access list of drives: ", targetListName)
-		fmt.Scanln(&line)
-		drives = strings.Split(line, ",")
-		for i, drive := range drives {
-			drives[i] = strings.TrimSpace(drive)
-		}
-		*targetList = drives
-	} else if line == "5" {
-		fmt.Printf("Converting from %s access list into %s access list...\n", targetListName, counterListName)
-		*counterList = *targetList
-		*targetList = nil
-	} else if line == "6" {
-		fmt.Println("Removing access control list from the user...")
-		*counterList = nil
-		*targetList = nil
+	// the drives of a list are kept when converting it to the other list
+	drives := append(user.DrivesWhiteList, user.DrivesBlackList...)
+	user.DrivesWhiteList, user.DrivesBlackList = nil, nil
+	switch mode {
+	case 1:
+		user.DrivesWhiteList, err = prompt.EditList(drivesList("white-list of drives"), drives)
+	case 2:
+		user.DrivesBlackList, err = prompt.EditList(drivesList("black-list of drives"), drives)
 	}
 	return
 }
 
+// SaveUser encrypts a user into its file and adds it to the users index. A
+// plaintext password is hashed and the policy is resolved first.
 func SaveUser(user *User) (err error) {
 	var b []byte
 	var userPath string
+	if err = user.HashPassword(); err != nil {
+		return
+	}
+	if _, err = ResolveUserPolicy(user); err != nil {
+		return
+	}
 	if userPath, err = ComputeUserPath(user.Name); err != nil {
 		return
 	}
+	if err = os.MkdirAll(filepath.Dir(userPath), 0700); err != nil {
+		return
+	}
 	fmt.Printf("Saving user to %s ...\n", userPath)
 	if b, err = json.Marshal(&user); err != nil {
 		return
 	}
-	if b, err = GCMEncrypt(Config.SecretKey, "user", b); err != nil {
+	if b, err = GCMEncrypt(MasterSecret(), "user", b); err != nil {
 		return
 	}
-	return ioutil.WriteFile(userPath, b, 0600)
-}
-
-func DeployGist(dir string, gistID string) (err error) {
-	if err = os.MkdirAll(dir, 0700); err != nil {
+	if err = ioutil.WriteFile(userPath, b, 0600); err != nil {
 		return
 	}
-	if _, err = os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
-		fmt.Printf("Initializing Git repo in %s...\n", dir)
-		if err = InitGitRepo(
-			dir,
-			fmt.Sprintf("https://gist.github.com/%s.git", gistID),
-			fmt.Sprintf("git@gist.github.com:%s.git", gistID),
-		); err != nil {
-			return
-		}
-	}
-	cmd := exec.Command("git", "remote", "get-url", "origin")
-	cmd.Dir = dir
-	gitURL, err := cmd.Output()
+	x, err := LoadUsersIndex()
 	if err != nil {
 		return
 	}
-	currentID, _ := ParseGistID(string(gitURL))
-	if currentID != gistID {
-		doSetURL := true
-		if currentID != "" {
-			fmt.Printf("Current %s directory is linked with Git: %s\n", string(gitURL))
-			if !PromptYesNoWithDefault(fmt.Sprintf("Replace it with your new Gist ID: %s?", gistID), true) {
-				doSetURL = false
-			}
-		}
-		if doSetURL {
-			if err = SetGitURL(
-				dir,
-				fmt.Sprintf("https://gist.github.com/%s.git", gistID),
-				fmt.Sprintf("git@gist.github.com:%s.git", gistID),
-			); err != nil {
-				return
-			}
-		}
-	}
-	cmd = exec.Command("git", "rev-list", "-n1", "--all")
+	x.Put(user)
+	return x.Save()
+}
+
+// PushGitRepo commits everything in dir and force pushes it to branch of
+// origin, unless there is nothing to commit.
+func PushGitRepo(dir string, branch string, target string) (err error) {
+	cmd := exec.Command("git", "rev-list", "-n1", "--all")
 	cmd.Dir = dir
 	revList, err := cmd.Output()
 	if err != nil {
@@ -796,7 +613,7 @@ func DeployGist(dir string, gistID string) (err error) {
 	if !orphan && !dirty {
 		return
 	}
-	fmt.Printf("Deploying %s to Gist...\n", dir)
+	fmt.Printf("Deploying %s to %s...\n", dir, target)
 	cmd = exec.Command("git", "add", ".")
 	cmd.Dir = dir
 	cmd.Stdout = os.Stdout
@@ -808,16 +625,19 @@ func DeployGist(dir string, gistID string) (err error) {
 	cmd.Dir = dir
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	_ = cmd.Run()
-	cmd = exec.Command("git", "push", "-f", "-u", "origin", "master")
+	if err = cmd.Run(); err != nil {
+		return
+	}
+	cmd = exec.Command("git", "push", "-f", "-u", "origin", "HEAD:"+branch)
 	cmd.Dir = dir
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	_ = cmd.Run()
+	err = cmd.Run()
 	return
 }
 
-func InitGitRepo(dir string, httpsRemote string, sshRemote string) (err error) {
+// InitGitRepo runs git init in dir with the committer gdir uses.
+func InitGitRepo(dir string) (err error) {
 	cmd := exec.Command("git", "init")
 	cmd.Dir = dir
 	cmd.Stdout = os.Stdout
@@ -836,29 +656,11 @@ func InitGitRepo(dir string, httpsRemote string, sshRemote string) (err error) {
 	cmd.Dir = dir
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	if err = cmd.Run(); err != nil {
-		return
-	}
-	return SetGitURL(dir, httpsRemote, sshRemote)
+	err = cmd.Run()
+	return
 }
 
-func SetGitURL(dir, httpsRemote string, sshRemote string) (err error) {
-	var remote string
-	fmt.Printf("Specify which protocol you want to configure your %s Git repo:\n", dir)
-	fmt.Println("    (1) HTTPS                                  (default)")
-	fmt.Println("    (2) SSH            (needs SSH key setup with GitHub)")
-	for {
-		var line string
-		fmt.Printf("Please enter your choice: ")
-		fmt.Scanln(&line)
-		if regexp.MustCompile(`^\s*$`).MatchString(line) || regexp.MustCompile(`^\s*1\s*$`).MatchString(line) {
-			remote = httpsRemote
-			break
-		} else if regexp.MustCompile(`^\s*2\s*$`).MatchString(line) {
-			remote = sshRemote
-			break
-		}
-	}
+func SetGitRemote(dir string, remote string) (err error) {
 	if Config.Debug {
 		log.Printf("Initialize %s with Git URL: %s", dir, remote)
 	}
@@ -876,10 +678,20 @@ func SetGitURL(dir, httpsRemote string, sshRemote string) (err error) {
 }
 
 func CopyStaticFiles() (err error) {
-	if err = os.MkdirAll("static", 0700); err != nil {
+	static, err := StaticDist()
+	if err != nil {
 		return
 	}
-	files, err := ioutil.ReadDir("static")
+	return replaceStaticFiles(static, ArtifactPath("static"))
+}
+
+// replaceStaticFiles replaces the static files in dst with those of src. The
+// git repositories of both are left out, as dst may be pushed to its own.
+func replaceStaticFiles(src fs.FS, dst string) (err error) {
+	if err = os.MkdirAll(dst, 0700); err != nil {
+		return
+	}
+	files, err := ioutil.ReadDir(dst)
 	if err != nil {
 		return
 	}
@@ -887,47 +699,108 @@ func CopyStaticFiles() (err error) {
 		if file.Name() == ".git" {
 			continue
 		}
-		if err = os.RemoveAll(filepath.Join("static", file.Name())); err != nil {
+		if err = os.RemoveAll(filepath.Join(dst, file.Name())); err != nil {
 			return
 		}
 	}
-	err = CopyDir("dist/static", "static")
-	return
+	return fs.WalkDir(src, ".", func(name string, d fs.DirEntry, err error) error {
+		switch {
+		case err != nil || name == ".":
+			return err
+		case d.Name() == ".git" && d.IsDir():
+			return fs.SkipDir
+		case d.Name() == ".git":
+			return nil
+		case d.IsDir():
+			return os.MkdirAll(filepath.Join(dst, filepath.FromSlash(name)), 0700)
+		}
+		b, err := fs.ReadFile(src, name)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(dst, filepath.FromSlash(name)), b, 0644)
+	})
+}
+
+func GistRawURL(gistID string) string {
+	return fmt.Sprintf("https://gist.githubusercontent.com/%s/%s/raw/", Config.GistUser, gistID)
 }
 
-func DeployWorker() (err error) {
-	b, err := ioutil.ReadFile("dist/worker.js")
+// DeployWorker uploads and publishes the worker, and returns its script and
+// bindings.
+func DeployWorker() (script string, bindings []WorkerBinding, err error) {
+	if script, err = WorkerScript(); err != nil {
+		return
+	}
+	if bindings, err = WorkerBindings(); err != nil {
+		return
+	}
+	dist, err := DescribeDist()
 	if err != nil {
 		return
 	}
-	r := strings.NewReplacer(
-		"__SECRET__", Config.SecretKey,
-		"__ACCOUNTS_COUNT__", strconv.FormatUint(Config.AccountsCount, 10),
-		"__ACCOUNT_ROTATION__", strconv.FormatUint(Config.AccountRotation, 10),
-		"__ACCOUNT_CANDIDATES__", strconv.FormatUint(Config.AccountCandidates, 10),
-		"__USERS_URL__", fmt.Sprintf("https://gist.githubusercontent.com/%s/%s/raw/", Config.GistUser, Config.GistID.Users),
-		"__STATIC_URL__", fmt.Sprintf("https://gist.githubusercontent.com/%s/%s/raw/", Config.GistUser, Config.GistID.Static),
-		"__ACCOUNTS_URL__", fmt.Sprintf("https://gist.githubusercontent.com/%s/%s/raw/", Config.GistUser, Config.GistID.Accounts),
-	)
-	script := r.Replace(string(b))
-	fmt.Printf("Deploying Cloudflare Worker %s...\n", Config.CloudflareWorker)
-	if _, err = Cf.UploadWorker(&cloudflare.WorkerRequestParams{
-		ScriptName: Config.CloudflareWorker,
-	}, string(script)); err != nil {
+	fmt.Printf("Deploying Cloudflare Worker %s from the %s...\n", Config.CloudflareWorker, dist)
+	if err = UploadWorker(script, bindings); err != nil {
 		return
 	}
 	if err = Cf.PublishWorker(Config.CloudflareWorker); err != nil {
 		return
 	}
-	fmt.Printf("\nYour gdir is now live at https://%s.%s.workers.dev\n", Config.CloudflareWorker, Config.CloudflareSubdomain)
-	fmt.Println("Check here to create custom routes with your own domain names:\nhttps://developers.cloudflare.com/workers/about/routes/")
+	if err = DeployWorkerRoutes(); err != nil {
+		return
+	}
+	at := "and at"
+	if url := WorkerURL(); url != "" {
+		fmt.Printf("\nYour gdir is now live at %s\n", url)
+	} else {
+		fmt.Printf("\nYour gdir is now live\n")
+		at = "at"
+	}
+	if len(Config.CloudflareRoutes) == 0 {
+		fmt.Println("Run setup again to add routes with your own domain names, see:\nhttps://developers.cloudflare.com/workers/about/routes/")
+	}
+	for _, pattern := range Config.CloudflareRoutes {
+		fmt.Printf("%s %s\n", at, pattern)
+	}
 	return
 }
 
+// WorkerURL returns the workers.dev URL of the worker, or nothing when the
+// account has no workers.dev subdomain. The subdomain is not saved in the
+// config, so it is looked up unless setup or deploy already did.
+func WorkerURL() string {
+	if Config.CloudflareSubdomain == "" {
+		subdomain, err := Cf.GetSubdomain()
+		if err != nil {
+			if Config.Debug {
+				log.Printf("Cannot look up the Cloudflare subdomain: %v", err)
+			}
+			return ""
+		}
+		Config.CloudflareSubdomain = subdomain
+	}
+	if Config.CloudflareSubdomain == "" {
+		return ""
+	}
+	return fmt.Sprintf("https://%s.%s.workers.dev", Config.CloudflareWorker, Config.CloudflareSubdomain)
+}
+
+// SaveConfigFile writes the config, with references instead of its secrets.
 func SaveConfigFile() (err error) {
+	restore, err := storeConfigSecrets()
+	if err != nil {
+		return
+	}
 	b, err := json.MarshalIndent(&Config, "", "    ")
+	if err == nil && Config.Profile != "" {
+		b, err = profileConfigFile(b)
+	}
+	restore()
 	if err != nil {
 		return
 	}
+	if err = os.MkdirAll(filepath.Dir(Config.ConfigFile), 0700); err != nil {
+		return
+	}
 	return ioutil.WriteFile(Config.ConfigFile, b, 0600)
 }
@@ -0,0 +1,384 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+// Types of UsageConfig.
+const (
+	UsageFile   = "file"
+	UsageKV     = "kv"
+	UsageMemory = "memory"
+)
+
+// DefaultUsageDir is the directory of the file usage store.
+const DefaultUsageDir = "usage"
+
+// UsageConfig selects where the daily usage of users is counted. The worker
+// can only count in a Workers KV namespace, and gdir serve in any store.
+type UsageConfig struct {
+	Type        string `json:"type,omitempty"`
+	Dir         string `json:"dir,omitempty"`
+	KVNamespace string `json:"kv_namespace,omitempty"`
+}
+
+// Usage is what a user has used on a day, in UTC.
+type Usage struct {
+	Day      string `json:"day"`
+	Requests int64  `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// UsageDay returns the day of t that daily limits count by.
+func UsageDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// UsageStore counts the usage of users, keyed by UsageKey. It only keeps the
+// usage of the last day a user has used.
+type UsageStore interface {
+	// Get returns the usage of a user on a day.
+	Get(key string, day string) (Usage, error)
+	// Add adds to the usage of a user on a day, and returns the new usage.
+	Add(key string, day string, requests int64, bytes int64) (Usage, error)
+	// Reset forgets the usage of a user.
+	Reset(key string) error
+}
+
+// UsageKey returns the key of a user in usage stores, which is the name of
+// the user file so that stores do not reveal user names.
+func UsageKey(secret string, name string) string {
+	return UserFileName(secret, name)
+}
+
+// NewUsageStore returns the store of Config.Usage, or nil when usage is not
+// counted.
+func NewUsageStore() (store UsageStore, err error) {
+	switch Config.Usage.Type {
+	case "":
+		return nil, nil
+	case UsageFile:
+		dir := ArtifactPath(DefaultUsageDir)
+		if Config.Usage.Dir != "" {
+			dir = StatePath(Config.Usage.Dir)
+		}
+		return &FileUsageStore{Dir: dir}, nil
+	case UsageKV:
+		if err = InitCloudflareAccount(); err != nil {
+			return
+		}
+		return &KVUsageStore{Namespace: Config.Usage.KVNamespace}, nil
+	case UsageMemory:
+		return &MemoryUsageStore{}, nil
+	}
+	return nil, fmt.Errorf("unknown usage store type: %s", Config.Usage.Type)
+}
+
+// UsageKVBinding is the name of the KV namespace binding the worker counts
+// usage in, or empty when the worker does not count usage.
+func UsageKVBinding() string {
+	if Config.Usage.Type != UsageKV {
+		return ""
+	}
+	return KVBinding("usage")
+}
+
+// MemoryUsageStore counts usage in memory, for tests and for gdir serve when
+// the usage may be lost on restarts.
+type MemoryUsageStore struct {
+	mu    sync.Mutex
+	usage map[string]Usage
+}
+
+func (s *MemoryUsageStore) Get(key string, day string) (usage Usage, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if usage = s.usage[key]; usage.Day != day {
+		usage = Usage{Day: day}
+	}
+	return
+}
+
+func (s *MemoryUsageStore) Add(key string, day string, requests int64, bytes int64) (usage Usage, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if usage = s.usage[key]; usage.Day != day {
+		usage = Usage{Day: day}
+	}
+	usage.Requests += requests
+	usage.Bytes += bytes
+	if s.usage == nil {
+		s.usage = make(map[string]Usage)
+	}
+	s.usage[key] = usage
+	return
+}
+
+func (s *MemoryUsageStore) Reset(key string) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.usage, key)
+	return
+}
+
+// FileUsageStore counts usage in a JSON file per user in Dir. Counts are
+// only consistent within a process.
+type FileUsageStore struct {
+	Dir string
+	mu  sync.Mutex
+}
+
+func (s *FileUsageStore) path(key string) string {
+	return filepath.Join(s.Dir, key+".json")
+}
+
+func (s *FileUsageStore) read(key string, day string) (usage Usage, err error) {
+	b, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return Usage{Day: day}, nil
+	}
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(b, &usage); err != nil {
+		return
+	}
+	if usage.Day != day {
+		usage = Usage{Day: day}
+	}
+	return
+}
+
+func (s *FileUsageStore) Get(key string, day string) (usage Usage, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read(key, day)
+}
+
+func (s *FileUsageStore) Add(key string, day string, requests int64, bytes int64) (usage Usage, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if usage, err = s.read(key, day); err != nil {
+		return
+	}
+	usage.Requests += requests
+	usage.Bytes += bytes
+	b, err := json.Marshal(&usage)
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(s.Dir, 0700); err != nil {
+		return
+	}
+	err = ioutil.WriteFile(s.path(key), b, 0600)
+	return
+}
+
+func (s *FileUsageStore) Reset(key string) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err = os.Remove(s.path(key)); os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
+// KVUsageStore counts usage in a Workers KV namespace, where the worker counts
+// it too. KV has no atomic increments, so concurrent requests may be missed.
+type KVUsageStore struct {
+	Namespace string
+}
+
+func (s *KVUsageStore) Get(key string, day string) (usage Usage, err error) {
+	b, err := Cf.ReadWorkersKV(context.Background(), s.Namespace, key)
+	if err != nil && strings.Contains(err.Error(), "HTTP status 404") {
+		return Usage{Day: day}, nil
+	}
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(b, &usage); err != nil {
+		return
+	}
+	if usage.Day != day {
+		usage = Usage{Day: day}
+	}
+	return
+}
+
+func (s *KVUsageStore) Add(key string, day string, requests int64, bytes int64) (usage Usage, err error) {
+	if usage, err = s.Get(key, day); err != nil {
+		return
+	}
+	usage.Requests += requests
+	usage.Bytes += bytes
+	b, err := json.Marshal(&usage)
+	if err != nil {
+		return
+	}
+	var resp cloudflare.Response
+	if resp, err = Cf.WriteWorkersKV(context.Background(), s.Namespace, key, b); err == nil && !resp.Success {
+		err = fmt.Errorf("cannot write usage to Workers KV namespace %s: %v", s.Namespace, resp.Errors)
+	}
+	return
+}
+
+func (s *KVUsageStore) Reset(key string) (err error) {
+	_, err = Cf.DeleteWorkersKV(context.Background(), s.Namespace, key)
+	if err != nil && strings.Contains(err.Error(), "HTTP status 404") {
+		err = nil
+	}
+	return
+}
+
+// Reasons of a LimitError.
+const (
+	LimitExpired  = "expired"
+	LimitRequests = "daily requests"
+	LimitBytes    = "daily bytes"
+)
+
+// LimitError is returned when a user has expired or reached a daily limit.
+type LimitError struct {
+	User   string
+	Reason string
+}
+
+func (e LimitError) Error() string {
+	if e.Reason == LimitExpired {
+		return fmt.Sprintf("user %s has expired", e.User)
+	}
+	return fmt.Sprintf("user %s has reached its limit of %s", e.User, e.Reason)
+}
+
+// Expired reports whether the user has expired at now.
+func (user *User) Expired(now time.Time) bool {
+	return user.ExpiresAt != nil && !now.Before(*user.ExpiresAt)
+}
+
+// CheckLimits returns a LimitError when the user has expired at now, or when
+// usage has reached its daily limit of requests, or of bytes for a transfer.
+func CheckLimits(user *User, usage Usage, now time.Time, transfer bool) error {
+	switch {
+	case user.Expired(now):
+		return LimitError{user.Name, LimitExpired}
+	case user.MaxDailyRequests > 0 && usage.Requests >= user.MaxDailyRequests:
+		return LimitError{user.Name, LimitRequests}
+	case transfer && user.MaxDailyBytes > 0 && usage.Bytes >= user.MaxDailyBytes:
+		return LimitError{user.Name, LimitBytes}
+	}
+	return nil
+}
+
+// Limiter enforces the expiry and the daily limits of users, counting their
+// usage in Store. Without a Store, it only enforces the expiry.
+type Limiter struct {
+	Store  UsageStore
+	Secret string
+	// Now replaces time.Now, e.g. in tests.
+	Now func() time.Time
+}
+
+func (l *Limiter) now() time.Time {
+	if l.Now != nil {
+		return l.Now()
+	}
+	return time.Now()
+}
+
+// Request checks the limits of a user before a request, which transfers file
+// contents with transfer, and counts the request.
+func (l *Limiter) Request(user *User, transfer bool) (err error) {
+	now := l.now()
+	if l.Store == nil {
+		return CheckLimits(user, Usage{}, now, transfer)
+	}
+	key, day := UsageKey(l.Secret, user.Name), UsageDay(now)
+	usage, err := l.Store.Get(key, day)
+	if err != nil {
+		return
+	}
+	if err = CheckLimits(user, usage, now, transfer); err != nil {
+		return
+	}
+	_, err = l.Store.Add(key, day, 1, 0)
+	return
+}
+
+// Transferred counts the bytes of file contents transferred for a user.
+func (l *Limiter) Transferred(user *User, bytes int64) (err error) {
+	if l.Store == nil || bytes <= 0 {
+		return
+	}
+	_, err = l.Store.Add(UsageKey(l.Secret, user.Name), UsageDay(l.now()), 0, bytes)
+	return
+}
+
+// ParseExpiry parses an expiry as a date, which expires at its end in UTC, or
+// as an RFC 3339 time. Empty and "never" are no expiry.
+func ParseExpiry(s string) (t *time.Time, err error) {
+	if s == "" || s == "never" {
+		return nil, nil
+	}
+	var v time.Time
+	if v, err = time.Parse("2006-01-02", s); err == nil {
+		v = v.AddDate(0, 0, 1)
+		return &v, nil
+	}
+	if v, err = time.Parse(time.RFC3339, s); err != nil {
+		return nil, fmt.Errorf("invalid expiry, want 2006-01-02 or an RFC 3339 time: %s", s)
+	}
+	return &v, nil
+}
+
+// FormatExpiry formats an expiry for ParseExpiry.
+func FormatExpiry(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+var byteUnits = []string{"B", "KB", "MB", "GB", "TB"}
+
+// ParseBytes parses a number of bytes with an optional unit such as 10GB,
+// where units are powers of 1024.
+func ParseBytes(value string) (n int64, err error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	if s == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	for i := len(byteUnits) - 1; i >= 0; i-- {
+		if strings.HasSuffix(s, byteUnits[i]) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, byteUnits[i]))
+			multiplier = 1 << (10 * uint(i))
+			break
+		}
+	}
+	if n, err = strconv.ParseInt(s, 10, 64); err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid number of bytes: %s", value)
+	}
+	return n * multiplier, nil
+}
+
+// FormatBytes formats a number of bytes with the largest unit that keeps it
+// exact, for ParseBytes.
+func FormatBytes(n int64) string {
+	i := 0
+	for ; i < len(byteUnits)-1 && n != 0 && n%1024 == 0; i++ {
+		n /= 1024
+	}
+	return strconv.FormatInt(n, 10) + byteUnits[i]
+}
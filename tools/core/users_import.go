@@ -0,0 +1,346 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// userColumn is a column of the CSV format of users. List values are
+// separated by semicolons.
+type userColumn struct {
+	name string
+	get  func(user *User) string
+	set  func(user *User, value string) error
+}
+
+func splitList(value string) (list []string) {
+	for _, s := range strings.Split(value, ";") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return
+}
+
+// userColumns are the columns of ExportUsersCSV, in order. Imports may have
+// any subset of them in any order, but must have a name.
+var userColumns = []userColumn{
+	{"name", func(u *User) string { return u.Name }, func(u *User, v string) error { u.Name = v; return nil }},
+	{"password", func(u *User) string { return u.Pass }, func(u *User, v string) error { u.Pass = v; return nil }},
+	{"pass_hash", func(u *User) string { return u.PassHash }, func(u *User, v string) error { u.PassHash = v; return nil }},
+	{
+		"drives_white_list",
+		func(u *User) string { return strings.Join(u.DrivesWhiteList, ";") },
+		func(u *User, v string) error { u.DrivesWhiteList = splitList(v); return nil },
+	},
+	{
+		"drives_black_list",
+		func(u *User) string { return strings.Join(u.DrivesBlackList, ";") },
+		func(u *User, v string) error { u.DrivesBlackList = splitList(v); return nil },
+	},
+	{
+		"role",
+		func(u *User) string { return u.Role },
+		func(u *User, v string) error {
+			if !ValidRole(v) {
+				return fmt.Errorf("unknown role: %s", v)
+			}
+			u.Role = v
+			return nil
+		},
+	},
+	{
+		"groups",
+		func(u *User) string { return strings.Join(u.Groups, ";") },
+		func(u *User, v string) error { u.Groups = splitList(v); return nil },
+	},
+	{
+		"expires_at",
+		func(u *User) string { return FormatExpiry(u.ExpiresAt) },
+		func(u *User, v string) (err error) { u.ExpiresAt, err = ParseExpiry(v); return },
+	},
+	{
+		"max_daily_bytes",
+		func(u *User) string {
+			if u.MaxDailyBytes == 0 {
+				return ""
+			}
+			return FormatBytes(u.MaxDailyBytes)
+		},
+		func(u *User, v string) (err error) { u.MaxDailyBytes, err = ParseBytes(v); return },
+	},
+	{
+		"max_daily_requests",
+		func(u *User) string {
+			if u.MaxDailyRequests == 0 {
+				return ""
+			}
+			return strconv.FormatInt(u.MaxDailyRequests, 10)
+		},
+		func(u *User, v string) (err error) {
+			if u.MaxDailyRequests = 0; v != "" {
+				u.MaxDailyRequests, err = strconv.ParseInt(v, 10, 64)
+			}
+			return
+		},
+	},
+	{
+		"disabled",
+		func(u *User) string { return strconv.FormatBool(u.Disabled) },
+		func(u *User, v string) (err error) {
+			if v == "" {
+				u.Disabled = false
+				return
+			}
+			u.Disabled, err = strconv.ParseBool(v)
+			return
+		},
+	},
+}
+
+// UsersImportError collects every problem found in imported users.
+type UsersImportError []string
+
+func (e UsersImportError) Error() string {
+	return "invalid users:\n    " + strings.Join(e, "\n    ")
+}
+
+// ReadUsersCSV parses users from CSV with a header row naming the columns.
+func ReadUsersCSV(r io.Reader) (users []*User, err error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("missing CSV header")
+	}
+	var columns []*userColumn
+	hasName := false
+	for _, name := range rows[0] {
+		var column *userColumn
+		for i := range userColumns {
+			if userColumns[i].name == strings.TrimSpace(name) {
+				column = &userColumns[i]
+			}
+		}
+		if column == nil {
+			return nil, fmt.Errorf("unknown CSV column: %s", name)
+		}
+		hasName = hasName || column.name == "name"
+		columns = append(columns, column)
+	}
+	if !hasName {
+		return nil, fmt.Errorf("missing CSV column: name")
+	}
+	var errs UsersImportError
+	for i, row := range rows[1:] {
+		user := &User{}
+		for j, value := range row {
+			if e := columns[j].set(user, strings.TrimSpace(value)); e != nil {
+				errs = append(errs, fmt.Sprintf("row %d: invalid %s: %s", i+2, columns[j].name, value))
+			}
+		}
+		users = append(users, user)
+	}
+	if len(errs) > 0 {
+		err = errs
+	}
+	return
+}
+
+// ReadUsersJSON parses users from a JSON array of user records, where a
+// plaintext password is "pass".
+func ReadUsersJSON(r io.Reader) (users []*User, err error) {
+	err = json.NewDecoder(r).Decode(&users)
+	return
+}
+
+// ExportUsersCSV writes users as CSV, with every column of userColumns.
+func ExportUsersCSV(w io.Writer, users []*User) (err error) {
+	out := csv.NewWriter(w)
+	var header []string
+	for _, column := range userColumns {
+		header = append(header, column.name)
+	}
+	if err = out.Write(header); err != nil {
+		return
+	}
+	for _, user := range users {
+		var row []string
+		for _, column := range userColumns {
+			row = append(row, column.get(user))
+		}
+		if err = out.Write(row); err != nil {
+			return
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// ExportUsers reads every user of the index. With redact, the passwords and
+// their hashes are left out.
+func ExportUsers(redact bool) (users []*User, err error) {
+	x, err := LoadUsersIndex()
+	if err != nil {
+		return
+	}
+	for _, entry := range x.Users {
+		var user *User
+		if user, err = ReadUser(entry.Name); err != nil {
+			return
+		}
+		if redact {
+			user.Pass, user.PassHash = "", ""
+		}
+		users = append(users, user)
+	}
+	return
+}
+
+// Actions of a UserChange.
+const (
+	UserCreate    = "create"
+	UserUpdate    = "update"
+	UserUnchanged = "unchanged"
+)
+
+// UserChange is what importing a user would do. Fields are the changed fields
+// of an update, and Generated is a generated password.
+type UserChange struct {
+	Action    string
+	User      *User
+	Fields    []string
+	Generated string
+}
+
+// PlanUsersImport validates the imported users and compares them with the
+// existing ones. Imported users without a password keep their password, or
+// get a generated one with generatePasswords when they are new. Users without
+// folder rules keep theirs.
+func PlanUsersImport(users []*User, generatePasswords bool) (changes []*UserChange, err error) {
+	var errs UsersImportError
+	seen := make(map[string]bool)
+	for i, user := range users {
+		row := fmt.Sprintf("user %d", i+1)
+		if user.Name != "" {
+			row = fmt.Sprintf("user %d (%s)", i+1, user.Name)
+		}
+		switch {
+		case user.Name == "":
+			errs = append(errs, row+": missing name")
+			continue
+		case seen[user.Name]:
+			errs = append(errs, row+": duplicate name")
+			continue
+		}
+		seen[user.Name] = true
+		if len(user.DrivesWhiteList) > 0 && len(user.DrivesBlackList) > 0 {
+			errs = append(errs, row+": cannot have both a drives white list and black list")
+		}
+		if user.Pass != "" && user.PassHash != "" {
+			errs = append(errs, row+": cannot have both a password and a password hash")
+		}
+		if user.PassHash != "" {
+			if e := ValidatePasswordHash(user.PassHash); e != nil {
+				errs = append(errs, row+": "+e.Error())
+			}
+		}
+		if _, e := ResolvePolicy(user); e != nil {
+			errs = append(errs, row+": "+e.Error())
+		}
+
+		change := &UserChange{Action: UserCreate, User: user}
+		old, e := ReadUser(user.Name)
+		if _, ok := e.(NoSuchUserError); e != nil && !ok {
+			return nil, e
+		}
+		if old != nil {
+			change.Action = UserUpdate
+			if user.Pass == "" && user.PassHash == "" {
+				user.Pass, user.PassHash = old.Pass, old.PassHash
+			}
+			if user.Folders == nil {
+				// CSV has no folder rules, managed by gdir acl instead
+				user.Folders = old.Folders
+			}
+			change.Fields = changedUserFields(old, user)
+			if len(change.Fields) == 0 {
+				change.Action = UserUnchanged
+			}
+		} else if user.Pass == "" && user.PassHash == "" {
+			if !generatePasswords {
+				errs = append(errs, row+": missing password, or use generated passwords")
+			} else if change.Generated, err = GeneratePassword(); err != nil {
+				return
+			} else {
+				user.Pass = change.Generated
+			}
+		}
+		changes = append(changes, change)
+	}
+	if len(errs) > 0 {
+		err = errs
+	}
+	return
+}
+
+// changedUserFields compares the columns of two users. A plaintext password
+// is compared with the hash of the old user.
+func changedUserFields(old *User, user *User) (fields []string) {
+	if user.Pass != "" {
+		if !VerifyPassword(old, user.Pass) {
+			fields = append(fields, "password")
+		}
+	} else if user.PassHash != old.PassHash || old.Pass != "" {
+		fields = append(fields, "password")
+	}
+	for _, column := range userColumns {
+		switch column.name {
+		case "name", "password", "pass_hash":
+		default:
+			if column.get(old) != column.get(user) {
+				fields = append(fields, column.name)
+			}
+		}
+	}
+	if !reflect.DeepEqual(old.Folders, user.Folders) {
+		fields = append(fields, "folders")
+	}
+	return
+}
+
+// ApplyUsersImport saves the created and updated users.
+func ApplyUsersImport(changes []*UserChange) (err error) {
+	for _, change := range changes {
+		if change.Action == UserUnchanged {
+			continue
+		}
+		if err = SaveUser(change.User); err != nil {
+			return
+		}
+	}
+	return
+}
+
+const generatedPasswordChars = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// GeneratePassword returns a random password of 16 characters.
+func GeneratePassword() (pass string, err error) {
+	b := make([]byte, 16)
+	for i := range b {
+		var n *big.Int
+		if n, err = rand.Int(rand.Reader, big.NewInt(int64(len(generatedPasswordChars)))); err != nil {
+			return
+		}
+		b[i] = generatedPasswordChars[n.Int64()]
+	}
+	return string(b), nil
+}
@@ -0,0 +1,213 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// UsersIndexFile is the encrypted index of the users in the users directory,
+// whose file names are hashes of the user names. It is kept next to the config
+// and is not deployed.
+const UsersIndexFile = "users.index"
+
+// UserEntry describes a user in the index.
+type UserEntry struct {
+	Name     string    `json:"name"`
+	Added    time.Time `json:"added"`
+	Updated  time.Time `json:"updated"`
+	Disabled bool      `json:"disabled,omitempty"`
+}
+
+// UsersIndex lists the users. Undeployed is set when the users directory has
+// changed since it was last deployed.
+type UsersIndex struct {
+	Users      []*UserEntry `json:"users"`
+	Undeployed bool         `json:"undeployed,omitempty"`
+}
+
+// LoadUsersIndex reads the users index. Without an index, one is built by
+// decrypting every file in the users directory.
+func LoadUsersIndex() (x *UsersIndex, err error) {
+	x = &UsersIndex{}
+	b, err := ioutil.ReadFile(ArtifactPath(UsersIndexFile))
+	if err == nil {
+		if b, err = GCMDecrypt(MasterSecret(), "usersIndex", b); err != nil {
+			err = fmt.Errorf("cannot decrypt %s: %w", UsersIndexFile, err)
+			return
+		}
+		err = json.Unmarshal(b, x)
+		return
+	}
+	if !os.IsNotExist(err) {
+		return
+	}
+	err = nil
+
+	files, err := encryptedFiles(ArtifactPath("users"))
+	if err != nil {
+		return
+	}
+	for _, name := range files {
+		path := filepath.Join(ArtifactPath("users"), name)
+		var stat os.FileInfo
+		if stat, err = os.Stat(path); err != nil {
+			return
+		}
+		var user *User
+		if user, err = readUserFile(path); err != nil {
+			return
+		}
+		x.Users = append(x.Users, &UserEntry{
+			Name:     user.Name,
+			Added:    stat.ModTime().UTC(),
+			Updated:  stat.ModTime().UTC(),
+			Disabled: user.Disabled,
+		})
+	}
+	x.sort()
+	return
+}
+
+// Save writes the index.
+func (x *UsersIndex) Save() (err error) {
+	b, err := json.Marshal(x)
+	if err != nil {
+		return
+	}
+	if b, err = GCMEncrypt(MasterSecret(), "usersIndex", b); err != nil {
+		return
+	}
+	return ioutil.WriteFile(ArtifactPath(UsersIndexFile), b, 0600)
+}
+
+// Find returns the entry of a user.
+func (x *UsersIndex) Find(name string) *UserEntry {
+	for _, e := range x.Users {
+		if e.Name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// Put adds or updates the entry of a user.
+func (x *UsersIndex) Put(user *User) {
+	now := time.Now().UTC()
+	e := x.Find(user.Name)
+	if e == nil {
+		e = &UserEntry{Name: user.Name, Added: now}
+		x.Users = append(x.Users, e)
+		x.sort()
+	}
+	e.Updated = now
+	e.Disabled = user.Disabled
+	x.Undeployed = true
+}
+
+// Remove deletes the entry of a user.
+func (x *UsersIndex) Remove(name string) {
+	for i, e := range x.Users {
+		if e.Name == name {
+			x.Users = append(x.Users[:i], x.Users[i+1:]...)
+			x.Undeployed = true
+			return
+		}
+	}
+}
+
+func (x *UsersIndex) sort() {
+	sort.Slice(x.Users, func(i, j int) bool { return x.Users[i].Name < x.Users[j].Name })
+}
+
+// NoSuchUserError is returned for a user without a file.
+type NoSuchUserError string
+
+func (e NoSuchUserError) Error() string {
+	return "no such user: " + string(e)
+}
+
+// ReadUser decrypts the file of a user.
+func ReadUser(name string) (user *User, err error) {
+	path, err := ComputeUserPath(name)
+	if err != nil {
+		return
+	}
+	if user, err = readUserFile(path); os.IsNotExist(err) {
+		err = NoSuchUserError(name)
+	}
+	return
+}
+
+func readUserFile(path string) (user *User, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if b, err = GCMDecrypt(MasterSecret(), "user", b); err != nil {
+		return nil, fmt.Errorf("cannot decrypt user %s: %w", path, err)
+	}
+	user = &User{}
+	if err = json.Unmarshal(b, user); err != nil {
+		return nil, fmt.Errorf("cannot parse user %s: %w", path, err)
+	}
+	return
+}
+
+// DeleteUser deletes the file of a user and its index entry.
+func DeleteUser(name string) (err error) {
+	x, err := LoadUsersIndex()
+	if err != nil {
+		return
+	}
+	path, err := ComputeUserPath(name)
+	if err != nil {
+		return
+	}
+	if err = os.Remove(path); os.IsNotExist(err) {
+		if x.Find(name) == nil {
+			return NoSuchUserError(name)
+		}
+	} else if err != nil {
+		return
+	}
+	x.Remove(name)
+	return x.Save()
+}
+
+// RenameUser saves a user under a new name and deletes the old file. Logged
+// in users have to log in again.
+func RenameUser(oldName string, newName string) (err error) {
+	if oldName == newName {
+		return fmt.Errorf("user %s already has this name", oldName)
+	}
+	user, err := ReadUser(oldName)
+	if err != nil {
+		return
+	}
+	if _, e := ReadUser(newName); e == nil {
+		return fmt.Errorf("user %s already exists", newName)
+	}
+	user.Name = newName
+	if err = SaveUser(user); err != nil {
+		return
+	}
+	return DeleteUser(oldName)
+}
+
+// markUsersDeployed clears Undeployed in an existing users index.
+func markUsersDeployed() (err error) {
+	if _, err = os.Stat(ArtifactPath(UsersIndexFile)); os.IsNotExist(err) {
+		return nil
+	}
+	x, err := LoadUsersIndex()
+	if err != nil || !x.Undeployed {
+		return
+	}
+	x.Undeployed = false
+	return x.Save()
+}
@@ -10,39 +10,6 @@ import (
 	"strings"
 )
 
-func PromptYesNo(question string) bool {
-	var line string
-	for {
-		fmt.Printf("%s (y/n) ", question)
-		fmt.Scanln(&line)
-		if regexp.MustCompile(`(?i)^\s*y\s*$`).MatchString(line) {
-			return true
-		} else if regexp.MustCompile(`(?i)^\s*n\s*$`).MatchString(line) {
-			return false
-		}
-	}
-}
-
-func PromptYesNoWithDefault(question string, defaultYes bool) bool {
-	var line string
-	for {
-		fmt.Printf("%s (", question)
-		if defaultYes {
-			fmt.Printf("Y/n) ")
-		} else {
-			fmt.Printf("y/N) ")
-		}
-		fmt.Scanln(&line)
-		if regexp.MustCompile(`(?i)^\s*$`).MatchString(line) {
-			return defaultYes
-		} else if regexp.MustCompile(`(?i)^\s*y\s*$`).MatchString(line) {
-			return true
-		} else if regexp.MustCompile(`(?i)^\s*n\s*$`).MatchString(line) {
-			return false
-		}
-	}
-}
-
 func ParseGistID(s string) (id string, err error) {
 	s = strings.TrimSpace(s)
 	if m := regexp.MustCompile(`^\s*([0-9a-fA-F]{32})\s*$`).FindStringSubmatch(s); m != nil {
@@ -0,0 +1,313 @@
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/workerindex/gdir/tools/prompt"
+)
+
+// WorkerScriptFile is the built worker script uploaded to Cloudflare, in the
+// dist directory.
+const WorkerScriptFile = "worker.js"
+
+// Types of WorkerBinding.
+const (
+	BindingPlainText   = "plain_text"
+	BindingSecretText  = "secret_text"
+	BindingKVNamespace = "kv_namespace"
+)
+
+// WorkerBinding is a binding of the worker, a global variable of the script
+// set by Cloudflare. Secret texts cannot be read back from Cloudflare, nor
+// from the dashboard.
+type WorkerBinding struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Text        string `json:"text,omitempty"`
+	NamespaceID string `json:"namespace_id,omitempty"`
+}
+
+// String describes the binding without revealing secrets.
+func (b WorkerBinding) String() string {
+	switch b.Type {
+	case BindingSecretText:
+		return fmt.Sprintf("%s (secret)", b.Name)
+	case BindingKVNamespace:
+		return fmt.Sprintf("%s (KV namespace %s)", b.Name, b.NamespaceID)
+	}
+	return fmt.Sprintf("%s = %s", b.Name, b.Text)
+}
+
+// accountsFileSuffix is added to the account IDs the worker fetches, while
+// RotateSecretKey deploys the accounts under other names.
+var accountsFileSuffix string
+
+// WorkerBindings returns the bindings the worker reads its config from, by
+// name. The master secret is a secret binding, and the other settings are
+// plain text bindings.
+func WorkerBindings() (bindings []WorkerBinding, err error) {
+	return workerBindings(StorageURL)
+}
+
+// LocalWorkerBindings returns the texts of the bindings of a worker run on
+// this machine, such as by npm run dev, which fetches the files of every kind
+// from baseURL. Like on Cloudflare, it gets the master secret, the KDF salt
+// and the IDs of the accounts, but no KV namespace.
+func LocalWorkerBindings(baseURL string) (texts map[string]string, err error) {
+	bindings, err := workerBindings(func(string) (string, error) { return baseURL, nil })
+	if err != nil {
+		return
+	}
+	texts = make(map[string]string)
+	for _, b := range bindings {
+		if b.Type != BindingKVNamespace && b.Name != "GDIR_USAGE_BINDING" {
+			texts[b.Name] = b.Text
+		}
+	}
+	return
+}
+
+func workerBindings(storageURL func(kind string) (string, error)) (bindings []WorkerBinding, err error) {
+	var accountsURL, usersURL, staticURL string
+	if accountsURL, err = storageURL("accounts"); err != nil {
+		return
+	}
+	if usersURL, err = storageURL("users"); err != nil {
+		return
+	}
+	if staticURL, err = storageURL("static"); err != nil {
+		return
+	}
+	manifest, err := LoadAccountsManifest()
+	if err != nil {
+		return
+	}
+	ids := manifest.ActiveIDs()
+	for i := range ids {
+		ids[i] += accountsFileSuffix
+	}
+	accountIDs, err := json.Marshal(ids)
+	if err != nil {
+		return
+	}
+	text := func(name string, value string) {
+		bindings = append(bindings, WorkerBinding{Name: name, Type: BindingPlainText, Text: value})
+	}
+	bindings = append(bindings, WorkerBinding{Name: "GDIR_SECRET", Type: BindingSecretText, Text: MasterSecret()})
+	text("GDIR_KDF_SALT", hex.EncodeToString(Config.KDF.SaltBytes()))
+	text("GDIR_ACCOUNTS_IDS", string(accountIDs))
+	text("GDIR_ACCOUNTS_URL", accountsURL)
+	text("GDIR_ACCOUNT_ROTATION", strconv.FormatUint(Config.AccountRotation, 10))
+	text("GDIR_ACCOUNT_CANDIDATES", strconv.FormatUint(Config.AccountCandidates, 10))
+	text("GDIR_USERS_URL", usersURL)
+	text("GDIR_STATIC_URL", staticURL)
+	if binding := UsageKVBinding(); binding != "" {
+		text("GDIR_USAGE_BINDING", binding)
+		bindings = append(bindings, WorkerBinding{Name: binding, Type: BindingKVNamespace, NamespaceID: Config.Usage.KVNamespace})
+	}
+	bindings = append(bindings, StorageKVBindings()...)
+	sort.Slice(bindings, func(i, j int) bool { return bindings[i].Name < bindings[j].Name })
+	return
+}
+
+// WorkerScript reads the worker script. It refuses scripts with the master
+// secret in them, or still expecting their settings to be substituted.
+func WorkerScript() (script string, err error) {
+	dist, err := DistFS()
+	if err != nil {
+		return
+	}
+	b, err := fs.ReadFile(dist, WorkerScriptFile)
+	if err != nil {
+		return
+	}
+	path := filepath.Join(DistSource(), WorkerScriptFile)
+	script = string(b)
+	if strings.Contains(script, "__SECRET__") {
+		return "", fmt.Errorf("%s is outdated, it expects the secret to be written into it, please rebuild it", path)
+	}
+	if secret := MasterSecret(); secret != "" && strings.Contains(script, secret) {
+		return "", fmt.Errorf("%s contains the master secret, it must not be uploaded", path)
+	}
+	return
+}
+
+// cloudflareResponse is the envelope of Cloudflare API responses.
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// UploadWorker uploads the worker script with its bindings. The bindings are
+// sent apart from the script, so that secrets never become part of it.
+func UploadWorker(script string, bindings []WorkerBinding) (err error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	meta, err := json.Marshal(struct {
+		BodyPart string          `json:"body_part"`
+		Bindings []WorkerBinding `json:"bindings"`
+	}{"script", bindings})
+	if err != nil {
+		return
+	}
+	for _, part := range []struct{ name, contentType, content string }{
+		{"metadata", "application/json", string(meta)},
+		{"script", "application/javascript", script},
+	} {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"`, part.name))
+		header.Set("Content-Type", part.contentType)
+		var pw io.Writer
+		if pw, err = w.CreatePart(header); err != nil {
+			return
+		}
+		if _, err = pw.Write([]byte(part.content)); err != nil {
+			return
+		}
+	}
+	if err = w.Close(); err != nil {
+		return
+	}
+	url := fmt.Sprintf("%s/accounts/%s/workers/scripts/%s", Cf.BaseURL, Config.CloudflareAccount, Config.CloudflareWorker)
+	req, err := http.NewRequest("PUT", url, &body)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	if UsesCloudflareToken() {
+		req.Header.Set("Authorization", "Bearer "+Cf.APIToken)
+	} else {
+		req.Header.Set("X-Auth-Key", Cf.APIKey)
+		req.Header.Set("X-Auth-Email", Cf.APIEmail)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	var r cloudflareResponse
+	if err = json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("cannot upload worker script: %s", resp.Status)
+	}
+	if !r.Success {
+		var errs []string
+		for _, e := range r.Errors {
+			errs = append(errs, fmt.Sprintf("%s (%d)", e.Message, e.Code))
+		}
+		return fmt.Errorf("cannot upload worker script: %s", strings.Join(errs, ", "))
+	}
+	return
+}
+
+// CloudflareZoneID returns the ID of the zone of the routes.
+func CloudflareZoneID() (id string, err error) {
+	if id, err = Cf.ZoneIDByName(Config.CloudflareZone); err != nil {
+		err = fmt.Errorf("cannot find Cloudflare zone %s: %w", Config.CloudflareZone, err)
+	}
+	return
+}
+
+// DeployWorkerRoutes points the routes of the config at the worker, creating
+// them or taking them over from other workers. Routes of the worker that are
+// not in the config are left as they are.
+func DeployWorkerRoutes() (err error) {
+	if len(Config.CloudflareRoutes) == 0 {
+		return
+	}
+	zoneID, err := CloudflareZoneID()
+	if err != nil {
+		return
+	}
+	resp, err := Cf.ListWorkerRoutes(zoneID)
+	if err != nil {
+		return
+	}
+	existing := make(map[string]cloudflare.WorkerRoute)
+	for _, route := range resp.Routes {
+		existing[route.Pattern] = route
+	}
+	for _, pattern := range Config.CloudflareRoutes {
+		route := cloudflare.WorkerRoute{Pattern: pattern, Script: Config.CloudflareWorker}
+		old, ok := existing[pattern]
+		switch {
+		case ok && old.Script == Config.CloudflareWorker:
+			continue
+		case ok:
+			fmt.Printf("Moving route %s from %q to the worker...\n", pattern, old.Script)
+			_, err = Cf.UpdateWorkerRoute(zoneID, old.ID, route)
+		default:
+			fmt.Printf("Creating route %s...\n", pattern)
+			_, err = Cf.CreateWorkerRoute(zoneID, route)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot deploy route %s: %w", pattern, err)
+		}
+	}
+	for _, route := range resp.Routes {
+		if route.Script == Config.CloudflareWorker && !containsString(Config.CloudflareRoutes, route.Pattern) {
+			fmt.Printf("Route %s also runs the worker, but is not in the config\n", route.Pattern)
+		}
+	}
+	return
+}
+
+// ConfigureWorkerRoutes asks whether to run the worker on routes of a custom
+// domain besides workers.dev, and for the zone and patterns of the routes.
+func ConfigureWorkerRoutes() (err error) {
+	if len(Config.CloudflareRoutes) == 0 {
+		var yes bool
+		if yes, err = prompt.Confirm("Do you want to run gdir on your own domain name too?", false); err != nil || !yes {
+			return
+		}
+	}
+	if err = confirmSetting("Your Cloudflare zone of the routes", &Config.CloudflareZone); err != nil {
+		return
+	}
+	if Config.CloudflareZone == "" {
+		var all, zones []cloudflare.Zone
+		if all, err = Cf.ListZones(); err != nil {
+			return
+		}
+		for _, zone := range all {
+			if zone.Account.ID == Config.CloudflareAccount {
+				zones = append(zones, zone)
+			}
+		}
+		if len(zones) == 0 {
+			return fmt.Errorf("no zones under your Cloudflare account, please add your domain name to Cloudflare first")
+		}
+		options := make([]string, len(zones))
+		for i, zone := range zones {
+			options[i] = zone.Name
+		}
+		var choice int
+		if choice, err = prompt.Select("Your available Cloudflare zones:", options, -1); err != nil {
+			return
+		}
+		Config.CloudflareZone = zones[choice].Name
+	}
+	fmt.Printf("Route patterns are such as gdir.%s/* or %s/gdir/*\n", Config.CloudflareZone, Config.CloudflareZone)
+	if Config.CloudflareRoutes, err = prompt.EditList(prompt.List{Name: "list of routes"}, Config.CloudflareRoutes); err != nil {
+		return
+	}
+	if len(Config.CloudflareRoutes) == 0 {
+		Config.CloudflareZone = ""
+	}
+	return SaveConfigFile()
+}
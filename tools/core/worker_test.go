@@ -0,0 +1,51 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+func TestWorkerURL(t *testing.T) {
+	var subdomain string
+	lookups := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/accounts/account/workers/subdomain" {
+			http.NotFound(w, r)
+			return
+		}
+		lookups++
+		if subdomain == "" {
+			fmt.Fprint(w, `{"success": true, "result": null}`)
+			return
+		}
+		fmt.Fprintf(w, `{"success": true, "result": {"subdomain": %q}}`, subdomain)
+	}))
+	defer srv.Close()
+	defer func(old string) { Cf, Config.CloudflareSubdomain = nil, old }(Config.CloudflareSubdomain)
+	defer func(old string) { Config.CloudflareWorker = old }(Config.CloudflareWorker)
+	Cf, _ = cloudflare.NewWithAPIToken("token")
+	Cf.BaseURL, Cf.AccountID = srv.URL, "account"
+	Config.CloudflareWorker, Config.CloudflareSubdomain = "gdir", ""
+
+	if url := WorkerURL(); url != "" {
+		t.Errorf("URL without a subdomain: %s", url)
+	}
+	subdomain = "example"
+	for i := 0; i < 2; i++ {
+		if url, want := WorkerURL(), "https://gdir.example.workers.dev"; url != want {
+			t.Errorf("URL %s, want %s", url, want)
+		}
+	}
+	if lookups != 2 {
+		t.Errorf("looked up the subdomain %d times, want it looked up until found", lookups)
+	}
+	Cf.AccountID = "other"
+	Config.CloudflareSubdomain = ""
+	if url := WorkerURL(); url != "" {
+		t.Errorf("URL when the subdomain cannot be looked up: %s", url)
+	}
+}
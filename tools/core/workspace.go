@@ -0,0 +1,109 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// ConfigFileName is the config file in the state directory.
+const ConfigFileName = "config.json"
+
+// ArtifactPaths are the locations of artifacts kept apart from the others.
+// Relative paths are in the state directory.
+type ArtifactPaths struct {
+	Accounts string `json:"accounts,omitempty"`
+	Users    string `json:"users,omitempty"`
+	Static   string `json:"static,omitempty"`
+	Releases string `json:"releases,omitempty"`
+	// Dist is a build of the worker and static files to deploy instead of
+	// those embedded in the tools.
+	Dist string `json:"dist,omitempty"`
+}
+
+// of returns the location of an artifact by name, if it is set.
+func (p ArtifactPaths) of(name string) string {
+	switch name {
+	case "accounts":
+		return p.Accounts
+	case "users":
+		return p.Users
+	case "static":
+		return p.Static
+	case ReleasesDir:
+		return p.Releases
+	}
+	return ""
+}
+
+// Workspace locates the files the tools read and write: the config and the
+// secrets in the state directory, the artifacts of a profile, such as the
+// encrypted users and accounts, and a local build of the worker.
+type Workspace struct {
+	// Root is the state directory, which relative paths are in.
+	Root string
+	// Dir is the directory of the artifacts.
+	Dir   string
+	Paths ArtifactPaths
+}
+
+// Path returns a path in the state directory, or path itself when absolute.
+func (w *Workspace) Path(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(w.Root, path)
+}
+
+// Artifact returns the path of an artifact, such as the users directory or
+// the users index.
+func (w *Workspace) Artifact(name string) string {
+	if path := w.Paths.of(name); path != "" {
+		return w.Path(path)
+	}
+	return w.Path(filepath.Join(w.Dir, name))
+}
+
+// DistDir returns the directory of the built worker and static files, or
+// empty to use those embedded in the tools.
+func (w *Workspace) DistDir() string {
+	if w.Paths.Dist == "" {
+		return ""
+	}
+	return w.Path(w.Paths.Dist)
+}
+
+// DefaultStateDir returns the state directory when none is given. It is the
+// working directory when it has a config file from before state directories,
+// or else $XDG_STATE_HOME/gdir, ~/.local/state/gdir by default.
+func DefaultStateDir() string {
+	if _, err := os.Stat(ConfigFileName); err == nil {
+		return "."
+	}
+	if dir := os.Getenv("XDG_STATE_HOME"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, "gdir")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(home, ".local", "state", "gdir")
+}
+
+// CurrentWorkspace returns the workspace of the config and its profile.
+func CurrentWorkspace() *Workspace {
+	dir := Config.Dir
+	if dir == "" && Config.Profile != "" {
+		dir = filepath.Join(ProfilesDir, Config.Profile)
+	}
+	return &Workspace{Root: Config.StateDir, Dir: dir, Paths: Config.Paths}
+}
+
+// StatePath returns a path in the state directory.
+func StatePath(path string) string {
+	return CurrentWorkspace().Path(path)
+}
+
+// ArtifactPath returns the path of an artifact of the profile.
+func ArtifactPath(name string) string {
+	return CurrentWorkspace().Artifact(name)
+}
@@ -0,0 +1,147 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setEnv sets or, with an empty value, unsets environment variables until the
+// test ends.
+func setEnv(t *testing.T, env map[string]string) {
+	for name, value := range env {
+		old, ok := os.LookupEnv(name)
+		if value == "" {
+			os.Unsetenv(name)
+		} else {
+			os.Setenv(name, value)
+		}
+		name := name
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(name, old)
+			} else {
+				os.Unsetenv(name)
+			}
+		})
+	}
+}
+
+func TestDefaultStateDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	tmp := t.TempDir()
+	if err = os.Chdir(tmp); err != nil {
+		t.Fatal(err)
+	}
+	home := filepath.Join(tmp, "home")
+	setEnv(t, map[string]string{"HOME": home, "XDG_STATE_HOME": ""})
+
+	if dir, want := DefaultStateDir(), filepath.Join(home, ".local", "state", "gdir"); dir != want {
+		t.Errorf("without XDG_STATE_HOME: %s, want %s", dir, want)
+	}
+	setEnv(t, map[string]string{"XDG_STATE_HOME": "relative"})
+	if dir, want := DefaultStateDir(), filepath.Join(home, ".local", "state", "gdir"); dir != want {
+		t.Errorf("with a relative XDG_STATE_HOME: %s, want %s", dir, want)
+	}
+	setEnv(t, map[string]string{"XDG_STATE_HOME": filepath.Join(tmp, "state")})
+	if dir, want := DefaultStateDir(), filepath.Join(tmp, "state", "gdir"); dir != want {
+		t.Errorf("with XDG_STATE_HOME: %s, want %s", dir, want)
+	}
+	if err = ioutil.WriteFile(ConfigFileName, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if dir := DefaultStateDir(); dir != "." {
+		t.Errorf("with a config in the working directory: %s, want .", dir)
+	}
+}
+
+func TestLoadConfigStateDir(t *testing.T) {
+	old := Config
+	defer func() { Config = old }()
+	for _, env := range configEnv {
+		*env.value = ""
+	}
+	state := t.TempDir()
+	setEnv(t, map[string]string{"GDIR_STATE_DIR": state, "GDIR_PROFILE": ""})
+	config := `{"dir": "prod", "paths": {"users": "/srv/gdir/users", "releases": "releases-of-prod"}}`
+	if err := ioutil.WriteFile(filepath.Join(state, ConfigFileName), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadConfigFile(); err != nil {
+		t.Fatal(err)
+	}
+	if Config.StateDir != state || Config.ConfigFile != filepath.Join(state, ConfigFileName) {
+		t.Errorf("state dir %s and config %s, want them from GDIR_STATE_DIR", Config.StateDir, Config.ConfigFile)
+	}
+	for path, want := range map[string]string{
+		StatePath("secrets.enc"):     filepath.Join(state, "secrets.enc"),
+		StatePath("/etc/gdir.enc"):   "/etc/gdir.enc",
+		ArtifactPath("accounts"):     filepath.Join(state, "prod", "accounts"),
+		ArtifactPath(UsersIndexFile): filepath.Join(state, "prod", UsersIndexFile),
+		ArtifactPath("users"):        "/srv/gdir/users",
+		ArtifactPath(ReleasesDir):    filepath.Join(state, "releases-of-prod"),
+		CurrentWorkspace().DistDir(): "",
+		(&Workspace{Root: "/state", Paths: ArtifactPaths{Dist: "dist"}}).DistDir(): "/state/dist",
+	} {
+		if path != want {
+			t.Errorf("path %s, want %s", path, want)
+		}
+	}
+
+	Config.Dir, Config.Profile = "", "staging"
+	if path, want := ArtifactPath("static"), filepath.Join(state, ProfilesDir, "staging", "static"); path != want {
+		t.Errorf("static files of a profile in %s, want %s", path, want)
+	}
+}
+
+func TestEnsureKDFConfigStateDir(t *testing.T) {
+	old := Config
+	defer func() { Config = old }()
+	for _, env := range configEnv {
+		*env.value = ""
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	state := t.TempDir()
+	setEnv(t, map[string]string{"GDIR_STATE_DIR": state, "GDIR_PROFILE": ""})
+	if err = ioutil.WriteFile(filepath.Join(state, ConfigFileName), []byte(`{"secret_key": "legacy"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	user := filepath.Join(state, "users", "0123")
+	if err = os.MkdirAll(filepath.Dir(user), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(user, []byte("encrypted without a KDF"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = LoadConfigFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = EnsureKDFConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if Config.KDF.Enabled() {
+		t.Errorf("selected KDF %+v over the users in the state dir", *Config.KDF)
+	}
+	if err = os.Remove(user); err != nil {
+		t.Fatal(err)
+	}
+	if err = EnsureKDFConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if !Config.KDF.Enabled() || Config.KDF.Type != KDFTypeHKDF {
+		t.Errorf("KDF %+v without encrypted files, want %s", Config.KDF, KDFTypeHKDF)
+	}
+}
@@ -0,0 +1,44 @@
+// Command distversion writes dist/version.json from package.json and the
+// commit checked out, like the version task of the gulpfile, for builds of
+// the tools without npm. Run it with go generate from the repository root.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/workerindex/gdir/tools/core"
+)
+
+func run() (err error) {
+	b, err := ioutil.ReadFile("package.json")
+	if err != nil {
+		return
+	}
+	var pkg struct {
+		Version string `json:"version"`
+	}
+	if err = json.Unmarshal(b, &pkg); err != nil {
+		return
+	}
+	version := core.DistVersion{Version: pkg.Version, Built: time.Now().UTC()}
+	// builds outside of a checkout have no commit
+	if out, e := exec.Command("git", "rev-parse", "--short", "HEAD").Output(); e == nil {
+		version.Commit = strings.TrimSpace(string(out))
+	}
+	if b, err = json.MarshalIndent(version, "", "    "); err != nil {
+		return
+	}
+	return ioutil.WriteFile(filepath.Join("dist", core.DistVersionFile), append(b, '\n'), 0644)
+}
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
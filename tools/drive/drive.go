@@ -0,0 +1,301 @@
+// Package drive is a Google Drive v3 client that works the same way as
+// GoogleDrive in worker/drive.ts. It authenticates service accounts with
+// signed JWT tokens and user accounts with OAuth2 refresh tokens.
+package drive
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultAPIURL   = "https://www.googleapis.com"
+	DefaultTokenURL = "https://oauth2.googleapis.com/token"
+	Scope           = "https://www.googleapis.com/auth/drive"
+)
+
+// Account is a Google Drive account as produced by AutoRclone or gcloud auth,
+// either a service account or an authorized user.
+type Account struct {
+	Type string `json:"type"`
+
+	// authorized_user
+	ClientID     string `json:"client_id,omitempty"`
+	ClientSecret string `json:"client_secret,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+
+	// service_account
+	ClientEmail  string `json:"client_email,omitempty"`
+	PrivateKeyID string `json:"private_key_id,omitempty"`
+	PrivateKey   string `json:"private_key,omitempty"`
+	TokenURI     string `json:"token_uri,omitempty"`
+	ProjectID    string `json:"project_id,omitempty"`
+
+	// ID names the account in error messages.
+	ID string `json:"-"`
+
+	mu          sync.Mutex
+	accessToken string
+	expires     time.Time
+}
+
+// ParseAccount parses an account JSON file.
+func ParseAccount(id string, b []byte) (a *Account, err error) {
+	a = &Account{ID: id}
+	if err = json.Unmarshal(b, a); err != nil {
+		err = fmt.Errorf("cannot parse account %s: %w", id, err)
+		return nil, err
+	}
+	if a.Type != "authorized_user" && a.Type != "service_account" {
+		err = fmt.Errorf("unknown type of account %s: %q", id, a.Type)
+		return nil, err
+	}
+	return
+}
+
+// Name returns the email of a service account, or the client ID of a user
+// account.
+func (a *Account) Name() string {
+	if a.ClientEmail != "" {
+		return a.ClientEmail
+	}
+	return a.ClientID
+}
+
+// TokenError is returned when an access token cannot be fetched for an
+// account, e.g. because its key was deleted.
+type TokenError struct {
+	Account     string
+	StatusCode  int
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *TokenError) Error() string {
+	return fmt.Sprintf("cannot get access token for account %s: %d %s %s", e.Account, e.StatusCode, e.Code, e.Description)
+}
+
+// Error is an error response of the Drive API.
+type Error struct {
+	StatusCode int
+	Code       int    `json:"code"`
+	Message    string `json:"message"`
+	Errors     []struct {
+		Domain  string `json:"domain"`
+		Reason  string `json:"reason"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Google Drive API error %d: %s", e.StatusCode, e.Message)
+}
+
+// Reason returns the reason of the first error, e.g. "notFound" or
+// "userRateLimitExceeded".
+func (e *Error) Reason() string {
+	if len(e.Errors) > 0 {
+		return e.Errors[0].Reason
+	}
+	return ""
+}
+
+// Client talks to the Drive API. The zero value uses the Google endpoints;
+// APIURL and TokenURL can point it to a fake Drive API for testing.
+type Client struct {
+	// APIURL replaces https://www.googleapis.com.
+	APIURL string
+	// TokenURL replaces the OAuth2 token endpoint of every account.
+	TokenURL   string
+	HTTPClient *http.Client
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (c *Client) apiURL() string {
+	if c.APIURL != "" {
+		return strings.TrimSuffix(c.APIURL, "/")
+	}
+	return DefaultAPIURL
+}
+
+// AccessToken returns a cached access token of the account, fetching a new
+// one when it is about to expire.
+func (c *Client) AccessToken(a *Account) (token string, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.accessToken != "" && time.Now().Before(a.expires) {
+		return a.accessToken, nil
+	}
+	var resp *tokenResponse
+	if a.Type == "authorized_user" {
+		resp, err = c.fetchOauth2Token(a)
+	} else {
+		resp, err = c.fetchJwtToken(a)
+	}
+	if err != nil {
+		return
+	}
+	a.accessToken = resp.AccessToken
+	expiresIn := resp.ExpiresIn - 100
+	if expiresIn < 0 {
+		expiresIn = 0
+	}
+	a.expires = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	return a.accessToken, nil
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func (c *Client) fetchOauth2Token(a *Account) (resp *tokenResponse, err error) {
+	form := url.Values{}
+	form.Set("client_id", a.ClientID)
+	form.Set("client_secret", a.ClientSecret)
+	form.Set("refresh_token", a.RefreshToken)
+	form.Set("grant_type", "refresh_token")
+	tokenURL := c.TokenURL
+	if tokenURL == "" {
+		tokenURL = DefaultTokenURL
+	}
+	return c.postToken(a, tokenURL, form)
+}
+
+func (c *Client) fetchJwtToken(a *Account) (resp *tokenResponse, err error) {
+	block, _ := pem.Decode([]byte(a.PrivateKey))
+	if block == nil {
+		err = fmt.Errorf("invalid private key of account %s", a.ID)
+		return
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		err = fmt.Errorf("invalid private key of account %s: %w", a.ID, err)
+		return
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		err = fmt.Errorf("private key of account %s is not an RSA key", a.ID)
+		return
+	}
+	tokenURL := c.TokenURL
+	if tokenURL == "" {
+		tokenURL = a.TokenURI
+	}
+	if tokenURL == "" {
+		tokenURL = DefaultTokenURL
+	}
+	now := time.Now().Unix() - 10
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": a.PrivateKeyID})
+	claimSet, _ := json.Marshal(map[string]interface{}{
+		"iat":   now,
+		"exp":   now + 3600,
+		"iss":   a.ClientEmail,
+		"aud":   a.TokenURI,
+		"scope": Scope,
+	})
+	body := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claimSet)
+	hash := sha256.Sum256([]byte(body))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, hash[:])
+	if err != nil {
+		return
+	}
+	form := url.Values{}
+	form.Set("assertion", body+"."+base64.RawURLEncoding.EncodeToString(sig))
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	return c.postToken(a, tokenURL, form)
+}
+
+func (c *Client) postToken(a *Account, tokenURL string, form url.Values) (resp *tokenResponse, err error) {
+	r, err := c.httpClient().Post(tokenURL, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		e := &TokenError{Account: a.ID, StatusCode: r.StatusCode}
+		json.NewDecoder(r.Body).Decode(e)
+		err = e
+		return
+	}
+	resp = &tokenResponse{}
+	if err = json.NewDecoder(r.Body).Decode(resp); err != nil {
+		return
+	}
+	if resp.AccessToken == "" {
+		err = &TokenError{Account: a.ID, StatusCode: r.StatusCode, Code: "no access_token in response"}
+	}
+	return
+}
+
+// Do sends an authorized request to the Drive API. path is relative to the API
+// URL, e.g. /drive/v3/files. The response is returned whatever its status is.
+func (c *Client) Do(a *Account, method string, path string, query url.Values, header http.Header, body io.Reader) (resp *http.Response, err error) {
+	token, err := c.AccessToken(a)
+	if err != nil {
+		return
+	}
+	u := c.apiURL() + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return c.httpClient().Do(req)
+}
+
+// getJSON decodes the response of a GET request into v, or returns an *Error
+// when the API responds with an error status.
+func (c *Client) getJSON(a *Account, path string, query url.Values, v interface{}) (err error) {
+	resp, err := c.Do(a, "GET", path, query, nil, nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if err = checkResponse(resp); err != nil {
+		return
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode < 400 {
+		return nil
+	}
+	var body struct {
+		Error *Error `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	e := body.Error
+	if e == nil {
+		e = &Error{Code: resp.StatusCode, Message: resp.Status}
+	}
+	e.StatusCode = resp.StatusCode
+	return e
+}
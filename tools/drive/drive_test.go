@@ -0,0 +1,191 @@
+package drive
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeDrive is a Drive API and token endpoint with two pages of shared drives.
+type fakeDrive struct {
+	key      *rsa.PrivateKey
+	tokens   int
+	failAuth bool
+}
+
+func (f *fakeDrive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		f.token(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer access-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error": {"code": 401, "message": "Invalid Credentials", "errors": [{"reason": "authError"}]}}`)
+		return
+	}
+	switch r.URL.Path {
+	case "/drive/v3/drives":
+		switch r.URL.Query().Get("pageToken") {
+		case "":
+			fmt.Fprint(w, `{"nextPageToken": "2", "drives": [{"id": "0A", "name": "A"}, {"id": "0B", "name": "B"}]}`)
+		case "2":
+			fmt.Fprint(w, `{"drives": [{"id": "0C", "name": "C"}]}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": {"code": 400, "message": "Invalid page token", "errors": [{"reason": "invalid"}]}}`)
+		}
+	case "/drive/v3/files/media":
+		w.Header().Set("Content-Range", r.Header.Get("Range"))
+		w.WriteHeader(http.StatusPartialContent)
+		fmt.Fprint(w, "content")
+	case "/drive/v3/files/broken":
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, "<html>Bad Gateway</html>")
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error": {"code": 404, "message": "File not found", "errors": [{"reason": "notFound"}]}}`)
+	}
+}
+
+// token checks the refresh token or the signed JWT of the token request.
+func (f *fakeDrive) token(w http.ResponseWriter, r *http.Request) {
+	f.tokens++
+	r.ParseForm()
+	valid := false
+	switch r.Form.Get("grant_type") {
+	case "refresh_token":
+		valid = r.Form.Get("refresh_token") == "refresh-token" && r.Form.Get("client_secret") == "client-secret"
+	case "urn:ietf:params:oauth:grant-type:jwt-bearer":
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		if len(parts) == 3 {
+			hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+			var claimSet struct {
+				Iss   string `json:"iss"`
+				Scope string `json:"scope"`
+			}
+			json.Unmarshal(claims, &claimSet)
+			valid = rsa.VerifyPKCS1v15(&f.key.PublicKey, crypto.SHA256, hash[:], sig) == nil &&
+				claimSet.Iss == "sa@project.iam.gserviceaccount.com" && claimSet.Scope == Scope
+		}
+	}
+	if !valid || f.failAuth {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error": "invalid_grant", "error_description": "Invalid grant"}`)
+		return
+	}
+	fmt.Fprint(w, `{"access_token": "access-token", "token_type": "Bearer", "expires_in": 3600}`)
+}
+
+func newFakeDrive(t *testing.T) (f *fakeDrive, c *Client, stop func()) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f = &fakeDrive{key: key}
+	srv := httptest.NewServer(f)
+	return f, &Client{APIURL: srv.URL, TokenURL: srv.URL + "/token"}, srv.Close
+}
+
+func serviceAccount(t *testing.T, key *rsa.PrivateKey) *Account {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "sa@project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	})
+	a, err := ParseAccount("sa", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestDrives(t *testing.T) {
+	f, c, stop := newFakeDrive(t)
+	defer stop()
+	user, err := ParseAccount("user", []byte(`{"type": "authorized_user", "client_id": "client", "client_secret": "client-secret", "refresh_token": "refresh-token"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range []*Account{serviceAccount(t, f.key), user} {
+		f.tokens = 0
+		drives, err := c.Drives(a)
+		if err != nil {
+			t.Fatalf("%s: %v", a.ID, err)
+		}
+		var ids []string
+		for _, d := range drives {
+			ids = append(ids, d.ID)
+		}
+		if strings.Join(ids, ",") != "0A,0B,0C" {
+			t.Errorf("%s: drives = %v, want every page", a.ID, ids)
+		}
+		if f.tokens != 1 {
+			t.Errorf("%s: fetched %d tokens, want the cached one reused", a.ID, f.tokens)
+		}
+	}
+}
+
+func TestDriveErrors(t *testing.T) {
+	f, c, stop := newFakeDrive(t)
+	defer stop()
+	a := serviceAccount(t, f.key)
+
+	var apiErr *Error
+	if _, err := c.File(a, "missing"); !errors.As(err, &apiErr) || apiErr.StatusCode != 404 || apiErr.Reason() != "notFound" {
+		t.Errorf("getting a missing file: %v", err)
+	}
+	if _, err := c.Ls(a, "", "", "expired"); !errors.As(err, &apiErr) || apiErr.Reason() != "invalid" {
+		t.Errorf("listing with an invalid page token: %v", err)
+	}
+	if _, err := c.Parents(a, "broken"); !errors.As(err, &apiErr) || apiErr.StatusCode != 502 || apiErr.Reason() != "" {
+		t.Errorf("getting a file from a failing API: %v", err)
+	}
+
+	resp, err := c.Download(a, "media", "bytes=0-6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Range") != "bytes=0-6" || string(b) != "content" {
+		t.Errorf("download = %s %q, Content-Range %q", resp.Status, b, resp.Header.Get("Content-Range"))
+	}
+
+	f.failAuth = true
+	var tokenErr *TokenError
+	revoked := serviceAccount(t, f.key)
+	if _, err := c.Drives(revoked); !errors.As(err, &tokenErr) || tokenErr.Code != "invalid_grant" || tokenErr.Account != "sa" {
+		t.Errorf("listing drives with a revoked account: %v", err)
+	}
+	other, _ := rsa.GenerateKey(rand.Reader, 1024)
+	f.failAuth = false
+	forged := serviceAccount(t, other)
+	if _, err := c.Drives(forged); !errors.As(err, &tokenErr) || tokenErr.StatusCode != 400 {
+		t.Errorf("listing drives with a wrong key: %v", err)
+	}
+	if _, err := ParseAccount("bad", []byte(`{"type": "unknown"}`)); err == nil {
+		t.Error("parsing an account of an unknown type did not fail")
+	}
+	invalid := &Account{ID: "invalid", Type: "service_account", PrivateKey: "not a key"}
+	if _, err := c.AccessToken(invalid); err == nil || !strings.Contains(err.Error(), "invalid private key") {
+		t.Errorf("signing with an invalid key: %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package drive
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// File is a file or folder in Google Drive. Size is a decimal string as
+// returned by the API.
+type File struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	Kind         string   `json:"kind,omitempty"`
+	MimeType     string   `json:"mimeType,omitempty"`
+	Size         string   `json:"size,omitempty"`
+	ModifiedTime string   `json:"modifiedTime,omitempty"`
+	Parents      []string `json:"parents,omitempty"`
+	MD5Checksum  string   `json:"md5Checksum,omitempty"`
+}
+
+// Drive is a shared drive.
+type Drive struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Kind string `json:"kind,omitempty"`
+}
+
+// FileList is a page of files, or of drives when listing the shared drives.
+type FileList struct {
+	NextPageToken string  `json:"nextPageToken,omitempty"`
+	Files         []File  `json:"files,omitempty"`
+	Drives        []Drive `json:"drives,omitempty"`
+}
+
+const fileFields = "id,name,kind,mimeType,size,modifiedTime,parents,md5Checksum"
+
+// FolderMimeType is the MIME type of folders.
+const FolderMimeType = "application/vnd.google-apps.folder"
+
+// Ls lists the files in folder parent, or the shared drives of the account
+// when parent is empty.
+func (c *Client) Ls(a *Account, parent string, orderBy string, pageToken string) (list *FileList, err error) {
+	query := url.Values{}
+	path := "/drive/v3/drives"
+	if parent != "" {
+		path = "/drive/v3/files"
+		query.Set("includeItemsFromAllDrives", "true")
+		query.Set("supportsAllDrives", "true")
+		query.Set("q", fmt.Sprintf("'%s' in parents and trashed = false", escapeQuery(parent)))
+		query.Set("fields", "nextPageToken,files(id,name,mimeType,size,modifiedTime,parents)")
+		if orderBy == "" {
+			orderBy = "folder,name,modifiedTime desc"
+		}
+		query.Set("orderBy", orderBy)
+	}
+	query.Set("pageSize", "100")
+	if pageToken != "" {
+		query.Set("pageToken", pageToken)
+	}
+	list = &FileList{}
+	if err = c.getJSON(a, path, query, list); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Drives lists every shared drive the account is a member of.
+func (c *Client) Drives(a *Account) (drives []Drive, err error) {
+	var pageToken string
+	for {
+		var list *FileList
+		if list, err = c.Ls(a, "", "", pageToken); err != nil {
+			return
+		}
+		drives = append(drives, list.Drives...)
+		if pageToken = list.NextPageToken; pageToken == "" {
+			return
+		}
+	}
+}
+
+// Search runs a full text search for all terms in a drive, or in all drives
+// when drive is empty.
+func (c *Client) Search(a *Account, terms []string, drive string, pageToken string) (list *FileList, err error) {
+	var clauses []string
+	for _, term := range terms {
+		clauses = append(clauses, fmt.Sprintf("fullText contains '%s'", escapeQuery(term)))
+	}
+	clauses = append(clauses, "trashed = false")
+	query := url.Values{}
+	query.Set("includeItemsFromAllDrives", "true")
+	query.Set("supportsAllDrives", "true")
+	query.Set("fields", "nextPageToken,files(id,name,mimeType,size,modifiedTime,parents)")
+	query.Set("pageSize", "100")
+	query.Set("q", strings.Join(clauses, " and "))
+	if drive != "" {
+		query.Set("driveId", drive)
+		query.Set("corpora", "drive")
+	} else {
+		query.Set("corpora", "allDrives")
+	}
+	if pageToken != "" {
+		query.Set("pageToken", pageToken)
+	}
+	list = &FileList{}
+	if err = c.getJSON(a, "/drive/v3/files", query, list); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// File returns the metadata of a file. When id is a shared drive, its kind and
+// name are those of the drive instead of its root folder.
+func (c *Client) File(a *Account, id string) (file *File, err error) {
+	query := url.Values{}
+	query.Set("supportsAllDrives", "true")
+	query.Set("fields", fileFields)
+	file = &File{}
+	if err = c.getJSON(a, "/drive/v3/files/"+url.PathEscape(id), query, file); err != nil {
+		return nil, err
+	}
+	if drive, e := c.Drive(a, id); e == nil {
+		file.Kind = drive.Kind
+		file.Name = drive.Name
+	}
+	return
+}
+
+// Parents returns the IDs of the parents of a file, none for a shared drive.
+func (c *Client) Parents(a *Account, id string) (parents []string, err error) {
+	query := url.Values{}
+	query.Set("supportsAllDrives", "true")
+	query.Set("fields", "parents")
+	file := &File{}
+	if err = c.getJSON(a, "/drive/v3/files/"+url.PathEscape(id), query, file); err != nil {
+		return nil, err
+	}
+	return file.Parents, nil
+}
+
+// FindFiles returns the files named name in folder parent, or only the folders
+// unless files is true.
+func (c *Client) FindFiles(a *Account, parent string, name string, files bool) (found []File, err error) {
+	q := fmt.Sprintf("'%s' in parents and name = '%s' and trashed = false", escapeQuery(parent), escapeQuery(name))
+	if !files {
+		q += fmt.Sprintf(" and mimeType = '%s'", FolderMimeType)
+	}
+	query := url.Values{}
+	query.Set("includeItemsFromAllDrives", "true")
+	query.Set("supportsAllDrives", "true")
+	query.Set("q", q)
+	query.Set("fields", "files(id,name,mimeType,parents)")
+	list := &FileList{}
+	if err = c.getJSON(a, "/drive/v3/files", query, list); err != nil {
+		return nil, err
+	}
+	return list.Files, nil
+}
+
+// Drive returns the shared drive id.
+func (c *Client) Drive(a *Account, id string) (drive *Drive, err error) {
+	query := url.Values{}
+	query.Set("fields", "id,name,kind")
+	drive = &Drive{}
+	if err = c.getJSON(a, "/drive/v3/drives/"+url.PathEscape(id), query, drive); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Download returns the response of downloading the content of a file. An
+// optional Range header value such as "bytes=0-1023" is passed to the API, and
+// the caller must check the status of the response and close its body.
+func (c *Client) Download(a *Account, id string, rangeHeader string) (*http.Response, error) {
+	query := url.Values{}
+	query.Set("alt", "media")
+	query.Set("supportsAllDrives", "true")
+	header := make(http.Header)
+	if rangeHeader != "" {
+		header.Set("Range", rangeHeader)
+	}
+	return c.Do(a, "GET", "/drive/v3/files/"+url.PathEscape(id), query, header, nil)
+}
+
+// escapeQuery escapes a string to be quoted in a Drive search query.
+func escapeQuery(s string) string {
+	return strings.Replace(strings.Replace(s, `\`, `\\`, -1), `'`, `\'`, -1)
+}
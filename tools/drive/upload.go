@@ -0,0 +1,160 @@
+package drive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// UploadStatus is the progress of a resumable upload. Status is one of
+// "uploading", "uploaded", "expired" or "error".
+type UploadStatus struct {
+	Status   string `json:"status"`
+	Uploaded int64  `json:"uploaded,omitempty"`
+	File     *File  `json:"file,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+func uploadPath(uploadID string) string {
+	query := url.Values{}
+	query.Set("uploadType", "resumable")
+	query.Set("supportsAllDrives", "true")
+	query.Set("upload_id", uploadID)
+	return "/upload/drive/v3/files?" + query.Encode()
+}
+
+// StartUpload starts a resumable upload of a new file with the name, parents
+// and mimeType of file, and returns its upload ID.
+func (c *Client) StartUpload(a *Account, file *File, size int64) (uploadID string, err error) {
+	metadata := map[string]interface{}{"name": file.Name}
+	if len(file.Parents) > 0 {
+		metadata["parents"] = file.Parents
+	}
+	if file.MimeType != "" {
+		metadata["mimeType"] = file.MimeType
+	}
+	body, err := json.Marshal(metadata)
+	if err != nil {
+		return
+	}
+	query := url.Values{}
+	query.Set("uploadType", "resumable")
+	query.Set("supportsAllDrives", "true")
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json; charset=UTF-8")
+	if file.MimeType != "" {
+		header.Set("X-Upload-Content-Type", file.MimeType)
+	}
+	if size >= 0 {
+		header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+	}
+	resp, err := c.Do(a, "POST", "/upload/drive/v3/files", query, header, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if err = checkResponse(resp); err != nil {
+		return
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return
+	}
+	if uploadID = location.Query().Get("upload_id"); uploadID == "" {
+		err = fmt.Errorf("no upload ID in resumable upload location %q", resp.Header.Get("Location"))
+	}
+	return
+}
+
+// ResumeUpload sends the rest of the content of an upload, starting at byte
+// offset. The caller must check the status of the response and close its body.
+func (c *Client) ResumeUpload(a *Account, uploadID string, contentType string, offset int64, size int64, body io.Reader) (*http.Response, error) {
+	header := make(http.Header)
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	if offset > 0 {
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, size-1, size))
+	}
+	return c.Do(a, "PUT", uploadPath(uploadID), nil, header, body)
+}
+
+// UploadStatus asks the API how much of an upload has been received.
+func (c *Client) UploadStatus(a *Account, uploadID string) (status *UploadStatus, err error) {
+	header := make(http.Header)
+	header.Set("Content-Range", "bytes */*")
+	resp, err := c.Do(a, "PUT", uploadPath(uploadID), nil, header, nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		status = &UploadStatus{Status: "uploaded", File: &File{}}
+		err = json.NewDecoder(resp.Body).Decode(status.File)
+	case http.StatusNotFound:
+		status = &UploadStatus{Status: "expired"}
+	case http.StatusPermanentRedirect:
+		status = &UploadStatus{Status: "uploading"}
+		var last int64
+		if _, e := fmt.Sscanf(resp.Header.Get("Range"), "bytes=0-%d", &last); e == nil {
+			status.Uploaded = last + 1
+		}
+	default:
+		status = &UploadStatus{
+			Status:  "error",
+			Message: fmt.Sprintf("unexpected API response status: %d", resp.StatusCode),
+		}
+	}
+	return
+}
+
+// Upload uploads size bytes of content as a new file with a resumable upload.
+// When the upload is interrupted it is resumed from where the API got to.
+func (c *Client) Upload(a *Account, file *File, size int64, content io.ReadSeeker) (uploaded *File, err error) {
+	uploadID, err := c.StartUpload(a, file, size)
+	if err != nil {
+		return
+	}
+	var offset int64
+	for retries := 0; ; retries++ {
+		if _, err = content.Seek(offset, io.SeekStart); err != nil {
+			return
+		}
+		var resp *http.Response
+		resp, err = c.ResumeUpload(a, uploadID, file.MimeType, offset, size, content)
+		if err == nil {
+			if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated {
+				defer resp.Body.Close()
+				uploaded = &File{}
+				err = json.NewDecoder(resp.Body).Decode(uploaded)
+				return
+			}
+			err = checkResponse(resp)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusPermanentRedirect && resp.StatusCode < 500 {
+				return
+			}
+		}
+		if retries == 3 {
+			return
+		}
+		var status *UploadStatus
+		if status, err = c.UploadStatus(a, uploadID); err != nil {
+			return
+		}
+		switch status.Status {
+		case "uploaded":
+			return status.File, nil
+		case "uploading":
+			offset = status.Uploaded
+		default:
+			err = fmt.Errorf("cannot resume upload of %s: %s %s", file.Name, status.Status, status.Message)
+			return
+		}
+	}
+}
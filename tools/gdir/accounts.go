@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/workerindex/gdir/tools/core"
+	"github.com/workerindex/gdir/tools/drive"
+)
+
+var accountsCommands = map[string]command{}
+
+func init() {
+	commands["accounts"] = command{"manage the Google Drive accounts", runAccounts}
+	accountsCommands["check"] = command{"check that every account can access Google Drive", runAccountsCheck}
+	accountsCommands["add"] = command{"add accounts from JSON files or directories of them", runAccountsAdd}
+	accountsCommands["remove"] = command{"remove accounts by client email or ID", runAccountsRemove}
+	accountsCommands["list"] = command{"list the accounts", runAccountsList}
+}
+
+// deployAccounts deploys the accounts, and the worker which has the list of
+// account IDs.
+func deployAccounts() (err error) {
+	if err = core.DeployStorage("accounts"); err != nil {
+		return
+	}
+	if err = core.InitCloudflareAccount(); err != nil {
+		return
+	}
+	return core.DeployWorkerRelease()
+}
+
+func runAccountsAdd(args []string) (err error) {
+	flags := newFlagSet("accounts add")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gdir accounts add [options] <file|dir>...\n")
+		flags.PrintDefaults()
+	}
+	if err = loadKeyedConfig(flags, args); err != nil {
+		return
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	added, err := core.AddAccounts(flags.Args()...)
+	if err != nil {
+		return
+	}
+	fmt.Printf("%d new accounts, %d accounts in total\n", added, core.Config.AccountsCount)
+	if added == 0 {
+		return
+	}
+	return deployAccounts()
+}
+
+func runAccountsRemove(args []string) (err error) {
+	flags := newFlagSet("accounts remove")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gdir accounts remove [options] <email|id>...\n")
+		flags.PrintDefaults()
+	}
+	if err = loadKeyedConfig(flags, args); err != nil {
+		return
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	manifest, err := core.LoadAccountsManifest()
+	if err != nil {
+		return
+	}
+	for _, key := range flags.Args() {
+		entry := manifest.Find(key)
+		if entry == nil {
+			return fmt.Errorf("no such account: %s", key)
+		}
+		fmt.Printf("Removing account %s: %s\n", entry.ID, entry.Name())
+		if err = manifest.Remove(entry); err != nil {
+			return
+		}
+	}
+	if err = manifest.Save(); err != nil {
+		return
+	}
+	return deployAccounts()
+}
+
+func runAccountsList(args []string) (err error) {
+	var jsonOutput bool
+	flags := newFlagSet("accounts list")
+	flags.BoolVar(&jsonOutput, "json", false, "print the accounts as JSON")
+	if err = loadKeyedConfig(flags, args); err != nil {
+		return
+	}
+	manifest, err := core.LoadAccountsManifest()
+	if err != nil {
+		return
+	}
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		return enc.Encode(manifest.Accounts)
+	}
+	for _, entry := range manifest.Accounts {
+		fmt.Printf("%-6s %-12s %s  %.12s  %s\n", entry.ID, entry.Status, entry.Added.Format("2006-01-02"), entry.Hash, entry.Name())
+	}
+	fmt.Printf("\n%d accounts, %d active\n", len(manifest.Accounts), len(manifest.Active()))
+	return
+}
+
+func runAccounts(args []string) (err error) {
+	return runCommandGroup("accounts", accountsCommands, args)
+}
+
+func runAccountsCheck(args []string) (err error) {
+	var drives string
+	var parallel int
+	var jsonOutput, quarantine bool
+	client := &drive.Client{}
+	flags := newFlagSet("accounts check")
+	flags.StringVar(&drives, "drive", "", "comma separated shared drive IDs every account must be able to read (default: any shared drive)")
+	flags.IntVar(&parallel, "parallel", 10, "number of accounts to check at the same time")
+	flags.BoolVar(&jsonOutput, "json", false, "print the results as JSON")
+	flags.BoolVar(&quarantine, "quarantine", false, "move bad accounts out of the deployed accounts and redeploy")
+	flags.StringVar(&client.APIURL, "drive-api-url", "", "Google Drive API base URL (default https://www.googleapis.com)")
+	flags.StringVar(&client.TokenURL, "token-url", "", "OAuth2 token URL to use instead of the one of each account")
+	if err = loadKeyedConfig(flags, args); err != nil {
+		return
+	}
+
+	accounts, err := core.ReadAccounts()
+	if err != nil {
+		return
+	}
+	var driveIDs []string
+	for _, id := range strings.Split(drives, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			driveIDs = append(driveIDs, id)
+		}
+	}
+	checks := core.CheckAccounts(client, accounts, driveIDs, parallel)
+
+	var bad []*drive.Account
+	for i, check := range checks {
+		if check.Bad() {
+			bad = append(bad, accounts[i])
+		}
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		if err = enc.Encode(checks); err != nil {
+			return
+		}
+	} else {
+		counts := make(map[string]int)
+		for _, check := range checks {
+			counts[check.Status]++
+			fmt.Printf("%-6s %-16s %s", check.ID, check.Status, check.Name)
+			if check.Message != "" {
+				fmt.Printf(": %s", check.Message)
+			}
+			fmt.Println()
+		}
+		fmt.Printf("\n%d accounts checked:", len(checks))
+		for _, status := range []string{core.AccountValid, core.AccountInvalidKey, core.AccountDisabledProject, core.AccountNoDrive, core.AccountQuotaExceeded, core.AccountError} {
+			if counts[status] > 0 {
+				fmt.Printf(" %d %s", counts[status], status)
+			}
+		}
+		fmt.Println()
+	}
+
+	if len(bad) == 0 {
+		return
+	}
+	if !quarantine {
+		return fmt.Errorf("%d bad accounts, run with -quarantine to take them out of the deployed accounts", len(bad))
+	}
+	if len(bad) == len(accounts) {
+		return fmt.Errorf("all %d accounts are bad, refusing to quarantine all of them", len(bad))
+	}
+	if jsonOutput {
+		// keep stdout for the JSON results only
+		os.Stdout = os.Stderr
+	}
+	manifest, err := core.LoadAccountsManifest()
+	if err != nil {
+		return
+	}
+	for _, a := range bad {
+		if entry := manifest.Find(a.ID); entry != nil {
+			fmt.Printf("Quarantining account %s: %s\n", entry.ID, entry.Name())
+			if err = manifest.Quarantine(entry); err != nil {
+				return
+			}
+		}
+	}
+	if err = manifest.Save(); err != nil {
+		return
+	}
+	return deployAccounts()
+}
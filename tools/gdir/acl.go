@@ -0,0 +1,221 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/workerindex/gdir/tools/core"
+	"github.com/workerindex/gdir/tools/drive"
+)
+
+var aclCommands = map[string]command{}
+
+func init() {
+	commands["acl"] = command{"manage the folder rules of users and groups", runACL}
+	aclCommands["list"] = command{"list the folder rules of a user or group", runACLList}
+	aclCommands["allow"] = command{"allow a folder and everything inside it", runACLAllow}
+	aclCommands["deny"] = command{"deny a folder and everything inside it", runACLDeny}
+	aclCommands["remove"] = command{"remove the rules of a folder", runACLRemove}
+	aclCommands["check"] = command{"show the access of a user to a file or folder", runACLCheck}
+}
+
+func runACL(args []string) (err error) {
+	return runCommandGroup("acl", aclCommands, args)
+}
+
+// aclFlags are the options shared by the acl commands.
+type aclFlags struct {
+	*flag.FlagSet
+	group    bool
+	noDeploy bool
+	client   drive.Client
+}
+
+func newACLFlagSet(name string, arguments string, api bool) *aclFlags {
+	flags := &aclFlags{FlagSet: newFlagSet("acl " + name)}
+	if name != "check" {
+		flags.BoolVar(&flags.group, "group", false, "change the rules of a group instead of a user")
+	}
+	if name != "list" && name != "check" {
+		flags.BoolVar(&flags.noDeploy, "no-deploy", false, "only change the local files, to deploy several changes at once")
+	}
+	if api {
+		flags.StringVar(&flags.client.APIURL, "drive-api-url", "", "Google Drive API base URL (default https://www.googleapis.com)")
+		flags.StringVar(&flags.client.TokenURL, "token-url", "", "OAuth2 token URL to use instead of the one of each account")
+	}
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gdir acl %s [options] %s\n", name, arguments)
+		fmt.Fprintf(os.Stderr, "A folder is an ID, or a path starting with the name of its shared drive like \"Team Drive/Projects\".\n")
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// loadFolderACL returns the folder rules of a user or group, and a function to
+// save them.
+func loadFolderACL(name string, group bool) (acl *core.FolderACL, save func(noDeploy bool) error, err error) {
+	if group {
+		g, ok := core.Config.Groups[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("no such group: %s", name)
+		}
+		if g.Folders == nil {
+			g.Folders = &core.FolderACL{}
+		}
+		save = func(noDeploy bool) error {
+			if g.Folders.Empty() {
+				g.Folders = nil
+			}
+			return saveGroups(noDeploy, nil)
+		}
+		return g.Folders, save, nil
+	}
+	user, err := core.ReadUser(name)
+	if err != nil {
+		return
+	}
+	if user.Folders == nil {
+		user.Folders = &core.FolderACL{}
+	}
+	save = func(noDeploy bool) (err error) {
+		if user.Folders.Empty() {
+			user.Folders = nil
+		}
+		if err = core.SaveUser(user); err != nil {
+			return
+		}
+		return deployUsers(noDeploy)
+	}
+	return user.Folders, save, nil
+}
+
+// driveAccount returns an account to call the Drive API with.
+func driveAccount() (a *drive.Account, err error) {
+	accounts, err := core.ReadAccounts()
+	if err != nil {
+		return
+	}
+	if len(accounts) == 0 {
+		return nil, fmt.Errorf("no accounts to call the Google Drive API with")
+	}
+	return accounts[0], nil
+}
+
+func printFolderRules(acl *core.FolderACL) {
+	if acl.Empty() {
+		fmt.Println("No folder rules, every folder of the allowed drives is allowed")
+		return
+	}
+	for _, rules := range []struct {
+		access string
+		rules  []core.FolderRule
+	}{{"allow", acl.Allow}, {"deny", acl.Deny}} {
+		for _, rule := range rules.rules {
+			fmt.Printf("%-5s  %s  %s\n", rules.access, rule.ID, rule.Name)
+		}
+	}
+}
+
+func runACLList(args []string) (err error) {
+	flags := newACLFlagSet("list", "<user or group>", false)
+	if err = loadKeyedConfig(flags.FlagSet, args); err != nil {
+		return
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	acl, _, err := loadFolderACL(flags.Arg(0), flags.group)
+	if err != nil {
+		return
+	}
+	printFolderRules(acl)
+	return
+}
+
+func runACLAllow(args []string) (err error) {
+	return setFolderRule("allow", args, true)
+}
+
+func runACLDeny(args []string) (err error) {
+	return setFolderRule("deny", args, false)
+}
+
+func setFolderRule(name string, args []string, allow bool) (err error) {
+	flags := newACLFlagSet(name, "<user or group> <folder>", true)
+	if err = loadKeyedConfig(flags.FlagSet, args); err != nil {
+		return
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	acl, save, err := loadFolderACL(flags.Arg(0), flags.group)
+	if err != nil {
+		return
+	}
+	a, err := driveAccount()
+	if err != nil {
+		return
+	}
+	rule, err := core.ResolveFolder(&flags.client, a, flags.Arg(1))
+	if err != nil {
+		return
+	}
+	fmt.Printf("%s %s (%s)\n", name, rule.Name, rule.ID)
+	acl.Set(rule, allow)
+	return save(flags.noDeploy)
+}
+
+func runACLRemove(args []string) (err error) {
+	flags := newACLFlagSet("remove", "<user or group> <folder ID or name>", false)
+	if err = loadKeyedConfig(flags.FlagSet, args); err != nil {
+		return
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	acl, save, err := loadFolderACL(flags.Arg(0), flags.group)
+	if err != nil {
+		return
+	}
+	if !acl.Remove(flags.Arg(1)) {
+		return fmt.Errorf("no rule of folder %s", flags.Arg(1))
+	}
+	return save(flags.noDeploy)
+}
+
+func runACLCheck(args []string) (err error) {
+	flags := newACLFlagSet("check", "<user> <file or folder>", true)
+	if err = loadKeyedConfig(flags.FlagSet, args); err != nil {
+		return
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	user, err := core.ReadUser(flags.Arg(0))
+	if err != nil {
+		return
+	}
+	if _, err = core.ResolveUserPolicy(user); err != nil {
+		return
+	}
+	user.ApplyPolicy()
+	a, err := driveAccount()
+	if err != nil {
+		return
+	}
+	rule, err := core.ResolveFile(&flags.client, a, flags.Arg(1))
+	if err != nil {
+		return
+	}
+	chain := []string{rule.ID}
+	for i := len(rule.Path) - 1; i >= 0; i-- {
+		chain = append(chain, rule.Path[i])
+	}
+	fmt.Printf("%s: %s\n", rule.Name, user.Folders.Evaluate(chain))
+	return
+}
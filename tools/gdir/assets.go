@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+
+	"github.com/workerindex/gdir/tools/core"
+)
+
+func init() {
+	commands["assets"] = command{"show the version and the hashes of the built worker and static files", runAssets}
+}
+
+func runAssets(args []string) (err error) {
+	flags := newFlagSet("assets")
+	embedded := flags.Bool("embedded", false, "show the files embedded in gdir, even when -dist or paths.dist is set")
+	flags.Parse(args)
+	if err = core.LoadConfigFile(); err != nil {
+		return
+	}
+	source := core.DistSource()
+	var dist fs.FS
+	if *embedded || source == core.DistEmbedded {
+		source = core.DistEmbedded
+		dist, err = core.EmbeddedDist()
+	} else {
+		dist, err = core.DistFS()
+	}
+	if err != nil {
+		return
+	}
+	version, err := core.ReadDistVersion(dist)
+	if err != nil {
+		return
+	}
+	files, err := core.DistFiles(dist)
+	if err != nil {
+		return
+	}
+	if source == core.DistEmbedded {
+		fmt.Println("Build: embedded in gdir")
+	} else {
+		fmt.Printf("Build: %s\n", source)
+	}
+	fmt.Printf("Version: %s\n", version)
+	for _, file := range files {
+		fmt.Printf("%s  %s\n", file.Hash, file.Name)
+	}
+	return
+}
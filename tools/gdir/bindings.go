@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/workerindex/gdir/tools/core"
+)
+
+func init() {
+	commands["bindings"] = command{"print the bindings of a local worker as JSON, including the master secret", runBindings}
+}
+
+func runBindings(args []string) (err error) {
+	flags := newFlagSet("bindings")
+	url := flags.String("url", "http://127.0.0.1:3005/", "base URL the local worker fetches accounts, users and static files from")
+	if err = loadKeyedConfig(flags, args); err != nil {
+		return
+	}
+	bindings, err := core.LocalWorkerBindings(*url)
+	if err != nil {
+		return
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "    ")
+	return enc.Encode(bindings)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/workerindex/gdir/tools/core"
+)
+
+func init() {
+	commands["deploy"] = command{"deploy the storages and the worker, or show what would change", runDeploy}
+	commands["releases"] = command{"list the recorded releases", runReleases}
+	commands["rollback"] = command{"restore the worker and the Gists of a release", runRollback}
+}
+
+// initCloudflare signs in to Cloudflare with the configured account and
+// finds the workers.dev subdomain.
+func initCloudflare() (err error) {
+	if err = core.InitCloudflareAPI(); err != nil {
+		return
+	}
+	if err = core.VerifyCloudflareToken(); err != nil {
+		return
+	}
+	if err = core.ResolveCloudflareAccount(); err != nil {
+		return
+	}
+	return core.ResolveCloudflareSubdomain()
+}
+
+func runDeploy(args []string) (err error) {
+	flags := newFlagSet("deploy")
+	plan := flags.Bool("plan", false, "only show what would change: the worker script hash, bindings and Gist files")
+	if err = loadKeyedConfig(flags, args); err != nil {
+		return
+	}
+	if core.Config.CloudflareWorker == "" {
+		return fmt.Errorf("no Cloudflare Worker in %s, please run setup first", core.Config.ConfigFile)
+	}
+	if err = initCloudflare(); err != nil {
+		return
+	}
+	if *plan {
+		var p *core.DeployPlan
+		if p, err = core.PlanDeploy(); err != nil {
+			return
+		}
+		p.Print()
+		return
+	}
+	return core.Deploy()
+}
+
+func runReleases(args []string) (err error) {
+	flags := newFlagSet("releases")
+	flags.Parse(args)
+	if err = core.LoadConfigFile(); err != nil {
+		return
+	}
+	releases, err := core.ReadReleases()
+	if err != nil {
+		return
+	}
+	if len(releases) == 0 {
+		fmt.Println("No releases recorded yet")
+	}
+	for _, release := range releases {
+		fmt.Println(core.FormatRelease(release))
+	}
+	return
+}
+
+func runRollback(args []string) (err error) {
+	flags := newFlagSet("rollback")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gdir rollback [options] <release>\n")
+		fmt.Fprintf(os.Stderr, "Run gdir releases to list the releases.\n")
+		flags.PrintDefaults()
+	}
+	if err = loadKeyedConfig(flags, args); err != nil {
+		return
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	id, err := strconv.Atoi(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("invalid release: %s", flags.Arg(0))
+	}
+	if err = initCloudflare(); err != nil {
+		return
+	}
+	return core.Rollback(id)
+}
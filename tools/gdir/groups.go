@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/workerindex/gdir/tools/core"
+)
+
+var groupsCommands = map[string]command{}
+
+func init() {
+	commands["groups"] = command{"manage the groups of users", runGroups}
+	groupsCommands["list"] = command{"list the groups", runGroupsList}
+	groupsCommands["set"] = command{"create or change a group", runGroupsSet}
+	groupsCommands["delete"] = command{"delete a group and remove its members from it", runGroupsDelete}
+}
+
+func runGroups(args []string) (err error) {
+	return runCommandGroup("groups", groupsCommands, args)
+}
+
+func newGroupsFlagSet(name string, arguments string, noDeploy *bool) *flag.FlagSet {
+	flags := newFlagSet("groups " + name)
+	flags.BoolVar(noDeploy, "no-deploy", false, "only change the local files, to deploy several changes at once")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gdir groups %s [options] %s\n", name, arguments)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// splitIDs splits a comma separated option.
+func splitIDs(value string) (ids []string) {
+	for _, id := range strings.Split(value, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return
+}
+
+// saveGroups saves the config, then saves again and deploys the users whose
+// policy has changed, besides the already changed ones.
+func saveGroups(noDeploy bool, changed []string) (err error) {
+	if err = core.SaveConfigFile(); err != nil {
+		return
+	}
+	resolved, err := core.ResolveUsers()
+	if err != nil {
+		return
+	}
+	changed = append(changed, resolved...)
+	if len(changed) == 0 {
+		fmt.Println("No user has changed")
+		return
+	}
+	fmt.Printf("Changed the policy of %s\n", strings.Join(changed, ", "))
+	return deployUsers(noDeploy)
+}
+
+func runGroupsList(args []string) (err error) {
+	flags := newFlagSet("groups list")
+	if err = loadKeyedConfig(flags, args); err != nil {
+		return
+	}
+	var names []string
+	for name := range core.Config.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		group := core.Config.Groups[name]
+		fmt.Printf("%s\n", name)
+		if len(group.DrivesWhiteList) > 0 {
+			fmt.Printf("    White list: %s\n", strings.Join(group.DrivesWhiteList, ", "))
+		}
+		if len(group.DrivesBlackList) > 0 {
+			fmt.Printf("    Black list: %s\n", strings.Join(group.DrivesBlackList, ", "))
+		}
+	}
+	fmt.Printf("\n%d groups\n", len(names))
+	return
+}
+
+func runGroupsSet(args []string) (err error) {
+	var noDeploy bool
+	var whiteList, blackList string
+	flags := newGroupsFlagSet("set", "<name>", &noDeploy)
+	flags.StringVar(&whiteList, "white-list", "", "comma separated IDs of the drives the members can see")
+	flags.StringVar(&blackList, "black-list", "", "comma separated IDs of the drives hidden from the members")
+	if err = loadKeyedConfig(flags, args); err != nil {
+		return
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	name := flags.Arg(0)
+	group, ok := core.Config.Groups[name]
+	if !ok {
+		group = &core.Group{}
+	}
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "white-list":
+			group.DrivesWhiteList = splitIDs(whiteList)
+		case "black-list":
+			group.DrivesBlackList = splitIDs(blackList)
+		}
+	})
+	if core.Config.Groups == nil {
+		core.Config.Groups = make(map[string]*core.Group)
+	}
+	core.Config.Groups[name] = group
+	return saveGroups(noDeploy, nil)
+}
+
+func runGroupsDelete(args []string) (err error) {
+	var noDeploy bool
+	flags := newGroupsFlagSet("delete", "<name>", &noDeploy)
+	if err = loadKeyedConfig(flags, args); err != nil {
+		return
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	name := flags.Arg(0)
+	if _, ok := core.Config.Groups[name]; !ok {
+		return fmt.Errorf("no such group: %s", name)
+	}
+	delete(core.Config.Groups, name)
+	x, err := core.LoadUsersIndex()
+	if err != nil {
+		return
+	}
+	var changed []string
+	for _, entry := range x.Users {
+		var user *core.User
+		if user, err = core.ReadUser(entry.Name); err != nil {
+			return
+		}
+		var groups []string
+		for _, g := range user.Groups {
+			if g != name {
+				groups = append(groups, g)
+			}
+		}
+		if len(groups) == len(user.Groups) {
+			continue
+		}
+		fmt.Printf("Removing user %s from group %s\n", user.Name, name)
+		user.Groups = groups
+		if err = core.SaveUser(user); err != nil {
+			return
+		}
+		changed = append(changed, user.Name)
+	}
+	return saveGroups(noDeploy, changed)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/workerindex/gdir/tools/core"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{}
+
+// newFlagSet returns the flag set of a sub command, with the options shared by
+// every command.
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet("gdir "+name, flag.ExitOnError)
+	flags.StringVar(&core.Config.StateDir, "state-dir", "", "directory of the config and the encrypted files (default GDIR_STATE_DIR, or $XDG_STATE_HOME/gdir)")
+	flags.StringVar(&core.Config.ConfigFile, "config", "", "config file to read and write (default config.json in the state directory)")
+	flags.StringVar(&core.Config.DistDir, "dist", "", "directory of your own build of the worker and static files, instead of the one embedded in gdir")
+	flags.StringVar(&core.Config.Profile, "profile", "", "profile of the config to use (default GDIR_PROFILE, or the options outside of the profiles)")
+	flags.StringVar(&core.Config.SecretKey, "key", "", "gdir master secret key to derive other encryption keys")
+	flags.BoolVar(&core.Config.Debug, "debug", false, "log debug messages")
+	return flags
+}
+
+// loadKeyedConfig parses the options of a command and loads the config, which
+// must have a secret key.
+func loadKeyedConfig(flags *flag.FlagSet, args []string) (err error) {
+	flags.Parse(args)
+	if err = core.LoadConfigFile(); err != nil {
+		return
+	}
+	if core.Config.SecretKey == "" {
+		flags.Usage()
+		return fmt.Errorf("missing secret key")
+	}
+	return
+}
+
+// runCommandGroup runs a sub command of a command group such as accounts.
+func runCommandGroup(group string, commands map[string]command, args []string) (err error) {
+	if len(args) > 0 {
+		if cmd, ok := commands[args[0]]; ok {
+			return cmd.run(args[1:])
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Usage: gdir %s <command> [options]\n\nCommands:\n", group)
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "    %-16s %s\n", name, commands[name].usage)
+	}
+	os.Exit(2)
+	return
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: gdir <command> [options]\n\nCommands:\n")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "    %-16s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun gdir <command> -h for the options of a command.\n")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/workerindex/gdir/tools/core"
+)
+
+func init() {
+	commands["migrate"] = command{"upgrade encrypted files to the current format and redeploy", runMigrate}
+}
+
+func runMigrate(args []string) (err error) {
+	var dryRun, noDeploy bool
+	flags := newFlagSet("migrate")
+	flags.BoolVar(&dryRun, "dry-run", false, "only list the files to upgrade")
+	flags.BoolVar(&noDeploy, "no-deploy", false, "upgrade the local files without deploying them")
+	flags.Parse(args)
+
+	if err = core.LoadConfigFile(); err != nil {
+		return
+	}
+	if core.Config.SecretKey == "" {
+		flags.Usage()
+		return fmt.Errorf("missing secret key")
+	}
+
+	migrated, err := core.MigrateCiphertext(dryRun)
+	if err != nil {
+		return
+	}
+	for _, path := range migrated {
+		if dryRun {
+			fmt.Printf("    upgrade %s\n", path)
+		} else {
+			fmt.Printf("Upgraded %s\n", path)
+		}
+	}
+	if dryRun {
+		fmt.Printf("%d files to upgrade\n", len(migrated))
+	} else {
+		fmt.Printf("%d files upgraded\n", len(migrated))
+	}
+	if dryRun || noDeploy || len(migrated) == 0 {
+		return
+	}
+
+	// the worker must be able to read the new format before it is deployed
+	if err = core.InitCloudflareAccount(); err != nil {
+		return
+	}
+	script, bindings, err := core.DeployWorker()
+	if err != nil {
+		return
+	}
+	for _, kind := range []string{"accounts", "users"} {
+		if err = core.DeployStorage(kind); err != nil {
+			return
+		}
+	}
+	release, err := core.RecordRelease(script, bindings, 0)
+	if err != nil {
+		return
+	}
+	fmt.Printf("Recorded release %d\n", release.ID)
+	return
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/workerindex/gdir/tools/core"
+)
+
+var promoteCommands = map[string]command{}
+
+func init() {
+	commands["promote"] = command{"copy users or static files from a profile to another, and deploy them", runPromote}
+	promoteCommands["users"] = command{"copy users of the profile to another profile", runPromoteUsers}
+	promoteCommands["static"] = command{"copy the deployed static files of the profile to another profile", runPromoteStatic}
+}
+
+func runPromote(args []string) (err error) {
+	return runCommandGroup("promote", promoteCommands, args)
+}
+
+// newPromoteFlagSet returns the flag set of a promote command, which copies
+// from the profile of -profile to the one of -to.
+func newPromoteFlagSet(name string, arguments string, to *string) *flag.FlagSet {
+	flags := newFlagSet("promote " + name)
+	flags.StringVar(to, "to", "", "profile to copy to")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gdir promote %s -profile <from> -to <to> [options] %s\n", name, arguments)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func runPromoteUsers(args []string) (err error) {
+	var to string
+	flags := newPromoteFlagSet("users", "[<name>...]", &to)
+	if err = loadKeyedConfig(flags, args); err != nil {
+		return
+	}
+	if to == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	return core.PromoteUsers(to, flags.Args())
+}
+
+func runPromoteStatic(args []string) (err error) {
+	var to string
+	flags := newPromoteFlagSet("static", "", &to)
+	if err = loadKeyedConfig(flags, args); err != nil {
+		return
+	}
+	if to == "" || flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	return core.PromoteStatic(to)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/workerindex/gdir/tools/core"
+	"github.com/workerindex/gdir/tools/prompt"
+)
+
+func init() {
+	commands["rotate-key"] = command{"re-encrypt everything with a new secret key and redeploy", runRotateKey}
+}
+
+func runRotateKey(args []string) (err error) {
+	var newKey string
+	var passphrase, yes bool
+	flags := newFlagSet("rotate-key")
+	flags.StringVar(&newKey, "new-key", "", "new secret key (default: generate a secure random value)")
+	flags.BoolVar(&passphrase, "passphrase", false, "the new secret key is a passphrase to stretch with Argon2id (default: ask for it)")
+	flags.BoolVar(&yes, "yes", false, "do not ask for confirmation")
+	flags.Parse(args)
+
+	if err = core.LoadConfigFile(); err != nil {
+		return
+	}
+	if core.Config.SecretKey == "" {
+		flags.Usage()
+		return fmt.Errorf("missing secret key")
+	}
+	if !yes {
+		if yes, err = prompt.Confirm("Re-encrypt all accounts and users with a new secret key and redeploy them?", false); err != nil {
+			return
+		}
+		if !yes {
+			os.Exit(1)
+		}
+	}
+
+	kdfType := core.KDFTypeHKDF
+	if passphrase {
+		kdfType = core.KDFTypeArgon2id
+		if newKey == "" {
+			if newKey, err = prompt.Secret("New passphrase", prompt.Required); err != nil {
+				return
+			}
+		}
+	}
+	newKDF, err := core.NewKDFConfig(kdfType)
+	if err != nil {
+		return
+	}
+
+	generated := newKey == ""
+	if generated {
+		b := make([]byte, 64)
+		if _, err = rand.Read(b); err != nil {
+			return
+		}
+		newKey = hex.EncodeToString(b)
+	}
+
+	if err = core.InitCloudflareAccount(); err != nil {
+		return
+	}
+	if err = core.RotateSecretKey(newKey, newKDF); err != nil {
+		return
+	}
+	if generated {
+		// the key itself is only saved, to keep it out of terminals and logs
+		fmt.Printf("Your new gdir secret key %s is saved in %s\n", core.MaskSecret(newKey), core.SecretSource("secret_key", newKey))
+	}
+	fmt.Println("All done! Users have to log in again.")
+	return
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/workerindex/gdir/tools/core"
+)
+
+var secretsCommands = map[string]command{}
+
+func init() {
+	commands["secrets"] = command{"manage where the secrets of the config are kept", runSecrets}
+	secretsCommands["list"] = command{"list the secrets of the config and where they come from", runSecretsList}
+	secretsCommands["set"] = command{"set a secret to a value or a reference", runSecretsSet}
+	secretsCommands["store"] = command{"choose where new secret values are kept, moving existing ones", runSecretsStore}
+}
+
+func runSecrets(args []string) (err error) {
+	return runCommandGroup("secrets", secretsCommands, args)
+}
+
+func runSecretsList(args []string) (err error) {
+	flags := newFlagSet("secrets list")
+	flags.Parse(args)
+	if err = core.LoadConfigFile(); err != nil {
+		return
+	}
+	store := core.Config.Secrets.Store
+	if store == "" {
+		store = core.SecretStoreConfig
+	}
+	fmt.Printf("New secrets are kept in: %s\n", store)
+	for _, secret := range core.ConfigSecrets() {
+		fmt.Printf("    %-24s %s\n", secret.Name, core.SecretSource(secret.Name, *secret.Value))
+	}
+	return
+}
+
+func runSecretsSet(args []string) (err error) {
+	flags := newFlagSet("secrets set")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gdir secrets set [options] <name> [env:VARIABLE | cmd:COMMAND]\n")
+		fmt.Fprintf(os.Stderr, "Without a reference, asks for the secret.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err = core.LoadConfigFile(); err != nil {
+		return
+	}
+	name := flags.Arg(0)
+	var secret *core.ConfigSecret
+	secrets := core.ConfigSecrets()
+	for i := range secrets {
+		if secrets[i].Name == name {
+			secret = &secrets[i]
+		}
+	}
+	if secret == nil {
+		return fmt.Errorf("no such secret: %s", name)
+	}
+	if flags.NArg() == 2 {
+		ref := flags.Arg(1)
+		if _, _, ok := core.ParseSecretRef(ref); !ok {
+			return fmt.Errorf("not a secret reference: %s", ref)
+		}
+		// the config resolves the reference when it is loaded again
+		*secret.Value = ref
+		if err = core.ResolveConfigSecrets(); err != nil {
+			return
+		}
+	} else if err = core.EnterSecret(name, name); err != nil {
+		return
+	}
+	if err = core.SaveConfigFile(); err != nil {
+		return
+	}
+	fmt.Printf("%s: %s\n", name, core.SecretSource(name, *secret.Value))
+	return
+}
+
+func runSecretsStore(args []string) (err error) {
+	flags := newFlagSet("secrets store")
+	flags.StringVar(&core.Config.Secrets.File, "file", "", "the secrets file (default "+core.DefaultSecretsFile+" in the state directory)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gdir secrets store [options] <%s | %s>\n", core.SecretStoreFile, core.SecretStoreConfig)
+		fmt.Fprintf(os.Stderr, "With %s, the secret values of the config are moved into the passphrase encrypted secrets file.\n", core.SecretStoreFile)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || (flags.Arg(0) != core.SecretStoreFile && flags.Arg(0) != core.SecretStoreConfig) {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err = core.LoadConfigFile(); err != nil {
+		return
+	}
+	core.Config.Secrets.Store = flags.Arg(0)
+	if err = core.SaveConfigFile(); err != nil {
+		return
+	}
+	for _, secret := range core.ConfigSecrets() {
+		if *secret.Value != "" {
+			fmt.Printf("    %-24s %s\n", secret.Name, core.SecretSource(secret.Name, *secret.Value))
+		}
+	}
+	return
+}
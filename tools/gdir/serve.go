@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/workerindex/gdir/tools/core"
+	"github.com/workerindex/gdir/tools/serve"
+)
+
+func init() {
+	commands["serve"] = command{"serve gdir from this machine instead of Cloudflare", runServe}
+}
+
+func runServe(args []string) (err error) {
+	var listen, staticDir string
+	s := &serve.Server{}
+	flags := newFlagSet("serve")
+	flags.StringVar(&listen, "listen", ":8080", "address to listen on")
+	flags.StringVar(&s.AccountsDir, "accounts-dir", "", "directory of encrypted accounts (default accounts in the directory of the profile)")
+	flags.StringVar(&s.UsersDir, "users-dir", "", "directory of encrypted users (default users in the directory of the profile)")
+	flags.StringVar(&staticDir, "static-dir", "", "directory of static files (default those of the build)")
+	flags.StringVar(&s.DriveAPIURL, "drive-api-url", "", "Google Drive API base URL (default https://www.googleapis.com)")
+	flags.StringVar(&s.TokenURL, "token-url", "", "OAuth2 token URL to use instead of the one of each account")
+	flags.Parse(args)
+
+	if err = core.LoadConfigFile(); err != nil {
+		return
+	}
+	if core.Config.SecretKey == "" {
+		flags.Usage()
+		return fmt.Errorf("missing secret key")
+	}
+	if s.AccountsDir == "" {
+		s.AccountsDir = core.ArtifactPath("accounts")
+	}
+	if s.UsersDir == "" {
+		s.UsersDir = core.ArtifactPath("users")
+	}
+	if staticDir != "" {
+		s.Static = os.DirFS(staticDir)
+	} else if s.Static, err = core.StaticDist(); err != nil {
+		return
+	}
+
+	s.Secret = core.MasterSecret()
+	s.AccountRotation = core.Config.AccountRotation
+	s.AccountCandidates = core.Config.AccountCandidates
+	if s.AccountRotation == 0 {
+		s.AccountRotation = 60
+	}
+	if s.AccountCandidates == 0 {
+		s.AccountCandidates = 10
+	}
+	if s.Usage, err = core.NewUsageStore(); err != nil {
+		return
+	}
+	if err = s.Load(); err != nil {
+		return
+	}
+
+	fmt.Printf("Serving gdir on %s\n", listen)
+	return http.ListenAndServe(listen, s)
+}
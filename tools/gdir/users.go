@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/workerindex/gdir/tools/core"
+	"github.com/workerindex/gdir/tools/prompt"
+)
+
+var usersCommands = map[string]command{}
+
+func init() {
+	commands["users"] = command{"manage the users", runUsers}
+	usersCommands["list"] = command{"list the users", runUsersList}
+	usersCommands["show"] = command{"show a user", runUsersShow}
+	usersCommands["delete"] = command{"delete users", runUsersDelete}
+	usersCommands["disable"] = command{"disable users without deleting them", runUsersDisable}
+	usersCommands["enable"] = command{"enable disabled users", runUsersEnable}
+	usersCommands["rename"] = command{"rename a user", runUsersRename}
+	usersCommands["passwd"] = command{"change the password of a user", runUsersPasswd}
+	usersCommands["set"] = command{"change the role, groups, expiry or limits of users", runUsersSet}
+	usersCommands["deploy"] = command{"deploy the users", runUsersDeploy}
+}
+
+func runUsers(args []string) (err error) {
+	return runCommandGroup("users", usersCommands, args)
+}
+
+// newUsersFlagSet returns the flag set of a users command that changes users.
+// Changes made with -no-deploy are deployed together by the next users command
+// without it, or by users deploy.
+func newUsersFlagSet(name string, arguments string, noDeploy *bool) *flag.FlagSet {
+	flags := newFlagSet("users " + name)
+	flags.BoolVar(noDeploy, "no-deploy", false, "only change the local files, to deploy several changes at once")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gdir users %s [options] %s\n", name, arguments)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// deployUsers deploys the users once all the changes of a command are made.
+func deployUsers(noDeploy bool) (err error) {
+	if noDeploy {
+		fmt.Println("Not deployed, run gdir users deploy when done")
+		return
+	}
+	return core.DeployStorage("users")
+}
+
+func runUsersList(args []string) (err error) {
+	var jsonOutput bool
+	flags := newFlagSet("users list")
+	flags.BoolVar(&jsonOutput, "json", false, "print the users as JSON")
+	if err = loadKeyedConfig(flags, args); err != nil {
+		return
+	}
+	x, err := core.LoadUsersIndex()
+	if err != nil {
+		return
+	}
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		return enc.Encode(x.Users)
+	}
+	disabled := 0
+	for _, e := range x.Users {
+		status := "enabled"
+		if e.Disabled {
+			status = "disabled"
+			disabled++
+		}
+		fmt.Printf("%-9s %s  %s  %s\n", status, e.Added.Format("2006-01-02"), e.Updated.Format("2006-01-02"), e.Name)
+	}
+	fmt.Printf("\n%d users, %d disabled\n", len(x.Users), disabled)
+	if x.Undeployed {
+		fmt.Println("Some changes are not deployed yet, run gdir users deploy")
+	}
+	return
+}
+
+func runUsersShow(args []string) (err error) {
+	var jsonOutput bool
+	flags := newFlagSet("users show")
+	flags.BoolVar(&jsonOutput, "json", false, "print the user as JSON, without the password")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gdir users show [options] <name>\n")
+		flags.PrintDefaults()
+	}
+	if err = loadKeyedConfig(flags, args); err != nil {
+		return
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	user, err := core.ReadUser(flags.Arg(0))
+	if err != nil {
+		return
+	}
+	password := "none"
+	if user.PassHash != "" {
+		password = "hashed (" + strings.SplitN(user.PassHash, "$", 2)[0] + ")"
+	} else if user.Pass != "" {
+		password = "plaintext, hashed on the next change"
+	}
+	user.Pass, user.PassHash = "", ""
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		return enc.Encode(user)
+	}
+	path, err := core.ComputeUserPath(user.Name)
+	if err != nil {
+		return
+	}
+	status := "enabled"
+	if user.Disabled {
+		status = "disabled"
+	}
+	fmt.Printf("Name:       %s\n", user.Name)
+	fmt.Printf("File:       %s\n", path)
+	if user.Expired(time.Now()) {
+		status += ", expired"
+	}
+	fmt.Printf("Status:     %s\n", status)
+	if user.ExpiresAt != nil {
+		fmt.Printf("Expires:    %s\n", user.ExpiresAt.Local().Format("2006-01-02 15:04:05"))
+	}
+	var limits []string
+	if user.MaxDailyBytes > 0 {
+		limits = append(limits, core.FormatBytes(user.MaxDailyBytes))
+	}
+	if user.MaxDailyRequests > 0 {
+		limits = append(limits, fmt.Sprintf("%d requests", user.MaxDailyRequests))
+	}
+	if len(limits) > 0 {
+		fmt.Printf("Daily:      %s\n", strings.Join(limits, ", "))
+	}
+	fmt.Printf("Password:   %s\n", password)
+	if x, e := core.LoadUsersIndex(); e == nil {
+		if entry := x.Find(user.Name); entry != nil {
+			fmt.Printf("Added:      %s\n", entry.Added.Format("2006-01-02 15:04:05"))
+			fmt.Printf("Updated:    %s\n", entry.Updated.Format("2006-01-02 15:04:05"))
+		}
+	}
+	role := user.Role
+	if role == "" {
+		role = core.DefaultRole + " (default)"
+	}
+	fmt.Printf("Role:       %s\n", role)
+	if len(user.Groups) > 0 {
+		fmt.Printf("Groups:     %s\n", strings.Join(user.Groups, ", "))
+	}
+	if len(user.DrivesWhiteList) > 0 {
+		fmt.Printf("White list: %s\n", strings.Join(user.DrivesWhiteList, ", "))
+	}
+	if len(user.DrivesBlackList) > 0 {
+		fmt.Printf("Black list: %s\n", strings.Join(user.DrivesBlackList, ", "))
+	}
+	if user.Policy != nil {
+		fmt.Printf("Policy:\n")
+		fmt.Printf("    Permissions: %s\n", strings.Join(user.Policy.Permissions, ", "))
+		if len(user.Policy.DrivesWhiteList) > 0 {
+			fmt.Printf("    White list:  %s\n", strings.Join(user.Policy.DrivesWhiteList, ", "))
+		}
+		if len(user.Policy.DrivesBlackList) > 0 {
+			fmt.Printf("    Black list:  %s\n", strings.Join(user.Policy.DrivesBlackList, ", "))
+		}
+	}
+	return
+}
+
+func runUsersDelete(args []string) (err error) {
+	var noDeploy bool
+	flags := newUsersFlagSet("delete", "<name>...", &noDeploy)
+	if err = loadKeyedConfig(flags, args); err != nil {
+		return
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	// check every name first, so that a typo does not leave half of a batch
+	for _, name := range flags.Args() {
+		if _, err = core.ReadUser(name); err != nil {
+			return
+		}
+	}
+	for _, name := range flags.Args() {
+		fmt.Printf("Deleting user %s\n", name)
+		if err = core.DeleteUser(name); err != nil {
+			return
+		}
+	}
+	return deployUsers(noDeploy)
+}
+
+func runUsersDisable(args []string) (err error) {
+	return setUsersDisabled("disable", args, true)
+}
+
+func runUsersEnable(args []string) (err error) {
+	return setUsersDisabled("enable", args, false)
+}
+
+func setUsersDisabled(name string, args []string, disabled bool) (err error) {
+	var noDeploy bool
+	flags := newUsersFlagSet(name, "<name>...", &noDeploy)
+	if err = loadKeyedConfig(flags, args); err != nil {
+		return
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	var users []*core.User
+	for _, name := range flags.Args() {
+		var user *core.User
+		if user, err = core.ReadUser(name); err != nil {
+			return
+		}
+		users = append(users, user)
+	}
+	changed := false
+	for _, user := range users {
+		if user.Disabled == disabled {
+			continue
+		}
+		user.Disabled = disabled
+		if err = core.SaveUser(user); err != nil {
+			return
+		}
+		changed = true
+	}
+	if !changed {
+		fmt.Println("Nothing to change")
+		return
+	}
+	return deployUsers(noDeploy)
+}
+
+func runUsersRename(args []string) (err error) {
+	var noDeploy bool
+	flags := newUsersFlagSet("rename", "<name> <new name>", &noDeploy)
+	if err = loadKeyedConfig(flags, args); err != nil {
+		return
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err = core.RenameUser(flags.Arg(0), flags.Arg(1)); err != nil {
+		return
+	}
+	return deployUsers(noDeploy)
+}
+
+func runUsersPasswd(args []string) (err error) {
+	var noDeploy bool
+	var pass string
+	flags := newUsersFlagSet("passwd", "<name>", &noDeploy)
+	flags.StringVar(&pass, "pass", "", "new password (default: ask for it)")
+	if err = loadKeyedConfig(flags, args); err != nil {
+		return
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	user, err := core.ReadUser(flags.Arg(0))
+	if err != nil {
+		return
+	}
+	for pass == "" {
+		var again string
+		if pass, err = prompt.Secret("New password", prompt.Required); err != nil {
+			return
+		}
+		if again, err = prompt.Secret("Repeat the new password", nil); err != nil {
+			return
+		}
+		if pass != again {
+			fmt.Println("The passwords do not match")
+			pass = ""
+		}
+	}
+	user.Pass, user.PassHash = pass, ""
+	if err = core.SaveUser(user); err != nil {
+		return
+	}
+	return deployUsers(noDeploy)
+}
+
+func runUsersSet(args []string) (err error) {
+	var noDeploy bool
+	var role, groups, expires, maxDailyBytes string
+	var maxDailyRequests int64
+	flags := newUsersFlagSet("set", "<name>...", &noDeploy)
+	flags.StringVar(&role, "role", "", fmt.Sprintf("role of the users: %s", strings.Join(core.Roles, ", ")))
+	flags.StringVar(&groups, "groups", "", "comma separated groups of the users, replacing their groups")
+	flags.StringVar(&expires, "expires", "", "last day of the users like 2006-01-02, an RFC 3339 time, or never")
+	flags.StringVar(&maxDailyBytes, "max-daily-bytes", "", "bytes the users can download per day like 10GB, 0 for no limit")
+	flags.Int64Var(&maxDailyRequests, "max-daily-requests", 0, "requests the users can make per day, 0 for no limit")
+	if err = loadKeyedConfig(flags, args); err != nil {
+		return
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	expiresAt, err := core.ParseExpiry(expires)
+	if err != nil {
+		return
+	}
+	bytes, err := core.ParseBytes(maxDailyBytes)
+	if err != nil {
+		return
+	}
+	var users []*core.User
+	for _, name := range flags.Args() {
+		var user *core.User
+		if user, err = core.ReadUser(name); err != nil {
+			return
+		}
+		flags.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "role":
+				user.Role = role
+			case "groups":
+				user.Groups = splitIDs(groups)
+			case "expires":
+				user.ExpiresAt = expiresAt
+			case "max-daily-bytes":
+				user.MaxDailyBytes = bytes
+			case "max-daily-requests":
+				user.MaxDailyRequests = maxDailyRequests
+			}
+		})
+		// check every user first, so that a typo does not leave half of a batch
+		if _, err = core.ResolvePolicy(user); err != nil {
+			return
+		}
+		users = append(users, user)
+	}
+	for _, user := range users {
+		if err = core.SaveUser(user); err != nil {
+			return
+		}
+	}
+	return deployUsers(noDeploy)
+}
+
+func runUsersDeploy(args []string) (err error) {
+	flags := newFlagSet("users deploy")
+	if err = loadKeyedConfig(flags, args); err != nil {
+		return
+	}
+	return core.DeployStorage("users")
+}
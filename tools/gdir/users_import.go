@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/workerindex/gdir/tools/core"
+)
+
+func init() {
+	usersCommands["import"] = command{"create or update users from a CSV or JSON file", runUsersImport}
+	usersCommands["export"] = command{"export the users as CSV or JSON", runUsersExport}
+}
+
+// usersFileFormat returns the format option, or guesses it from the file name.
+func usersFileFormat(format string, path string) (string, error) {
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+	switch format {
+	case "csv", "json":
+		return format, nil
+	case "":
+		return "csv", nil
+	}
+	return "", fmt.Errorf("unknown users file format: %s", format)
+}
+
+func runUsersImport(args []string) (err error) {
+	var noDeploy, dryRun, generatePasswords bool
+	var format string
+	flags := newUsersFlagSet("import", "<file.csv|file.json>", &noDeploy)
+	flags.BoolVar(&dryRun, "dry-run", false, "only print what would change")
+	flags.BoolVar(&generatePasswords, "generate-passwords", false, "generate passwords for new users without one, and print them")
+	flags.StringVar(&format, "format", "", "csv or json (default: from the file extension)")
+	if err = loadKeyedConfig(flags, args); err != nil {
+		return
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	path := flags.Arg(0)
+	if format, err = usersFileFormat(format, path); err != nil {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var users []*core.User
+	if format == "json" {
+		users, err = core.ReadUsersJSON(f)
+	} else {
+		users, err = core.ReadUsersCSV(f)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %w", path, err)
+	}
+
+	changes, err := core.PlanUsersImport(users, generatePasswords)
+	if err != nil {
+		return
+	}
+	counts := make(map[string]int)
+	for _, change := range changes {
+		counts[change.Action]++
+		switch change.Action {
+		case core.UserCreate:
+			fmt.Printf("    create %s\n", change.User.Name)
+		case core.UserUpdate:
+			fmt.Printf("    update %s: %s\n", change.User.Name, strings.Join(change.Fields, ", "))
+		}
+	}
+	fmt.Printf("%d to create, %d to update, %d unchanged\n", counts[core.UserCreate], counts[core.UserUpdate], counts[core.UserUnchanged])
+	if dryRun || counts[core.UserCreate]+counts[core.UserUpdate] == 0 {
+		return
+	}
+
+	if err = core.ApplyUsersImport(changes); err != nil {
+		return
+	}
+	if generatePasswords {
+		fmt.Println("\nGenerated passwords:")
+		for _, change := range changes {
+			if change.Generated != "" {
+				fmt.Printf("%s\t%s\n", change.User.Name, change.Generated)
+			}
+		}
+		fmt.Println()
+	}
+	return deployUsers(noDeploy)
+}
+
+func runUsersExport(args []string) (err error) {
+	var format, output string
+	var redact bool
+	flags := newFlagSet("users export")
+	flags.StringVar(&format, "format", "", "csv or json (default: from the output file extension, or csv)")
+	flags.StringVar(&output, "o", "", "file to write (default: standard output)")
+	flags.BoolVar(&redact, "redact-passwords", false, "leave the passwords and their hashes out")
+	if err = loadKeyedConfig(flags, args); err != nil {
+		return
+	}
+	if format, err = usersFileFormat(format, output); err != nil {
+		return
+	}
+	users, err := core.ExportUsers(redact)
+	if err != nil {
+		return
+	}
+	var w io.Writer = os.Stdout
+	if output != "" {
+		var f *os.File
+		if f, err = os.OpenFile(output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600); err != nil {
+			return
+		}
+		defer f.Close()
+		w = f
+	}
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "    ")
+		return enc.Encode(users)
+	}
+	return core.ExportUsersCSV(w, users)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/workerindex/gdir/tools/core"
+)
+
+func init() {
+	usersCommands["usage"] = command{"show or reset the daily usage of users", runUsersUsage}
+}
+
+// userUsage is a line of users usage.
+type userUsage struct {
+	Name             string     `json:"name"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	MaxDailyBytes    int64      `json:"max_daily_bytes,omitempty"`
+	MaxDailyRequests int64      `json:"max_daily_requests,omitempty"`
+	core.Usage
+}
+
+// humanBytes formats a number of bytes for reading.
+func humanBytes(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	f := float64(n)
+	i := 0
+	for ; f >= 1024 && i < len(units)-1; i++ {
+		f /= 1024
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.1f%s", f, units[i])
+}
+
+func runUsersUsage(args []string) (err error) {
+	var reset, jsonOutput bool
+	flags := newFlagSet("users usage")
+	flags.BoolVar(&reset, "reset", false, "reset the usage of the users of today")
+	flags.BoolVar(&jsonOutput, "json", false, "print the usage as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gdir users usage [options] [name...]\n")
+		fmt.Fprintf(os.Stderr, "Without names, shows the usage of every user.\n")
+		flags.PrintDefaults()
+	}
+	if err = loadKeyedConfig(flags, args); err != nil {
+		return
+	}
+	store, err := core.NewUsageStore()
+	if err != nil {
+		return
+	}
+	if store == nil {
+		return fmt.Errorf("usage is not counted, set usage in %s", core.Config.ConfigFile)
+	}
+	names := flags.Args()
+	if len(names) == 0 {
+		if reset {
+			flags.Usage()
+			os.Exit(2)
+		}
+		var x *core.UsersIndex
+		if x, err = core.LoadUsersIndex(); err != nil {
+			return
+		}
+		for _, entry := range x.Users {
+			names = append(names, entry.Name)
+		}
+	}
+	var users []*core.User
+	for _, name := range names {
+		var user *core.User
+		if user, err = core.ReadUser(name); err != nil {
+			return
+		}
+		users = append(users, user)
+	}
+
+	secret, day := core.MasterSecret(), core.UsageDay(time.Now())
+	if reset {
+		for _, user := range users {
+			fmt.Printf("Resetting the usage of user %s\n", user.Name)
+			if err = store.Reset(core.UsageKey(secret, user.Name)); err != nil {
+				return
+			}
+		}
+		return
+	}
+	var usage []*userUsage
+	for _, user := range users {
+		u := &userUsage{Name: user.Name, ExpiresAt: user.ExpiresAt, MaxDailyBytes: user.MaxDailyBytes, MaxDailyRequests: user.MaxDailyRequests}
+		if u.Usage, err = store.Get(core.UsageKey(secret, user.Name), day); err != nil {
+			return
+		}
+		usage = append(usage, u)
+	}
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		return enc.Encode(usage)
+	}
+	fmt.Printf("Usage of %s (UTC):\n", day)
+	for _, u := range usage {
+		requests := fmt.Sprintf("%d", u.Requests)
+		if u.MaxDailyRequests > 0 {
+			requests += fmt.Sprintf("/%d", u.MaxDailyRequests)
+		}
+		bytes := humanBytes(u.Bytes)
+		if u.MaxDailyBytes > 0 {
+			bytes += "/" + humanBytes(u.MaxDailyBytes)
+		}
+		expires := ""
+		if u.ExpiresAt != nil {
+			expires = "expires " + u.ExpiresAt.Local().Format("2006-01-02 15:04")
+			if !time.Now().Before(*u.ExpiresAt) {
+				expires = "expired"
+			}
+		}
+		fmt.Printf("    %-20s %12s requests  %18s  %s\n", u.Name, requests, bytes, expires)
+	}
+	return
+}
@@ -0,0 +1,421 @@
+// Package prompt asks typed questions on a terminal: texts, secrets,
+// confirmations, selections and lists. Answers can also be scripted, one per
+// line, for tests and unattended runs.
+package prompt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// ErrNoAnswer is returned when the input ends before a question is answered.
+var ErrNoAnswer = errors.New("no answer")
+
+// Prompter asks questions on an output and reads the answers from an input,
+// a line each.
+type Prompter struct {
+	in  *bufio.Reader
+	fd  int
+	out io.Writer
+	// scripted prompters echo the answers, and fail on invalid answers
+	// instead of asking again.
+	scripted bool
+}
+
+// New returns a Prompter asking on out and reading from in. Secrets are read
+// without echo when in is a terminal.
+func New(in io.Reader, out io.Writer) *Prompter {
+	p := &Prompter{in: bufio.NewReader(in), fd: -1, out: out}
+	if f, ok := in.(*os.File); ok && terminal.IsTerminal(int(f.Fd())) {
+		p.fd = int(f.Fd())
+	}
+	return p
+}
+
+// NewScript returns a Prompter answering the questions with the lines of
+// script in order, and writing the questions and their answers to out.
+func NewScript(script io.Reader, out io.Writer) *Prompter {
+	return &Prompter{in: bufio.NewReader(script), fd: -1, out: out, scripted: true}
+}
+
+var std = New(os.Stdin, os.Stdout)
+
+// Default returns the Prompter of the package functions.
+func Default() *Prompter {
+	return std
+}
+
+// SetDefault replaces the Prompter of the package functions, e.g. with a
+// scripted one.
+func SetDefault(p *Prompter) {
+	std = p
+}
+
+// Printf writes to the output of the Prompter.
+func (p *Prompter) Printf(format string, a ...interface{}) {
+	fmt.Fprintf(p.out, format, a...)
+}
+
+// Println writes a line to the output of the Prompter.
+func (p *Prompter) Println(a ...interface{}) {
+	fmt.Fprintln(p.out, a...)
+}
+
+func (p *Prompter) readLine(secret bool) (line string, err error) {
+	if secret && p.fd >= 0 {
+		var b []byte
+		b, err = terminal.ReadPassword(p.fd)
+		p.Println()
+		return string(b), err
+	}
+	line, err = p.in.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	if err == io.EOF {
+		err = ErrNoAnswer
+	}
+	if err != nil {
+		return
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if p.scripted {
+		if secret {
+			p.Println(strings.Repeat("*", len(line)))
+		} else {
+			p.Println(line)
+		}
+	} else if secret {
+		p.Println()
+	}
+	return
+}
+
+// ask writes question and reads answers until parse accepts one. Rejected
+// answers are reported with the error of parse, which ends a script.
+func (p *Prompter) ask(question string, secret bool, parse func(line string) error) (err error) {
+	for {
+		p.Printf("%s", question)
+		var line string
+		if line, err = p.readLine(secret); err != nil {
+			return fmt.Errorf("%w: %s", err, strings.TrimSpace(question))
+		}
+		if err = parse(line); err == nil {
+			return
+		}
+		if p.scripted {
+			return fmt.Errorf("invalid answer %q: %w", line, err)
+		}
+		p.Printf("%v\n", err)
+	}
+}
+
+// Required rejects empty answers, as the validate func of Text and Secret.
+func Required(answer string) error {
+	if answer == "" {
+		return errors.New("an answer is required")
+	}
+	return nil
+}
+
+// Text asks for a line of text, trimmed of spaces. An empty answer gives def,
+// and validate, when not nil, rejects answers by returning an error.
+func (p *Prompter) Text(question string, def string, validate func(answer string) error) (answer string, err error) {
+	if def != "" {
+		question = fmt.Sprintf("%s (default %s): ", question, def)
+	} else {
+		question += ": "
+	}
+	err = p.ask(question, false, func(line string) error {
+		if answer = strings.TrimSpace(line); answer == "" {
+			answer = def
+		}
+		if validate != nil {
+			return validate(answer)
+		}
+		return nil
+	})
+	return
+}
+
+// Secret asks for a line of text without echoing it on a terminal. Spaces are
+// kept, and validate, when not nil, rejects answers by returning an error.
+func (p *Prompter) Secret(question string, validate func(answer string) error) (answer string, err error) {
+	err = p.ask(question+": ", true, func(line string) error {
+		if answer = line; validate != nil {
+			return validate(answer)
+		}
+		return nil
+	})
+	return
+}
+
+// Confirm asks a yes or no question, where an empty answer gives def.
+func (p *Prompter) Confirm(question string, def bool) (yes bool, err error) {
+	choices := "(y/N) "
+	if def {
+		choices = "(Y/n) "
+	}
+	err = p.ask(fmt.Sprintf("%s %s", question, choices), false, func(line string) error {
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "":
+			yes = def
+		case "y", "yes":
+			yes = true
+		case "n", "no":
+			yes = false
+		default:
+			return errors.New("please answer y or n")
+		}
+		return nil
+	})
+	return
+}
+
+// printOptions prints numbered options, marking the default one.
+func (p *Prompter) printOptions(options []string, def int) {
+	for i, option := range options {
+		if i == def {
+			p.Printf("    (%d) %s    (default)\n", i+1, option)
+		} else {
+			p.Printf("    (%d) %s\n", i+1, option)
+		}
+	}
+}
+
+// parseChoice parses the number of an option.
+func parseChoice(s string, options int) (i int, err error) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 1 || n > options {
+		return 0, fmt.Errorf("please enter a number from 1 to %d", options)
+	}
+	return n - 1, nil
+}
+
+// Select asks to choose one of options by number, and returns its index. An
+// empty answer gives def, unless def is negative.
+func (p *Prompter) Select(question string, options []string, def int) (choice int, err error) {
+	if len(options) == 0 {
+		return 0, fmt.Errorf("nothing to choose from: %s", question)
+	}
+	if def >= len(options) {
+		def = -1
+	}
+	p.Println(question)
+	p.printOptions(options, def)
+	err = p.ask("Please enter your choice: ", false, func(line string) (err error) {
+		if strings.TrimSpace(line) == "" && def >= 0 {
+			choice = def
+			return
+		}
+		choice, err = parseChoice(line, len(options))
+		return
+	})
+	return
+}
+
+// MultiSelect asks to choose any of options by comma separated numbers, and
+// returns their indexes in order.
+func (p *Prompter) MultiSelect(question string, options []string) (choices []int, err error) {
+	p.Println(question)
+	p.printOptions(options, -1)
+	p.Println("(Use comma to separate between selections, or leave empty for none.)")
+	err = p.ask("Please enter your choices: ", false, func(line string) error {
+		chosen := make([]bool, len(options))
+		for _, s := range strings.Split(line, ",") {
+			if strings.TrimSpace(s) == "" {
+				continue
+			}
+			i, err := parseChoice(s, len(options))
+			if err != nil {
+				return err
+			}
+			chosen[i] = true
+		}
+		choices = nil
+		for i := range chosen {
+			if chosen[i] {
+				choices = append(choices, i)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// List describes a list of strings to edit with EditList.
+type List struct {
+	// Name names the list in questions, such as "white-list of drives".
+	Name string
+	// Format shows an item, or nil to show items as they are.
+	Format func(item string) string
+	// Enter asks for items to add, or nil to ask for comma separated items.
+	Enter func(p *Prompter, question string) ([]string, error)
+}
+
+func (list *List) format(item string) string {
+	if list.Format == nil {
+		return item
+	}
+	return list.Format(item)
+}
+
+func (list *List) enter(p *Prompter, question string) (items []string, err error) {
+	if list.Enter != nil {
+		return list.Enter(p, question)
+	}
+	p.Println("(Use comma to separate between items.)")
+	line, err := p.Text(question, "", nil)
+	if err != nil {
+		return
+	}
+	for _, item := range strings.Split(line, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return
+}
+
+// EditList shows a list and asks to append, remove or replace its items until
+// it is confirmed, and returns the edited items.
+func (p *Prompter) EditList(list List, items []string) (edited []string, err error) {
+	edited = append([]string(nil), items...)
+	for {
+		if len(edited) == 0 {
+			p.Printf("The %s is empty.\n", list.Name)
+		} else {
+			p.Printf("The %s has the following items:\n", list.Name)
+			for _, item := range edited {
+				p.Printf("    %s\n", list.format(item))
+			}
+		}
+		var choice int
+		if choice, err = p.Select("Please specify what do you want to do with it:", []string{
+			"Confirm",
+			"Append items to the list",
+			"Remove items from the list",
+			"Replace with a new list",
+		}, 0); err != nil {
+			return
+		}
+		var entered []string
+		switch choice {
+		case 0:
+			return
+		case 1:
+			if entered, err = list.enter(p, fmt.Sprintf("Append to the %s", list.Name)); err != nil {
+				return
+			}
+			for _, item := range entered {
+				if !contains(edited, item) {
+					edited = append(edited, item)
+				}
+			}
+		case 2:
+			if len(edited) == 0 {
+				continue
+			}
+			options := make([]string, len(edited))
+			for i, item := range edited {
+				options[i] = list.format(item)
+			}
+			var removed []int
+			if removed, err = p.MultiSelect(fmt.Sprintf("Remove from the %s:", list.Name), options); err != nil {
+				return
+			}
+			kept := edited[:0:0]
+			for i, item := range edited {
+				if len(removed) > 0 && removed[0] == i {
+					removed = removed[1:]
+					continue
+				}
+				kept = append(kept, item)
+			}
+			edited = kept
+		case 3:
+			if entered, err = list.enter(p, fmt.Sprintf("New %s", list.Name)); err != nil {
+				return
+			}
+			edited = nil
+			for _, item := range entered {
+				if !contains(edited, item) {
+					edited = append(edited, item)
+				}
+			}
+		}
+	}
+}
+
+func contains(items []string, item string) bool {
+	for _, s := range items {
+		if s == item {
+			return true
+		}
+	}
+	return false
+}
+
+// Printf writes to the output of the default Prompter.
+func Printf(format string, a ...interface{}) {
+	std.Printf(format, a...)
+}
+
+// Println writes a line to the output of the default Prompter.
+func Println(a ...interface{}) {
+	std.Println(a...)
+}
+
+// Text asks a question with the default Prompter.
+func Text(question string, def string, validate func(answer string) error) (string, error) {
+	return std.Text(question, def, validate)
+}
+
+// Secret asks for a secret with the default Prompter.
+func Secret(question string, validate func(answer string) error) (string, error) {
+	return std.Secret(question, validate)
+}
+
+// Confirm asks a yes or no question with the default Prompter.
+func Confirm(question string, def bool) (bool, error) {
+	return std.Confirm(question, def)
+}
+
+// Select asks to choose one of options with the default Prompter.
+func Select(question string, options []string, def int) (int, error) {
+	return std.Select(question, options, def)
+}
+
+// MultiSelect asks to choose any of options with the default Prompter.
+func MultiSelect(question string, options []string) ([]int, error) {
+	return std.MultiSelect(question, options)
+}
+
+// EditList edits a list with the default Prompter.
+func EditList(list List, items []string) ([]string, error) {
+	return std.EditList(list, items)
+}
+
+// UseScriptFile makes the package functions answer the questions with the
+// lines of a file, or of the standard input with "-".
+func UseScriptFile(path string) (err error) {
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		var b []byte
+		if b, err = ioutil.ReadFile(path); err != nil {
+			return
+		}
+		in = bytes.NewReader(b)
+	}
+	SetDefault(NewScript(in, os.Stdout))
+	return
+}
@@ -0,0 +1,136 @@
+package prompt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScript(t *testing.T) {
+	script := strings.Join([]string{
+		"  alice  ",
+		"",
+		"s3cret ",
+		"yes",
+		"",
+		"2",
+		"",
+		"3, 1,3",
+		"",
+		"2",
+		"c, d",
+		"3",
+		"1,4",
+		"1",
+	}, "\n")
+	var out bytes.Buffer
+	p := NewScript(strings.NewReader(script), &out)
+
+	var answers []interface{}
+	text, err := p.Text("Name", "", Required)
+	answers = append(answers, text, err)
+	text, err = p.Text("Worker", "gdir", nil)
+	answers = append(answers, text, err)
+	text, err = p.Secret("Password", Required)
+	answers = append(answers, text, err)
+	yes, err := p.Confirm("Continue?", false)
+	answers = append(answers, yes, err)
+	yes, err = p.Confirm("Really?", true)
+	answers = append(answers, yes, err)
+	options := []string{"one", "two", "three"}
+	choice, err := p.Select("Pick one:", options, 0)
+	answers = append(answers, choice, err)
+	choice, err = p.Select("Pick again:", options, 2)
+	answers = append(answers, choice, err)
+	choices, err := p.MultiSelect("Pick any:", options)
+	answers = append(answers, choices, err)
+	choices, err = p.MultiSelect("Pick none:", options)
+	answers = append(answers, choices, err)
+	items, err := p.EditList(List{Name: "list"}, []string{"a", "b"})
+	answers = append(answers, items, err)
+
+	want := []interface{}{
+		"alice", nil,
+		"gdir", nil,
+		"s3cret ", nil,
+		true, nil,
+		true, nil,
+		1, nil,
+		2, nil,
+		[]int{0, 2}, nil,
+		[]int(nil), nil,
+		[]string{"b", "c"}, nil,
+	}
+	if fmt.Sprint(answers) != fmt.Sprint(want) {
+		t.Errorf("answers = %v, want %v", answers, want)
+	}
+	if strings.Contains(out.String(), "s3cret") || !strings.Contains(out.String(), "Password: *******\n") {
+		t.Errorf("the secret is not masked in the output:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "Name:   alice  \n") {
+		t.Errorf("the answers are not echoed in the output:\n%s", out.String())
+	}
+
+	if _, err = p.Text("More", "", nil); !errors.Is(err, ErrNoAnswer) {
+		t.Errorf("asking past the end of the script: %v", err)
+	}
+}
+
+func TestScriptInvalidAnswer(t *testing.T) {
+	for _, test := range []struct {
+		script string
+		ask    func(p *Prompter) error
+	}{
+		{"", func(p *Prompter) (err error) {
+			_, err = p.Text("Name", "", Required)
+			return
+		}},
+		{"maybe", func(p *Prompter) (err error) {
+			_, err = p.Confirm("Continue?", true)
+			return
+		}},
+		{"4", func(p *Prompter) (err error) {
+			_, err = p.Select("Pick one:", []string{"one", "two"}, 0)
+			return
+		}},
+		{"", func(p *Prompter) (err error) {
+			_, err = p.Select("Pick one:", []string{"one", "two"}, -1)
+			return
+		}},
+		{"1,x", func(p *Prompter) (err error) {
+			_, err = p.MultiSelect("Pick any:", []string{"one", "two"})
+			return
+		}},
+	} {
+		p := NewScript(strings.NewReader(test.script+"\n1\n"), ioutil.Discard)
+		if err := test.ask(p); err == nil || !strings.Contains(err.Error(), "invalid answer") {
+			t.Errorf("answering %q: %v, want the script to end", test.script, err)
+		}
+	}
+}
+
+func TestUseScriptFile(t *testing.T) {
+	defer SetDefault(Default())
+	path := filepath.Join(t.TempDir(), "answers")
+	if err := ioutil.WriteFile(path, []byte("bob\r\nn\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := UseScriptFile(path); err != nil {
+		t.Fatal(err)
+	}
+	Default().out = ioutil.Discard
+	if name, err := Text("Name", "", nil); name != "bob" || err != nil {
+		t.Errorf("Text = %q, %v", name, err)
+	}
+	if yes, err := Confirm("Continue?", true); yes || err != nil {
+		t.Errorf("Confirm = %v, %v", yes, err)
+	}
+	if err := UseScriptFile(filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Errorf("using a missing script: %v", err)
+	}
+}
@@ -0,0 +1,669 @@
+// Package serve implements the routes of the Cloudflare Worker in
+// worker/handler.ts as a Go HTTP server, so that gdir can be self-hosted or
+// tested without Cloudflare. It reads the encrypted accounts and users from
+// the local directories written by setup and adduser.
+package serve
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/workerindex/gdir/tools/core"
+	"github.com/workerindex/gdir/tools/drive"
+)
+
+type Server struct {
+	Secret            string
+	AccountsDir       string
+	UsersDir          string
+	Static            fs.FS
+	AccountRotation   uint64
+	AccountCandidates uint64
+	// DriveAPIURL and TokenURL replace https://www.googleapis.com and the
+	// OAuth2 token endpoints, e.g. with a fake Drive API for testing.
+	DriveAPIURL string
+	TokenURL    string
+	// Usage counts the usage of users for their daily limits, which are not
+	// enforced without it.
+	Usage core.UsageStore
+
+	drive    *drive.Client
+	accounts []*drive.Account
+}
+
+// Load decrypts every account in AccountsDir.
+func (s *Server) Load() (err error) {
+	s.drive = &drive.Client{APIURL: s.DriveAPIURL, TokenURL: s.TokenURL}
+	files, err := ioutil.ReadDir(s.AccountsDir)
+	if err != nil {
+		return
+	}
+	s.accounts = nil
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		var b []byte
+		if b, err = ioutil.ReadFile(filepath.Join(s.AccountsDir, file.Name())); err != nil {
+			return
+		}
+		if b, err = core.GCMDecrypt(s.Secret, "account", b); err != nil {
+			err = fmt.Errorf("cannot decrypt account %s: %w", file.Name(), err)
+			return
+		}
+		var a *drive.Account
+		if a, err = drive.ParseAccount(file.Name(), b); err != nil {
+			return
+		}
+		s.accounts = append(s.accounts, a)
+	}
+	if len(s.accounts) == 0 {
+		err = fmt.Errorf("no accounts in %s", s.AccountsDir)
+	}
+	sort.Slice(s.accounts, func(i, j int) bool { return s.accounts[i].ID < s.accounts[j].ID })
+	return
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := s.handle(w, r); err != nil {
+		var apiErr *drive.Error
+		if errors.As(err, &apiErr) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(apiErr.StatusCode)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": apiErr})
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) (err error) {
+	if r.Method == "POST" && r.Header.Get("Content-Type") != "" {
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			err = r.ParseMultipartForm(32 << 20)
+		} else {
+			err = r.ParseForm()
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	var user *core.User
+	if t := getParam(r, "t", true); t != "" {
+		if user, err = s.userFromToken(t); err != nil {
+			return
+		}
+		if user != nil {
+			user.ApplyPolicy()
+		}
+	}
+	can := func(permission string) bool { return user != nil && user.Can(permission) }
+	// parents caches the parents of files for the folder rules of the user
+	parents := make(map[string][]string)
+
+	limiter := &core.Limiter{Store: s.Usage, Secret: s.Secret}
+	if user != nil && (strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/file/")) {
+		transfer := strings.HasPrefix(r.URL.Path, "/file/") || r.URL.Path == "/api/copyFileExec"
+		if err = limiter.Request(user, transfer); err != nil {
+			var limitErr core.LimitError
+			if errors.As(err, &limitErr) {
+				http.Error(w, err.Error(), http.StatusTooManyRequests)
+				return nil
+			}
+			return
+		}
+	}
+
+	switch p := r.URL.Path; {
+	case p == "/login":
+		name := getParam(r, "name", false)
+		pass := getParam(r, "pass", false)
+		if name != "" {
+			var u *core.User
+			if u, err = s.getUser(name); err != nil {
+				return
+			}
+			if u != nil && u.Name == name && !u.Disabled && !u.Expired(time.Now()) && core.VerifyPassword(u, pass) {
+				var t string
+				if t, err = s.userToken(u); err != nil {
+					return
+				}
+				w.Header().Set("Location", "/")
+				w.Header().Set("Set-Cookie", "t="+t)
+				w.WriteHeader(http.StatusTemporaryRedirect)
+				return
+			}
+		}
+
+	case p == "/logout":
+		w.Header().Set("Location", "/")
+		w.Header().Set("Set-Cookie", "t=deleted; path=/; expires=Thu, 01 Jan 1970 00:00:00 GMT")
+		w.WriteHeader(http.StatusTemporaryRedirect)
+		return
+
+	case p == "/api/list" && can(core.PermissionBrowse):
+		parent := getParam(r, "parent", false)
+		if parent == "" || validDriveForUser(parent, user, false) {
+			if parent != "" {
+				var access core.Access
+				if access, err = s.folderAccess(user, parent, parents); err != nil {
+					return
+				} else if access == core.AccessDenied {
+					break
+				}
+			}
+			var list *drive.FileList
+			if list, err = s.ls(parent, getParam(r, "orderBy", false), getParam(r, "pageToken", false)); err != nil {
+				return
+			}
+			var drives []drive.Drive
+			for _, d := range list.Drives {
+				if validDriveForUser(d.ID, user, parent == "") && user.Folders.Evaluate([]string{d.ID}) != core.AccessDenied {
+					drives = append(drives, d)
+				}
+			}
+			list.Drives = drives
+			if list.Files, err = s.filterFiles(user, list.Files, parents); err != nil {
+				return
+			}
+			return writeJSON(w, list)
+		}
+
+	case p == "/api/search" && can(core.PermissionBrowse):
+		var drives []string
+		if len(user.DrivesWhiteList) > 0 {
+			for _, id := range user.DrivesWhiteList {
+				if validDriveForUser(id, user, false) {
+					drives = append(drives, id)
+				}
+			}
+			if len(drives) == 0 {
+				// every white listed drive is black listed too
+				return writeJSON(w, &drive.FileList{})
+			}
+		} else if len(user.DrivesBlackList) > 0 {
+			var list *drive.FileList
+			if list, err = s.ls("", "", ""); err != nil {
+				return
+			}
+			for _, d := range list.Drives {
+				if validDriveForUser(d.ID, user, false) {
+					drives = append(drives, d.ID)
+				}
+			}
+		}
+		var list *drive.FileList
+		if list, err = s.search(getParam(r, "q", false), drives, getParam(r, "pageToken", false)); err != nil {
+			return
+		}
+		if list.Files, err = s.filterFiles(user, list.Files, parents); err != nil {
+			return
+		}
+		return writeJSON(w, list)
+
+	case p == "/api/file" && can(core.PermissionBrowse):
+		id := getParam(r, "id", false)
+		if id == "" || validDriveForUser(id, user, false) {
+			if id != "" {
+				var access core.Access
+				if access, err = s.folderAccess(user, id, parents); err != nil {
+					return
+				} else if access == core.AccessDenied {
+					break
+				}
+			}
+			var file *drive.File
+			if file, err = s.drive.File(s.pickAccount(), id); err != nil {
+				return
+			}
+			valid := true
+			for _, parent := range file.Parents {
+				if !validDriveForUser(parent, user, false) {
+					valid = false
+				}
+			}
+			if valid {
+				return writeJSON(w, file)
+			}
+		}
+
+	case p == "/api/copyFileInit" && can(core.PermissionCopy):
+		src := getParam(r, "src", false)
+		dst := getParam(r, "dst", false)
+		if src != "" && dst != "" {
+			var access core.Access
+			if access, err = s.folderAccess(user, src, parents); err != nil {
+				return
+			} else if access != core.AccessAllowed {
+				break
+			}
+			var file interface{}
+			if file, err = s.copyFileInit(s.pickAccount(), src, dst); err != nil {
+				return
+			}
+			return writeJSON(w, file)
+		}
+
+	case p == "/api/copyFileExec" && can(core.PermissionCopy):
+		src := getParam(r, "src", false)
+		token := getParam(r, "token", false)
+		if src != "" && token != "" {
+			var access core.Access
+			if access, err = s.folderAccess(user, src, parents); err != nil {
+				return
+			} else if access != core.AccessAllowed {
+				break
+			}
+			var resp *http.Response
+			var bytes int64
+			if resp, bytes, err = s.copyFileExec(s.pickAccount(), src, token); err != nil {
+				return
+			}
+			if err = limiter.Transferred(user, bytes); err != nil {
+				return
+			}
+			return proxyResponse(w, resp)
+		}
+
+	case p == "/api/copyFileStat" && can(core.PermissionCopy):
+		if token := getParam(r, "token", false); token != "" {
+			var stat interface{}
+			if stat, err = s.copyFileStat(s.pickAccount(), token); err != nil {
+				return
+			}
+			return writeJSON(w, stat)
+		}
+
+	case strings.HasPrefix(p, "/file/") && can(core.PermissionDownload):
+		if m := regexp.MustCompile(`^/file/([^/]+)`).FindStringSubmatch(p); m != nil {
+			var access core.Access
+			if access, err = s.folderAccess(user, m[1], parents); err != nil {
+				return
+			} else if access != core.AccessAllowed {
+				break
+			}
+			var resp *http.Response
+			if resp, err = s.drive.Download(s.pickAccount(), m[1], r.Header.Get("Range")); err != nil {
+				return
+			}
+			if err = limiter.Transferred(user, resp.ContentLength); err != nil {
+				resp.Body.Close()
+				return
+			}
+			return proxyResponse(w, resp)
+		}
+	}
+
+	return s.serveStatic(w, r)
+}
+
+func (s *Server) serveStatic(w http.ResponseWriter, r *http.Request) (err error) {
+	pathname := path.Clean(r.URL.Path)
+	if pathname == "/" || strings.HasPrefix(pathname, "/folder/") {
+		pathname = "/index.html"
+	}
+	f, err := s.Static.Open(strings.TrimPrefix(pathname, "/"))
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+		http.NotFound(w, r)
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	switch {
+	case strings.HasSuffix(pathname, ".html"):
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	case strings.HasSuffix(pathname, ".js"):
+		w.Header().Set("Content-Type", "application/javascript")
+	case strings.HasSuffix(pathname, ".css"):
+		w.Header().Set("Content-Type", "text/css")
+	case strings.HasSuffix(pathname, ".ico"):
+		w.Header().Set("Content-Type", "image/x-icon")
+	}
+	_, err = io.Copy(w, f)
+	return
+}
+
+// getUser reads a user from UsersDir, or returns nil if there is no such user.
+func (s *Server) getUser(name string) (user *core.User, err error) {
+	b, err := ioutil.ReadFile(filepath.Join(s.UsersDir, core.UserFileName(s.Secret, name)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+	if b, err = core.GCMDecrypt(s.Secret, "user", b); err != nil {
+		return
+	}
+	user = &core.User{}
+	err = json.Unmarshal(b, user)
+	return
+}
+
+func (s *Server) userToken(user *core.User) (t string, err error) {
+	b, err := json.Marshal(map[string]string{"name": user.Name, "stamp": core.PasswordStamp(user)})
+	if err != nil {
+		return
+	}
+	if b, err = core.GCMEncrypt(s.Secret, "userToken", b); err != nil {
+		return
+	}
+	t = base64.RawURLEncoding.EncodeToString(b)
+	return
+}
+
+// userFromToken returns the user logged in with token t, or nil if the token
+// is no longer valid.
+func (s *Server) userFromToken(t string) (user *core.User, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(t)
+	if err != nil {
+		return nil, nil
+	}
+	if b, err = core.GCMDecrypt(s.Secret, "userToken", b); err != nil {
+		return nil, nil
+	}
+	var token struct {
+		Name  string `json:"name"`
+		Stamp string `json:"stamp"`
+	}
+	if err = json.Unmarshal(b, &token); err != nil {
+		return nil, nil
+	}
+	if user, err = s.getUser(token.Name); err != nil || user == nil {
+		return
+	}
+	if user.Name != token.Name || user.Disabled || user.Expired(time.Now()) || token.Stamp == "" || core.PasswordStamp(user) != token.Stamp {
+		user = nil
+	}
+	return
+}
+
+// folderAccess returns the access of a user to a file or folder by the folder
+// rules of the user, caching the parents of files in parents.
+func (s *Server) folderAccess(user *core.User, id string, parents map[string][]string) (access core.Access, err error) {
+	if user.Folders.Empty() {
+		return core.AccessAllowed, nil
+	}
+	chain, err := core.FolderChain(id, func(id string) (p []string, err error) {
+		var ok bool
+		if p, ok = parents[id]; ok {
+			return
+		}
+		if p, err = s.drive.Parents(s.pickAccount(), id); err == nil {
+			parents[id] = p
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+	return user.Folders.Evaluate(chain), nil
+}
+
+// filterFiles removes the files denied by the folder rules of a user.
+func (s *Server) filterFiles(user *core.User, files []drive.File, parents map[string][]string) (filtered []drive.File, err error) {
+	if user.Folders.Empty() {
+		return files, nil
+	}
+	for _, file := range files {
+		parents[file.ID] = file.Parents
+		var access core.Access
+		if access, err = s.folderAccess(user, file.ID, parents); err != nil {
+			return
+		}
+		if access != core.AccessDenied {
+			filtered = append(filtered, file)
+		}
+	}
+	return
+}
+
+// pickAccount chooses an account the same way as the worker does: a window of
+// AccountCandidates accounts moves every AccountRotation seconds, and a random
+// account is picked from the window.
+func (s *Server) pickAccount() *drive.Account {
+	candidates := s.accounts
+	if uint64(len(s.accounts)) > s.AccountCandidates && s.AccountRotation > 0 {
+		seed := s.Secret + strconv.FormatInt(time.Now().Unix()/int64(s.AccountRotation), 10)
+		hash := sha256.Sum256([]byte(seed))
+		start := int(binary.LittleEndian.Uint32(hash[:4]) % uint32(len(s.accounts)))
+		candidates = nil
+		for i, j := start, uint64(0); j < s.AccountCandidates; i, j = (i+1)%len(s.accounts), j+1 {
+			candidates = append(candidates, s.accounts[i])
+		}
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+func (s *Server) accountByID(id string) *drive.Account {
+	for _, a := range s.accounts {
+		if a.ID == id {
+			return a
+		}
+	}
+	return nil
+}
+
+// pageToken is what encrypted page tokens hold. Unlike the worker, which puts
+// the whole account in it, only the account ID is kept.
+type pageToken struct {
+	Account      string            `json:"account"`
+	PageToken    string            `json:"pageToken,omitempty"`
+	PageTokenMap map[string]string `json:"pageTokenMap,omitempty"`
+}
+
+func (s *Server) decryptPageToken(t string) (token *pageToken, a *drive.Account) {
+	if t == "" {
+		return
+	}
+	b, err := base64.RawURLEncoding.DecodeString(t)
+	if err != nil {
+		return
+	}
+	if b, err = core.GCMDecrypt(s.Secret, "pageToken", b); err != nil {
+		return
+	}
+	token = &pageToken{}
+	if err = json.Unmarshal(b, token); err != nil {
+		return nil, nil
+	}
+	return token, s.accountByID(token.Account)
+}
+
+func (s *Server) encryptPageToken(token *pageToken) (t string, err error) {
+	b, err := json.Marshal(token)
+	if err != nil {
+		return
+	}
+	if b, err = core.GCMEncrypt(s.Secret, "pageToken", b); err != nil {
+		return
+	}
+	t = base64.RawURLEncoding.EncodeToString(b)
+	return
+}
+
+func (s *Server) ls(parent string, orderBy string, encryptedPageToken string) (list *drive.FileList, err error) {
+	var pageTokenValue string
+	token, a := s.decryptPageToken(encryptedPageToken)
+	if a != nil {
+		pageTokenValue = token.PageToken
+	} else {
+		a = s.pickAccount()
+	}
+	if list, err = s.drive.Ls(a, parent, orderBy, pageTokenValue); err != nil {
+		return
+	}
+	if list.NextPageToken != "" {
+		if list.NextPageToken, err = s.encryptPageToken(&pageToken{Account: a.ID, PageToken: list.NextPageToken}); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *Server) search(query string, drives []string, encryptedPageToken string) (list *drive.FileList, err error) {
+	pageTokenMap := make(map[string]string)
+	token, a := s.decryptPageToken(encryptedPageToken)
+	if a != nil && token.PageTokenMap != nil {
+		pageTokenMap = token.PageTokenMap
+	} else {
+		a = s.pickAccount()
+	}
+	terms := strings.Fields(query)
+	if len(drives) == 0 {
+		drives = []string{""}
+	}
+	list = &drive.FileList{}
+	for _, d := range drives {
+		key := d
+		if key == "" {
+			key = "global"
+		}
+		if encryptedPageToken != "" && pageTokenMap[key] == "" {
+			// this drive has no more pages
+			continue
+		}
+		var found *drive.FileList
+		if found, err = s.drive.Search(a, terms, d, pageTokenMap[key]); err != nil {
+			return
+		}
+		if found.NextPageToken != "" {
+			pageTokenMap[key] = found.NextPageToken
+		} else {
+			delete(pageTokenMap, key)
+		}
+		list.Files = append(list.Files, found.Files...)
+	}
+	if len(pageTokenMap) > 0 {
+		if list.NextPageToken, err = s.encryptPageToken(&pageToken{Account: a.ID, PageTokenMap: pageTokenMap}); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// copyFileInit starts a resumable upload of a copy of src into folder dst and
+// returns the file with the upload ID as its token.
+func (s *Server) copyFileInit(a *drive.Account, src string, dst string) (file interface{}, err error) {
+	f, err := s.drive.File(a, src)
+	if err != nil {
+		return
+	}
+	size, _ := strconv.ParseInt(f.Size, 10, 64)
+	token, err := s.drive.StartUpload(a, &drive.File{Name: f.Name, Parents: []string{dst}, MimeType: f.MimeType}, size)
+	if err != nil {
+		return
+	}
+	file = struct {
+		*drive.File
+		Token string `json:"token"`
+	}{f, token}
+	return
+}
+
+// copyFileExec streams the content of src into the resumable upload token.
+func (s *Server) copyFileExec(a *drive.Account, src string, token string) (resp *http.Response, bytes int64, err error) {
+	data, err := s.drive.Download(a, src, "")
+	if err != nil {
+		return
+	}
+	defer data.Body.Close()
+	resp, err = s.drive.ResumeUpload(a, token, data.Header.Get("Content-Type"), 0, 0, data.Body)
+	return resp, data.ContentLength, err
+}
+
+// copyFileStat reports the progress of the resumable upload token in the
+// format of the worker, where uploaded is the offset of the last byte.
+func (s *Server) copyFileStat(a *drive.Account, token string) (stat interface{}, err error) {
+	status, err := s.drive.UploadStatus(a, token)
+	if err != nil {
+		return
+	}
+	switch status.Status {
+	case "uploaded":
+		stat = struct {
+			*drive.File
+			Status string `json:"status"`
+		}{status.File, status.Status}
+	case "uploading":
+		uploaded := status.Uploaded - 1
+		if uploaded < 0 {
+			uploaded = 0
+		}
+		stat = map[string]interface{}{"status": status.Status, "uploaded": uploaded}
+	default:
+		stat = status
+	}
+	return
+}
+
+func validDriveForUser(driveID string, user *core.User, enforceWhiteList bool) bool {
+	if enforceWhiteList && user.DrivesWhiteList != nil && !contains(user.DrivesWhiteList, driveID) {
+		return false
+	}
+	if user.DrivesBlackList != nil && contains(user.DrivesBlackList, driveID) {
+		return false
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// getParam returns the request parameter the same way the worker does: query
+// parameters override form values, and cookies override both if allowed.
+func getParam(r *http.Request, key string, cookie bool) (val string) {
+	if r.PostForm != nil {
+		val = r.PostForm.Get(key)
+	}
+	if v, ok := r.URL.Query()[key]; ok && len(v) > 0 {
+		val = v[0]
+	}
+	if cookie {
+		if c, err := r.Cookie(key); err == nil && c.Value != "" {
+			val = c.Value
+		}
+	}
+	return
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
+
+func proxyResponse(w http.ResponseWriter, resp *http.Response) (err error) {
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, err = io.Copy(w, resp.Body)
+	return
+}
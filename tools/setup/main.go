@@ -6,10 +6,21 @@ import (
 	"log"
 
 	"github.com/workerindex/gdir/tools/core"
+	"github.com/workerindex/gdir/tools/prompt"
 )
 
+// answers is the file of scripted answers to the questions.
+var answers string
+
 func run() (err error) {
 	flag.Parse()
+	core.Config.CreateProfile = true
+
+	if answers != "" {
+		if err = prompt.UseScriptFile(answers); err != nil {
+			return
+		}
+	}
 
 	fmt.Println("                                                                   ")
 	fmt.Println("                                  _ _                              ")
@@ -23,11 +34,16 @@ func run() (err error) {
 		return
 	}
 
-	if err = core.EnterCloudflareEmail(); err != nil {
+	if core.Config.Apply || core.Config.DryRun {
+		core.Config.Apply = true
+		return core.ApplySetup()
+	}
+
+	if err = core.SetSecretsStore(); err != nil {
 		return
 	}
 
-	if err = core.EnterCloudflareKey(); err != nil {
+	if err = core.EnterCloudflareCredentials(); err != nil {
 		return
 	}
 
@@ -35,35 +51,39 @@ func run() (err error) {
 		return
 	}
 
+	if err = core.VerifyCloudflareToken(); err != nil {
+		return
+	}
+
 	if err = core.SelectCloudflareAccount(); err != nil {
 		return
 	}
 
-	if err = core.SetupCloudflareSubdomain(); err != nil {
+	if err = core.ReportCloudflarePermissions(); err != nil {
 		return
 	}
 
-	if err = core.SelectWorker(); err != nil {
+	if err = core.SetupCloudflareSubdomain(); err != nil {
 		return
 	}
 
-	if err = core.EnterGistToken(); err != nil {
+	if err = core.SelectWorker(); err != nil {
 		return
 	}
 
-	if err = core.InitGitHubAPI(); err != nil {
+	if err = core.ConfigureWorkerRoutes(); err != nil {
 		return
 	}
 
-	if err = core.EnterAccoutsGist("Accounts", &core.Config.GistID.Accounts); err != nil {
+	if err = core.ConfigureStorage("Accounts"); err != nil {
 		return
 	}
 
-	if err = core.EnterAccoutsGist("Users", &core.Config.GistID.Users); err != nil {
+	if err = core.ConfigureStorage("Users"); err != nil {
 		return
 	}
 
-	if err = core.EnterAccoutsGist("Static", &core.Config.GistID.Static); err != nil {
+	if err = core.ConfigureStorage("Static"); err != nil {
 		return
 	}
 
@@ -95,23 +115,7 @@ func run() (err error) {
 		return
 	}
 
-	if err = core.CopyStaticFiles(); err != nil {
-		return
-	}
-
-	if err = core.DeployGist("accounts", core.Config.GistID.Accounts); err != nil {
-		return
-	}
-
-	if err = core.DeployGist("users", core.Config.GistID.Users); err != nil {
-		return
-	}
-
-	if err = core.DeployGist("static", core.Config.GistID.Static); err != nil {
-		return
-	}
-
-	if err = core.DeployWorker(); err != nil {
+	if err = core.Deploy(); err != nil {
 		return
 	}
 
@@ -119,11 +123,18 @@ func run() (err error) {
 }
 
 func init() {
-	flag.StringVar(&core.Config.ConfigFile, "config", "config.json", "config file to read and write")
-	flag.StringVar(&core.Config.CloudflareEmail, "cf-email", "", "Cloudflare login Email")
-	flag.StringVar(&core.Config.CloudflareKey, "cf-key", "", "Cloudflare Key")
+	flag.StringVar(&core.Config.StateDir, "state-dir", "", "directory of the config and the encrypted files (default GDIR_STATE_DIR, or $XDG_STATE_HOME/gdir)")
+	flag.StringVar(&core.Config.ConfigFile, "config", "", "config file to read and write (default config.json in the state directory)")
+	flag.StringVar(&core.Config.DistDir, "dist", "", "directory of your own build of the worker and static files, instead of the one embedded in gdir")
+	flag.StringVar(&core.Config.Profile, "profile", "", "profile of the config to set up, which is added if it does not exist yet")
+	flag.StringVar(&core.Config.CloudflareEmail, "cf-email", "", "Cloudflare login Email of the Global API Key")
+	flag.StringVar(&core.Config.CloudflareToken, "cf-token", "", "Cloudflare API token")
+	flag.StringVar(&core.Config.CloudflareKey, "cf-key", "", "Cloudflare Global API Key (legacy, use -cf-token instead)")
 	flag.StringVar(&core.Config.CloudflareAccount, "cf-account", "", "Cloudflare account")
+	flag.StringVar(&core.Config.CloudflareSubdomain, "cf-subdomain", "", "Cloudflare Workers subdomain to register if you don't have one yet")
 	flag.StringVar(&core.Config.CloudflareWorker, "cf-worker", "", "Cloudflare Worker script ID to deploy to")
+	flag.StringVar(&core.Config.CloudflareZone, "cf-zone", "", "Cloudflare zone (domain name) of the routes")
+	flag.StringVar(&core.Config.CloudflareRoutesStr, "cf-routes", "", "comma separated route patterns to run the Worker on, such as gdir.example.com/*")
 	flag.StringVar(&core.Config.GistToken, "gist-token", "", "GitHub Token with gist scope")
 	flag.StringVar(&core.Config.GistID.Accounts, "accounts-gist", "", "Gist ID for accounts")
 	flag.StringVar(&core.Config.GistID.Users, "users-gist", "", "Gist ID for users")
@@ -132,7 +143,14 @@ func init() {
 	flag.StringVar(&core.Config.AccountRotationStr, "account-rotation", "", "number of seconds to rotate the next list of account candidates (default 60)")
 	flag.StringVar(&core.Config.AccountCandidatesStr, "account-candidates", "", "number of accounts to be selected as candidates at each rotation (default 10)")
 	flag.StringVar(&core.Config.AccountsJSONDir, "accounts-json-dir", "", "AutoRclone generated accounts directory with JSON files")
+	flag.BoolVar(&core.Config.RescanAccounts, "rescan-accounts", false, "re-scan accounts JSON directory even if accounts have been added")
+	flag.StringVar(&core.Config.AdminUser, "admin-user", "", "admin user name to create if there are no users yet")
+	flag.StringVar(&core.Config.AdminPass, "admin-pass", "", "admin user password to create if there are no users yet")
+	flag.StringVar(&core.Config.Secrets.Store, "secrets-store", "", "where to keep new secrets: \""+core.SecretStoreFile+"\" for the passphrase encrypted secrets file, or \""+core.SecretStoreConfig+"\" for the config file")
+	flag.BoolVar(&core.Config.Apply, "apply", false, "run setup without prompts, taking every answer from config file, options and GDIR_* environment variables")
+	flag.BoolVar(&core.Config.DryRun, "dry-run", false, "print what -apply would do without doing it")
 	flag.BoolVar(&core.Config.Debug, "debug", false, "log debug messages")
+	flag.StringVar(&answers, "answers", "", "answer the questions with the lines of a file, or of stdin with -")
 }
 
 func main() {
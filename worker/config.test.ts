@@ -0,0 +1,43 @@
+import assert from 'assert';
+import test from 'node:test';
+
+// The worker reads its bindings from self, as in a Workers runtime.
+const self = globalThis as any;
+self.self = self;
+
+const files: Record<string, string> = { 'index.html': '<html></html>', 'app.js': 'app()' };
+
+// fetched serves files under the storage URL, like the storages of
+// tools/core/storage_*.go serve the files they deploy.
+const fetched: string[] = [];
+self.fetch = async (url: string) => {
+    fetched.push(url);
+    const name = url.slice(url.lastIndexOf('/') + 1);
+    return name in files && !url.includes('//' + name) ? new Response(files[name]) : new Response(null, { status: 404 });
+};
+self.GDIR_STATIC = { get: async (key: string) => (key in files ? new TextEncoder().encode(files[key]).buffer : null) };
+
+const storageURLs: Record<string, string> = {
+    gist: 'https://gist.githubusercontent.com/gdir/0123456789abcdef/raw/',
+    git: 'https://raw.githubusercontent.com/gdir/static/master/',
+    kv: 'kv://GDIR_STATIC/',
+    s3: 'https://s3.us-east-1.amazonaws.com/gdir/static/',
+    local: 'http://127.0.0.1:3005/',
+};
+
+for (const [storage, url] of Object.entries(storageURLs)) {
+    test(`static files from ${storage} storage`, async () => {
+        const { default: config } = await import('./config');
+        const { fetchStorage } = await import('./utils');
+        self.GDIR_STATIC_URL = url;
+        for (const pathname of ['/index.html', '/app.js']) {
+            const staticURL = await config.static(pathname);
+            assert.strictEqual(staticURL, url + pathname.slice(1));
+            const response = await fetchStorage(staticURL);
+            assert.strictEqual(response.status, 200, `${pathname} from ${staticURL}`);
+            assert.strictEqual(await response.text(), files[pathname.slice(1)]);
+        }
+        const response = await fetchStorage(await config.static('/missing.html'));
+        assert.strictEqual(response.status, 404);
+    });
+}
@@ -1,18 +1,26 @@
 import { GoogleDriveConfig } from './drive';
 import { buf2hex, str2buf } from './utils';
 
-declare const __ACCOUNTS_COUNT__: number;
-declare const __ACCOUNT_ROTATION__: number;
-declare const __ACCOUNT_CANDIDATES__: number;
+// setting reads a plain text or secret binding of the worker, see
+// tools/core/worker.go.
+const setting = (name: string, def = ''): string =>
+    (self as any)[name] === undefined ? def : `${(self as any)[name]}`;
 
 const config: GoogleDriveConfig = {
-    secret: '__SECRET__',
-    accounts: Array.from({ length: __ACCOUNTS_COUNT__ }, (_, i: number) => `__ACCOUNTS_URL__${i + 1}`),
-    accountRotation: __ACCOUNT_ROTATION__,
-    accountCandidates: __ACCOUNT_CANDIDATES__,
+    secret: setting('GDIR_SECRET'),
+    kdfSalt: setting('GDIR_KDF_SALT'),
+    accounts: JSON.parse(setting('GDIR_ACCOUNTS_IDS', '[]')).map(
+        (id: string) => setting('GDIR_ACCOUNTS_URL') + id,
+    ),
+    accountRotation: Number(setting('GDIR_ACCOUNT_ROTATION', '60')),
+    accountCandidates: Number(setting('GDIR_ACCOUNT_CANDIDATES', '10')),
     userURL: async (user: string) =>
-        '__USERS_URL__' + buf2hex(await crypto.subtle.digest('SHA-256', str2buf(config.secret + user))),
-    static: async (pathname: string) => '__STATIC_URL__' + pathname,
+        setting('GDIR_USERS_URL') + buf2hex(await crypto.subtle.digest('SHA-256', str2buf(config.secret + user))),
+    // Storage URLs end with a slash and files are deployed under plain names, so
+    // the leading slash of the pathname is dropped.
+    static: async (pathname: string) => setting('GDIR_STATIC_URL') + pathname.replace(/^\/+/, ''),
+    usageBinding: setting('GDIR_USAGE_BINDING'),
+    usageKey: async (user: string) => buf2hex(await crypto.subtle.digest('SHA-256', str2buf(config.secret + user))),
 };
 
 export default config;
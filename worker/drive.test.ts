@@ -0,0 +1,95 @@
+import assert from 'assert';
+import test from 'node:test';
+import { GoogleDrive, GoogleDriveConfig } from './drive';
+
+// tree holds the parents of files in a fake drive:
+// drive > a > b > f1, f2 and drive > a > c > f3.
+const tree: Record<string, string[]> = {
+    drive: [],
+    a: ['drive'],
+    b: ['a'],
+    c: ['a'],
+    f1: ['b'],
+    f2: ['b'],
+    f3: ['c'],
+};
+for (let i = 0; i < 150; i++) {
+    tree[`g${i}`] = ['c'];
+}
+
+// batches records the files looked up by each batch request.
+let batches: string[][] = [];
+(globalThis as any).fetch = async (url: string, init: RequestInit) => {
+    assert.strictEqual(url, 'https://www.googleapis.com/batch/drive/v3');
+    const ids = [...(init.body as string).matchAll(/^GET \/drive\/v3\/files\/([^?]+)\?/gm)].map((m) => m[1]);
+    const cids = [...(init.body as string).matchAll(/^Content-ID: <(\d+)>/gm)].map((m) => m[1]);
+    batches.push(ids);
+    const body = ids
+        .map((id, i) => {
+            const found = id in tree;
+            return (
+                `--batch_resp\r\nContent-Type: application/http\r\nContent-ID: <response-${cids[i]}>\r\n\r\n` +
+                `HTTP/1.1 ${found ? '200 OK' : '404 Not Found'}\r\nContent-Type: application/json\r\n\r\n` +
+                `${JSON.stringify(found ? { parents: tree[id].length ? tree[id] : undefined } : { error: {} })}\r\n`
+            );
+        })
+        .join('');
+    return new Response(body + '--batch_resp--\r\n', {
+        headers: { 'Content-Type': 'multipart/mixed; boundary=batch_resp' },
+    });
+};
+
+function newDrive(): { gd: GoogleDrive; picked: () => number } {
+    const gd = new GoogleDrive({} as GoogleDriveConfig);
+    let picked = 0;
+    gd.pickAccount = async () => {
+        picked++;
+        // a freshly fetched account without a token
+        return { type: 'authorized_user', client_id: '', client_secret: '', refresh_token: '' } as any;
+    };
+    gd.accessToken = async () => 'token';
+    return { gd, picked: () => picked };
+}
+
+test('folder chains of searched files', async () => {
+    batches = [];
+    const { gd, picked } = newDrive();
+    const parents = new Map<string, string[]>([
+        ['f1', ['b']],
+        ['f2', ['b']],
+        ['f3', ['c']],
+    ]);
+    const chains = await gd.folderChains(['f1', 'f2', 'f3'], parents);
+    assert.deepStrictEqual(chains, [
+        ['f1', 'b', 'a', 'drive'],
+        ['f2', 'b', 'a', 'drive'],
+        ['f3', 'c', 'a', 'drive'],
+    ]);
+    // one batch a level of ancestors, with one account for all of them
+    assert.deepStrictEqual(batches, [['b', 'c'], ['a'], ['drive']]);
+    assert.strictEqual(picked(), 1);
+
+    // the chain of the listed folder is cached for its files
+    batches = [];
+    assert.deepStrictEqual(await gd.folderChain('b', parents), ['b', 'a', 'drive']);
+    parents.set('f4', ['b']);
+    assert.deepStrictEqual(await gd.folderChains(['f4'], parents), [['f4', 'b', 'a', 'drive']]);
+    assert.deepStrictEqual(batches, []);
+});
+
+test('folder chains of more files than a batch takes', async () => {
+    batches = [];
+    const { gd } = newDrive();
+    const ids = Object.keys(tree).filter((id) => id.startsWith('g'));
+    const chains = await gd.folderChains(ids, new Map());
+    assert.ok(chains.every((chain, i) => chain.join() === `${ids[i]},c,a,drive`));
+    assert.deepStrictEqual(
+        batches.map((batch) => batch.length),
+        [100, 50, 1, 1, 1],
+    );
+});
+
+test('folder chain of a missing file', async () => {
+    const { gd } = newDrive();
+    await assert.rejects(gd.folderChain('missing', new Map()), /cannot get the parents of missing: 404/);
+});
@@ -1,4 +1,9 @@
-import { base64, str2buf, buf2str } from './utils';
+import { base64, str2buf, buf2str, buf2hex, hex2buf, concatBuf, fetchStorage } from './utils';
+
+const ENVELOPE_MAGIC = 'GDIR';
+const ENVELOPE_VERSION = 1;
+const KDF_SHA256 = 1;
+const KDF_HKDF = 2;
 
 export interface AccessToken {
     expires?: number;
@@ -31,11 +36,22 @@ export type GoogleDriveAccount = GoogleDriveUserAccount | GoogleDriveServiceAcco
 export interface GoogleDriveConfig {
     // secure random string that provides app-level security
     secret: string;
+    // hex encoded HKDF salt of the deployment, empty for the legacy SHA-256 KDF
+    kdfSalt: string;
     accountRotation: number;
     accountCandidates: number;
     accounts: (GoogleDriveAccount | string)[];
     userURL: (user: string) => Promise<string>;
     static: (pathname: string) => Promise<string>;
+    // KV namespace binding to count the usage of users in, empty to not count it
+    usageBinding: string;
+    usageKey: (user: string) => Promise<string>;
+}
+
+export interface Usage {
+    day: string;
+    requests: number;
+    bytes: number;
 }
 
 interface TokenResponse {
@@ -59,17 +75,171 @@ export interface SearchOptions {
 
 export interface User {
     name: string;
-    pass: string;
+    // plaintext password of users saved before passwords were hashed
+    pass?: string;
+    pass_hash?: string;
+    drives_white_list?: string[];
+    drives_black_list?: string[];
+    disabled?: boolean;
+    role?: string;
+    groups?: string[];
+    folders?: FolderACL;
+    // RFC 3339 time after which the user can no longer log in
+    expires_at?: string;
+    max_daily_bytes?: number;
+    max_daily_requests?: number;
+    // resolved from the fields above by the Go tooling, see tools/core/policy.go
+    policy?: UserPolicy;
+}
+
+export interface UserPolicy {
+    permissions: string[];
     drives_white_list?: string[];
     drives_black_list?: string[];
+    folders?: FolderACL;
+}
+
+export interface FolderRule {
+    id: string;
+    path?: string[];
+    name?: string;
+}
+
+export interface FolderACL {
+    allow?: FolderRule[];
+    deny?: FolderRule[];
+}
+
+export type FolderAccess = 'denied' | 'allowed' | 'traverse';
+
+// applyPolicy replaces the drive lists and folder rules of a user with the ones
+// of its policy.
+export function applyPolicy(user: User): User {
+    if (user.policy) {
+        user.drives_white_list = user.policy.drives_white_list;
+        user.drives_black_list = user.policy.drives_black_list;
+        user.folders = user.policy.folders;
+    }
+    return user;
+}
+
+export function emptyFolderACL(acl?: FolderACL): boolean {
+    return !acl || (acl.allow || []).length + (acl.deny || []).length === 0;
+}
+
+// evaluateFolderACL returns the access to the file whose ID and ancestor IDs are
+// chain, the file first, see FolderACL.Evaluate in tools/core/acl.go.
+export function evaluateFolderACL(acl: FolderACL | undefined, chain: string[]): FolderAccess {
+    if (!acl || emptyFolderACL(acl)) {
+        return 'allowed';
+    }
+    const allow = acl.allow || [];
+    const deny = acl.deny || [];
+    let denied = allow.length > 0;
+    for (const id of chain) {
+        if (deny.some((rule) => rule.id === id)) {
+            denied = true;
+            break;
+        }
+        if (allow.some((rule) => rule.id === id)) {
+            return 'allowed';
+        }
+    }
+    if (!denied) {
+        return 'allowed';
+    }
+    if (chain.length > 0 && allow.some((rule) => (rule.path || []).indexOf(chain[0]) >= 0)) {
+        return 'traverse';
+    }
+    return 'denied';
+}
+
+const MAX_FOLDER_DEPTH = 64;
+
+// MAX_BATCH_SIZE is the most calls Drive takes in a batch request.
+const MAX_BATCH_SIZE = 100;
+const BATCH_BOUNDARY = 'gdir_batch';
+
+// parseBatchResponse returns the Content-ID, status and body of the responses
+// in a multipart/mixed batch response.
+export function parseBatchResponse(
+    contentType: string | null,
+    text: string,
+): { id: number; status: number; body: string }[] {
+    const m = /boundary="?([^";]+)"?/.exec(contentType || '');
+    if (!m) {
+        throw new Error(`not a batch response: ${contentType}`);
+    }
+    const parts = [];
+    for (const part of text.split('--' + m[1])) {
+        const id = /^Content-ID:\s*<response-(\d+)>/im.exec(part);
+        const status = /^HTTP\/[\d.]+ (\d+)/m.exec(part);
+        if (!id || !status) {
+            continue;
+        }
+        const rest = part.slice(status.index);
+        const body = /\r?\n\r?\n/.exec(rest);
+        parts.push({
+            id: parseInt(id[1]),
+            status: parseInt(status[1]),
+            body: body ? rest.slice(body.index + body[0].length).trim() : '',
+        });
+    }
+    return parts;
+}
+
+// userExpired reports whether the user can no longer log in.
+export function userExpired(user: User): boolean {
+    return !!user.expires_at && Date.now() >= Date.parse(user.expires_at);
+}
+
+// userCan reports whether the policy of a user has a permission. Users saved
+// before policies can do anything.
+export function userCan(user: User | undefined, permission: string): boolean {
+    return !!user && (!user.policy || user.policy.permissions.indexOf(permission) >= 0);
+}
+
+const PASSWORD_HASH_PBKDF2 = 'pbkdf2-sha256';
+
+const equalBuf = (a: Uint8Array, b: Uint8Array) => a.length === b.length && a.reduce((diff, x, i) => diff | (x ^ b[i]), 0) === 0;
+
+// verifyPassword checks a pbkdf2-sha256$<iterations>$<hex salt>$<hex hash> password
+// hash, or a plaintext password, see tools/core/password.go.
+export async function verifyPassword(user: User, pass: string): Promise<boolean> {
+    if (user.pass_hash) {
+        const [type, iterations, salt, hash] = user.pass_hash.split('$');
+        if (type !== PASSWORD_HASH_PBKDF2 || !salt || !hash) {
+            return false;
+        }
+        const want = hex2buf(hash);
+        const key = await crypto.subtle.deriveBits(
+            { name: 'PBKDF2', hash: 'SHA-256', salt: hex2buf(salt), iterations: parseInt(iterations) },
+            await crypto.subtle.importKey('raw', new TextEncoder().encode(pass), 'PBKDF2', false, ['deriveBits']),
+            want.length * 8,
+        );
+        return equalBuf(new Uint8Array(key), want);
+    }
+    return !!user.pass && equalBuf(new TextEncoder().encode(user.pass), new TextEncoder().encode(pass));
+}
+
+// passwordStamp changes whenever the password of the user changes. Login tokens
+// carry it instead of the password.
+export async function passwordStamp(user: User): Promise<string> {
+    const hash = await crypto.subtle.digest(
+        'SHA-256',
+        new TextEncoder().encode('gdir:pass-stamp:' + (user.pass_hash || user.pass || '')),
+    );
+    return buf2hex(hash.slice(0, 16));
 }
 
 export class GoogleDrive {
+    private lookup?: Promise<GoogleDriveAccount>;
+
     constructor(private config: GoogleDriveConfig) {}
 
     async getUser(user: string): Promise<User> {
         return JSON.parse(
-            buf2str(await this.decrypt('user', await (await fetch(await this.config.userURL(user))).arrayBuffer())),
+            buf2str(await this.decrypt('user', await (await fetchStorage(await this.config.userURL(user))).arrayBuffer())),
         );
     }
 
@@ -88,6 +258,146 @@ export class GoogleDrive {
         });
     }
 
+    // checkLimits returns why a user cannot make a request, which transfers file
+    // contents with transfer, or counts the request, see Limiter in
+    // tools/core/usage.go.
+    async checkLimits(user: User, transfer: boolean): Promise<string | undefined> {
+        if (userExpired(user)) {
+            return `user ${user.name} has expired`;
+        }
+        if (!this.config.usageBinding) {
+            return;
+        }
+        const usage = await this.usage(user);
+        if (user.max_daily_requests && usage.requests >= user.max_daily_requests) {
+            return `user ${user.name} has reached its limit of daily requests`;
+        }
+        if (transfer && user.max_daily_bytes && usage.bytes >= user.max_daily_bytes) {
+            return `user ${user.name} has reached its limit of daily bytes`;
+        }
+        await this.addUsage(user, 1, 0);
+    }
+
+    // usage returns the usage of a user today, in UTC.
+    async usage(user: User): Promise<Usage> {
+        const day = new Date().toISOString().slice(0, 10);
+        if (this.config.usageBinding) {
+            const key = await this.config.usageKey(user.name);
+            const usage: Usage | null = await (self as any)[this.config.usageBinding].get(key, 'json');
+            if (usage && usage.day === day) {
+                return usage;
+            }
+        }
+        return { day, requests: 0, bytes: 0 };
+    }
+
+    async addUsage(user: User, requests: number, bytes: number): Promise<void> {
+        if (!this.config.usageBinding) {
+            return;
+        }
+        const usage = await this.usage(user);
+        usage.requests += requests;
+        usage.bytes += bytes;
+        try {
+            const key = await this.config.usageKey(user.name);
+            await (self as any)[this.config.usageBinding].put(key, JSON.stringify(usage));
+        } catch (err) {
+            // KV takes one write per second to a key, so counts are best effort
+        }
+    }
+
+    // parents returns the parents of files by their IDs, looking them up with
+    // one batch request for up to MAX_BATCH_SIZE files.
+    async parents(account: GoogleDriveAccount | null, ids: string[]): Promise<Map<string, string[]>> {
+        if (account == null) {
+            account = await this.lookupAccount();
+        }
+        const result = new Map<string, string[]>();
+        for (let i = 0; i < ids.length; i += MAX_BATCH_SIZE) {
+            const batch = ids.slice(i, i + MAX_BATCH_SIZE);
+            const body = batch
+                .map(
+                    (id, j) =>
+                        `--${BATCH_BOUNDARY}\r\nContent-Type: application/http\r\nContent-ID: <${j}>\r\n\r\n` +
+                        `GET /drive/v3/files/${encodeURIComponent(id)}?supportsAllDrives=true&fields=parents\r\n\r\n`,
+                )
+                .join('');
+            const resp = await fetch('https://www.googleapis.com/batch/drive/v3', {
+                method: 'POST',
+                headers: {
+                    Authorization: `Bearer ${await this.accessToken(account)}`,
+                    'Content-Type': `multipart/mixed; boundary=${BATCH_BOUNDARY}`,
+                },
+                body: body + `--${BATCH_BOUNDARY}--\r\n`,
+            });
+            if (!resp.ok) {
+                throw new Error(`cannot get the parents of ${batch.length} files: ${resp.status}`);
+            }
+            for (const part of parseBatchResponse(resp.headers.get('Content-Type'), await resp.text())) {
+                const id = batch[part.id];
+                if (id == null) {
+                    continue;
+                }
+                if (part.status !== 200) {
+                    throw new Error(`cannot get the parents of ${id}: ${part.status}`);
+                }
+                result.set(id, JSON.parse(part.body).parents || []);
+            }
+            for (const id of batch) {
+                if (!result.has(id)) {
+                    throw new Error(`cannot get the parents of ${id}: missing from the batch response`);
+                }
+            }
+        }
+        return result;
+    }
+
+    // lookupAccount returns the account of the lookups of parents, picked once
+    // for a request so that each lookup does not fetch an account and a token.
+    lookupAccount(): Promise<GoogleDriveAccount> {
+        if (!this.lookup) {
+            this.lookup = this.pickAccount();
+        }
+        return this.lookup;
+    }
+
+    // folderChain returns id and the IDs of its ancestors, its drive last, caching
+    // the parents of files in parents.
+    async folderChain(id: string, parents: Map<string, string[]>): Promise<string[]> {
+        return (await this.folderChains([id], parents))[0];
+    }
+
+    // folderChains returns the folder chains of ids, see folderChain, looking up
+    // the unknown parents of a level of ancestors of all of them together.
+    async folderChains(ids: string[], parents: Map<string, string[]>): Promise<string[][]> {
+        const chains = ids.map((id) => [id]);
+        for (let active = chains; active.length > 0; ) {
+            const unknown = new Set<string>();
+            for (const chain of active) {
+                if (!parents.has(chain[chain.length - 1])) {
+                    unknown.add(chain[chain.length - 1]);
+                }
+            }
+            if (unknown.size > 0) {
+                for (const [id, ps] of await this.parents(null, [...unknown])) {
+                    parents.set(id, ps);
+                }
+            }
+            active = active.filter((chain) => {
+                const next = (parents.get(chain[chain.length - 1]) as string[])[0];
+                if (!next) {
+                    return false;
+                }
+                if (chain.length === MAX_FOLDER_DEPTH) {
+                    throw new Error(`too many ancestors of folder ${chain[0]}`);
+                }
+                chain.push(next);
+                return true;
+            });
+        }
+        return chains;
+    }
+
     async file(account: GoogleDriveAccount | null, id: string): Promise<any> {
         if (account == null) {
             account = await this.pickAccount();
@@ -334,12 +644,20 @@ export class GoogleDrive {
         return new Response(JSON.stringify({ ...file, token: location.searchParams.get('upload_id') as string }));
     }
 
-    async copyFileExec(account: GoogleDriveAccount | null, src: string, token: string): Promise<Response> {
+    async copyFileExec(
+        account: GoogleDriveAccount | null,
+        src: string,
+        token: string,
+        transferred?: (bytes: number) => Promise<void>,
+    ): Promise<Response> {
         if (account == null) {
             account = await this.pickAccount();
         }
         const location = `https://www.googleapis.com/upload/drive/v3/files?uploadType=resumable&supportsAllDrives=true&upload_id=${token}`;
         const data = await this.download(account, src);
+        if (transferred) {
+            await transferred(parseInt(data.headers.get('Content-Length') || '0'));
+        }
         return fetch(location, {
             method: 'PUT',
             headers: {
@@ -381,10 +699,20 @@ export class GoogleDrive {
         );
     }
 
-    async secretKey(namespace: string): Promise<CryptoKey> {
+    // secretKey derives the key of a namespace with HKDF when given a salt, see tools/core/kdf.go.
+    async secretKey(namespace: string, salt?: Uint8Array): Promise<CryptoKey> {
         const {
             config: { secret },
         } = this;
+        if (salt) {
+            return crypto.subtle.deriveKey(
+                { name: 'HKDF', hash: 'SHA-256', salt, info: str2buf('gdir:' + namespace) },
+                await crypto.subtle.importKey('raw', str2buf(secret), 'HKDF', false, ['deriveKey']),
+                { name: 'AES-GCM', length: 256 },
+                false,
+                ['encrypt', 'decrypt'],
+            );
+        }
         return crypto.subtle.importKey(
             'raw',
             await crypto.subtle.digest('SHA-256', str2buf(secret + ':' + namespace)),
@@ -394,33 +722,84 @@ export class GoogleDrive {
         );
     }
 
+    // keyID identifies the secret key in ciphertext envelopes with HKDF and the salt, or is empty without a salt,
+    // see tools/core/crypto.go.
+    async keyID(salt?: Uint8Array): Promise<Uint8Array> {
+        if (!salt) {
+            return new Uint8Array(0);
+        }
+        return new Uint8Array(
+            await crypto.subtle.deriveBits(
+                { name: 'HKDF', hash: 'SHA-256', salt, info: str2buf('gdir:key-id') },
+                await crypto.subtle.importKey('raw', str2buf(this.config.secret), 'HKDF', false, ['deriveBits']),
+                64,
+            ),
+        );
+    }
+
+    // encrypt returns an envelope: "GDIR" | version | KDF | KDF params length | KDF params | key ID length | key ID | iv | ciphertext
     async encrypt(namespace: string, data: string | ArrayBufferLike): Promise<ArrayBuffer> {
+        const salt = this.config.kdfSalt ? hex2buf(this.config.kdfSalt) : undefined;
+        const keyID = await this.keyID(salt);
+        const params = salt || new Uint8Array(0);
+        const header = concatBuf(
+            str2buf(ENVELOPE_MAGIC),
+            new Uint8Array([ENVELOPE_VERSION, salt ? KDF_HKDF : KDF_SHA256, params.length]),
+            params,
+            new Uint8Array([keyID.length]),
+            keyID,
+        );
         const iv = crypto.getRandomValues(new Uint8Array(12));
         const ciphertext = new Uint8Array(
             await crypto.subtle.encrypt(
-                { name: 'AES-GCM', iv },
-                await this.secretKey(namespace),
+                { name: 'AES-GCM', iv, additionalData: concatBuf(header, str2buf(namespace)) },
+                await this.secretKey(namespace, salt),
                 typeof data === 'string' ? str2buf(data) : new Uint8Array(data),
             ),
         );
-        const packed = new Uint8Array(12 + ciphertext.byteLength);
-        packed.set(iv);
-        packed.set(ciphertext, 12);
-        return packed;
+        return concatBuf(header, iv, ciphertext);
     }
 
     async decrypt(namespace: string, data: string | ArrayBufferLike): Promise<ArrayBuffer> {
         if (typeof data === 'string') {
             data = base64.decode(data);
         }
-        if (!(data instanceof Uint8Array)) {
-            data = new Uint8Array(data);
+        const buf = new Uint8Array(data);
+        if (buf2str(buf.slice(0, ENVELOPE_MAGIC.length)) === ENVELOPE_MAGIC) {
+            try {
+                return await this.decryptEnvelope(namespace, buf);
+            } catch (e) {
+                // a legacy iv can start with the magic too
+            }
         }
-        const iv = new Uint8Array((data as Uint8Array).buffer, 0, 12);
-        const ciphertext = new Uint8Array((data as Uint8Array).buffer, 12);
+        const iv = buf.slice(0, 12);
+        const ciphertext = buf.slice(12);
         return crypto.subtle.decrypt({ name: 'AES-GCM', iv }, await this.secretKey(namespace), ciphertext);
     }
 
+    async decryptEnvelope(namespace: string, buf: Uint8Array): Promise<ArrayBuffer> {
+        let offset = ENVELOPE_MAGIC.length;
+        const version = buf[offset++];
+        const kdf = buf[offset++];
+        if (version !== ENVELOPE_VERSION) {
+            throw new Error(`unsupported ciphertext envelope version ${version}`);
+        }
+        const params = buf.slice(offset + 1, offset + 1 + buf[offset]);
+        offset += 1 + buf[offset]; // KDF params
+        offset += 1 + buf[offset]; // key ID
+        const header = buf.slice(0, offset);
+        const iv = buf.slice(offset, offset + 12);
+        const ciphertext = buf.slice(offset + 12);
+        if (kdf !== KDF_SHA256 && kdf !== KDF_HKDF) {
+            throw new Error(`unknown KDF ${kdf}`);
+        }
+        return crypto.subtle.decrypt(
+            { name: 'AES-GCM', iv, additionalData: concatBuf(header, str2buf(namespace)) },
+            await this.secretKey(namespace, kdf === KDF_HKDF ? params : undefined),
+            ciphertext,
+        );
+    }
+
     async pickAccount(): Promise<GoogleDriveAccount> {
         const {
             config: { secret, accounts, accountRotation, accountCandidates },
@@ -441,7 +820,7 @@ export class GoogleDrive {
         // choose randomly without seed, an item from the candidates
         const account = candidates[Math.floor(Math.random() * candidates.length)];
         if (typeof account === 'string') {
-            const ciphertext = await (await fetch(account)).arrayBuffer();
+            const ciphertext = await (await fetchStorage(account)).arrayBuffer();
             const plaintext = buf2str(await this.decrypt('account', ciphertext));
             return JSON.parse(plaintext);
         } else {
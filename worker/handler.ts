@@ -1,8 +1,19 @@
 // import html from './index.html';
 
 import config from './config';
-import { GoogleDrive, User } from './drive';
-import { parseCookie, buf2str, base64 } from './utils';
+import {
+    GoogleDrive,
+    User,
+    FolderAccess,
+    verifyPassword,
+    passwordStamp,
+    applyPolicy,
+    userCan,
+    userExpired,
+    emptyFolderACL,
+    evaluateFolderACL,
+} from './drive';
+import { parseCookie, buf2str, base64, fetchStorage } from './utils';
 
 export async function handleRequest(request: Request): Promise<Response> {
     try {
@@ -14,6 +25,8 @@ export async function handleRequest(request: Request): Promise<Response> {
         let user: User | undefined;
         let form: FormData | undefined;
         let cookie: Record<string, string> = {};
+        // parents caches the parents of files for the folder rules of the user
+        const parents = new Map<string, string[]>();
 
         if (method === 'POST' && headers.has('Content-Type') && headers.get('Content-Type') !== '') {
             form = await request.formData();
@@ -26,15 +39,16 @@ export async function handleRequest(request: Request): Promise<Response> {
         {
             const t = getParam('t', form, params, cookie);
             if (t) {
-                user = JSON.parse(buf2str(await gd.decrypt('userToken', base64.RAWURL.decode(t))));
-                if (!user || typeof user.name !== 'string' || typeof user.pass !== 'string') {
-                    user = undefined;
-                } else {
-                    const userData = await gd.getUser(user.name);
-                    if (user.name !== userData.name || user.pass !== userData.pass) {
-                        user = undefined;
-                    } else {
-                        user = userData;
+                const token = JSON.parse(buf2str(await gd.decrypt('userToken', base64.RAWURL.decode(t))));
+                if (token && typeof token.name === 'string' && typeof token.stamp === 'string') {
+                    const userData = await gd.getUser(token.name);
+                    if (
+                        token.name === userData.name &&
+                        !userData.disabled &&
+                        !userExpired(userData) &&
+                        token.stamp === (await passwordStamp(userData))
+                    ) {
+                        user = applyPolicy(userData);
                     }
                 }
             }
@@ -45,9 +59,15 @@ export async function handleRequest(request: Request): Promise<Response> {
             const pass = getParam('pass', form, params);
             if (name && name !== '') {
                 const user = await gd.getUser(name);
-                if (user && user.name === name && user.pass === pass) {
+                if (
+                    user &&
+                    user.name === name &&
+                    !user.disabled &&
+                    !userExpired(user) &&
+                    (await verifyPassword(user, pass || ''))
+                ) {
                     const t = base64.RAWURL.encode(
-                        await gd.encrypt('userToken', JSON.stringify(user, ['name', 'pass'])),
+                        await gd.encrypt('userToken', JSON.stringify({ name, stamp: await passwordStamp(user) })),
                     );
                     return new Response(null, {
                         status: 307,
@@ -67,39 +87,67 @@ export async function handleRequest(request: Request): Promise<Response> {
             });
         }
 
-        if (url.pathname === '/api/list' && user) {
+        if (user && (url.pathname.startsWith('/api/') || url.pathname.startsWith('/file/'))) {
+            const transfer = url.pathname.startsWith('/file/') || url.pathname === '/api/copyFileExec';
+            const limit = await gd.checkLimits(user, transfer);
+            if (limit) {
+                return new Response(limit, { status: 429 });
+            }
+        }
+
+        if (url.pathname === '/api/list' && user && userCan(user, 'browse')) {
             const parent = getParam('parent', form, params);
             const orderBy = getParam('orderBy', form, params);
             const pageToken = getParam('pageToken', form, params);
-            if (!parent || validDriveForUser(parent, user)) {
+            if (
+                (!parent || validDriveForUser(parent, user)) &&
+                (!parent || (await folderAccess(gd, user, parent, parents)) !== 'denied')
+            ) {
                 const fileList = await gd.ls(null, parent, orderBy, pageToken);
                 if (fileList && fileList.drives != null) {
-                    fileList.drives = fileList.drives.filter((drive: any) =>
-                        validDriveForUser(drive.id, user as User, !parent),
+                    fileList.drives = fileList.drives.filter(
+                        (drive: any) =>
+                            validDriveForUser(drive.id, user as User, !parent) &&
+                            evaluateFolderACL((user as User).folders, [drive.id]) !== 'denied',
                     );
                 }
+                if (fileList && fileList.files != null) {
+                    fileList.files = await filterFiles(gd, user, fileList.files, parents);
+                }
                 return new Response(JSON.stringify(fileList), { headers: { 'Content-Type': 'application/json' } });
             }
         }
 
-        if (url.pathname === '/api/search' && user) {
+        if (url.pathname === '/api/search' && user && userCan(user, 'browse')) {
             const query = getParam('q', form, params) || '';
             const encrypted_page_token = getParam('pageToken', form, params);
             const drives: string[] = [];
-            if (user.drives_black_list && user.drives_black_list.length > 0) {
+            if (user.drives_white_list && user.drives_white_list.length > 0) {
+                drives.push(...user.drives_white_list.filter((id) => validDriveForUser(id, user as User)));
+                if (drives.length === 0) {
+                    // every white listed drive is black listed too
+                    return new Response(JSON.stringify({ files: [] }), {
+                        headers: { 'Content-Type': 'application/json' },
+                    });
+                }
+            } else if (user.drives_black_list && user.drives_black_list.length > 0) {
                 (((await gd.ls()) as any).drives || []).forEach((drive: any) => {
                     ((user as any).drives_black_list as string[]).indexOf(drive.id) < 0 && drives.push(drive.id);
                 });
-            } else if (user.drives_white_list && user.drives_white_list.length > 0) {
-                drives.push(...user.drives_white_list);
             }
             const fileList = await gd.search(null, { query, drives, encrypted_page_token });
+            if (fileList && fileList.files != null) {
+                fileList.files = await filterFiles(gd, user, fileList.files, parents);
+            }
             return new Response(JSON.stringify(fileList), { headers: { 'Content-Type': 'application/json' } });
         }
 
-        if (url.pathname === '/api/file' && user) {
+        if (url.pathname === '/api/file' && user && userCan(user, 'browse')) {
             const id = getParam('id', form, params);
-            if (!id || validDriveForUser(id, user)) {
+            if (
+                (!id || validDriveForUser(id, user)) &&
+                (!id || (await folderAccess(gd, user, id, parents)) !== 'denied')
+            ) {
                 const file = await gd.file(null, id as string);
                 if (
                     file &&
@@ -111,40 +159,44 @@ export async function handleRequest(request: Request): Promise<Response> {
             }
         }
 
-        if (url.pathname === '/api/copyFileInit' && user) {
+        if (url.pathname === '/api/copyFileInit' && userCan(user, 'copy')) {
             const src = getParam('src', form, params);
             const dst = getParam('dst', form, params);
-            if (src && dst) {
+            if (src && dst && (await folderAccess(gd, user as User, src, parents)) === 'allowed') {
                 return gd.copyFileInit(null, src as string, dst as string);
             }
         }
 
-        if (url.pathname === '/api/copyFileExec' && user) {
+        if (url.pathname === '/api/copyFileExec' && userCan(user, 'copy')) {
             const src = getParam('src', form, params);
             const token = getParam('token', form, params);
-            if (src && token) {
-                return gd.copyFileExec(null, src as string, token as string);
+            if (src && token && (await folderAccess(gd, user as User, src, parents)) === 'allowed') {
+                return gd.copyFileExec(null, src as string, token as string, (bytes) =>
+                    gd.addUsage(user as User, 0, bytes),
+                );
             }
         }
 
-        if (url.pathname === '/api/copyFileStat' && user) {
+        if (url.pathname === '/api/copyFileStat' && userCan(user, 'copy')) {
             const token = getParam('token', form, params);
             if (token) {
                 return gd.copyFileStat(null, token as string);
             }
         }
 
-        if (url.pathname.startsWith('/file/') && user) {
+        if (url.pathname.startsWith('/file/') && userCan(user, 'download')) {
             const m = url.pathname.match(/^\/file\/([^\/]+)/);
-            if (m) {
+            if (m && (await folderAccess(gd, user as User, m[1], parents)) === 'allowed') {
                 const fileID = m[1];
-                return gd.download(null, fileID, headers.get('Range') || undefined);
+                const response = await gd.download(null, fileID, headers.get('Range') || undefined);
+                await gd.addUsage(user as User, 0, parseInt(response.headers.get('Content-Length') || '0'));
+                return response;
             }
         }
 
         {
             const pathname = url.pathname === '/' || url.pathname.startsWith('/folder/') ? '/index.html' : url.pathname;
-            const response = await fetch(await config.static(pathname));
+            const response = await fetchStorage(await config.static(pathname));
 
             const headers = new Headers(response.headers);
             headers.delete('x-xss-protection');
@@ -170,6 +222,35 @@ export async function handleRequest(request: Request): Promise<Response> {
     }
 }
 
+// folderAccess returns the access of a user to a file or folder by the folder
+// rules of the user, caching the parents of files in parents.
+async function folderAccess(
+    gd: GoogleDrive,
+    user: User,
+    id: string,
+    parents: Map<string, string[]>,
+): Promise<FolderAccess> {
+    if (emptyFolderACL(user.folders)) {
+        return 'allowed';
+    }
+    return evaluateFolderACL(user.folders, await gd.folderChain(id, parents));
+}
+
+// filterFiles removes the files denied by the folder rules of a user. The
+// parents of listed files are known, so a listing needs no lookups past the
+// chain of its folder, and the ancestors of searched files are looked up a
+// level at a time.
+async function filterFiles(gd: GoogleDrive, user: User, files: any[], parents: Map<string, string[]>): Promise<any[]> {
+    if (emptyFolderACL(user.folders)) {
+        return files;
+    }
+    for (const file of files) {
+        parents.set(file.id, file.parents || []);
+    }
+    const chains = await gd.folderChains(files.map((file) => file.id), parents);
+    return files.filter((file, i) => evaluateFolderACL(user.folders, chains[i]) !== 'denied');
+}
+
 function validDriveForUser(driveID: string, user: User, enforceWhileList: boolean = false): boolean {
     if (enforceWhileList && user.drives_white_list != null && user.drives_white_list.indexOf(driveID) < 0) {
         return false;
@@ -3,6 +3,11 @@ export const buf2str = (b: ArrayBufferLike) => String.fromCharCode(...new Uint8A
 export const buf2hex = (b: ArrayBufferLike) =>
     Array.prototype.map.call(new Uint8Array(b), x => ('00' + x.toString(16)).slice(-2)).join('');
 export const hex2buf = (s = '') => new Uint8Array((s.match(/[\da-f]{2}/gi) as string[]).map(h => parseInt(h, 16)));
+export const concatBuf = (...bufs: Uint8Array[]) => {
+    const out = new Uint8Array(bufs.reduce((length, b) => length + b.length, 0));
+    bufs.reduce((offset, b) => (out.set(b, offset), offset + b.length), 0);
+    return out;
+};
 
 export const base64 = {
     decode: (s: string) => str2buf(atob(s)),
@@ -26,6 +31,25 @@ export const base64 = {
     },
 };
 
+// Gist files can only hold text, so binary files are deployed base64 encoded after this prefix.
+const GIST_BASE64_PREFIX = 'gdir:base64:';
+
+// fetchStorage fetches a deployed file either over HTTP, or from a Workers KV
+// namespace binding when the URL is kv://<binding>/<key>.
+export async function fetchStorage(url: string): Promise<Response> {
+    const m = url.match(/^kv:\/\/([^\/]+)\/(.*)$/);
+    if (m) {
+        const value: ArrayBuffer | null = await (self as any)[m[1]].get(m[2], 'arrayBuffer');
+        return new Response(value, { status: value == null ? 404 : 200 });
+    }
+    const response = await fetch(url);
+    const body = await response.arrayBuffer();
+    if (buf2str(body.slice(0, GIST_BASE64_PREFIX.length)) === GIST_BASE64_PREFIX) {
+        return new Response(base64.decode(buf2str(body.slice(GIST_BASE64_PREFIX.length))), response);
+    }
+    return new Response(body, response);
+}
+
 export const parseCookie = (str: string) =>
     str
         .split(';')